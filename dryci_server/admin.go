@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+
+	"zombiezen.com/go/sqlite"
+)
+
+type CreateUserRequest struct {
+	Email     string `json:"email"`
+	FullName  string `json:"full_name"`
+	Superuser bool   `json:"superuser"`
+}
+
+type CreateUserResponse struct {
+	UserId int `json:"user_id"`
+}
+
+func (s *ApiServer) CreateUserHandler(db *sqlite.Conn, req *CreateUserRequest, res *CreateUserResponse, _ AuthInfo) error {
+	if req.Email == "" {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Missing email", fmt.Errorf("missing email"))
+	}
+	userId, err := CreateUser(db, req.Email, req.FullName, req.Superuser)
+	if err != nil {
+		return err
+	}
+	*res = CreateUserResponse{UserId: userId}
+	return nil
+}
+
+type CreateTokenRequest struct {
+	UserId int `json:"user_id"`
+	// Seconds until the token expires, 0 for never
+	ExpiresIn int `json:"expires_in"`
+	// E.g. {"ci": "protected"}, matched by trust policies. Can't be changed later.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type CreateTokenResponse struct {
+	Token string `json:"token"`
+	// Identifies the token's results, see /api/v1/invalidate
+	TokenId int64 `json:"token_id"`
+}
+
+func (s *ApiServer) CreateTokenHandler(db *sqlite.Conn, req *CreateTokenRequest, res *CreateTokenResponse, _ AuthInfo) error {
+	if req.ExpiresIn < 0 {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid expires_in", fmt.Errorf("negative expires_in %d", req.ExpiresIn))
+	}
+	err := validateLabels(req.Labels)
+	if err != nil {
+		return err
+	}
+	exists, err := UserExists(db, req.UserId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return HttpErrWrap(http.StatusNotFound, "User Not Found", fmt.Errorf("no user %d", req.UserId))
+	}
+	token, tokenId, err := CreateUserToken(db, req.UserId, req.ExpiresIn, req.Labels)
+	if err != nil {
+		return err
+	}
+	*res = CreateTokenResponse{Token: token, TokenId: tokenId}
+	return nil
+}
+
+type DisableTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type DisableTokenResponse struct {
+}
+
+func (s *ApiServer) DisableTokenHandler(db *sqlite.Conn, req *DisableTokenRequest, res *DisableTokenResponse, _ AuthInfo) error {
+	*res = DisableTokenResponse{}
+	return DisableUserToken(db, req.Token)
+}
+
+type GetNamespacePolicyRequest struct {
+	UserId int `json:"user_id"`
+}
+
+type GetNamespacePolicyResponse struct {
+	Policy NamespacePolicy `json:"policy"`
+}
+
+func (s *ApiServer) GetNamespacePolicyHandler(db *sqlite.Conn, req *GetNamespacePolicyRequest, res *GetNamespacePolicyResponse, _ AuthInfo) error {
+	policy, err := GetNamespacePolicy(db, req.UserId)
+	if err != nil {
+		return err
+	}
+	*res = GetNamespacePolicyResponse{Policy: policy}
+	return nil
+}
+
+type SetNamespacePolicyRequest struct {
+	UserId int `json:"user_id"`
+	// Replaces the whole policy, null fields use the server's defaults
+	Policy NamespacePolicy `json:"policy"`
+}
+
+type SetNamespacePolicyResponse struct {
+}
+
+func (s *ApiServer) SetNamespacePolicyHandler(db *sqlite.Conn, req *SetNamespacePolicyRequest, res *SetNamespacePolicyResponse, _ AuthInfo) error {
+	*res = SetNamespacePolicyResponse{}
+	if rate := req.Policy.CanaryRate; rate != nil && (*rate < 0 || *rate > 1) {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "canary_rate must be between 0 and 1", fmt.Errorf("canary_rate %g out of range", *rate)).WithErrorCode("invalid_canary_rate")
+	}
+	if len(req.Policy.ScopeFallbacks) > MAX_SCOPE_FALLBACKS {
+		return HttpErrWrap(http.StatusUnprocessableEntity, fmt.Sprintf("More than %d scope_fallbacks", MAX_SCOPE_FALLBACKS), fmt.Errorf("%d scope fallbacks", len(req.Policy.ScopeFallbacks))).WithErrorCode("invalid_scope")
+	}
+	for _, scope := range req.Policy.ScopeFallbacks {
+		if scope == "" {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "Empty scope in scope_fallbacks, the unscoped results are always consulted last", fmt.Errorf("empty scope fallback")).WithErrorCode("invalid_scope")
+		}
+		err := validateScope(scope)
+		if err != nil {
+			return err
+		}
+	}
+	if maxAge := req.Policy.MaxAge; maxAge != nil && *maxAge < 0 {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid max_age", fmt.Errorf("negative max_age %d", *maxAge)).WithErrorCode("invalid_max_age")
+	}
+	err := validateTrustPolicy(req.Policy.Trust)
+	if err != nil {
+		return err
+	}
+	exists, err := UserExists(db, req.UserId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return HttpErrWrap(http.StatusNotFound, "User Not Found", fmt.Errorf("no user %d", req.UserId))
+	}
+	return s.setNamespacePolicy(req.UserId, req.Policy)
+}
+
+const MAX_DEAD_LETTERS_PER_REQUEST = 1000
+
+type ListDeadLettersRequest struct {
+	// Defaults to 100
+	Limit int `json:"limit"`
+}
+
+type ListDeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"dead_letters"`
+}
+
+func (s *ApiServer) ListDeadLettersHandler(db *sqlite.Conn, req *ListDeadLettersRequest, res *ListDeadLettersResponse, _ AuthInfo) error {
+	limit, err := validateLimit(req.Limit, MAX_DEAD_LETTERS_PER_REQUEST)
+	if err != nil {
+		return err
+	}
+	deadLetters, err := ListDeadLetters(db, nil, limit)
+	if err != nil {
+		return err
+	}
+	*res = ListDeadLettersResponse{DeadLetters: deadLetters}
+	return nil
+}
+
+type RetryDeadLettersRequest struct {
+	Ids []int64 `json:"ids"`
+}
+
+type RetryDeadLettersResponse struct {
+	// Unknown ids are skipped
+	Requeued int `json:"requeued"`
+	// Dead letters that can't be decoded anymore, left in place
+	Undecodable []int64 `json:"undecodable"`
+}
+
+// RetryDeadLettersHandler deletes the dead letters in a transaction of its own, and only queues
+// them once it commits: enqueue blocks while the queue is full, and draining it may need the
+// write lock.
+func (s *ApiServer) RetryDeadLettersHandler(_ *sqlite.Conn, req *RetryDeadLettersRequest, res *RetryDeadLettersResponse, _ AuthInfo) error {
+	if len(req.Ids) == 0 || len(req.Ids) > MAX_DEAD_LETTERS_PER_REQUEST {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid ids", fmt.Errorf("%d ids", len(req.Ids)))
+	}
+	*res = RetryDeadLettersResponse{Undecodable: []int64{}}
+	tasks := []BackgroundTask{}
+	err := s.withConn(s.dbPool, func(db *sqlite.Conn) error {
+		return DbTxn(db, true, func() error {
+			deadLetters, err := ListDeadLetters(db, req.Ids, len(req.Ids))
+			if err != nil {
+				return err
+			}
+			for _, deadLetter := range deadLetters {
+				task, err := s.decodeTask(deadLetter.Kind, deadLetter.Payload)
+				if err != nil {
+					slog.Warn("Skipping undecodable dead letter", "id", deadLetter.Id, "kind", deadLetter.Kind, "err", err)
+					res.Undecodable = append(res.Undecodable, deadLetter.Id)
+					continue
+				}
+				err = DeleteDeadLetter(db, deadLetter.Id)
+				if err != nil {
+					return err
+				}
+				tasks = append(tasks, task)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		s.enqueue(task)
+	}
+	res.Requeued = len(tasks)
+	return nil
+}
+
+// registerAdminRoutes registers the sensitive endpoints. They go on the admin listener if
+// there is one, otherwise on the public one (where they always require a superuser token).
+func registerAdminRoutes(mux *http.ServeMux, s *ApiServer, openDebug bool) {
+	debugAuth := func(h http.HandlerFunc) http.HandlerFunc {
+		if openDebug {
+			return h
+		}
+		return superuserOnly(s, h)
+	}
+
+	handleRoute(mux, "GET /healthz", s.HealthzHandler)
+	handleRoute(mux, "GET /readyz", s.ReadyzHandler)
+	handleRoute(mux, "GET /metrics", debugAuth(MetricsHandler))
+	handleRoute(mux, "GET /debug/pprof/", debugAuth(pprof.Index))
+	handleRoute(mux, "GET /debug/pprof/cmdline", debugAuth(pprof.Cmdline))
+	handleRoute(mux, "GET /debug/pprof/profile", debugAuth(pprof.Profile))
+	handleRoute(mux, "GET /debug/pprof/symbol", debugAuth(pprof.Symbol))
+	handleRoute(mux, "GET /debug/pprof/trace", debugAuth(pprof.Trace))
+
+	handleApi(mux, "POST /admin/api/v1/create-user", "Create a user.", jsonApi(s, true, USAGE_ADMIN, requireSuperuser(s.CreateUserHandler)))
+	handleApi(mux, "POST /admin/api/v1/create-token", "Create an API token for a user.", jsonApi(s, true, USAGE_ADMIN, requireSuperuser(s.CreateTokenHandler)))
+	handleApi(mux, "POST /admin/api/v1/disable-token", "Disable an API token.", jsonApi(s, true, USAGE_ADMIN, requireSuperuser(s.DisableTokenHandler)))
+	handleApi(mux, "POST /admin/api/v1/get-namespace-policy", "Get a user's settings, null fields use the server's defaults.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.GetNamespacePolicyHandler)))
+	handleApi(mux, "POST /admin/api/v1/set-namespace-policy", "Replace a user's settings.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.SetNamespacePolicyHandler)))
+	handleApi(mux, "POST /admin/api/v1/invalidate", "Remove cached passes of a user, like /api/v1/invalidate.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.AdminInvalidateHandler)))
+	handleApi(mux, "POST /admin/api/v1/revert", "Undo everything a token or run published, like /api/v1/revert.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.AdminRevertHandler)))
+	handleApi(mux, "POST /admin/api/v1/list-dead-letters", "List background tasks that failed too many times, oldest first.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.ListDeadLettersHandler)))
+	handleApi(mux, "POST /admin/api/v1/list-jobs", "List maintenance jobs, their schedules and last run.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.ListJobsHandler)))
+	handleApi(mux, "POST /admin/api/v1/run-job", "Run a maintenance job now, in the background.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.RunJobHandler)))
+	handleApi(mux, "POST /admin/api/v1/retry-dead-letters", "Queue dead letters to be tried again.", jsonApi(s, false, USAGE_ADMIN, requireSuperuser(s.RetryDeadLettersHandler)))
+}
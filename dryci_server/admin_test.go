@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminUsersAndTokens(t *testing.T) {
+	ts := newTestServer(t)
+	_, userToken := ts.createUser("user@example.com", false)
+
+	var user CreateUserResponse
+	status := ts.call(ts.admin, "/admin/api/v1/create-user", ts.adminToken, CreateUserRequest{Email: "new@example.com"}, &user)
+	if status != http.StatusOK || user.UserId == 0 {
+		t.Fatalf("create-user = %d, %+v", status, user)
+	}
+	var token CreateTokenResponse
+	status = ts.call(ts.admin, "/admin/api/v1/create-token", ts.adminToken, CreateTokenRequest{UserId: user.UserId}, &token)
+	if status != http.StatusOK || token.Token == "" {
+		t.Fatalf("create-token = %d, %+v", status, token)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		req        interface{}
+		wantStatus int
+	}{
+		{name: "new token works", path: "/api/v1/query-passed", token: token.Token, req: QueryPassedRequest{TestFileHashes: []string{}}, wantStatus: http.StatusOK},
+		{name: "no token", path: "/admin/api/v1/create-user", req: CreateUserRequest{Email: "a@example.com"}, wantStatus: http.StatusUnauthorized},
+		{name: "unknown token", path: "/admin/api/v1/create-user", token: "dryci-nope", req: CreateUserRequest{Email: "a@example.com"}, wantStatus: http.StatusUnauthorized},
+		{name: "not a superuser", path: "/admin/api/v1/create-user", token: userToken, req: CreateUserRequest{Email: "a@example.com"}, wantStatus: http.StatusForbidden},
+		{name: "missing email", path: "/admin/api/v1/create-user", token: ts.adminToken, req: CreateUserRequest{}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "duplicate email", path: "/admin/api/v1/create-user", token: ts.adminToken, req: CreateUserRequest{Email: "new@example.com"}, wantStatus: http.StatusConflict},
+		{name: "token of unknown user", path: "/admin/api/v1/create-token", token: ts.adminToken, req: CreateTokenRequest{UserId: 9999}, wantStatus: http.StatusNotFound},
+		{name: "negative expiry", path: "/admin/api/v1/create-token", token: ts.adminToken, req: CreateTokenRequest{UserId: user.UserId, ExpiresIn: -1}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "disable token", path: "/admin/api/v1/disable-token", token: ts.adminToken, req: DisableTokenRequest{Token: token.Token}, wantStatus: http.StatusOK},
+		{name: "disabled token", path: "/api/v1/query-passed", token: token.Token, req: QueryPassedRequest{TestFileHashes: []string{}}, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		mux := ts.admin
+		if strings.HasPrefix(tt.path, "/api/") {
+			mux = ts.public
+		}
+		status := ts.call(mux, tt.path, tt.token, tt.req, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: %s = %d, want %d", tt.name, tt.path, status, tt.wantStatus)
+		}
+	}
+}
+
+func TestAdminDebugRoutes(t *testing.T) {
+	ts := newTestServer(t)
+	_, userToken := ts.createUser("user@example.com", false)
+	open := http.NewServeMux()
+	registerAdminRoutes(open, ts.ApiServer, true)
+
+	tests := []struct {
+		name       string
+		mux        http.Handler
+		path       string
+		token      string
+		wantStatus int
+	}{
+		{name: "metrics need a token", mux: ts.admin, path: "/metrics", wantStatus: http.StatusUnauthorized},
+		{name: "metrics need a superuser", mux: ts.admin, path: "/metrics", token: userToken, wantStatus: http.StatusForbidden},
+		{name: "metrics", mux: ts.admin, path: "/metrics", token: ts.adminToken, wantStatus: http.StatusOK},
+		{name: "pprof needs a superuser", mux: ts.admin, path: "/debug/pprof/", token: userToken, wantStatus: http.StatusForbidden},
+		{name: "pprof", mux: ts.admin, path: "/debug/pprof/", token: ts.adminToken, wantStatus: http.StatusOK},
+		{name: "open metrics", mux: open, path: "/metrics", wantStatus: http.StatusOK},
+		{name: "open pprof", mux: open, path: "/debug/pprof/", wantStatus: http.StatusOK},
+		{name: "admin api stays closed", mux: open, path: "/admin/api/v1/create-user", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		method := "GET"
+		if strings.HasPrefix(tt.path, "/admin/") {
+			method = "POST"
+		}
+		rec := ts.do(tt.mux, method, tt.path, tt.token, []byte(`{"email":"x@example.com"}`), nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: %s = %d, want %d", tt.name, tt.path, rec.Code, tt.wantStatus)
+		}
+	}
+
+	rec := ts.do(ts.admin, "GET", "/metrics", ts.adminToken, nil, nil)
+	for _, want := range []string{"# TYPE dryci_http_requests_total counter", `dryci_http_requests_total{route="GET /metrics",status="403"}`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const MIN_BLOOM_FP_RATE = 1e-6
+const MAX_BLOOM_FP_RATE = 0.5
+
+// BloomFilter is a set of node ids that clients check membership in locally.
+//
+// Node ids are already uniformly distributed hashes, so they're used directly for double
+// hashing: with h1 and h2 the big-endian uint64s of the first and last 8 bytes of the
+// (16-byte) node id, and h2 forced odd, the filter sets bit (h1 + i*h2) mod num_bits for
+// i in [0, num_hashes). Bit j is (bits[j/8] >> (j%8)) & 1.
+type BloomFilter struct {
+	Bits      []byte `json:"bits"`
+	NumBits   uint64 `json:"num_bits"`
+	NumHashes int    `json:"num_hashes"`
+	// Number of node ids in the filter
+	Count int `json:"count"`
+}
+
+// NewBloomFilter sizes a filter for n items with the given false positive rate.
+func NewBloomFilter(n int, fpRate float64) BloomFilter {
+	if n == 0 {
+		return BloomFilter{Bits: []byte{}}
+	}
+	numBits := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	numBits = (numBits + 7) / 8 * 8
+	numHashes := int(math.Round(float64(numBits) / float64(n) * math.Ln2))
+	numHashes = max(1, numHashes)
+	return BloomFilter{
+		Bits:      make([]byte, numBits/8),
+		NumBits:   numBits,
+		NumHashes: numHashes,
+	}
+}
+
+func (f *BloomFilter) AddHex(nodeId string) error {
+	var raw [NODEID_HASH_SIZE]byte
+	if len(nodeId) != NODEID_HASH_HEX_SIZE {
+		return fmt.Errorf("node id %q is not %d hex bytes", nodeId, NODEID_HASH_SIZE)
+	}
+	_, err := hex.Decode(raw[:], []byte(nodeId))
+	if err != nil {
+		return fmt.Errorf("node id %q is not %d hex bytes", nodeId, NODEID_HASH_SIZE)
+	}
+	h1 := binary.BigEndian.Uint64(raw[:8])
+	h2 := binary.BigEndian.Uint64(raw[8:]) | 1
+	for i := 0; i < f.NumHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.NumBits
+		f.Bits[bit/8] |= 1 << (bit % 8)
+	}
+	f.Count++
+	return nil
+}
+
+type QueryPassedBloomRequest struct {
+	TestFileHashes []string `json:"test_file_hashes"`
+	// Defaults to -bloom-fp-rate
+	FalsePositiveRate float64 `json:"false_positive_rate,omitempty"`
+	// See /api/v1/query-passed
+	Scope  string `json:"scope,omitempty"`
+	MaxAge int64  `json:"max_age,omitempty"`
+}
+
+type QueryPassedBloomResponse struct {
+	// One filter per test file hash, in the same order
+	Filters []BloomFilter `json:"filters"`
+}
+
+const QUERY_PASSED_BLOOM_DOC = `Like /api/v1/query-passed, but returns a Bloom filter of the successful node IDs per test file hash.
+Clients check their own node IDs against the filter locally, which is much smaller than the full list for big test files,
+and doesn't reveal the other node IDs. A false positive means skipping a test that should've run, so choose the rate accordingly.
+
+Filter membership: with h1 and h2 the big-endian uint64s of the first and last 8 bytes of the 16-byte node id,
+and h2 |= 1, a node id is in the filter if bit (h1 + i*h2) mod num_bits is set for every i in [0, num_hashes).
+Bit j is (bits[j/8] >> (j%8)) & 1, and bits is base64 encoded.
+
+Example request:
+    {
+        "test_file_hashes": ["ed69bb4aa4547f7d83799875d800d4158a125c2316fe1bddb6a6a79ad8611b48"],
+        "false_positive_rate": 0.0001
+    }
+
+Example response:
+    {
+        "filters": [
+            {"bits": "qmMIrv0uXvBWvWHFsuRAMmkZePOLRxnatcLiDmWyHY68Y8vXdzjOUIUGj5k9tgRz", "num_bits": 384, "num_hashes": 13, "count": 20}
+        ]
+    }`
+
+func (s *ApiServer) QueryPassedBloomHandler(db *sqlite.Conn, req *QueryPassedBloomRequest, res *QueryPassedBloomResponse, auth AuthInfo) error {
+	fpRate := req.FalsePositiveRate
+	if fpRate == 0 {
+		fpRate = *bloomFpRate
+	}
+	if fpRate < MIN_BLOOM_FP_RATE || fpRate > MAX_BLOOM_FP_RATE {
+		return HttpErrWrap(
+			http.StatusUnprocessableEntity,
+			fmt.Sprintf("false_positive_rate must be between %g and %g", MIN_BLOOM_FP_RATE, MAX_BLOOM_FP_RATE),
+			fmt.Errorf("false_positive_rate %g out of range", fpRate),
+		).WithErrorCode("invalid_false_positive_rate")
+	}
+
+	err := validateScope(req.Scope)
+	if err == nil {
+		err = validateMaxAge(req.MaxAge)
+	}
+	if err == nil {
+		err = validateDepHashes(req.TestFileHashes)
+	}
+	if err != nil {
+		return err
+	}
+	scopes, err := s.scopeChain(db, auth.UserId, req.Scope)
+	if err != nil {
+		return err
+	}
+	minPublishedAt, err := s.minPublishedAt(db, auth.UserId, req.MaxAge)
+	if err != nil {
+		return err
+	}
+
+	var nodeIds [][]string
+	err = s.withResultsDb(db, auth.UserId, func(rdb *sqlite.Conn) error {
+		version, err := GetResultsVersion(rdb, auth.UserId)
+		if err != nil {
+			return err
+		}
+		trust, err := s.trustFilter(db, auth.UserId)
+		if err != nil {
+			return err
+		}
+		nodeIds, _, _, _, err = s.queryScoped(rdb, auth.UserId, version, req.TestFileHashes, scopes, trust, minPublishedAt)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	filters := make([]BloomFilter, len(nodeIds))
+	for i, ids := range nodeIds {
+		filters[i] = NewBloomFilter(len(ids), fpRate)
+		for _, id := range ids {
+			// Like nodeIdsFromHex, a bad stored id is left out rather than failing the response
+			err := filters[i].AddHex(id)
+			if err != nil {
+				slog.Warn("Skipping invalid stored node id", "dep_hash", req.TestFileHashes[i], "err", err)
+			}
+		}
+	}
+	*res = QueryPassedBloomResponse{Filters: filters}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewBloomFilter(t *testing.T) {
+	tests := []struct {
+		n             int
+		fpRate        float64
+		wantNumBits   uint64
+		wantNumHashes int
+	}{
+		{n: 0, fpRate: 0.01, wantNumBits: 0, wantNumHashes: 0},
+		{n: 1, fpRate: 0.5, wantNumBits: 8, wantNumHashes: 6},
+		{n: 1, fpRate: 0.01, wantNumBits: 16, wantNumHashes: 11},
+		{n: 100, fpRate: 0.01, wantNumBits: 960, wantNumHashes: 7},
+		{n: 1000, fpRate: 0.01, wantNumBits: 9592, wantNumHashes: 7},
+		{n: 1000, fpRate: 1e-6, wantNumBits: 28760, wantNumHashes: 20},
+		{n: 1000, fpRate: 0.5, wantNumBits: 1448, wantNumHashes: 1},
+	}
+	for _, tt := range tests {
+		f := NewBloomFilter(tt.n, tt.fpRate)
+		if f.NumBits != tt.wantNumBits || f.NumHashes != tt.wantNumHashes {
+			t.Errorf("NewBloomFilter(%d, %g) has %d bits and %d hashes, want %d and %d", tt.n, tt.fpRate, f.NumBits, f.NumHashes, tt.wantNumBits, tt.wantNumHashes)
+		}
+		if uint64(len(f.Bits))*8 != f.NumBits {
+			t.Errorf("NewBloomFilter(%d, %g) has %d bytes for %d bits", tt.n, tt.fpRate, len(f.Bits), f.NumBits)
+		}
+		if f.Bits == nil {
+			t.Errorf("NewBloomFilter(%d, %g) has nil bits", tt.n, tt.fpRate)
+		}
+	}
+}
+
+// bloomContains mirrors the lookup clients do, as documented on BloomFilter.
+func bloomContains(f BloomFilter, nodeId string) bool {
+	raw, _ := hex.DecodeString(nodeId)
+	h1 := binary.BigEndian.Uint64(raw[:8])
+	h2 := binary.BigEndian.Uint64(raw[8:]) | 1
+	for i := 0; i < f.NumHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.NumBits
+		if (f.Bits[bit/8]>>(bit%8))&1 == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBloomFilterAddHex(t *testing.T) {
+	f := NewBloomFilter(3, 0.01)
+	added := []string{strings.Repeat("1", 32), strings.Repeat("ab", 16), "00112233445566778899aabbccddeeff"}
+	for _, nodeId := range added {
+		if err := f.AddHex(nodeId); err != nil {
+			t.Fatalf("AddHex(%q) failed: %v", nodeId, err)
+		}
+	}
+	for _, nodeId := range []string{"", "123", strings.Repeat("g", 32), strings.Repeat("1", 34)} {
+		if err := f.AddHex(nodeId); err == nil {
+			t.Errorf("AddHex(%q) succeeded, want an error", nodeId)
+		}
+	}
+	if f.Count != len(added) {
+		t.Errorf("Count = %d, want %d", f.Count, len(added))
+	}
+	for _, nodeId := range added {
+		if !bloomContains(f, nodeId) {
+			t.Errorf("filter doesn't contain %q", nodeId)
+		}
+	}
+}
+
+func TestQueryPassedBloom(t *testing.T) {
+	ts := newTestServer(t)
+	passed := []string{testNodeId(1), testNodeId(2), testNodeId(3)}
+	ts.call(ts.public, "/api/v1/publish", ts.adminToken, PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): passed}}, nil)
+	ts.applyBackground()
+
+	var res QueryPassedBloomResponse
+	status := ts.call(ts.public, "/api/v1/query-passed-bloom", ts.adminToken, QueryPassedBloomRequest{TestFileHashes: []string{testDepHash(1), testDepHash(2)}, FalsePositiveRate: 1e-6}, &res)
+	if status != http.StatusOK || len(res.Filters) != 2 {
+		t.Fatalf("query-passed-bloom = %d %+v", status, res)
+	}
+	if res.Filters[0].Count != len(passed) || res.Filters[1].Count != 0 || res.Filters[1].NumBits != 0 {
+		t.Errorf("filters = %+v", res.Filters)
+	}
+	for _, nodeId := range passed {
+		if !bloomContains(res.Filters[0], nodeId) {
+			t.Errorf("filter doesn't contain %q", nodeId)
+		}
+	}
+	if bloomContains(res.Filters[0], testNodeId(4)) {
+		t.Errorf("filter contains %q, which wasn't published", testNodeId(4))
+	}
+
+	tests := []struct {
+		name       string
+		req        QueryPassedBloomRequest
+		wantStatus int
+	}{
+		{name: "default rate", req: QueryPassedBloomRequest{TestFileHashes: []string{testDepHash(1)}}, wantStatus: http.StatusOK},
+		{name: "rate too low", req: QueryPassedBloomRequest{TestFileHashes: []string{testDepHash(1)}, FalsePositiveRate: MIN_BLOOM_FP_RATE / 2}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "rate too high", req: QueryPassedBloomRequest{TestFileHashes: []string{testDepHash(1)}, FalsePositiveRate: 0.9}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid dep hash", req: QueryPassedBloomRequest{TestFileHashes: []string{"abc"}}, wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		status := ts.call(ts.public, "/api/v1/query-passed-bloom", ts.adminToken, tt.req, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// ResultCache is an LRU cache of decoded test_results rows, in front of QueryPassedTestHashes.
+//
+// Readers race the background publisher, which invalidates rows only after its commit. So
+// readers pass the user's results version (see result_versions) their transaction sees:
+//   - An entry read at version V can't be put if a publish after V was already invalidated.
+//   - A reader at version V can't trust the cache while a publish at or before V is
+//     committed but not invalidated yet. The publisher marks publishes as pending before
+//     committing them.
+type ResultCache struct {
+	// Maximum number of node ids held, 0 disables the cache
+	maxNodeIds  int
+	mu          sync.Mutex
+	nodeIds     int
+	lru         *list.List
+	entries     map[resultCacheKey]*list.Element
+	invalidated map[int]int64
+	pending     map[int]pendingPublishes
+}
+
+type pendingPublishes struct {
+	minVersion int64
+	count      int
+}
+
+type resultCacheKey struct {
+	userId  int
+	depHash string
+}
+
+type resultCacheEntry struct {
+	key     resultCacheKey
+	nodeIds []string
+	// Version of the row, 0 if it doesn't exist
+	version int64
+	age     resultAge
+}
+
+func NewResultCache(maxNodeIds int) *ResultCache {
+	return &ResultCache{
+		maxNodeIds:  maxNodeIds,
+		lru:         list.New(),
+		entries:     map[resultCacheKey]*list.Element{},
+		invalidated: map[int]int64{},
+		pending:     map[int]pendingPublishes{},
+	}
+}
+
+// Get returns a cached row, for a reader that sees the user's results at `userVersion`.
+func (c *ResultCache) Get(userId int, depHash string, userVersion int64) (resultCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[resultCacheKey{userId, depHash}]
+	if !ok {
+		return resultCacheEntry{}, false
+	}
+	if pending, isPending := c.pending[userId]; isPending && pending.minVersion <= userVersion {
+		return resultCacheEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(resultCacheEntry), true
+}
+
+func (c *ResultCache) Put(userId int, depHash string, userVersion int64, nodeIds []string, version int64, age resultAge) {
+	cost := len(nodeIds) + 1
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invalidated[userId] > userVersion || cost > c.maxNodeIds {
+		return
+	}
+	key := resultCacheKey{userId, depHash}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(resultCacheEntry{key: key, nodeIds: nodeIds, version: version, age: age})
+	c.nodeIds += cost
+	for c.nodeIds > c.maxNodeIds {
+		c.remove(c.lru.Back())
+	}
+}
+
+// MarkPending is called before committing a publish of the user's results at `userVersion`.
+// Each call must be matched by a ClearPending.
+func (c *ResultCache) MarkPending(userId int, userVersion int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending, isPending := c.pending[userId]
+	if !isPending {
+		pending.minVersion = userVersion
+	}
+	pending.minVersion = min(pending.minVersion, userVersion)
+	pending.count++
+	c.pending[userId] = pending
+}
+
+// Invalidate drops the rows changed by a committed publish. Must be called in commit order.
+func (c *ResultCache) Invalidate(userId int, depHashes []string, userVersion int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, depHash := range depHashes {
+		if elem, ok := c.entries[resultCacheKey{userId, depHash}]; ok {
+			c.remove(elem)
+		}
+	}
+	c.invalidated[userId] = max(c.invalidated[userId], userVersion)
+}
+
+// ClearPending is called once a pending publish is invalidated, or rolled back. The user's
+// pending publishes are only cleared once all of them are, since they may be invalidated
+// one by one.
+func (c *ResultCache) ClearPending(userId int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pending[userId]
+	pending.count--
+	if pending.count <= 0 {
+		delete(c.pending, userId)
+	} else {
+		c.pending[userId] = pending
+	}
+}
+
+func (c *ResultCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(resultCacheEntry)
+	delete(c.entries, entry.key)
+	c.nodeIds -= len(entry.nodeIds) + 1
+}
+
+func (c *ResultCache) Size() (entries int, nodeIds int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.nodeIds
+}
+
+// queryPassed is QueryPassedTestHashes through the cache, returning all node ids (see
+// omitUnchanged). `userVersion` must come from GetResultsVersion in the same transaction, and
+// `trust` from the user's policy, since the cache holds filtered rows. Rows that expired or
+// were last published before `minPublishedAt` are returned like unknown ones. The returned
+// node ids are shared, don't modify them.
+func (s *ApiServer) queryPassed(db *sqlite.Conn, userId int, userVersion int64, depHashes []string, trust *trustFilter, minPublishedAt int64) ([][]string, []int64, error) {
+	now := time.Now().Unix()
+	nodeIds := make([][]string, len(depHashes))
+	versions := make([]int64, len(depHashes))
+	missIdxs := []int{}
+	missHashes := []string{}
+	for i, depHash := range depHashes {
+		entry, ok := s.resultCache.Get(userId, depHash, userVersion)
+		if !ok {
+			missIdxs = append(missIdxs, i)
+			missHashes = append(missHashes, depHash)
+			continue
+		}
+		if entry.age.stale(now, minPublishedAt) {
+			nodeIds[i] = []string{}
+			continue
+		}
+		nodeIds[i] = entry.nodeIds
+		versions[i] = entry.version
+	}
+	resultCacheTotal.Add(float64(len(depHashes)-len(missHashes)), "hit")
+	resultCacheTotal.Add(float64(len(missHashes)), "miss")
+
+	if len(missHashes) > 0 {
+		// Always fetch the full rows, so they can be cached
+		missNodeIds, missVersions, missAges, err := QueryPassedTestHashes(db, userId, missHashes, 0, trust)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, i := range missIdxs {
+			s.resultCache.Put(userId, missHashes[j], userVersion, missNodeIds[j], missVersions[j], missAges[j])
+			if missAges[j].stale(now, minPublishedAt) {
+				nodeIds[i] = []string{}
+				continue
+			}
+			nodeIds[i] = missNodeIds[j]
+			versions[i] = missVersions[j]
+		}
+	}
+	return nodeIds, versions, nil
+}
+
+// omitUnchanged replaces the node ids of dep hashes that didn't change since version `since`
+// with nil, like QueryPassedTestHashes.
+func omitUnchanged(nodeIds [][]string, versions []int64, since int64) {
+	for i := range nodeIds {
+		if versions[i] != 0 && versions[i] <= since {
+			nodeIds[i] = nil
+		}
+	}
+}
+
+// deleteResults deletes the test_results rows matching `where` in a transaction of its own,
+// bumping the results version of the affected users and invalidating the cache like the
+// background publisher does.
+func (s *ApiServer) deleteResults(db *sqlite.Conn, where string, args ...interface{}) ([]resultKey, error) {
+	deleted := []resultKey{}
+	versions := map[int]int64{}
+	err := DbTxn(db, true, func() error {
+		var err error
+		deleted, err = DeleteTestResults(db, where, args...)
+		if err != nil {
+			return err
+		}
+		for _, key := range deleted {
+			if _, bumped := versions[key.userId]; bumped {
+				continue
+			}
+			version, err := BumpResultsVersion(db, key.userId)
+			if err != nil {
+				return err
+			}
+			versions[key.userId] = version
+			s.resultCache.MarkPending(key.userId, version)
+		}
+		return nil
+	})
+
+	if err == nil {
+		depHashes := map[int][]string{}
+		for _, key := range deleted {
+			depHashes[key.userId] = append(depHashes[key.userId], key.depHash)
+		}
+		for userId, version := range versions {
+			s.resultCache.Invalidate(userId, depHashes[userId], version)
+		}
+	}
+	for userId := range versions {
+		s.resultCache.ClearPending(userId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// changeResults runs f in a transaction of its own, with a new results version for the user.
+// f returns the dep hashes it changed, which are invalidated in the cache once committed.
+func (s *ApiServer) changeResults(db *sqlite.Conn, userId int, f func(version int64) ([]string, error)) error {
+	var version int64
+	var depHashes []string
+	marked := false
+	err := DbTxn(db, true, func() (err error) {
+		version, err = BumpResultsVersion(db, userId)
+		if err != nil {
+			return err
+		}
+		depHashes, err = f(version)
+		if err != nil {
+			return err
+		}
+		s.resultCache.MarkPending(userId, version)
+		marked = true
+		return nil
+	})
+	if err == nil {
+		s.resultCache.Invalidate(userId, depHashes, version)
+	}
+	if marked {
+		s.resultCache.ClearPending(userId)
+	}
+	return err
+}
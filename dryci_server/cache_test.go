@@ -0,0 +1,272 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// cacheOp is one step of a ResultCache test, applied to user 1 unless userId is set.
+type cacheOp struct {
+	op          string // put, pending, invalidate, clear
+	userId      int
+	depHash     string
+	userVersion int64
+}
+
+func TestResultCachePendingProtocol(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []cacheOp
+		// Gets after the ops, with the version the reader sees, and whether they hit
+		getVersion int64
+		wantHits   map[string]bool
+	}{
+		{
+			name:       "put then get",
+			ops:        []cacheOp{{op: "put", depHash: "a", userVersion: 1}},
+			getVersion: 1,
+			wantHits:   map[string]bool{"a": true, "b": false},
+		},
+		{
+			name: "pending at the reader's version misses",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "pending", userVersion: 2},
+			},
+			getVersion: 2,
+			wantHits:   map[string]bool{"a": false},
+		},
+		{
+			name: "pending after the reader's version still hits",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "pending", userVersion: 2},
+			},
+			getVersion: 1,
+			wantHits:   map[string]bool{"a": true},
+		},
+		{
+			name: "pending of another user hits",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "pending", userId: 2, userVersion: 1},
+			},
+			getVersion: 5,
+			wantHits:   map[string]bool{"a": true},
+		},
+		{
+			name: "invalidate drops only the changed rows",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "put", depHash: "b", userVersion: 1},
+				{op: "pending", userVersion: 2},
+				{op: "invalidate", depHash: "a", userVersion: 2},
+				{op: "clear"},
+			},
+			getVersion: 2,
+			wantHits:   map[string]bool{"a": false, "b": true},
+		},
+		{
+			name: "put read before an invalidated publish is ignored",
+			ops: []cacheOp{
+				{op: "pending", userVersion: 2},
+				{op: "invalidate", depHash: "a", userVersion: 2},
+				{op: "clear"},
+				{op: "put", depHash: "a", userVersion: 1},
+			},
+			getVersion: 2,
+			wantHits:   map[string]bool{"a": false},
+		},
+		{
+			name: "put read at the invalidated version is kept",
+			ops: []cacheOp{
+				{op: "pending", userVersion: 2},
+				{op: "invalidate", depHash: "a", userVersion: 2},
+				{op: "clear"},
+				{op: "put", depHash: "a", userVersion: 2},
+			},
+			getVersion: 2,
+			wantHits:   map[string]bool{"a": true},
+		},
+		{
+			name: "pending stays until every publish is cleared",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "pending", userVersion: 3},
+				{op: "pending", userVersion: 2},
+				{op: "invalidate", depHash: "b", userVersion: 2},
+				{op: "clear"},
+			},
+			getVersion: 3,
+			wantHits:   map[string]bool{"a": false},
+		},
+		{
+			name: "pending keeps the lowest version",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "pending", userVersion: 3},
+				{op: "pending", userVersion: 2},
+			},
+			getVersion: 2,
+			wantHits:   map[string]bool{"a": false},
+		},
+		{
+			name: "cleared after every publish",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "pending", userVersion: 3},
+				{op: "pending", userVersion: 2},
+				{op: "invalidate", depHash: "b", userVersion: 2},
+				{op: "clear"},
+				{op: "invalidate", depHash: "c", userVersion: 3},
+				{op: "clear"},
+			},
+			getVersion: 3,
+			wantHits:   map[string]bool{"a": true},
+		},
+		{
+			name: "rolled back publish only clears",
+			ops: []cacheOp{
+				{op: "put", depHash: "a", userVersion: 1},
+				{op: "pending", userVersion: 2},
+				{op: "clear"},
+				{op: "put", depHash: "b", userVersion: 1},
+			},
+			getVersion: 1,
+			wantHits:   map[string]bool{"a": true, "b": true},
+		},
+	}
+	for _, tt := range tests {
+		c := NewResultCache(100)
+		for _, op := range tt.ops {
+			userId := op.userId
+			if userId == 0 {
+				userId = 1
+			}
+			switch op.op {
+			case "put":
+				c.Put(userId, op.depHash, op.userVersion, []string{"node-" + op.depHash}, op.userVersion, resultAge{})
+			case "pending":
+				c.MarkPending(userId, op.userVersion)
+			case "invalidate":
+				c.Invalidate(userId, []string{op.depHash}, op.userVersion)
+			case "clear":
+				c.ClearPending(userId)
+			default:
+				t.Fatalf("%s: unknown op %q", tt.name, op.op)
+			}
+		}
+		for depHash, wantHit := range tt.wantHits {
+			entry, hit := c.Get(1, depHash, tt.getVersion)
+			if hit != wantHit {
+				t.Errorf("%s: Get(%q) at version %d hit = %v, want %v", tt.name, depHash, tt.getVersion, hit, wantHit)
+			} else if hit && !reflect.DeepEqual(entry.nodeIds, []string{"node-" + depHash}) {
+				t.Errorf("%s: Get(%q) = %v", tt.name, depHash, entry.nodeIds)
+			}
+		}
+	}
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxNodeIds  int
+		puts        map[string]int
+		order       []string
+		wantEntries int
+		wantNodeIds int
+		wantHits    map[string]bool
+	}{
+		{
+			name:        "disabled",
+			maxNodeIds:  0,
+			order:       []string{"a"},
+			puts:        map[string]int{"a": 0},
+			wantEntries: 0,
+			wantHits:    map[string]bool{"a": false},
+		},
+		{
+			name:        "too large to cache",
+			maxNodeIds:  3,
+			order:       []string{"a", "b"},
+			puts:        map[string]int{"a": 3, "b": 2},
+			wantEntries: 1,
+			wantNodeIds: 3,
+			wantHits:    map[string]bool{"a": false, "b": true},
+		},
+		{
+			name:        "least recently used is evicted",
+			maxNodeIds:  6,
+			order:       []string{"a", "b", "c"},
+			puts:        map[string]int{"a": 1, "b": 1, "c": 2},
+			wantEntries: 2,
+			wantNodeIds: 5,
+			wantHits:    map[string]bool{"a": false, "b": true, "c": true},
+		},
+		{
+			name:        "replacing an entry",
+			maxNodeIds:  10,
+			order:       []string{"a", "a"},
+			puts:        map[string]int{"a": 4},
+			wantEntries: 1,
+			wantNodeIds: 5,
+			wantHits:    map[string]bool{"a": true},
+		},
+	}
+	for _, tt := range tests {
+		c := NewResultCache(tt.maxNodeIds)
+		for _, depHash := range tt.order {
+			c.Put(1, depHash, 1, make([]string, tt.puts[depHash]), 1, resultAge{})
+		}
+		entries, nodeIds := c.Size()
+		if entries != tt.wantEntries || nodeIds != tt.wantNodeIds {
+			t.Errorf("%s: Size() = %d, %d, want %d, %d", tt.name, entries, nodeIds, tt.wantEntries, tt.wantNodeIds)
+		}
+		for depHash, wantHit := range tt.wantHits {
+			if _, hit := c.Get(1, depHash, 1); hit != wantHit {
+				t.Errorf("%s: Get(%q) hit = %v, want %v", tt.name, depHash, hit, wantHit)
+			}
+		}
+	}
+}
+
+func TestQueryPassedCache(t *testing.T) {
+	ts := newTestServer(t)
+	publish := func(nodeIds ...string) {
+		ts.call(ts.public, "/api/v1/publish", ts.adminToken, PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): nodeIds}}, nil)
+		ts.applyBackground()
+	}
+
+	publish(testNodeId(1))
+	if got := ts.queryPassed(ts.adminToken, testDepHash(1)); len(got[0]) != 1 {
+		t.Errorf("first query = %v", got)
+	}
+	// Served from the cache, without reading the row again
+	ts.withConn(func(db *sqlite.Conn) {
+		err := sqlitex.Execute(db, "UPDATE test_results SET node_ids = ''", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got := ts.queryPassed(ts.adminToken, testDepHash(1)); len(got[0]) != 1 {
+		t.Errorf("cached query = %v", got)
+	}
+
+	// Publishing invalidates the cached row
+	publish(testNodeId(2))
+	if got := ts.queryPassed(ts.adminToken, testDepHash(1)); len(got[0]) != 1 || got[0][0] != testNodeId(2) {
+		t.Errorf("after publishing: %v", got)
+	}
+	if entries, _ := ts.resultCache.Size(); entries != 1 {
+		t.Errorf("cache has %d entries, want 1", entries)
+	}
+
+	// Other users have their own rows
+	_, otherToken := ts.createUser("other@example.com", false)
+	if got := ts.queryPassed(otherToken, testDepHash(1)); len(got[0]) != 0 {
+		t.Errorf("other user got %v", got)
+	}
+}
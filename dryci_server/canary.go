@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Canaries: with a canary rate, query-passed withholds a random fraction of the cached node ids
+// from each run, so they run again. The sample is a hash of the run id, so the publish of the
+// same run finds the same canaries without storing them: a canary that passes confirms its dep
+// hash captures the test's dependencies, one that fails contradicts it (and is a hermeticity
+// violation). Each dep hash gets a confidence score from these.
+
+// isCanary reports whether a node id is withheld from the run.
+func isCanary(runId string, depHash string, nodeId string, rate float64) bool {
+	h := sha256.Sum256([]byte(runId + ":" + depHash + ":" + nodeId))
+	return float64(binary.BigEndian.Uint64(h[:8])) < rate*math.MaxUint64
+}
+
+// withholdCanaries splits each dep hash's node ids into the ones to skip and the canaries.
+// The node ids may be shared (see queryPassed), so they're copied.
+func withholdCanaries(runId string, rate float64, depHashes []string, nodeIds [][]string) ([][]string, [][]string) {
+	kept := make([][]string, len(nodeIds))
+	withheld := make([][]string, len(nodeIds))
+	for i, ids := range nodeIds {
+		kept[i] = make([]string, 0, len(ids))
+		withheld[i] = []string{}
+		for _, id := range ids {
+			if isCanary(runId, depHashes[i], id, rate) {
+				withheld[i] = append(withheld[i], id)
+			} else {
+				kept[i] = append(kept[i], id)
+			}
+		}
+	}
+	return kept, withheld
+}
+
+// canaryRate returns the user's canary rate, from the control database.
+func (s *ApiServer) canaryRate(db *sqlite.Conn, userId int) (float64, error) {
+	policy, err := GetNamespacePolicy(db, userId)
+	if err != nil {
+		return 0, err
+	}
+	if policy.CanaryRate != nil {
+		return *policy.CanaryRate, nil
+	}
+	return *canaryRate, nil
+}
+
+// sampleCanaries counts the canaries of a run among its passed node ids (`passed`, before
+// they're published) and its hermeticity violations. Node ids are cached if they're in any
+// scope of the publish's chain, like the query that withheld them saw.
+func sampleCanaries(db *sqlite.Conn, t *PublishTask, passed map[string][]string, violations []HermeticityViolation) (map[string]canarySamples, error) {
+	samples := map[string]canarySamples{}
+	for depHash, nodeIds := range passed {
+		cached := map[string]bool{}
+		for _, scope := range t.scopes() {
+			scopeCached, _, err := getTestResult(db, t.UserId, scopedDepHash(depHash, scope))
+			if err != nil {
+				return nil, err
+			}
+			for nodeId := range scopeCached {
+				cached[nodeId] = true
+			}
+		}
+		for _, nodeId := range nodeIds {
+			if cached[nodeId] && isCanary(t.RunId, depHash, nodeId, t.CanaryRate) {
+				sample := samples[depHash]
+				sample.confirmed++
+				samples[depHash] = sample
+			}
+		}
+	}
+	contradicted := map[[2]string]bool{}
+	for _, v := range violations {
+		depHash, _ := splitScopedDepHash(v.DepHash)
+		if !contradicted[[2]string{depHash, v.NodeId}] && isCanary(t.RunId, depHash, v.NodeId, t.CanaryRate) {
+			contradicted[[2]string{depHash, v.NodeId}] = true
+			sample := samples[depHash]
+			sample.contradicted++
+			samples[depHash] = sample
+		}
+	}
+	return samples, nil
+}
+
+type HermeticityConfidenceRequest struct {
+	// Only report these dep hashes, all of them if empty
+	TestFileHashes []string `json:"test_file_hashes,omitempty"`
+	// Defaults to 100
+	Limit int `json:"limit,omitempty"`
+}
+
+type HermeticityConfidenceResponse struct {
+	Scores []CanaryScore `json:"scores"`
+}
+
+const HERMETICITY_CONFIDENCE_DOC = `List how confident the server is that test file hashes capture all of their tests' dependencies, least confident first.
+With a canary rate (-canary-rate, or the namespace policy), /api/v1/query-passed requests with a run_id withhold that fraction
+of the cached node IDs, which the run then re-runs. When the run publishes with the same run_id, each withheld node ID that
+passed confirms its test file hash, and each one that failed contradicts it. Test file hashes that were never sampled aren't listed.
+
+Example request:
+    {"limit": 10}
+
+Example response:
+    {
+        "scores": [
+            {
+                "dep_hash": "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6",
+                "confirmed": 8,
+                "contradicted": 1,
+                "confidence": 0.8181818181818182,
+                "last_sampled_at": 1760003600
+            }
+        ]
+    }`
+
+func (s *ApiServer) HermeticityConfidenceHandler(db *sqlite.Conn, req *HermeticityConfidenceRequest, res *HermeticityConfidenceResponse, auth AuthInfo) error {
+	limit, err := validateLimit(req.Limit, MAX_LIST_LIMIT)
+	if err == nil {
+		err = validateDepHashes(req.TestFileHashes)
+	}
+	if err != nil {
+		return err
+	}
+
+	var scores []CanaryScore
+	err = s.withResultsDb(db, auth.UserId, func(rdb *sqlite.Conn) (err error) {
+		scores, err = ListCanaryScores(rdb, auth.UserId, req.TestFileHashes, limit)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*res = HermeticityConfidenceResponse{Scores: scores}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWithholdCanaries(t *testing.T) {
+	nodeIds := []string{}
+	for i := 0; i < 1000; i++ {
+		nodeIds = append(nodeIds, testNodeId(i))
+	}
+	tests := []struct {
+		rate    float64
+		wantMin int
+		wantMax int
+	}{
+		{rate: 0, wantMin: 0, wantMax: 0},
+		{rate: 0.1, wantMin: 50, wantMax: 150},
+		{rate: 0.5, wantMin: 400, wantMax: 600},
+		{rate: 1, wantMin: 1000, wantMax: 1000},
+	}
+	for _, tt := range tests {
+		kept, withheld := withholdCanaries("run-1", tt.rate, []string{testDepHash(1)}, [][]string{nodeIds})
+		if len(kept[0])+len(withheld[0]) != len(nodeIds) {
+			t.Errorf("rate %g: kept %d and withheld %d of %d", tt.rate, len(kept[0]), len(withheld[0]), len(nodeIds))
+		}
+		if len(withheld[0]) < tt.wantMin || len(withheld[0]) > tt.wantMax {
+			t.Errorf("rate %g: withheld %d, want %d to %d", tt.rate, len(withheld[0]), tt.wantMin, tt.wantMax)
+		}
+		for _, nodeId := range withheld[0] {
+			if !isCanary("run-1", testDepHash(1), nodeId, tt.rate) {
+				t.Errorf("rate %g: withheld %s isn't a canary", tt.rate, nodeId)
+			}
+		}
+		// Another run gets another sample
+		_, other := withholdCanaries("run-2", tt.rate, []string{testDepHash(1)}, [][]string{nodeIds})
+		same := fmt.Sprint(other[0]) == fmt.Sprint(withheld[0])
+		if tt.rate > 0 && tt.rate < 1 && same {
+			t.Errorf("rate %g: runs withheld the same node ids", tt.rate)
+		}
+	}
+}
+
+func TestNamespacePolicy(t *testing.T) {
+	ts := newTestServer(t)
+	userId, _ := ts.createUser("user@example.com", false)
+	rate := func(r float64) *float64 { return &r }
+
+	tests := []struct {
+		name       string
+		req        SetNamespacePolicyRequest
+		wantStatus int
+	}{
+		{name: "set", req: SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{CanaryRate: rate(0.25)}}, wantStatus: http.StatusOK},
+		{name: "rate above 1", req: SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{CanaryRate: rate(1.5)}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "negative rate", req: SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{CanaryRate: rate(-0.1)}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "unknown user", req: SetNamespacePolicyRequest{UserId: 9999, Policy: NamespacePolicy{CanaryRate: rate(0.5)}}, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		status := ts.call(ts.admin, "/admin/api/v1/set-namespace-policy", ts.adminToken, tt.req, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: set-namespace-policy = %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+
+	var res GetNamespacePolicyResponse
+	ts.call(ts.admin, "/admin/api/v1/get-namespace-policy", ts.adminToken, GetNamespacePolicyRequest{UserId: userId}, &res)
+	if res.Policy.CanaryRate == nil || *res.Policy.CanaryRate != 0.25 {
+		t.Errorf("policy = %+v", res.Policy)
+	}
+	res = GetNamespacePolicyResponse{}
+	ts.call(ts.admin, "/admin/api/v1/get-namespace-policy", ts.adminToken, GetNamespacePolicyRequest{UserId: 9999}, &res)
+	if res.Policy.CanaryRate != nil {
+		t.Errorf("policy of unknown user = %+v", res.Policy)
+	}
+}
+
+func TestCanaries(t *testing.T) {
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	half := 0.5
+	ts.call(ts.admin, "/admin/api/v1/set-namespace-policy", ts.adminToken, SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{CanaryRate: &half}}, nil)
+	publish := func(req PublishRequest) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", token, req, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	query := func(runId string) QueryPassedResponse {
+		t.Helper()
+		var res QueryPassedResponse
+		status := ts.call(ts.public, "/api/v1/query-passed", token, QueryPassedRequest{TestFileHashes: []string{testDepHash(1)}, RunId: runId}, &res)
+		if status != http.StatusOK {
+			t.Fatalf("query-passed = %d", status)
+		}
+		return res
+	}
+
+	nodeIds := []string{}
+	for i := 0; i < 20; i++ {
+		nodeIds = append(nodeIds, testNodeId(i))
+	}
+	publish(PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): nodeIds}})
+
+	if res := query(""); len(res.NodeIds[0]) != len(nodeIds) || res.Withheld != nil {
+		t.Errorf("without a run id: %+v", res)
+	}
+	res := query("run-1")
+	withheld := res.Withheld[0]
+	if len(withheld) == 0 || len(res.NodeIds[0])+len(withheld) != len(nodeIds) {
+		t.Fatalf("run-1 kept %d and withheld %d of %d", len(res.NodeIds[0]), len(withheld), len(nodeIds))
+	}
+	if again := query("run-1"); fmt.Sprint(again.Withheld) != fmt.Sprint(res.Withheld) {
+		t.Errorf("run-1 withheld %v, then %v", res.Withheld, again.Withheld)
+	}
+
+	// The run confirms all but one canary, which fails. Passes of node ids that weren't
+	// withheld don't count.
+	publish(PublishRequest{
+		PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): append([]string{res.NodeIds[0][0]}, withheld[1:]...)},
+		FailedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {withheld[0]}},
+		RunId:                    "run-1",
+	})
+	// Without a run id, nothing is sampled
+	publish(PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): withheld[1:]}})
+
+	var scores HermeticityConfidenceResponse
+	status := ts.call(ts.public, "/api/v1/hermeticity-confidence", token, HermeticityConfidenceRequest{}, &scores)
+	if status != http.StatusOK || len(scores.Scores) != 1 {
+		t.Fatalf("hermeticity-confidence = %d, %+v", status, scores)
+	}
+	score := scores.Scores[0]
+	wantConfidence := float64(len(withheld)) / float64(len(withheld)+2)
+	if score.DepHash != testDepHash(1) || score.Confirmed != len(withheld)-1 || score.Contradicted != 1 || score.Confidence != wantConfidence {
+		t.Errorf("score = %+v, want %d confirmed and 1 contradicted", score, len(withheld)-1)
+	}
+
+	// The failed canary is gone from the results
+	passed := ts.queryPassed(token, testDepHash(1))[0]
+	if len(passed) != len(nodeIds)-1 {
+		t.Errorf("passed %d node ids, want %d", len(passed), len(nodeIds)-1)
+	}
+
+	for _, req := range []HermeticityConfidenceRequest{{Limit: -1}, {TestFileHashes: []string{"abc"}}} {
+		status := ts.call(ts.public, "/api/v1/hermeticity-confidence", token, req, nil)
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("%+v: status = %d, want 422", req, status)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Responses smaller than this aren't worth compressing
+const MIN_COMPRESS_BYTES = 1024
+
+// Caps the memory a single zstd request body may make us allocate for its window
+const MAX_ZSTD_WINDOW_BYTES = 8 * 1024 * 1024
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// decodeRequestBody undoes the request's Content-Encoding. Size limits must be applied to
+// the returned (decompressed) reader, so compression can't be used to smuggle in more data.
+func decodeRequestBody(r *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, HttpErrWrap(http.StatusBadRequest, "Invalid gzip body", err).WithErrorCode("invalid_encoding")
+		}
+		return gz, nil
+	case "zstd":
+		dec, err := zstd.NewReader(
+			r.Body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(MAX_ZSTD_WINDOW_BYTES),
+			zstd.WithDecoderMaxMemory(MAX_REQUEST_BODY_BYTES),
+		)
+		if err != nil {
+			return nil, HttpErrWrap(http.StatusBadRequest, "Invalid zstd body", err).WithErrorCode("invalid_encoding")
+		}
+		return zstdReadCloser{dec}, nil
+	default:
+		return nil, HttpErrWrap(
+			http.StatusUnsupportedMediaType,
+			"Unsupported Content-Encoding, use gzip or zstd",
+			fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding")),
+		).WithErrorCode("unsupported_encoding")
+	}
+}
+
+// negotiateEncoding picks the best response encoding we support from Accept-Encoding.
+func negotiateEncoding(r *http.Request) string {
+	best := ""
+	bestQ := 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if qStr, hasQ := strings.CutPrefix(strings.TrimSpace(params), "q="); hasQ {
+			parsed, err := strconv.ParseFloat(qStr, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 || (name != "zstd" && name != "gzip") {
+			continue
+		}
+		// Prefer zstd on ties, it's cheaper for us and smaller for the client
+		if q > bestQ || (q == bestQ && name == "zstd") {
+			best = name
+			bestQ = q
+		}
+	}
+	return best
+}
+
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+
+// writeEncoded writes a response body, compressed if the client accepts it and it's big
+// enough to matter.
+func writeEncoded(w http.ResponseWriter, r *http.Request, body []byte) error {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := ""
+	if len(body) >= MIN_COMPRESS_BYTES {
+		encoding = negotiateEncoding(r)
+	}
+
+	switch encoding {
+	case "zstd":
+		body = zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/4))
+	case "gzip":
+		var buf bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		_, err := gz.Write(body)
+		if err == nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	return fullWriteBytes(w, body)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	switch encoding {
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		return buf.Bytes()
+	case "zstd":
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer enc.Close()
+		return enc.EncodeAll(body, nil)
+	}
+	return body
+}
+
+func decompressBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(body)
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	ts := newTestServer(t)
+	depHash := strings.Repeat("a", DEP_HASH_HEX_SIZE)
+	nodeIds := []string{}
+	for i := 0; i < 64; i++ {
+		nodeIds = append(nodeIds, fmt.Sprintf("%032x", i))
+	}
+
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		publish, _ := json.Marshal(PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{depHash: nodeIds}})
+		rec := ts.do(ts.public, "POST", "/api/v1/publish", ts.adminToken, compressBody(t, encoding, publish), http.Header{"Content-Encoding": {encoding}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: publish = %d %s", encoding, rec.Code, rec.Body.String())
+		}
+		ts.applyBackground()
+
+		query, _ := json.Marshal(QueryPassedRequest{TestFileHashes: []string{depHash}})
+		rec = ts.do(ts.public, "POST", "/api/v1/query-passed", ts.adminToken, compressBody(t, encoding, query), http.Header{
+			"Content-Encoding": {encoding},
+			"Accept-Encoding":  {encoding},
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: query-passed = %d %s", encoding, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Errorf("%q: response Content-Encoding = %q", encoding, got)
+		}
+		var res QueryPassedResponse
+		err := json.Unmarshal(decompressBody(t, encoding, rec.Body.Bytes()), &res)
+		if err != nil {
+			t.Fatalf("%q: failed to decode response: %v", encoding, err)
+		}
+		if len(res.NodeIds) != 1 || len(res.NodeIds[0]) != len(nodeIds) {
+			t.Errorf("%q: got %v", encoding, res.NodeIds)
+		}
+	}
+}
+
+func TestBadRequestEncoding(t *testing.T) {
+	ts := newTestServer(t)
+	// Well under the limit on the wire, well over it once decompressed
+	bomb := []byte(`{"test_file_hashes": [` + strings.Repeat(" ", MAX_REQUEST_BODY_BYTES) + `]}`)
+
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "unsupported", encoding: "br", body: []byte(`{}`), wantStatus: 415, wantCode: "unsupported_encoding"},
+		{name: "not gzip", encoding: "gzip", body: []byte(`{}`), wantStatus: 400, wantCode: "invalid_encoding"},
+		{name: "gzip bomb", encoding: "gzip", body: compressBody(t, "gzip", bomb), wantStatus: 413, wantCode: "request_too_large"},
+		{name: "zstd bomb", encoding: "zstd", body: compressBody(t, "zstd", bomb), wantStatus: 413, wantCode: "request_too_large"},
+	}
+	for _, tt := range tests {
+		rec := ts.do(ts.public, "POST", "/api/v1/query-passed", ts.adminToken, tt.body, http.Header{"Content-Encoding": {tt.encoding}})
+		var res ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != tt.wantStatus || res.Error.Code != tt.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, rec.Code, res.Error.Code, tt.wantStatus, tt.wantCode)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "identity", want: ""},
+		{acceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "GZIP", want: "gzip"},
+		{acceptEncoding: "gzip, zstd", want: "zstd"},
+		{acceptEncoding: "br, gzip;q=0.5", want: "gzip"},
+		{acceptEncoding: "zstd;q=0.5, gzip", want: "gzip"},
+		{acceptEncoding: "zstd;q=0, gzip;q=0.1", want: "gzip"},
+		{acceptEncoding: "gzip;q=0", want: ""},
+		{acceptEncoding: "gzip;q=oops", want: ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		if got := negotiateEncoding(r); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestWriteEncodedSmallBody(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, zstd")
+	err := writeEncoded(rec, r, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "{}" {
+		t.Errorf("small body was compressed: %v %q", rec.Header(), rec.Body.String())
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" || rec.Header().Get("Content-Length") != "2" {
+		t.Errorf("headers = %v", rec.Header())
+	}
+}
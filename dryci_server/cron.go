@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule decides when a job runs next.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (e everySchedule) Next(after time.Time) time.Time {
+	return after.Add(e.interval)
+}
+
+// cronSchedule is a classic 5-field cron spec (minute hour day-of-month month day-of-week),
+// in local time. Each field is a bitmask of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Like cron, if both day fields are restricted a day matching either one matches
+	domRestricted, dowRestricted bool
+}
+
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// ParseSchedule parses a cron spec ("30 4 * * 1-5"), a descriptor (@hourly, @daily,
+// @weekly, @monthly) or an interval ("@every 5m").
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if interval, isEvery := strings.CutPrefix(spec, "@every "); isEvery {
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid interval in %q", spec)
+		}
+		return everySchedule{d}, nil
+	}
+	if expanded, ok := cronDescriptors[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q doesn't have 5 fields", spec)
+	}
+	var c cronSchedule
+	var err error
+	bounds := []struct {
+		out      *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}}
+	for i, b := range bounds {
+		*b.out, err = parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, fmt.Errorf("cron spec %q: %w", spec, err)
+		}
+	}
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domRestricted = fields[2] != "*"
+	c.dowRestricted = fields[4] != "*"
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of "*", "N", "N-M", each optionally with a "/STEP".
+func parseCronField(field string, min int, max int) (uint64, error) {
+	mask := uint64(0)
+	for _, item := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			loStr, hiStr, isRange := strings.Cut(rangePart, "-")
+			var err error
+			lo, err = strconv.Atoi(loStr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", item)
+			}
+			hi = lo
+			if isRange {
+				hi, err = strconv.Atoi(hiStr)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value in %q", item)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := c.dom&(1<<t.Day()) != 0
+	dowMatch := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domRestricted && c.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func (c cronSchedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Skip whole months/days/hours that don't match. A spec that never matches (Feb 30th)
+	// gives up after a few years.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
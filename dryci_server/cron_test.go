@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	bits := func(values ...int) uint64 {
+		mask := uint64(0)
+		for _, v := range values {
+			mask |= 1 << v
+		}
+		return mask
+	}
+	tests := []struct {
+		field    string
+		min, max int
+		want     uint64
+		wantErr  bool
+	}{
+		{field: "*", min: 0, max: 6, want: bits(0, 1, 2, 3, 4, 5, 6)},
+		{field: "5", min: 0, max: 59, want: bits(5)},
+		{field: "1-3", min: 0, max: 59, want: bits(1, 2, 3)},
+		{field: "1,5,9", min: 0, max: 59, want: bits(1, 5, 9)},
+		{field: "*/15", min: 0, max: 59, want: bits(0, 15, 30, 45)},
+		{field: "10-20/5", min: 0, max: 59, want: bits(10, 15, 20)},
+		{field: "50/5", min: 0, max: 59, want: bits(50, 55)},
+		{field: "1-2,*/12", min: 0, max: 23, want: bits(0, 1, 2, 12)},
+		{field: "1", min: 1, max: 12, want: bits(1)},
+		{field: "0", min: 1, max: 12, wantErr: true},
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "5-1", min: 0, max: 59, wantErr: true},
+		{field: "*/0", min: 0, max: 59, wantErr: true},
+		{field: "*/x", min: 0, max: 59, wantErr: true},
+		{field: "a", min: 0, max: 59, wantErr: true},
+		{field: "1-b", min: 0, max: 59, wantErr: true},
+		{field: "", min: 0, max: 59, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.min, tt.max)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCronField(%q, %d, %d) = %b, want an error", tt.field, tt.min, tt.max, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCronField(%q, %d, %d) failed: %v", tt.field, tt.min, tt.max, err)
+		} else if got != tt.want {
+			t.Errorf("parseCronField(%q, %d, %d) = %b, want %b", tt.field, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		spec  string
+		after string
+		want  string
+	}{
+		{spec: "@every 5m", after: "2024-03-10 10:02:30", want: "2024-03-10 10:07:30"},
+		{spec: "* * * * *", after: "2024-03-10 10:02:30", want: "2024-03-10 10:03:00"},
+		{spec: "* * * * *", after: "2024-03-10 10:02:00", want: "2024-03-10 10:03:00"},
+		{spec: "@hourly", after: "2024-03-10 10:00:00", want: "2024-03-10 11:00:00"},
+		{spec: "@daily", after: "2024-12-31 23:59:59", want: "2025-01-01 00:00:00"},
+		{spec: "30 4 * * *", after: "2024-03-10 04:30:00", want: "2024-03-11 04:30:00"},
+		{spec: "30 4 * * *", after: "2024-03-10 04:29:59", want: "2024-03-10 04:30:00"},
+		{spec: "*/20 9-17 * * *", after: "2024-03-10 17:40:00", want: "2024-03-11 09:00:00"},
+		// 2024-03-10 is a Sunday
+		{spec: "0 4 * * 0", after: "2024-03-10 05:00:00", want: "2024-03-17 04:00:00"},
+		{spec: "0 4 * * 7", after: "2024-03-10 05:00:00", want: "2024-03-17 04:00:00"},
+		{spec: "0 0 * * 1-5", after: "2024-03-08 12:00:00", want: "2024-03-11 00:00:00"},
+		{spec: "@monthly", after: "2024-01-31 00:00:00", want: "2024-02-01 00:00:00"},
+		{spec: "0 0 31 * *", after: "2024-01-31 00:00:00", want: "2024-03-31 00:00:00"},
+		{spec: "0 0 29 2 *", after: "2024-03-01 00:00:00", want: "2028-02-29 00:00:00"},
+		// Either day field matches when both are restricted: the 15th, or Mondays
+		{spec: "0 0 15 * 1", after: "2024-03-10 00:00:00", want: "2024-03-11 00:00:00"},
+		{spec: "0 0 15 * 1", after: "2024-03-11 00:00:00", want: "2024-03-15 00:00:00"},
+		// Never matches, gives up
+		{spec: "0 0 30 2 *", after: "2024-01-01 00:00:00", want: ""},
+	}
+	for _, tt := range tests {
+		schedule, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		got := schedule.Next(at(tt.after))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s = %s, want none", tt.spec, tt.after, got)
+			}
+			continue
+		}
+		if !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s = %s, want %s", tt.spec, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"@every",
+		"@every 5",
+		"@every 10ms",
+		"61 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -4,17 +4,20 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base32"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
+	"sort"
 	"time"
 
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 )
 
-func OpenDbPool() (*sqlitex.Pool, error) {
-	return sqlitex.NewPool(*dbPath, sqlitex.PoolOptions{
+func OpenDbPool(path string) (*sqlitex.Pool, error) {
+	return sqlitex.NewPool(path, sqlitex.PoolOptions{
 		Flags:    sqlite.OpenReadWrite | sqlite.OpenCreate | sqlite.OpenWAL,
 		PoolSize: 128,
 		PrepareConn: func(conn *sqlite.Conn) error {
@@ -29,7 +32,9 @@ func OpenDbPool() (*sqlitex.Pool, error) {
 	})
 }
 
-func MigrateDb(dbPool *sqlitex.Pool, downgradeVersion int) (err error) {
+// MigrateDb brings the database to the latest schema. Result shards get the same schema, but
+// only the control database (`isControl`) gets an admin token.
+func MigrateDb(dbPool *sqlitex.Pool, downgradeVersion int, isControl bool) (err error) {
 	db, err := dbPool.Take(context.TODO())
 	if err != nil {
 		return fmt.Errorf("failed to take connection from pool: %w", err)
@@ -58,17 +63,12 @@ func MigrateDb(dbPool *sqlitex.Pool, downgradeVersion int) (err error) {
 	if err != nil {
 		return fmt.Errorf("failed to set initial schema version: %w", err)
 	}
-	err = sqlitex.ExecuteTransient(db, "SELECT value FROM settings WHERE key = 'schema_version'", &sqlitex.ExecOptions{
-		ResultFunc: func(stmt *sqlite.Stmt) error {
-			schemaVersion = stmt.ColumnInt(0)
-			return nil
-		},
-	})
+	schemaVersion, err = GetSchemaVersion(db)
 	if err != nil {
-		return fmt.Errorf("failed to get schema version: %w", err)
+		return err
 	}
 
-	log.Println("Current DB schema version:", schemaVersion)
+	slog.Info("Current DB schema version", "version", schemaVersion)
 
 	// Downgrade to the requested version
 	if downgradeVersion != -1 {
@@ -77,7 +77,7 @@ func MigrateDb(dbPool *sqlitex.Pool, downgradeVersion int) (err error) {
 			if err != nil {
 				return fmt.Errorf("failed to find downgrade migration %d: %w", i, err)
 			}
-			log.Printf("- Unapplying migration %d", i)
+			slog.Info("Unapplying migration", "version", i)
 			err = sqlitex.ExecuteScript(db, string(sql), nil)
 			if err != nil {
 				return fmt.Errorf("failed to apply downgrade migration %d: %w", i, err)
@@ -99,7 +99,7 @@ func MigrateDb(dbPool *sqlitex.Pool, downgradeVersion int) (err error) {
 		if err != nil {
 			break
 		}
-		log.Printf("- Applying migration %d", i)
+		slog.Info("Applying migration", "version", i)
 		err = sqlitex.ExecuteScript(db, string(sql), nil)
 		if err != nil {
 			return fmt.Errorf("failed to apply migration %d: %w", i, err)
@@ -114,7 +114,7 @@ func MigrateDb(dbPool *sqlitex.Pool, downgradeVersion int) (err error) {
 	}
 
 	// If we just upgraded from schema version 0, generate an admin token
-	if schemaVersion == 0 {
+	if schemaVersion == 0 && isControl {
 		admin_uid := -1
 		err = sqlitex.ExecuteTransient(db, "SELECT id FROM users WHERE superuser = 1", &sqlitex.ExecOptions{
 			ResultFunc: func(stmt *sqlite.Stmt) error {
@@ -131,21 +131,89 @@ func MigrateDb(dbPool *sqlitex.Pool, downgradeVersion int) (err error) {
 		if admin_uid == -1 {
 			return fmt.Errorf("internal error: no admin user found after initial migration")
 		}
-		token, err := CreateUserToken(db, admin_uid, 0)
+		token, _, err := CreateUserToken(db, admin_uid, 0, nil)
 		if err != nil {
 			return fmt.Errorf("failed to generate admin token: %w", err)
 		}
-		log.Printf("Initial admin token: %s", token)
+		slog.Info("Created initial admin token", "token", token)
 	}
 
 	return err
 }
 
+func GetSchemaVersion(db *sqlite.Conn) (int, error) {
+	schemaVersion := 0
+	err := sqlitex.Execute(db, "SELECT value FROM settings WHERE key = 'schema_version'", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			schemaVersion = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	return schemaVersion, nil
+}
+
+// CheckResultShards fails if the database was used with a different number of result shards,
+// since users would be routed to shards that don't have their results. A database without
+// the setting was unsharded if it has any results.
+func CheckResultShards(db *sqlite.Conn, shards int) error {
+	stored := -1
+	err := sqlitex.Execute(db, "SELECT value FROM settings WHERE key = 'result_shards'", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			stored = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get result shards: %w", err)
+	}
+	if stored == -1 {
+		hasResults := false
+		err = sqlitex.Execute(db, "SELECT 1 FROM test_results LIMIT 1", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				hasResults = true
+				return nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to check for test results: %w", err)
+		}
+		stored = shards
+		if hasResults {
+			stored = 0
+		}
+		err = sqlitex.Execute(db, "INSERT INTO settings(key, value) VALUES('result_shards', ?)", &sqlitex.ExecOptions{
+			Args: []interface{}{stored},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set result shards: %w", err)
+		}
+	}
+	if stored != shards {
+		return fmt.Errorf("database uses %d result shards, not %d", stored, shards)
+	}
+	return nil
+}
+
+// latestMigrationVersion is the schema version MigrateDb upgrades to.
+func latestMigrationVersion() int {
+	version := 0
+	for {
+		_, err := fs.Stat(migrations, fmt.Sprintf("migrations/%d.up.sql", version+1))
+		if err != nil {
+			return version
+		}
+		version++
+	}
+}
+
 func DbTxn(db *sqlite.Conn, writesToDb bool, f func() error) (err error) {
 	if writesToDb {
-		endTxn, err := sqlitex.ImmediateTransaction(db)
-		if err != nil {
-			return fmt.Errorf("failed to start transaction: %w", err)
+		endTxn, beginErr := sqlitex.ImmediateTransaction(db)
+		if beginErr != nil {
+			return fmt.Errorf("failed to start transaction: %w", beginErr)
 		}
 		defer endTxn(&err)
 	} else {
@@ -155,41 +223,70 @@ func DbTxn(db *sqlite.Conn, writesToDb bool, f func() error) (err error) {
 	return f()
 }
 
+// DbSavepoint runs f in a nested transaction, so its changes are rolled back if it fails
+// without failing the enclosing transaction.
+func DbSavepoint(db *sqlite.Conn, f func() error) (err error) {
+	defer sqlitex.Save(db)(&err)
+	return f()
+}
+
 var base32Enc = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
 
 func GenToken() string {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err != nil {
-		log.Fatalf("failed to generate random bytes: %w", err)
+		fatal("Failed to generate random bytes", "err", err)
 	}
 	return "dryci-" + base32Enc.EncodeToString(b)
 }
 
-func CreateUserToken(db *sqlite.Conn, user_id int, expiration int) (string, error) {
+// CreateUserToken returns the new token and its id.
+func CreateUserToken(db *sqlite.Conn, user_id int, expiration int, labels map[string]string) (string, int64, error) {
 	token := GenToken()
-	if expiration == 0 {
-		err := sqlitex.Execute(
-			db,
-			"INSERT INTO api_tokens(user_id, token) VALUES(?, ?)",
-			&sqlitex.ExecOptions{Args: []interface{}{user_id, token}},
-		)
-		if err != nil {
-			return "", fmt.Errorf("failed to insert user token: %w", err)
-		}
-	} else {
-		currentTime := time.Now().Unix()
-		expirationTime := currentTime + int64(expiration)
-		err := sqlitex.Execute(
-			db,
-			"INSERT INTO api_tokens(user_id, token, expires_at) VALUES(?, ?, ?)",
-			&sqlitex.ExecOptions{Args: []interface{}{user_id, token, expirationTime}},
-		)
-		if err != nil {
-			return "", fmt.Errorf("failed to insert user token: %w", err)
-		}
+	var expirationTime interface{}
+	if expiration != 0 {
+		expirationTime = time.Now().Unix() + int64(expiration)
+	}
+	labelsJson := "{}"
+	if len(labels) > 0 {
+		b, _ := json.Marshal(labels)
+		labelsJson = string(b)
+	}
+	err := sqlitex.Execute(
+		db,
+		"INSERT INTO api_tokens(user_id, token, expires_at, labels) VALUES(?, ?, ?, ?)",
+		&sqlitex.ExecOptions{Args: []interface{}{user_id, token, expirationTime, labelsJson}},
+	)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to insert user token: %w", err)
+	}
+	return token, db.LastInsertRowID(), nil
+}
+
+// TrustedTokenIds returns the user's tokens that have all of the labels.
+func TrustedTokenIds(db *sqlite.Conn, userId int, labels map[string]string) ([]int64, error) {
+	labelsJson, _ := json.Marshal(labels)
+	tokenIds := []int64{}
+	err := sqlitex.Execute(
+		db,
+		`SELECT id FROM api_tokens
+		WHERE user_id = ? AND NOT EXISTS (
+			SELECT 1 FROM json_each(?) f
+			WHERE NOT EXISTS (SELECT 1 FROM json_each(api_tokens.labels) l WHERE l.key = f.key AND l.value = f.value)
+		)`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{userId, string(labelsJson)},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				tokenIds = append(tokenIds, stmt.ColumnInt64(0))
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trusted tokens of user:%d: %w", userId, err)
 	}
-	return token, nil
+	return tokenIds, nil
 }
 
 type Usage int
@@ -197,19 +294,26 @@ type Usage int
 const (
 	USAGE_QUERY   Usage = 1
 	USAGE_PUBLISH Usage = 2
+	USAGE_ADMIN   Usage = 3
 )
 
-func AuthUser(db *sqlite.Conn, token string) (userId int, err error) {
+type AuthInfo struct {
+	UserId    int
+	TokenId   int64
+	Superuser bool
+}
+
+func AuthUser(db *sqlite.Conn, token string) (auth AuthInfo, err error) {
 	found := false
 
 	// Early exit if the token is obviously invalid
 	if len(token) > 40 || len(token) == 0 {
-		return -1, HttpErrWrap(http.StatusUnauthorized, "Invalid Token", fmt.Errorf("token length out of bounds (%d)", len(token)))
+		return AuthInfo{}, HttpErrWrap(http.StatusUnauthorized, "Invalid Token", fmt.Errorf("token length out of bounds (%d)", len(token))).WithErrorCode("invalid_token")
 	}
 
 	err = sqlitex.Execute(
 		db,
-		`SELECT t.user_id, t.expires_at, t.disabled_at IS NULL AND u.disabled_at IS NULL
+		`SELECT t.user_id, t.expires_at, t.disabled_at IS NULL AND u.disabled_at IS NULL, u.superuser, t.id
 		FROM api_tokens t
 		JOIN users u ON t.user_id = u.id
 		WHERE token = ?`,
@@ -217,7 +321,7 @@ func AuthUser(db *sqlite.Conn, token string) (userId int, err error) {
 			Args: []interface{}{token},
 			ResultFunc: func(stmt *sqlite.Stmt) error {
 				found = true
-				userId = stmt.ColumnInt(0)
+				userId := stmt.ColumnInt(0)
 				if !stmt.ColumnIsNull(1) {
 					expiresAt := stmt.ColumnInt64(1)
 					if time.Now().Unix() > expiresAt {
@@ -225,7 +329,7 @@ func AuthUser(db *sqlite.Conn, token string) (userId int, err error) {
 							http.StatusUnauthorized,
 							"Token Expired",
 							fmt.Errorf("token expired at %d for user %d", expiresAt, userId),
-						)
+						).WithErrorCode("token_expired")
 					}
 				}
 				tokenEnabled := stmt.ColumnBool(2)
@@ -234,23 +338,73 @@ func AuthUser(db *sqlite.Conn, token string) (userId int, err error) {
 						http.StatusUnauthorized,
 						"Token Disabled",
 						fmt.Errorf("token disabled for user %d", userId),
-					)
+					).WithErrorCode("token_disabled")
 				}
 
+				auth = AuthInfo{UserId: userId, TokenId: stmt.ColumnInt64(4), Superuser: stmt.ColumnBool(3)}
 				return nil
 			},
 		},
 	)
 	if err != nil {
-		return -1, err
+		return AuthInfo{}, err
 	}
 	if !found {
-		return -1, HttpErrWrap(http.StatusUnauthorized, "Invalid Token", fmt.Errorf("token not found"))
+		return AuthInfo{}, HttpErrWrap(http.StatusUnauthorized, "Invalid Token", fmt.Errorf("token not found")).WithErrorCode("invalid_token")
 	}
 
 	return
 }
 
+func CreateUser(db *sqlite.Conn, email string, fullName string, superuser bool) (int, error) {
+	err := sqlitex.Execute(
+		db,
+		"INSERT INTO users(email, full_name, superuser) VALUES(?, ?, ?)",
+		&sqlitex.ExecOptions{Args: []interface{}{email, fullName, superuser}},
+	)
+	if err != nil {
+		if sqlite.ErrCode(err) == sqlite.ResultConstraintUnique {
+			return -1, HttpErrWrap(http.StatusConflict, "User Already Exists", err).WithErrorCode("user_exists")
+		}
+		return -1, fmt.Errorf("failed to insert user: %w", err)
+	}
+	return int(db.LastInsertRowID()), nil
+}
+
+func UserExists(db *sqlite.Conn, userId int) (bool, error) {
+	exists := false
+	err := sqlitex.Execute(
+		db,
+		"SELECT 1 FROM users WHERE id = ?",
+		&sqlitex.ExecOptions{
+			Args: []interface{}{userId},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up user %d: %w", userId, err)
+	}
+	return exists, nil
+}
+
+func DisableUserToken(db *sqlite.Conn, token string) error {
+	err := sqlitex.Execute(
+		db,
+		"UPDATE api_tokens SET disabled_at = ? WHERE token = ? AND disabled_at IS NULL",
+		&sqlitex.ExecOptions{Args: []interface{}{time.Now().Unix(), token}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to disable token: %w", err)
+	}
+	if db.Changes() == 0 {
+		return HttpErrWrap(http.StatusNotFound, "Token Not Found", fmt.Errorf("no enabled token to disable"))
+	}
+	return nil
+}
+
 func RecordUsage(db *sqlite.Conn, userId int, usage Usage, timestamp time.Time) error {
 	err := sqlitex.Execute(
 		db,
@@ -268,27 +422,60 @@ const DEP_HASH_HEX_SIZE = 64
 const NODEID_HASH_HEX_SIZE = 32
 const MAX_NODEIDS_PER_DEP = 32 * 1024
 
-func QueryPassedTestHashes(db *sqlite.Conn, userId int, depHashes []string) ([][]string, error) {
+// resultAge is when a test_results row was last published, and when it expires (0 for never).
+type resultAge struct {
+	publishedAt int64
+	expiresAt   int64
+}
+
+// QueryPassedTestHashes returns the node ids, row version and age of each dep hash. Dep hashes
+// that haven't changed since version `since` get nil node ids (0 returns everything), and
+// unknown dep hashes have version 0. With a trust filter, only trusted node ids are returned.
+// Expired rows are returned as is, see resultAge.stale.
+func QueryPassedTestHashes(db *sqlite.Conn, userId int, depHashes []string, since int64, trust *trustFilter) ([][]string, []int64, []resultAge, error) {
 	nodeIds := make([][]string, len(depHashes))
+	versions := make([]int64, len(depHashes))
+	ages := make([]resultAge, len(depHashes))
+	quarantined, err := getQuarantine(db, userId, depHashes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	for depHashIdx, depHash := range depHashes {
-		if len(depHash) != DEP_HASH_HEX_SIZE {
-			return nil, fmt.Errorf("invalid dep_hash length %d", len(depHash))
+		if !validDepHashKey(depHash) {
+			return nil, nil, nil, HttpErrWrap(http.StatusUnprocessableEntity, "Invalid test file hash", fmt.Errorf("invalid dep_hash length %d", len(depHash))).WithErrorCode("invalid_dep_hash")
 		}
 		nodeIds[depHashIdx] = []string{}
 
+		var trusted map[string]bool
+		if trust != nil {
+			trusted, err = getTrustedNodeIds(db, userId, depHash, trust)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
 		err := sqlitex.Execute(
 			db,
-			"SELECT node_ids FROM test_results WHERE user_id = ? AND dep_hash = ?",
+			"SELECT version, node_ids, accessed_at, IFNULL(expires_at, 0) FROM test_results WHERE user_id = ? AND dep_hash = ?",
 			&sqlitex.ExecOptions{
 				ResultFunc: func(stmt *sqlite.Stmt) error {
-					concatedNodeIds := make([]byte, stmt.ColumnLen(0))
-					stmt.ColumnBytes(0, concatedNodeIds)
+					versions[depHashIdx] = stmt.ColumnInt64(0)
+					ages[depHashIdx] = resultAge{publishedAt: stmt.ColumnInt64(2), expiresAt: stmt.ColumnInt64(3)}
+					if versions[depHashIdx] <= since {
+						nodeIds[depHashIdx] = nil
+						return nil
+					}
+
+					concatedNodeIds := make([]byte, stmt.ColumnLen(1))
+					stmt.ColumnBytes(1, concatedNodeIds)
 					if len(concatedNodeIds)%NODEID_HASH_HEX_SIZE != 0 {
 						return fmt.Errorf("invalid node_ids length %d of user:%d dep_hash:%s", len(nodeIds), userId, depHash)
 					}
 
 					for i := 0; i < len(concatedNodeIds); i += NODEID_HASH_HEX_SIZE {
-						nodeIds[depHashIdx] = append(nodeIds[depHashIdx], string(concatedNodeIds[i:i+NODEID_HASH_HEX_SIZE]))
+						nodeId := string(concatedNodeIds[i : i+NODEID_HASH_HEX_SIZE])
+						if !quarantined.has(depHash, nodeId) && (trusted == nil || trusted[nodeId]) {
+							nodeIds[depHashIdx] = append(nodeIds[depHashIdx], nodeId)
+						}
 					}
 					return nil
 				},
@@ -296,16 +483,143 @@ func QueryPassedTestHashes(db *sqlite.Conn, userId int, depHashes []string) ([][
 			},
 		)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get node_ids of user:%d dep_hash:%s: %w", userId, depHash, err)
+			return nil, nil, nil, fmt.Errorf("failed to get node_ids of user:%d dep_hash:%s: %w", userId, depHash, err)
 		}
 	}
 
-	return nodeIds, nil
+	return nodeIds, versions, ages, nil
 }
 
-func PublishTestHashes(db *sqlite.Conn, userId int, tests map[string][]string) error {
-	for depHash, newNodeIds := range tests {
+// getTrustedNodeIds returns the node ids of the dep hash whose provenance passes the filter.
+func getTrustedNodeIds(db *sqlite.Conn, userId int, depHash string, trust *trustFilter) (map[string]bool, error) {
+	tokenIdsJson, _ := json.Marshal(trust.tokenIds)
+	trusted := map[string]bool{}
+	err := sqlitex.Execute(
+		db,
+		`SELECT node_id FROM test_provenance WHERE user_id = ? AND dep_hash = ?
+		GROUP BY node_id
+		HAVING MAX(token_id IN (SELECT value FROM json_each(?3))) OR (?4 > 0 AND COUNT(DISTINCT NULLIF(token_id, 0)) >= ?4)`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{userId, depHash, string(tokenIdsJson), trust.quorum},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				trusted[stmt.ColumnText(0)] = true
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trusted node_ids of user:%d dep_hash:%s: %w", userId, depHash, err)
+	}
+	return trusted, nil
+}
+
+// BumpAllResults gives all of the user's results a new version, so they're queried again after
+// something that filters them changed. Returns their dep hashes.
+func BumpAllResults(db *sqlite.Conn, userId int, version int64) ([]string, error) {
+	depHashes := []string{}
+	err := sqlitex.Execute(db, "UPDATE test_results SET version = ? WHERE user_id = ? RETURNING dep_hash", &sqlitex.ExecOptions{
+		Args: []interface{}{version, userId},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			depHashes = append(depHashes, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bump results of user:%d: %w", userId, err)
+	}
+	return depHashes, nil
+}
+
+// GetResultsVersion returns the version of the user's latest publish, 0 if they never published.
+func GetResultsVersion(db *sqlite.Conn, userId int) (int64, error) {
+	version := int64(0)
+	err := sqlitex.Execute(
+		db,
+		"SELECT version FROM result_versions WHERE user_id = ?",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				version = stmt.ColumnInt64(0)
+				return nil
+			},
+			Args: []interface{}{userId},
+		},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get results version of user:%d: %w", userId, err)
+	}
+	return version, nil
+}
+
+// validateDepHashes checks dep hashes sent by clients. They can't be scoped, scopes are sent
+// with `scope` instead.
+func validateDepHashes(depHashes []string) error {
+	for _, depHash := range depHashes {
 		if len(depHash) != DEP_HASH_HEX_SIZE {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid test file hash", fmt.Errorf("invalid dep_hash length %d", len(depHash))).WithErrorCode("invalid_dep_hash")
+		}
+		if !isHex(depHash) {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid test file hash", fmt.Errorf("dep_hash %q is not hex", depHash)).WithErrorCode("invalid_dep_hash")
+		}
+	}
+	return nil
+}
+
+// ValidateTestHashes checks a publish request up front, since PublishTestHashes runs in the
+// background where errors can't reach the client. Hashes must be hex, so responses can send
+// them as bytes.
+func ValidateTestHashes(tests map[string][]string) error {
+	for depHash, nodeIds := range tests {
+		err := validateDepHashes([]string{depHash})
+		if err != nil {
+			return err
+		}
+		if len(nodeIds) > MAX_NODEIDS_PER_DEP {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "Too many node ids", fmt.Errorf("too many node_ids %d for dep_hash:%s", len(nodeIds), depHash)).WithErrorCode("too_many_node_ids")
+		}
+		for _, nodeId := range nodeIds {
+			if len(nodeId) != NODEID_HASH_HEX_SIZE || !isHex(nodeId) {
+				return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid node id", fmt.Errorf("invalid node_id %q", nodeId)).WithErrorCode("invalid_node_id")
+			}
+		}
+	}
+	return nil
+}
+
+// BumpResultsVersion returns a new version of the user's results, for the rows about to be published.
+// The version only ever goes up, even if rows are deleted, so it's safe to use as an ETag.
+func BumpResultsVersion(db *sqlite.Conn, userId int) (int64, error) {
+	version := int64(0)
+	err := sqlitex.Execute(
+		db,
+		"INSERT INTO result_versions(user_id, version) VALUES(?, 1) ON CONFLICT(user_id) DO UPDATE SET version = version + 1 RETURNING version",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				version = stmt.ColumnInt64(0)
+				return nil
+			},
+			Args: []interface{}{userId},
+		},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to bump results version of user:%d: %w", userId, err)
+	}
+	return version, nil
+}
+
+// PublishTestHashes merges node ids into the user's results, see BumpResultsVersion.
+// Quarantined node ids are left out. Rows expire at `expiresAt`, or never if it's missing,
+// whatever an earlier publish set.
+func PublishTestHashes(db *sqlite.Conn, userId int, version int64, tests map[string][]string, expiresAt map[string]int64) error {
+	depHashes := make([]string, 0, len(tests))
+	for depHash := range tests {
+		depHashes = append(depHashes, depHash)
+	}
+	quarantined, err := getQuarantine(db, userId, depHashes)
+	if err != nil {
+		return err
+	}
+	for depHash, newNodeIds := range tests {
+		if !validDepHashKey(depHash) {
 			return fmt.Errorf("invalid dep_hash length %d", len(depHash))
 		}
 		if len(newNodeIds) > MAX_NODEIDS_PER_DEP {
@@ -347,6 +661,9 @@ func PublishTestHashes(db *sqlite.Conn, userId int, tests map[string][]string) e
 			if len(newNodeId) != NODEID_HASH_HEX_SIZE {
 				return fmt.Errorf("invalid node_id length %d", len(newNodeId))
 			}
+			if quarantined.has(depHash, newNodeId) {
+				continue
+			}
 			nodeIds[([NODEID_HASH_HEX_SIZE]byte)([]byte(newNodeId))] = true
 		}
 
@@ -357,9 +674,9 @@ func PublishTestHashes(db *sqlite.Conn, userId int, tests map[string][]string) e
 		}
 		err = sqlitex.Execute(
 			db,
-			"INSERT OR REPLACE INTO test_results(user_id, dep_hash, accessed_at, node_ids) VALUES(?, ?, ?, ?)",
+			"INSERT OR REPLACE INTO test_results(user_id, dep_hash, accessed_at, node_ids, version, expires_at) VALUES(?, ?, ?, ?, ?, NULLIF(?, 0))",
 			&sqlitex.ExecOptions{
-				Args: []interface{}{userId, depHash, time.Now().Unix(), concatedNodeIds},
+				Args: []interface{}{userId, depHash, time.Now().Unix(), concatedNodeIds, version, expiresAt[depHash]},
 			},
 		)
 		if err != nil {
@@ -369,3 +686,1556 @@ func PublishTestHashes(db *sqlite.Conn, userId int, tests map[string][]string) e
 
 	return nil
 }
+
+// RecordTestPasses counts a passed run of node ids that failed before.
+func RecordTestPasses(db *sqlite.Conn, userId int, tests map[string][]string) error {
+	now := time.Now().Unix()
+	for depHash, nodeIds := range tests {
+		nodeIdsJson, _ := json.Marshal(nodeIds)
+		err := sqlitex.Execute(
+			db,
+			`UPDATE test_failures SET pass_count = pass_count + 1, last_passed_at = ?
+			WHERE user_id = ? AND dep_hash = ? AND node_id IN (SELECT value FROM json_each(?))`,
+			&sqlitex.ExecOptions{
+				Args: []interface{}{now, userId, depHash, string(nodeIdsJson)},
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to count passes of user:%d dep_hash:%s: %w", userId, depHash, err)
+		}
+	}
+	return nil
+}
+
+// RecordTestFailures counts a failed or errored run of node ids. If a node id is in the user's
+// results when it first fails, its earlier passes are counted as one. Returns the node ids
+// that are in the results of the scopes the run saw, which contradict them, keyed by scoped
+// dep hash.
+func RecordTestFailures(db *sqlite.Conn, userId int, scopes []string, failed map[string][]string, errored map[string][]string) ([]HermeticityViolation, error) {
+	now := time.Now().Unix()
+	violations := []HermeticityViolation{}
+	record := func(depHash string, nodeIds []string, outcome string, failCount int, errorCount int) error {
+		passedAt := map[string]int64{}
+		for _, scope := range scopes {
+			key := scopedDepHash(depHash, scope)
+			passed, accessedAt, err := getTestResult(db, userId, key)
+			if err != nil {
+				return err
+			}
+			for _, nodeId := range nodeIds {
+				if passed[nodeId] {
+					passedAt[nodeId] = max(passedAt[nodeId], accessedAt)
+					violations = append(violations, HermeticityViolation{
+						DepHash:    key,
+						NodeId:     nodeId,
+						Outcome:    outcome,
+						PassedAt:   accessedAt,
+						DetectedAt: now,
+					})
+				}
+			}
+		}
+		for _, nodeId := range nodeIds {
+			passCount := 0
+			var lastPassedAt interface{}
+			if at, ok := passedAt[nodeId]; ok {
+				passCount = 1
+				lastPassedAt = at
+			}
+			err := sqlitex.Execute(
+				db,
+				`INSERT INTO test_failures(user_id, dep_hash, node_id, pass_count, fail_count, error_count, last_passed_at, last_failed_at)
+				VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(user_id, dep_hash, node_id) DO UPDATE SET
+					fail_count = fail_count + excluded.fail_count,
+					error_count = error_count + excluded.error_count,
+					last_failed_at = excluded.last_failed_at`,
+				&sqlitex.ExecOptions{
+					Args: []interface{}{userId, depHash, nodeId, passCount, failCount, errorCount, lastPassedAt, now},
+				},
+			)
+			if err != nil {
+				return fmt.Errorf("failed to record failure of user:%d dep_hash:%s: %w", userId, depHash, err)
+			}
+		}
+		return nil
+	}
+	for depHash, nodeIds := range failed {
+		err := record(depHash, nodeIds, "failed", 1, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for depHash, nodeIds := range errored {
+		err := record(depHash, nodeIds, "errored", 0, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return violations, nil
+}
+
+// RemoveTestNodeIds removes node ids from the user's results, see BumpResultsVersion.
+func RemoveTestNodeIds(db *sqlite.Conn, userId int, version int64, tests map[string][]string) error {
+	for depHash, removed := range tests {
+		nodeIds, _, err := getTestResult(db, userId, depHash)
+		if err != nil {
+			return err
+		}
+		for _, nodeId := range removed {
+			delete(nodeIds, nodeId)
+		}
+		if len(nodeIds) == 0 {
+			err = sqlitex.Execute(db, "DELETE FROM test_results WHERE user_id = ? AND dep_hash = ?", &sqlitex.ExecOptions{
+				Args: []interface{}{userId, depHash},
+			})
+		} else {
+			concatedNodeIds := make([]byte, 0, len(nodeIds)*NODEID_HASH_HEX_SIZE)
+			for nodeId := range nodeIds {
+				concatedNodeIds = append(concatedNodeIds, nodeId...)
+			}
+			err = sqlitex.Execute(db, "UPDATE test_results SET node_ids = ?, version = ? WHERE user_id = ? AND dep_hash = ?", &sqlitex.ExecOptions{
+				Args: []interface{}{concatedNodeIds, version, userId, depHash},
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to remove node_ids of user:%d dep_hash:%s: %w", userId, depHash, err)
+		}
+		// Once the row is gone, so is all of its provenance
+		var removedJson interface{}
+		if len(nodeIds) > 0 {
+			b, _ := json.Marshal(removed)
+			removedJson = string(b)
+		}
+		err = sqlitex.Execute(
+			db,
+			`DELETE FROM test_provenance WHERE user_id = ? AND dep_hash = ?
+			AND (?3 IS NULL OR node_id IN (SELECT value FROM json_each(?3)))`,
+			&sqlitex.ExecOptions{Args: []interface{}{userId, depHash, removedJson}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to remove provenance of user:%d dep_hash:%s: %w", userId, depHash, err)
+		}
+	}
+	return nil
+}
+
+// ResultsSelector picks cached results to invalidate. Selectors add up, a node id is picked if
+// any of them matches.
+type ResultsSelector struct {
+	DepHashes []string
+	NodeIds   map[string][]string
+	// Node ids published by the token or run
+	TokenId int64
+	RunId   string
+	// Dep hashes last published before this unix timestamp
+	OlderThan int64
+}
+
+type InvalidatedResults struct {
+	DepHash string `json:"dep_hash"`
+	Scope   string `json:"scope,omitempty"`
+	// The test_results row, see scopedDepHash
+	key string
+	// The whole dep hash is gone, node_ids is omitted
+	Whole       bool     `json:"whole"`
+	NodeIdCount int      `json:"node_id_count"`
+	NodeIds     []string `json:"node_ids,omitempty"`
+}
+
+// InvalidateResults removes the node ids picked by sel from the user's results, and returns
+// what was removed, sorted by dep hash.
+func InvalidateResults(db *sqlite.Conn, userId int, version int64, sel ResultsSelector) ([]InvalidatedResults, error) {
+	whole := map[string]bool{}
+	picked := map[string]map[string]bool{}
+	pick := func(depHash, nodeId string) {
+		if picked[depHash] == nil {
+			picked[depHash] = map[string]bool{}
+		}
+		picked[depHash][nodeId] = true
+	}
+	// Dep hashes are selected in every scope
+	for _, depHash := range sel.DepHashes {
+		keys, err := scopedKeys(db, userId, depHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			whole[key] = true
+		}
+	}
+	for depHash, nodeIds := range sel.NodeIds {
+		keys, err := scopedKeys(db, userId, depHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			for _, nodeId := range nodeIds {
+				pick(key, nodeId)
+			}
+		}
+	}
+	if sel.OlderThan != 0 {
+		err := sqlitex.Execute(db, "SELECT dep_hash FROM test_results WHERE user_id = ? AND accessed_at < ?", &sqlitex.ExecOptions{
+			Args: []interface{}{userId, sel.OlderThan},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				whole[stmt.ColumnText(0)] = true
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get old results of user:%d: %w", userId, err)
+		}
+	}
+	if sel.TokenId != 0 || sel.RunId != "" {
+		err := sqlitex.Execute(
+			db,
+			"SELECT dep_hash, node_id FROM test_provenance WHERE user_id = ?1 AND ((?2 != 0 AND token_id = ?2) OR (?3 != '' AND run_id = ?3))",
+			&sqlitex.ExecOptions{
+				Args: []interface{}{userId, sel.TokenId, sel.RunId},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					pick(stmt.ColumnText(0), stmt.ColumnText(1))
+					return nil
+				},
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get provenance of user:%d: %w", userId, err)
+		}
+	}
+	return removePickedResults(db, userId, version, whole, picked)
+}
+
+// scopedKeys returns the test_results rows of the dep hash, in every scope.
+func scopedKeys(db *sqlite.Conn, userId int, depHash string) ([]string, error) {
+	keys := []string{}
+	err := sqlitex.Execute(
+		db,
+		"SELECT dep_hash FROM test_results WHERE user_id = ?1 AND (dep_hash = ?2 OR dep_hash BETWEEN ?2 || '@' AND ?2 || 'A')",
+		&sqlitex.ExecOptions{
+			Args: []interface{}{userId, depHash},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				keys = append(keys, stmt.ColumnText(0))
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scopes of user:%d dep_hash:%s: %w", userId, depHash, err)
+	}
+	return keys, nil
+}
+
+// removePickedResults removes the whole dep hashes and picked node ids from the user's results,
+// and returns what was there to remove, sorted by dep hash.
+func removePickedResults(db *sqlite.Conn, userId int, version int64, whole map[string]bool, picked map[string]map[string]bool) ([]InvalidatedResults, error) {
+	depHashes := make([]string, 0, len(whole)+len(picked))
+	for depHash := range whole {
+		depHashes = append(depHashes, depHash)
+	}
+	for depHash := range picked {
+		if !whole[depHash] {
+			depHashes = append(depHashes, depHash)
+		}
+	}
+	sort.Strings(depHashes)
+
+	invalidated := []InvalidatedResults{}
+	removals := map[string][]string{}
+	for _, depHash := range depHashes {
+		current, _, err := getTestResult(db, userId, depHash)
+		if err != nil {
+			return nil, err
+		}
+		removed := []string{}
+		for nodeId := range current {
+			if whole[depHash] || picked[depHash][nodeId] {
+				removed = append(removed, nodeId)
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		sort.Strings(removed)
+		removals[depHash] = removed
+		base, scope := splitScopedDepHash(depHash)
+		entry := InvalidatedResults{DepHash: base, Scope: scope, key: depHash, Whole: len(removed) == len(current), NodeIdCount: len(removed)}
+		if !entry.Whole {
+			entry.NodeIds = removed
+		}
+		invalidated = append(invalidated, entry)
+	}
+	err := RemoveTestNodeIds(db, userId, version, removals)
+	if err != nil {
+		return nil, err
+	}
+	return invalidated, nil
+}
+
+// RevertProvenance removes the node ids published by the token and run (either may be left
+// out) from the user's results, unless another token or run also published them. Either way,
+// the provenance of the token and run is removed. Also returns how many node ids were kept,
+// and the dep hashes they're in, which get a new version since a trust policy may not trust
+// them anymore.
+func RevertProvenance(db *sqlite.Conn, userId int, version int64, tokenId int64, runId string) ([]InvalidatedResults, int, []string, error) {
+	const match = "(?2 = 0 OR token_id = ?2) AND (?3 = '' OR run_id = ?3)"
+	picked := map[string]map[string]bool{}
+	kept := 0
+	keptIn := map[string]bool{}
+	err := sqlitex.Execute(
+		db,
+		`SELECT dep_hash, node_id, EXISTS(
+			SELECT 1 FROM test_provenance o
+			WHERE o.user_id = p.user_id AND o.dep_hash = p.dep_hash AND o.node_id = p.node_id AND NOT (`+match+`)
+		)
+		FROM test_provenance p WHERE user_id = ?1 AND `+match,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{userId, tokenId, runId},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if stmt.ColumnBool(2) {
+					kept++
+					keptIn[stmt.ColumnText(0)] = true
+					return nil
+				}
+				depHash := stmt.ColumnText(0)
+				if picked[depHash] == nil {
+					picked[depHash] = map[string]bool{}
+				}
+				picked[depHash][stmt.ColumnText(1)] = true
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to get provenance of user:%d: %w", userId, err)
+	}
+	reverted, err := removePickedResults(db, userId, version, nil, picked)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	err = sqlitex.Execute(db, "DELETE FROM test_provenance WHERE user_id = ?1 AND "+match, &sqlitex.ExecOptions{
+		Args: []interface{}{userId, tokenId, runId},
+	})
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to delete provenance of user:%d: %w", userId, err)
+	}
+	bumped := make([]string, 0, len(keptIn))
+	for depHash := range keptIn {
+		err = sqlitex.Execute(db, "UPDATE test_results SET version = ? WHERE user_id = ? AND dep_hash = ?", &sqlitex.ExecOptions{
+			Args: []interface{}{version, userId, depHash},
+		})
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to bump results of user:%d dep_hash:%s: %w", userId, depHash, err)
+		}
+		bumped = append(bumped, depHash)
+	}
+	return reverted, kept, bumped, nil
+}
+
+// OldProvenanceUsers returns the users with provenance last published before `before`.
+func OldProvenanceUsers(db *sqlite.Conn, before time.Time) ([]int, error) {
+	userIds := []int{}
+	err := sqlitex.Execute(db, "SELECT DISTINCT user_id FROM test_provenance WHERE published_at < ?", &sqlitex.ExecOptions{
+		Args: []interface{}{before.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			userIds = append(userIds, stmt.ColumnInt(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users with old provenance: %w", err)
+	}
+	return userIds, nil
+}
+
+// DeleteOldProvenance deletes the user's provenance last published before `before`. The rows
+// it was about get a new version, since a trust policy may not trust them anymore.
+func DeleteOldProvenance(db *sqlite.Conn, userId int, version int64, before time.Time) ([]string, error) {
+	depHashes := []string{}
+	err := sqlitex.Execute(
+		db,
+		`UPDATE test_results SET version = ?1 WHERE user_id = ?2 AND dep_hash IN (
+			SELECT dep_hash FROM test_provenance WHERE user_id = ?2 AND published_at < ?3
+		) RETURNING dep_hash`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{version, userId, before.Unix()},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				depHashes = append(depHashes, stmt.ColumnText(0))
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bump results with old provenance of user:%d: %w", userId, err)
+	}
+	err = sqlitex.Execute(db, "DELETE FROM test_provenance WHERE user_id = ? AND published_at < ?", &sqlitex.ExecOptions{
+		Args: []interface{}{userId, before.Unix()},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete old provenance of user:%d: %w", userId, err)
+	}
+	return depHashes, nil
+}
+
+type ProvenanceEntry struct {
+	DepHash     string `json:"dep_hash"`
+	Scope       string `json:"scope,omitempty"`
+	NodeId      string `json:"node_id"`
+	TokenId     int64  `json:"token_id"`
+	RunId       string `json:"run_id"`
+	PublishedAt int64  `json:"published_at"`
+}
+
+// ListProvenance lists who published the user's node ids, most recent first. Empty filters
+// match everything.
+func ListProvenance(db *sqlite.Conn, userId int, depHashes []string, tokenId int64, runId string, limit int) ([]ProvenanceEntry, error) {
+	depHashesJson, _ := json.Marshal(depHashes)
+	entries := []ProvenanceEntry{}
+	err := sqlitex.Execute(
+		db,
+		`SELECT dep_hash, node_id, token_id, run_id, published_at FROM test_provenance
+		WHERE user_id = ? AND (json_array_length(?2) = 0 OR substr(dep_hash, 1, 64) IN (SELECT value FROM json_each(?2)))
+		AND (?3 = 0 OR token_id = ?3) AND (?4 = '' OR run_id = ?4)
+		ORDER BY published_at DESC, dep_hash, node_id LIMIT ?5`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{userId, string(depHashesJson), tokenId, runId, limit},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				depHash, scope := splitScopedDepHash(stmt.ColumnText(0))
+				entries = append(entries, ProvenanceEntry{
+					DepHash:     depHash,
+					Scope:       scope,
+					NodeId:      stmt.ColumnText(1),
+					TokenId:     stmt.ColumnInt64(2),
+					RunId:       stmt.ColumnText(3),
+					PublishedAt: stmt.ColumnInt64(4),
+				})
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list provenance of user:%d: %w", userId, err)
+	}
+	return entries, nil
+}
+
+// RecordTestProvenance records that the token and run published the node ids.
+func RecordTestProvenance(db *sqlite.Conn, userId int, tokenId int64, runId string, tests map[string][]string) error {
+	now := time.Now().Unix()
+	for depHash, nodeIds := range tests {
+		nodeIdsJson, _ := json.Marshal(nodeIds)
+		err := sqlitex.Execute(
+			db,
+			`INSERT INTO test_provenance(user_id, dep_hash, node_id, token_id, run_id, published_at)
+			SELECT ?, ?, value, ?, ?, ? FROM json_each(?) WHERE true
+			ON CONFLICT DO UPDATE SET published_at = excluded.published_at`,
+			&sqlitex.ExecOptions{Args: []interface{}{userId, depHash, tokenId, runId, now, string(nodeIdsJson)}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record provenance of user:%d dep_hash:%s: %w", userId, depHash, err)
+		}
+	}
+	return nil
+}
+
+type HermeticityViolation struct {
+	Id int64 `json:"id"`
+	// Scoped until listed, see scopedDepHash
+	DepHash string `json:"dep_hash"`
+	// The scope of the contradicted pass, "" for the unscoped results
+	Scope  string `json:"scope,omitempty"`
+	NodeId string `json:"node_id"`
+	// "failed" or "errored"
+	Outcome string `json:"outcome"`
+	// When the contradicted pass was last published
+	PassedAt   int64 `json:"passed_at"`
+	DetectedAt int64 `json:"detected_at"`
+}
+
+func AddHermeticityViolations(db *sqlite.Conn, userId int, violations []HermeticityViolation) error {
+	for _, v := range violations {
+		err := sqlitex.Execute(
+			db,
+			"INSERT INTO hermeticity_violations(user_id, dep_hash, node_id, outcome, passed_at, detected_at) VALUES(?, ?, ?, ?, ?, ?)",
+			&sqlitex.ExecOptions{
+				Args: []interface{}{userId, v.DepHash, v.NodeId, v.Outcome, v.PassedAt, v.DetectedAt},
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record hermeticity violation of user:%d dep_hash:%s: %w", userId, v.DepHash, err)
+		}
+	}
+	return nil
+}
+
+// ListHermeticityViolations returns the user's violations with an id below `beforeId` (0 for
+// the latest), newest first.
+func ListHermeticityViolations(db *sqlite.Conn, userId int, beforeId int64, limit int) ([]HermeticityViolation, error) {
+	query := "SELECT id, dep_hash, node_id, outcome, passed_at, detected_at FROM hermeticity_violations WHERE user_id = ?"
+	args := []interface{}{userId}
+	if beforeId > 0 {
+		query += " AND id < ?"
+		args = append(args, beforeId)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	violations := []HermeticityViolation{}
+	err := sqlitex.Execute(db, query, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			depHash, scope := splitScopedDepHash(stmt.ColumnText(1))
+			violations = append(violations, HermeticityViolation{
+				Id:         stmt.ColumnInt64(0),
+				DepHash:    depHash,
+				Scope:      scope,
+				NodeId:     stmt.ColumnText(2),
+				Outcome:    stmt.ColumnText(3),
+				PassedAt:   stmt.ColumnInt64(4),
+				DetectedAt: stmt.ColumnInt64(5),
+			})
+			return nil
+		},
+		Args: args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hermeticity violations of user:%d: %w", userId, err)
+	}
+	return violations, nil
+}
+
+func DeleteOldHermeticityViolations(db *sqlite.Conn, before time.Time) (int, error) {
+	err := sqlitex.Execute(db, "DELETE FROM hermeticity_violations WHERE detected_at < ?", &sqlitex.ExecOptions{
+		Args: []interface{}{before.Unix()},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old hermeticity violations: %w", err)
+	}
+	return db.Changes(), nil
+}
+
+// getTestResult returns the passed node ids of a dep hash, and when they were last published.
+func getTestResult(db *sqlite.Conn, userId int, depHash string) (map[string]bool, int64, error) {
+	nodeIds := map[string]bool{}
+	accessedAt := int64(0)
+	err := sqlitex.Execute(
+		db,
+		"SELECT node_ids, accessed_at FROM test_results WHERE user_id = ? AND dep_hash = ?",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				concatedNodeIds := stmt.ColumnText(0)
+				if len(concatedNodeIds)%NODEID_HASH_HEX_SIZE != 0 {
+					return fmt.Errorf("invalid node_ids length %d of user:%d dep_hash:%s", len(concatedNodeIds), userId, depHash)
+				}
+				for i := 0; i < len(concatedNodeIds); i += NODEID_HASH_HEX_SIZE {
+					nodeIds[concatedNodeIds[i:i+NODEID_HASH_HEX_SIZE]] = true
+				}
+				accessedAt = stmt.ColumnInt64(1)
+				return nil
+			},
+			Args: []interface{}{userId, depHash},
+		},
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get node_ids of user:%d dep_hash:%s: %w", userId, depHash, err)
+	}
+	return nodeIds, accessedAt, nil
+}
+
+type FlakyTest struct {
+	DepHash    string `json:"dep_hash"`
+	NodeId     string `json:"node_id"`
+	PassCount  int    `json:"pass_count"`
+	FailCount  int    `json:"fail_count"`
+	ErrorCount int    `json:"error_count"`
+	// 1 if the node id passed as often as it failed or errored, towards 0 if it mostly did one
+	Flakiness    float64 `json:"flakiness"`
+	LastPassedAt int64   `json:"last_passed_at"`
+	LastFailedAt int64   `json:"last_failed_at"`
+}
+
+// ListFlakyTests returns the user's node ids that both passed and failed under the same dep
+// hash, flakiest first. Empty `depHashes` lists all dep hashes.
+func ListFlakyTests(db *sqlite.Conn, userId int, depHashes []string, limit int) ([]FlakyTest, error) {
+	query := `SELECT dep_hash, node_id, pass_count, fail_count, error_count, last_passed_at, last_failed_at,
+		2.0 * min(pass_count, fail_count + error_count) / (pass_count + fail_count + error_count) AS flakiness
+		FROM test_failures WHERE user_id = ? AND pass_count > 0`
+	args := []interface{}{userId}
+	if len(depHashes) > 0 {
+		query += " AND dep_hash IN (SELECT value FROM json_each(?))"
+		depHashesJson, _ := json.Marshal(depHashes)
+		args = append(args, string(depHashesJson))
+	}
+	query += " ORDER BY flakiness DESC, pass_count + fail_count + error_count DESC LIMIT ?"
+	args = append(args, limit)
+
+	tests := []FlakyTest{}
+	err := sqlitex.Execute(db, query, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			tests = append(tests, FlakyTest{
+				DepHash:      stmt.ColumnText(0),
+				NodeId:       stmt.ColumnText(1),
+				PassCount:    stmt.ColumnInt(2),
+				FailCount:    stmt.ColumnInt(3),
+				ErrorCount:   stmt.ColumnInt(4),
+				LastPassedAt: stmt.ColumnInt64(5),
+				LastFailedAt: stmt.ColumnInt64(6),
+				Flakiness:    stmt.ColumnFloat(7),
+			})
+			return nil
+		},
+		Args: args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list flaky tests of user:%d: %w", userId, err)
+	}
+	return tests, nil
+}
+
+// DeleteStaleTestFailures forgets node ids that didn't run since `before`, returning how many.
+func DeleteStaleTestFailures(db *sqlite.Conn, before time.Time) (int, error) {
+	err := sqlitex.Execute(
+		db,
+		"DELETE FROM test_failures WHERE max(last_failed_at, coalesce(last_passed_at, 0)) < ?",
+		&sqlitex.ExecOptions{Args: []interface{}{before.Unix()}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale test failures: %w", err)
+	}
+	return db.Changes(), nil
+}
+
+// NamespacePolicy holds a user's settings, nil fields use the server's defaults.
+type NamespacePolicy struct {
+	// Fraction of cached node ids withheld from a run, see /api/v1/hermeticity-confidence
+	CanaryRate *float64 `json:"canary_rate"`
+	// Scopes whose results a query with another scope also sees, before the unscoped ones
+	ScopeFallbacks []string `json:"scope_fallbacks"`
+	// Which publishes queries trust, null trusts all of them
+	Trust *TrustPolicy `json:"trust"`
+	// Seconds since a test file hash was last published after which queries ignore it, unless
+	// they send their own max_age
+	MaxAge *int64 `json:"max_age"`
+}
+
+// TrustPolicy makes queries only return node ids published by a trusted token, or by enough
+// distinct tokens, according to their provenance (see /api/v1/provenance). Node ids published
+// before provenance was recorded aren't trusted.
+type TrustPolicy struct {
+	// Tokens with all of these labels are trusted, see /admin/api/v1/create-token
+	TokenLabels map[string]string `json:"token_labels,omitempty"`
+	// Node ids published by this many distinct tokens are trusted, 0 to only trust labels.
+	// Counting tokens rather than run ids, since one token can make up any number of runs.
+	Quorum int `json:"quorum,omitempty"`
+}
+
+func GetNamespacePolicy(db *sqlite.Conn, userId int) (NamespacePolicy, error) {
+	policy := NamespacePolicy{}
+	err := sqlitex.Execute(db, "SELECT canary_rate, scope_fallbacks, trust, max_age FROM namespace_policies WHERE user_id = ?", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if stmt.ColumnType(0) != sqlite.TypeNull {
+				rate := stmt.ColumnFloat(0)
+				policy.CanaryRate = &rate
+			}
+			if stmt.ColumnType(1) != sqlite.TypeNull {
+				err := json.Unmarshal([]byte(stmt.ColumnText(1)), &policy.ScopeFallbacks)
+				if err != nil {
+					return fmt.Errorf("invalid scope_fallbacks: %w", err)
+				}
+			}
+			if stmt.ColumnType(2) != sqlite.TypeNull {
+				err := json.Unmarshal([]byte(stmt.ColumnText(2)), &policy.Trust)
+				if err != nil {
+					return fmt.Errorf("invalid trust: %w", err)
+				}
+			}
+			if stmt.ColumnType(3) != sqlite.TypeNull {
+				maxAge := stmt.ColumnInt64(3)
+				policy.MaxAge = &maxAge
+			}
+			return nil
+		},
+		Args: []interface{}{userId},
+	})
+	if err != nil {
+		return NamespacePolicy{}, fmt.Errorf("failed to get policy of user:%d: %w", userId, err)
+	}
+	return policy, nil
+}
+
+func SetNamespacePolicy(db *sqlite.Conn, userId int, policy NamespacePolicy) error {
+	var canaryRate, scopeFallbacks, trust, maxAge interface{}
+	if policy.CanaryRate != nil {
+		canaryRate = *policy.CanaryRate
+	}
+	if policy.ScopeFallbacks != nil {
+		fallbacks, _ := json.Marshal(policy.ScopeFallbacks)
+		scopeFallbacks = string(fallbacks)
+	}
+	if policy.Trust != nil {
+		trustJson, _ := json.Marshal(policy.Trust)
+		trust = string(trustJson)
+	}
+	if policy.MaxAge != nil {
+		maxAge = *policy.MaxAge
+	}
+	err := sqlitex.Execute(
+		db,
+		"INSERT OR REPLACE INTO namespace_policies(user_id, canary_rate, scope_fallbacks, trust, max_age) VALUES(?, ?, ?, ?, ?)",
+		&sqlitex.ExecOptions{Args: []interface{}{userId, canaryRate, scopeFallbacks, trust, maxAge}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set policy of user:%d: %w", userId, err)
+	}
+	return nil
+}
+
+// ListScopeFallbacks returns the scope fallbacks of the namespaces that set them.
+func ListScopeFallbacks(db *sqlite.Conn) (map[int][]string, error) {
+	fallbacks := map[int][]string{}
+	err := sqlitex.Execute(db, "SELECT user_id, scope_fallbacks FROM namespace_policies WHERE scope_fallbacks IS NOT NULL", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			scopes := []string{}
+			err := json.Unmarshal([]byte(stmt.ColumnText(1)), &scopes)
+			if err != nil {
+				return fmt.Errorf("invalid scope_fallbacks of user:%d: %w", stmt.ColumnInt(0), err)
+			}
+			fallbacks[stmt.ColumnInt(0)] = scopes
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scope fallbacks: %w", err)
+	}
+	return fallbacks, nil
+}
+
+type canarySamples struct {
+	confirmed    int
+	contradicted int
+}
+
+func AddCanarySamples(db *sqlite.Conn, userId int, samples map[string]canarySamples) error {
+	now := time.Now().Unix()
+	for depHash, sample := range samples {
+		err := sqlitex.Execute(
+			db,
+			`INSERT INTO canary_scores(user_id, dep_hash, confirmed, contradicted, last_sampled_at) VALUES(?, ?, ?, ?, ?)
+			ON CONFLICT(user_id, dep_hash) DO UPDATE SET
+				confirmed = confirmed + excluded.confirmed,
+				contradicted = contradicted + excluded.contradicted,
+				last_sampled_at = excluded.last_sampled_at`,
+			&sqlitex.ExecOptions{
+				Args: []interface{}{userId, depHash, sample.confirmed, sample.contradicted, now},
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record canaries of user:%d dep_hash:%s: %w", userId, depHash, err)
+		}
+	}
+	return nil
+}
+
+func DeleteOldCanaryScores(db *sqlite.Conn, before time.Time) (int, error) {
+	err := sqlitex.Execute(db, "DELETE FROM canary_scores WHERE last_sampled_at < ?", &sqlitex.ExecOptions{
+		Args: []interface{}{before.Unix()},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old canary scores: %w", err)
+	}
+	return db.Changes(), nil
+}
+
+type CanaryScore struct {
+	DepHash      string `json:"dep_hash"`
+	Confirmed    int    `json:"confirmed"`
+	Contradicted int    `json:"contradicted"`
+	// (confirmed + 1) / (confirmed + contradicted + 2), 0.5 with no samples
+	Confidence    float64 `json:"confidence"`
+	LastSampledAt int64   `json:"last_sampled_at"`
+}
+
+// ListCanaryScores returns the user's scores, least confident first. Empty `depHashes` lists
+// all dep hashes.
+func ListCanaryScores(db *sqlite.Conn, userId int, depHashes []string, limit int) ([]CanaryScore, error) {
+	query := `SELECT dep_hash, confirmed, contradicted, last_sampled_at,
+		(confirmed + 1.0) / (confirmed + contradicted + 2.0) AS confidence
+		FROM canary_scores WHERE user_id = ?`
+	args := []interface{}{userId}
+	if len(depHashes) > 0 {
+		query += " AND dep_hash IN (SELECT value FROM json_each(?))"
+		depHashesJson, _ := json.Marshal(depHashes)
+		args = append(args, string(depHashesJson))
+	}
+	query += " ORDER BY confidence, last_sampled_at DESC LIMIT ?"
+	args = append(args, limit)
+
+	scores := []CanaryScore{}
+	err := sqlitex.Execute(db, query, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			scores = append(scores, CanaryScore{
+				DepHash:       stmt.ColumnText(0),
+				Confirmed:     stmt.ColumnInt(1),
+				Contradicted:  stmt.ColumnInt(2),
+				LastSampledAt: stmt.ColumnInt64(3),
+				Confidence:    stmt.ColumnFloat(4),
+			})
+			return nil
+		},
+		Args: args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list canary scores of user:%d: %w", userId, err)
+	}
+	return scores, nil
+}
+
+type QuarantineEntry struct {
+	// Either or both of DepHash and NodeId. A node id alone matches under any dep hash.
+	DepHash   string `json:"dep_hash,omitempty"`
+	NodeId    string `json:"node_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+}
+
+// quarantineSet holds quarantine entries as (dep_hash, node_id) pairs, with "" for either.
+type quarantineSet map[[2]string]bool
+
+// has takes scoped dep hashes, the quarantine applies to every scope.
+func (q quarantineSet) has(depHash string, nodeId string) bool {
+	depHash, _ = splitScopedDepHash(depHash)
+	return q[[2]string{depHash, ""}] || q[[2]string{"", nodeId}] || q[[2]string{depHash, nodeId}]
+}
+
+// getQuarantine returns the user's quarantine entries that may match node ids of `depHashes`.
+func getQuarantine(db *sqlite.Conn, userId int, depHashes []string) (quarantineSet, error) {
+	baseDepHashes := make([]string, len(depHashes))
+	for i, depHash := range depHashes {
+		baseDepHashes[i], _ = splitScopedDepHash(depHash)
+	}
+	depHashesJson, _ := json.Marshal(baseDepHashes)
+	quarantined := quarantineSet{}
+	err := sqlitex.Execute(
+		db,
+		"SELECT dep_hash, node_id FROM quarantine WHERE user_id = ? AND (dep_hash = '' OR dep_hash IN (SELECT value FROM json_each(?)))",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				quarantined[[2]string{stmt.ColumnText(0), stmt.ColumnText(1)}] = true
+				return nil
+			},
+			Args: []interface{}{userId, string(depHashesJson)},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quarantine of user:%d: %w", userId, err)
+	}
+	return quarantined, nil
+}
+
+func ListQuarantine(db *sqlite.Conn, userId int) ([]QuarantineEntry, error) {
+	entries := []QuarantineEntry{}
+	err := sqlitex.Execute(
+		db,
+		"SELECT dep_hash, node_id, reason, created_at FROM quarantine WHERE user_id = ? ORDER BY created_at, dep_hash, node_id",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				entries = append(entries, QuarantineEntry{
+					DepHash:   stmt.ColumnText(0),
+					NodeId:    stmt.ColumnText(1),
+					Reason:    stmt.ColumnText(2),
+					CreatedAt: stmt.ColumnInt64(3),
+				})
+				return nil
+			},
+			Args: []interface{}{userId},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quarantine of user:%d: %w", userId, err)
+	}
+	return entries, nil
+}
+
+// AddQuarantine adds or replaces quarantine entries. Returns the dep hashes whose results
+// they hide, which get the results version `version`, see BumpResultsVersion.
+func AddQuarantine(db *sqlite.Conn, userId int, version int64, entries []QuarantineEntry) ([]string, error) {
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		err := sqlitex.Execute(
+			db,
+			"INSERT OR REPLACE INTO quarantine(user_id, dep_hash, node_id, reason, created_at) VALUES(?, ?, ?, ?, ?)",
+			&sqlitex.ExecOptions{
+				Args: []interface{}{userId, entry.DepHash, entry.NodeId, entry.Reason, now},
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to quarantine dep_hash:%s node_id:%s of user:%d: %w", entry.DepHash, entry.NodeId, userId, err)
+		}
+	}
+	return bumpQuarantinedResults(db, userId, version, entries)
+}
+
+// RemoveQuarantine is the opposite of AddQuarantine.
+func RemoveQuarantine(db *sqlite.Conn, userId int, version int64, entries []QuarantineEntry) ([]string, error) {
+	for _, entry := range entries {
+		err := sqlitex.Execute(
+			db,
+			"DELETE FROM quarantine WHERE user_id = ? AND dep_hash = ? AND node_id = ?",
+			&sqlitex.ExecOptions{
+				Args: []interface{}{userId, entry.DepHash, entry.NodeId},
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unquarantine dep_hash:%s node_id:%s of user:%d: %w", entry.DepHash, entry.NodeId, userId, err)
+		}
+	}
+	return bumpQuarantinedResults(db, userId, version, entries)
+}
+
+// bumpQuarantinedResults sets the version of the rows the entries match, since what
+// QueryPassedTestHashes returns for them changes.
+func bumpQuarantinedResults(db *sqlite.Conn, userId int, version int64, entries []QuarantineEntry) ([]string, error) {
+	changed := map[string]bool{}
+	for _, entry := range entries {
+		query := "UPDATE test_results SET version = ? WHERE user_id = ?"
+		args := []interface{}{version, userId}
+		if entry.DepHash != "" {
+			query += " AND (dep_hash = ? OR dep_hash BETWEEN ? || '@' AND ? || 'A')"
+			args = append(args, entry.DepHash, entry.DepHash, entry.DepHash)
+		}
+		if entry.NodeId != "" {
+			// May match across two node ids, which only costs a needless version bump
+			query += " AND instr(node_ids, ?) > 0"
+			args = append(args, entry.NodeId)
+		}
+		err := sqlitex.Execute(db, query+" RETURNING dep_hash", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				changed[stmt.ColumnText(0)] = true
+				return nil
+			},
+			Args: args,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to bump quarantined results of user:%d: %w", userId, err)
+		}
+	}
+	depHashes := make([]string, 0, len(changed))
+	for depHash := range changed {
+		depHashes = append(depHashes, depHash)
+	}
+	sort.Strings(depHashes)
+	return depHashes, nil
+}
+
+// RunMetadata describes a run, for grouping runs in listings. All fields are optional.
+type RunMetadata struct {
+	Commit      string            `json:"commit,omitempty"`
+	Branch      string            `json:"branch,omitempty"`
+	CiProvider  string            `json:"ci_provider,omitempty"`
+	CiJob       string            `json:"ci_job,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+func (m RunMetadata) labelsJson() string {
+	if len(m.Labels) == 0 {
+		return "{}"
+	}
+	labels, _ := json.Marshal(m.Labels)
+	return string(labels)
+}
+
+type RunTestCounts struct {
+	Total          int `json:"total"`
+	Passed         int `json:"passed"`
+	Failed         int `json:"failed"`
+	Skipped        int `json:"skipped"`
+	SkippedByCache int `json:"skipped_by_cache"`
+}
+
+type Run struct {
+	RunId string `json:"run_id"`
+	// The token that first used the run
+	TokenId    int64       `json:"token_id"`
+	Metadata   RunMetadata `json:"metadata"`
+	StartedAt  int64       `json:"started_at"`
+	LastSeenAt int64       `json:"last_seen_at"`
+	// Set by /api/v1/runs/end
+	EndedAt      int64  `json:"ended_at,omitempty"`
+	Outcome      string `json:"outcome,omitempty"`
+	QueryCount   int    `json:"query_count"`
+	PublishCount int    `json:"publish_count"`
+	// Totals of the counts sent to /api/v1/publish
+	TestCounts RunTestCounts `json:"test_counts"`
+}
+
+// BeginRun creates the run, or adds to its metadata if it exists: non-empty fields replace
+// the old ones and labels are merged.
+func BeginRun(db *sqlite.Conn, userId int, tokenId int64, runId string, meta RunMetadata, now time.Time) error {
+	err := sqlitex.Execute(
+		db,
+		`INSERT INTO runs(user_id, run_id, token_id, commit_sha, branch, ci_provider, ci_job, environment, labels, started_at, last_seen_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO UPDATE SET
+			commit_sha = IIF(excluded.commit_sha != '', excluded.commit_sha, commit_sha),
+			branch = IIF(excluded.branch != '', excluded.branch, branch),
+			ci_provider = IIF(excluded.ci_provider != '', excluded.ci_provider, ci_provider),
+			ci_job = IIF(excluded.ci_job != '', excluded.ci_job, ci_job),
+			environment = IIF(excluded.environment != '', excluded.environment, environment),
+			labels = json_patch(labels, excluded.labels),
+			started_at = MIN(started_at, excluded.started_at),
+			last_seen_at = MAX(last_seen_at, excluded.last_seen_at)`,
+		&sqlitex.ExecOptions{Args: []interface{}{
+			userId, runId, tokenId, meta.Commit, meta.Branch, meta.CiProvider, meta.CiJob, meta.Environment, meta.labelsJson(), now.Unix(), now.Unix(),
+		}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to begin run %s of user:%d: %w", runId, userId, err)
+	}
+	return nil
+}
+
+// EndRun records the run's outcome, creating the run if needed.
+func EndRun(db *sqlite.Conn, userId int, tokenId int64, runId string, outcome string, now time.Time) error {
+	err := sqlitex.Execute(
+		db,
+		`INSERT INTO runs(user_id, run_id, token_id, started_at, last_seen_at, ended_at, outcome)
+		VALUES(?1, ?2, ?3, ?4, ?4, ?4, ?5)
+		ON CONFLICT DO UPDATE SET
+			ended_at = excluded.ended_at,
+			outcome = excluded.outcome,
+			last_seen_at = MAX(last_seen_at, excluded.last_seen_at)`,
+		&sqlitex.ExecOptions{Args: []interface{}{userId, runId, tokenId, now.Unix(), outcome}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to end run %s of user:%d: %w", runId, userId, err)
+	}
+	return nil
+}
+
+// RecordRunActivity counts queries, publishes and tests of the run, creating it if needed.
+func RecordRunActivity(db *sqlite.Conn, userId int, tokenId int64, runId string, queries int, publishes int, tests RunTestCounts, now time.Time) error {
+	err := sqlitex.Execute(
+		db,
+		`INSERT INTO runs(user_id, run_id, token_id, started_at, last_seen_at, query_count, publish_count,
+			total_test_count, passed_test_count, failed_test_count, skipped_test_count, skipped_by_cache_test_count)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO UPDATE SET
+			last_seen_at = MAX(last_seen_at, excluded.last_seen_at),
+			query_count = query_count + excluded.query_count,
+			publish_count = publish_count + excluded.publish_count,
+			total_test_count = total_test_count + excluded.total_test_count,
+			passed_test_count = passed_test_count + excluded.passed_test_count,
+			failed_test_count = failed_test_count + excluded.failed_test_count,
+			skipped_test_count = skipped_test_count + excluded.skipped_test_count,
+			skipped_by_cache_test_count = skipped_by_cache_test_count + excluded.skipped_by_cache_test_count`,
+		&sqlitex.ExecOptions{Args: []interface{}{
+			userId, runId, tokenId, now.Unix(), now.Unix(), queries, publishes,
+			tests.Total, tests.Passed, tests.Failed, tests.Skipped, tests.SkippedByCache,
+		}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record activity of run %s of user:%d: %w", runId, userId, err)
+	}
+	return nil
+}
+
+// ListRuns returns the user's runs, most recently started first. Non-empty metadata fields of
+// `filter` must match, and so must each of its labels. startedBefore pages through the runs,
+// 0 for the most recent, and afterRunId continues from a run that started at startedBefore.
+func ListRuns(db *sqlite.Conn, userId int, filter RunMetadata, startedBefore int64, afterRunId string, limit int) ([]Run, error) {
+	runs := []Run{}
+	err := sqlitex.Execute(
+		db,
+		`SELECT run_id, token_id, commit_sha, branch, ci_provider, ci_job, environment, labels, started_at, last_seen_at,
+			IFNULL(ended_at, 0), outcome, query_count, publish_count,
+			total_test_count, passed_test_count, failed_test_count, skipped_test_count, skipped_by_cache_test_count
+		FROM runs
+		WHERE user_id = ?1
+		AND (?2 = '' OR commit_sha = ?2)
+		AND (?3 = '' OR branch = ?3)
+		AND (?4 = '' OR ci_provider = ?4)
+		AND (?5 = '' OR ci_job = ?5)
+		AND (?6 = '' OR environment = ?6)
+		AND NOT EXISTS (
+			SELECT 1 FROM json_each(?7) f
+			WHERE NOT EXISTS (SELECT 1 FROM json_each(runs.labels) l WHERE l.key = f.key AND l.value = f.value)
+		)
+		AND (?8 = 0 OR started_at < ?8 OR (?10 != '' AND started_at = ?8 AND run_id > ?10))
+		ORDER BY started_at DESC, run_id
+		LIMIT ?9`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{
+				userId, filter.Commit, filter.Branch, filter.CiProvider, filter.CiJob, filter.Environment, filter.labelsJson(), startedBefore, limit, afterRunId,
+			},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				run := Run{
+					RunId:   stmt.ColumnText(0),
+					TokenId: stmt.ColumnInt64(1),
+					Metadata: RunMetadata{
+						Commit:      stmt.ColumnText(2),
+						Branch:      stmt.ColumnText(3),
+						CiProvider:  stmt.ColumnText(4),
+						CiJob:       stmt.ColumnText(5),
+						Environment: stmt.ColumnText(6),
+					},
+					StartedAt:    stmt.ColumnInt64(8),
+					LastSeenAt:   stmt.ColumnInt64(9),
+					EndedAt:      stmt.ColumnInt64(10),
+					Outcome:      stmt.ColumnText(11),
+					QueryCount:   stmt.ColumnInt(12),
+					PublishCount: stmt.ColumnInt(13),
+					TestCounts: RunTestCounts{
+						Total:          stmt.ColumnInt(14),
+						Passed:         stmt.ColumnInt(15),
+						Failed:         stmt.ColumnInt(16),
+						Skipped:        stmt.ColumnInt(17),
+						SkippedByCache: stmt.ColumnInt(18),
+					},
+				}
+				err := json.Unmarshal([]byte(stmt.ColumnText(7)), &run.Metadata.Labels)
+				if err != nil {
+					return fmt.Errorf("invalid labels of run %s: %w", run.RunId, err)
+				}
+				if len(run.Metadata.Labels) == 0 {
+					run.Metadata.Labels = nil
+				}
+				runs = append(runs, run)
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs of user:%d: %w", userId, err)
+	}
+	return runs, nil
+}
+
+// DeleteOldRuns deletes runs last seen before `before`, returning how many.
+func DeleteOldRuns(db *sqlite.Conn, before time.Time) (int, error) {
+	err := sqlitex.Execute(db, "DELETE FROM runs WHERE last_seen_at < ?", &sqlitex.ExecOptions{
+		Args: []interface{}{before.Unix()},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old runs: %w", err)
+	}
+	return db.Changes(), nil
+}
+
+const MAX_PUBLISH_SESSION_CHUNKS = 4096
+
+// DeleteExpiredPublishSessions returns the number of sessions deleted.
+func DeleteExpiredPublishSessions(db *sqlite.Conn, now time.Time) (int, error) {
+	err := sqlitex.Execute(
+		db,
+		"DELETE FROM publish_session_chunks WHERE session_id IN (SELECT id FROM publish_sessions WHERE expires_at < ?)",
+		&sqlitex.ExecOptions{Args: []interface{}{now.Unix()}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired session chunks: %w", err)
+	}
+	err = sqlitex.Execute(
+		db,
+		"DELETE FROM publish_sessions WHERE expires_at < ?",
+		&sqlitex.ExecOptions{Args: []interface{}{now.Unix()}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	return db.Changes(), nil
+}
+
+func CreatePublishSession(db *sqlite.Conn, userId int, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	// Opportunistically clean up abandoned sessions
+	_, err := DeleteExpiredPublishSessions(db, now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate session id: %w", err)
+	}
+	sessionId := "ps-" + base32Enc.EncodeToString(b)
+	err = sqlitex.Execute(
+		db,
+		"INSERT INTO publish_sessions(id, user_id, expires_at) VALUES(?, ?, ?)",
+		&sqlitex.ExecOptions{Args: []interface{}{sessionId, userId, expiresAt.Unix()}},
+	)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to insert publish session: %w", err)
+	}
+	return sessionId, expiresAt, nil
+}
+
+// CheckPublishSession makes sure the session exists, belongs to the user and hasn't expired.
+func CheckPublishSession(db *sqlite.Conn, userId int, sessionId string) error {
+	found := false
+	err := sqlitex.Execute(
+		db,
+		"SELECT expires_at FROM publish_sessions WHERE id = ? AND user_id = ?",
+		&sqlitex.ExecOptions{
+			Args: []interface{}{sessionId, userId},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				found = true
+				if time.Now().Unix() > stmt.ColumnInt64(0) {
+					return HttpErrWrap(http.StatusGone, "Publish Session Expired", fmt.Errorf("session %s expired", sessionId)).WithErrorCode("session_expired")
+				}
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return HttpErrWrap(http.StatusNotFound, "Publish Session Not Found", fmt.Errorf("no session %s for user %d", sessionId, userId)).WithErrorCode("session_not_found")
+	}
+	return nil
+}
+
+// AddPublishSessionChunk stores a chunk. Re-sending a chunk (e.g. after a network error) is a no-op.
+func AddPublishSessionChunk(db *sqlite.Conn, sessionId string, chunkIndex int, data []byte) error {
+	if chunkIndex < 0 || chunkIndex >= MAX_PUBLISH_SESSION_CHUNKS {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid chunk index", fmt.Errorf("chunk index %d out of range", chunkIndex)).WithErrorCode("invalid_chunk_index")
+	}
+	err := sqlitex.Execute(
+		db,
+		"INSERT OR IGNORE INTO publish_session_chunks(session_id, chunk_index, node_ids_per_test_file) VALUES(?, ?, ?)",
+		&sqlitex.ExecOptions{Args: []interface{}{sessionId, chunkIndex, data}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store chunk %d of session %s: %w", chunkIndex, sessionId, err)
+	}
+	return nil
+}
+
+func ListPublishSessionChunks(db *sqlite.Conn, sessionId string) ([]int, error) {
+	chunks := []int{}
+	err := sqlitex.Execute(
+		db,
+		"SELECT chunk_index FROM publish_session_chunks WHERE session_id = ? ORDER BY chunk_index",
+		&sqlitex.ExecOptions{
+			Args: []interface{}{sessionId},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				chunks = append(chunks, stmt.ColumnInt(0))
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks of session %s: %w", sessionId, err)
+	}
+	return chunks, nil
+}
+
+// GetPublishSessionChunk returns the data of a chunk, nil if it doesn't exist.
+func GetPublishSessionChunk(db *sqlite.Conn, sessionId string, chunkIndex int) ([]byte, error) {
+	var data []byte
+	err := sqlitex.Execute(
+		db,
+		"SELECT node_ids_per_test_file FROM publish_session_chunks WHERE session_id = ? AND chunk_index = ?",
+		&sqlitex.ExecOptions{
+			Args: []interface{}{sessionId, chunkIndex},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				data = make([]byte, stmt.ColumnLen(0))
+				stmt.ColumnBytes(0, data)
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %d of session %s: %w", chunkIndex, sessionId, err)
+	}
+	return data, nil
+}
+
+// DeletePublishSession deletes the session and its chunks.
+func DeletePublishSession(db *sqlite.Conn, sessionId string) error {
+	err := sqlitex.Execute(db, "DELETE FROM publish_session_chunks WHERE session_id = ?", &sqlitex.ExecOptions{Args: []interface{}{sessionId}})
+	if err != nil {
+		return fmt.Errorf("failed to delete chunks of session %s: %w", sessionId, err)
+	}
+	err = sqlitex.Execute(db, "DELETE FROM publish_sessions WHERE id = ?", &sqlitex.ExecOptions{Args: []interface{}{sessionId}})
+	if err != nil {
+		return fmt.Errorf("failed to delete session %s: %w", sessionId, err)
+	}
+	return nil
+}
+
+type DeadLetter struct {
+	Id        int64           `json:"id"`
+	Kind      string          `json:"kind"`
+	ShardKey  int             `json:"shard_key"`
+	Payload   json.RawMessage `json:"payload"`
+	Error     string          `json:"error"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+func AddDeadLetter(db *sqlite.Conn, task BackgroundTask, attempts int, taskErr error) error {
+	payload, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s task: %w", task.Kind(), err)
+	}
+	err = sqlitex.Execute(
+		db,
+		"INSERT INTO dead_letter_tasks(kind, shard_key, payload, error, attempts) VALUES(?, ?, ?, ?, ?)",
+		&sqlitex.ExecOptions{Args: []interface{}{task.Kind(), task.ShardKey(), payload, taskErr.Error(), attempts}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add dead letter: %w", err)
+	}
+	return nil
+}
+
+// ListDeadLetters returns dead letters oldest first. If ids is empty, returns up to `limit`
+// of all of them.
+func ListDeadLetters(db *sqlite.Conn, ids []int64, limit int) ([]DeadLetter, error) {
+	query := "SELECT id, kind, shard_key, payload, error, attempts, created_at FROM dead_letter_tasks"
+	args := []interface{}{}
+	if len(ids) > 0 {
+		query += " WHERE id IN (SELECT value FROM json_each(?))"
+		idsJson, _ := json.Marshal(ids)
+		args = append(args, string(idsJson))
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit)
+
+	deadLetters := []DeadLetter{}
+	err := sqlitex.Execute(db, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			payload := make([]byte, stmt.ColumnLen(3))
+			stmt.ColumnBytes(3, payload)
+			deadLetters = append(deadLetters, DeadLetter{
+				Id:        stmt.ColumnInt64(0),
+				Kind:      stmt.ColumnText(1),
+				ShardKey:  stmt.ColumnInt(2),
+				Payload:   payload,
+				Error:     stmt.ColumnText(4),
+				Attempts:  stmt.ColumnInt(5),
+				CreatedAt: stmt.ColumnInt64(6),
+			})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	return deadLetters, nil
+}
+
+func DeleteDeadLetter(db *sqlite.Conn, id int64) error {
+	err := sqlitex.Execute(db, "DELETE FROM dead_letter_tasks WHERE id = ?", &sqlitex.ExecOptions{Args: []interface{}{id}})
+	if err != nil {
+		return fmt.Errorf("failed to delete dead letter %d: %w", id, err)
+	}
+	return nil
+}
+
+// -- Jobs --
+
+type JobStatus struct {
+	Running        bool   `json:"running"`
+	LastStartedAt  int64  `json:"last_started_at,omitempty"`
+	LastFinishedAt int64  `json:"last_finished_at,omitempty"`
+	LastStatus     string `json:"last_status,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	LastDurationMs int64  `json:"last_duration_ms,omitempty"`
+}
+
+// AcquireJobLease marks the job as running by `owner` until the lease expires, returning
+// false if someone else holds the lease.
+func AcquireJobLease(db *sqlite.Conn, name string, owner string, lease time.Duration) (bool, error) {
+	now := time.Now()
+	err := sqlitex.Execute(
+		db,
+		`INSERT INTO jobs(name, running_owner, lease_expires_at, last_started_at) VALUES(?1, ?2, ?3, ?4)
+		ON CONFLICT(name) DO UPDATE SET running_owner = ?2, lease_expires_at = ?3, last_started_at = ?4
+		WHERE running_owner IS NULL OR lease_expires_at < ?4`,
+		&sqlitex.ExecOptions{Args: []interface{}{name, owner, now.Add(lease).Unix(), now.Unix()}},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lease of job %s: %w", name, err)
+	}
+	return db.Changes() > 0, nil
+}
+
+// RenewJobLease extends the lease of a job still run by `owner`, returning false if the
+// owner lost it.
+func RenewJobLease(db *sqlite.Conn, name string, owner string, lease time.Duration) (bool, error) {
+	err := sqlitex.Execute(
+		db,
+		`UPDATE jobs SET lease_expires_at = ? WHERE name = ? AND running_owner = ?`,
+		&sqlitex.ExecOptions{Args: []interface{}{time.Now().Add(lease).Unix(), name, owner}},
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to renew lease of job %s: %w", name, err)
+	}
+	return db.Changes() > 0, nil
+}
+
+func FinishJob(db *sqlite.Conn, name string, owner string, duration time.Duration, jobErr error) error {
+	status, errText := "ok", ""
+	if jobErr != nil {
+		status, errText = "error", jobErr.Error()
+	}
+	err := sqlitex.Execute(
+		db,
+		`UPDATE jobs SET running_owner = NULL, lease_expires_at = NULL, last_finished_at = ?, last_status = ?, last_error = ?, last_duration_ms = ?
+		WHERE name = ? AND running_owner = ?`,
+		&sqlitex.ExecOptions{Args: []interface{}{time.Now().Unix(), status, errText, duration.Milliseconds(), name, owner}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record status of job %s: %w", name, err)
+	}
+	return nil
+}
+
+func GetJobStatuses(db *sqlite.Conn) (map[string]JobStatus, error) {
+	statuses := map[string]JobStatus{}
+	err := sqlitex.Execute(
+		db,
+		`SELECT name, running_owner IS NOT NULL AND lease_expires_at >= ?, IFNULL(last_started_at, 0), IFNULL(last_finished_at, 0),
+		IFNULL(last_status, ''), IFNULL(last_error, ''), IFNULL(last_duration_ms, 0) FROM jobs`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{time.Now().Unix()},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				statuses[stmt.ColumnText(0)] = JobStatus{
+					Running:        stmt.ColumnBool(1),
+					LastStartedAt:  stmt.ColumnInt64(2),
+					LastFinishedAt: stmt.ColumnInt64(3),
+					LastStatus:     stmt.ColumnText(4),
+					LastError:      stmt.ColumnText(5),
+					LastDurationMs: stmt.ColumnInt64(6),
+				}
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job statuses: %w", err)
+	}
+	return statuses, nil
+}
+
+// -- Maintenance --
+
+type resultKey struct {
+	userId  int
+	depHash string
+}
+
+// DeleteTestResults deletes the test_results rows matching `where`, returning their keys.
+// Use (*ApiServer).deleteResults instead, which keeps the cache consistent.
+func DeleteTestResults(db *sqlite.Conn, where string, args ...interface{}) ([]resultKey, error) {
+	deleted := []resultKey{}
+	err := sqlitex.Execute(
+		db,
+		"DELETE FROM test_results WHERE "+where+" RETURNING user_id, dep_hash",
+		&sqlitex.ExecOptions{
+			Args: args,
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				deleted = append(deleted, resultKey{stmt.ColumnInt(0), stmt.ColumnText(1)})
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete test results: %w", err)
+	}
+	for _, key := range deleted {
+		err = sqlitex.Execute(db, "DELETE FROM test_provenance WHERE user_id = ? AND dep_hash = ?", &sqlitex.ExecOptions{
+			Args: []interface{}{key.userId, key.depHash},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete provenance of user:%d dep_hash:%s: %w", key.userId, key.depHash, err)
+		}
+	}
+	return deleted, nil
+}
+
+// RollupUsage merges the usage rows before `before` into one row per user, type and hour.
+// Rolled up rows are hour-aligned and left alone, so each run only rewrites the rows recorded
+// since the last one (an hour that gets late rows ends up with more than one row).
+func RollupUsage(db *sqlite.Conn, before time.Time) (int, error) {
+	err := sqlitex.Execute(
+		db,
+		`INSERT INTO user_usage(timestamp, user_id, type, count)
+		SELECT timestamp / 3600 * 3600, user_id, type, SUM(count) FROM user_usage WHERE timestamp < ? AND timestamp % 3600 != 0
+		GROUP BY timestamp / 3600, user_id, type`,
+		&sqlitex.ExecOptions{Args: []interface{}{before.Unix()}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to roll up usage: %w", err)
+	}
+	rollups := db.Changes()
+	err = sqlitex.Execute(
+		db,
+		"DELETE FROM user_usage WHERE timestamp < ? AND timestamp % 3600 != 0",
+		&sqlitex.ExecOptions{Args: []interface{}{before.Unix()}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete rolled up usage: %w", err)
+	}
+	return db.Changes() - rollups, nil
+}
+
+// Vacuum frees unused pages, incrementally if the database has auto_vacuum = INCREMENTAL.
+// Must not be called in a transaction.
+func Vacuum(db *sqlite.Conn) error {
+	autoVacuum := 0
+	err := sqlitex.ExecuteTransient(db, "PRAGMA auto_vacuum", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			autoVacuum = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get auto_vacuum: %w", err)
+	}
+	query := "VACUUM"
+	if autoVacuum == 2 {
+		query = "PRAGMA incremental_vacuum"
+	}
+	err = sqlitex.ExecuteTransient(db, query, nil)
+	if err != nil {
+		return fmt.Errorf("failed to vacuum: %w", err)
+	}
+	return nil
+}
+
+// CheckpointWal copies the WAL into the database and truncates it.
+func CheckpointWal(db *sqlite.Conn) (busy bool, err error) {
+	err = sqlitex.ExecuteTransient(db, "PRAGMA wal_checkpoint(TRUNCATE)", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			busy = stmt.ColumnInt(0) != 0
+			return nil
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	return busy, nil
+}
+
+// CheckIntegrity runs SQLite's quick_check, returning the problems it found.
+func CheckIntegrity(db *sqlite.Conn) ([]string, error) {
+	problems := []string{}
+	err := sqlitex.ExecuteTransient(db, "PRAGMA quick_check", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if result := stmt.ColumnText(0); result != "ok" {
+				problems = append(problems, result)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check integrity: %w", err)
+	}
+	return problems, nil
+}
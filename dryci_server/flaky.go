@@ -0,0 +1,111 @@
+package main
+
+import (
+	"zombiezen.com/go/sqlite"
+)
+
+type FlakyRequest struct {
+	// Only report these dep hashes, all of them if empty
+	TestFileHashes []string `json:"test_file_hashes,omitempty"`
+	// Defaults to 100
+	Limit int `json:"limit,omitempty"`
+}
+
+type FlakyResponse struct {
+	Tests []FlakyTest `json:"tests"`
+}
+
+const FLAKY_DOC = `List node IDs that both passed and failed (or errored) under the same test file hash, flakiest first.
+Failures are recorded from the failed_node_ids_per_test_file and errored_node_ids_per_test_file fields of /api/v1/publish.
+flakiness is 2 * min(passes, failures + errors) / runs: 1 for a test that passes half the time, towards 0 for one that
+almost always passes or almost always fails. Passes before a node ID's first failure count as a single pass.
+
+Example request:
+    {"test_file_hashes": ["65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6"], "limit": 10}
+
+Example response:
+    {
+        "tests": [
+            {
+                "dep_hash": "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6",
+                "node_id": "0c5e3ad4ad0d6ca5f6e53bde2ce94d50",
+                "pass_count": 3,
+                "fail_count": 2,
+                "error_count": 0,
+                "flakiness": 0.8,
+                "last_passed_at": 1760000000,
+                "last_failed_at": 1760003600
+            }
+        ]
+    }`
+
+func (s *ApiServer) FlakyHandler(db *sqlite.Conn, req *FlakyRequest, res *FlakyResponse, auth AuthInfo) error {
+	limit, err := validateLimit(req.Limit, MAX_LIST_LIMIT)
+	if err == nil {
+		err = validateDepHashes(req.TestFileHashes)
+	}
+	if err != nil {
+		return err
+	}
+
+	var tests []FlakyTest
+	err = s.withResultsDb(db, auth.UserId, func(rdb *sqlite.Conn) (err error) {
+		tests, err = ListFlakyTests(rdb, auth.UserId, req.TestFileHashes, limit)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*res = FlakyResponse{Tests: tests}
+	return nil
+}
+
+type HermeticityViolationsRequest struct {
+	// Only list violations older than this id, to page through them
+	BeforeId int64 `json:"before_id,omitempty"`
+	// Defaults to 100
+	Limit int `json:"limit,omitempty"`
+}
+
+type HermeticityViolationsResponse struct {
+	Violations []HermeticityViolation `json:"violations"`
+}
+
+const HERMETICITY_VIOLATIONS_DOC = `List node IDs that were cached as passed, then failed or errored under the same test file hash, newest first.
+The test depends on something its test file hash doesn't cover (see repo_dagger.yaml), so the server removes it from
+the cache when the failure is published. Pass the last id as before_id to get the next page.
+
+Example request:
+    {"limit": 10}
+
+Example response:
+    {
+        "violations": [
+            {
+                "id": 12,
+                "dep_hash": "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6",
+                "node_id": "0c5e3ad4ad0d6ca5f6e53bde2ce94d50",
+                "outcome": "failed",
+                "passed_at": 1760000000,
+                "detected_at": 1760003600
+            }
+        ]
+    }`
+
+func (s *ApiServer) HermeticityViolationsHandler(db *sqlite.Conn, req *HermeticityViolationsRequest, res *HermeticityViolationsResponse, auth AuthInfo) error {
+	limit, err := validateLimit(req.Limit, MAX_LIST_LIMIT)
+	if err != nil {
+		return err
+	}
+
+	var violations []HermeticityViolation
+	err = s.withResultsDb(db, auth.UserId, func(rdb *sqlite.Conn) (err error) {
+		violations, err = ListHermeticityViolations(rdb, auth.UserId, req.BeforeId, limit)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*res = HermeticityViolationsResponse{Violations: violations}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestFlaky(t *testing.T) {
+	ts := newTestServer(t)
+	publish := func(req PublishRequest) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", ts.adminToken, req, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	nodeIds := func(ids ...int) map[string][]string {
+		tests := map[string][]string{}
+		for _, id := range ids {
+			tests[testDepHash(1)] = append(tests[testDepHash(1)], testNodeId(id))
+		}
+		return tests
+	}
+	publish(PublishRequest{PassedNodeIdsPerTestFile: nodeIds(1, 2)})
+	publish(PublishRequest{FailedNodeIdsPerTestFile: nodeIds(1, 3)})
+	publish(PublishRequest{PassedNodeIdsPerTestFile: nodeIds(1)})
+	publish(PublishRequest{ErroredNodeIdsPerTestFile: nodeIds(2)})
+
+	tests := []struct {
+		name       string
+		req        FlakyRequest
+		wantStatus int
+		// "node_id pass_count/fail_count/error_count flakiness" of each flaky test
+		want []string
+	}{
+		{
+			name:       "all",
+			wantStatus: http.StatusOK,
+			want:       []string{testNodeId(2) + " 1/0/1 1.00", testNodeId(1) + " 2/1/0 0.67"},
+		},
+		{name: "limit", req: FlakyRequest{Limit: 1}, wantStatus: http.StatusOK, want: []string{testNodeId(2) + " 1/0/1 1.00"}},
+		{name: "dep hash", req: FlakyRequest{TestFileHashes: []string{testDepHash(1)}}, wantStatus: http.StatusOK, want: []string{testNodeId(2) + " 1/0/1 1.00", testNodeId(1) + " 2/1/0 0.67"}},
+		{name: "other dep hash", req: FlakyRequest{TestFileHashes: []string{testDepHash(2)}}, wantStatus: http.StatusOK, want: []string{}},
+		{name: "invalid dep hash", req: FlakyRequest{TestFileHashes: []string{"abc"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "negative limit", req: FlakyRequest{Limit: -1}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "limit too large", req: FlakyRequest{Limit: MAX_LIST_LIMIT + 1}, wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		var res FlakyResponse
+		status := ts.call(ts.public, "/api/v1/flaky", ts.adminToken, tt.req, &res)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		got := []string{}
+		for _, test := range res.Tests {
+			if test.DepHash != testDepHash(1) || test.LastFailedAt == 0 || test.LastPassedAt == 0 {
+				t.Errorf("%s: %+v", tt.name, test)
+			}
+			got = append(got, fmt.Sprintf("%s %d/%d/%d %.2f", test.NodeId, test.PassCount, test.FailCount, test.ErrorCount, test.Flakiness))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: flaky = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Failures are validated like passes
+	status := ts.call(ts.public, "/api/v1/publish", ts.adminToken, PublishRequest{FailedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {"short"}}}, nil)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("publishing an invalid failure = %d", status)
+	}
+}
+
+func TestHermeticityViolations(t *testing.T) {
+	ts := newTestServer(t)
+	publish := func(req PublishRequest) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", ts.adminToken, req, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	dep := func(ids ...int) map[string][]string {
+		nodeIds := []string{}
+		for _, id := range ids {
+			nodeIds = append(nodeIds, testNodeId(id))
+		}
+		return map[string][]string{testDepHash(1): nodeIds}
+	}
+	publish(PublishRequest{PassedNodeIdsPerTestFile: dep(1, 2, 3)})
+	// 4 was never cached, so its failure isn't a violation
+	publish(PublishRequest{FailedNodeIdsPerTestFile: dep(1, 4), ErroredNodeIdsPerTestFile: dep(2)})
+	// Passing and failing in the same publish doesn't cache it
+	publish(PublishRequest{PassedNodeIdsPerTestFile: dep(5), FailedNodeIdsPerTestFile: dep(5)})
+
+	if got := ts.queryPassed(ts.adminToken, testDepHash(1)); fmt.Sprint(got) != fmt.Sprint([][]string{{testNodeId(3)}}) {
+		t.Errorf("passed = %v", got)
+	}
+
+	tests := []struct {
+		name       string
+		req        HermeticityViolationsRequest
+		wantStatus int
+		// "node_id outcome" of each violation, newest first
+		want []string
+	}{
+		{name: "all", wantStatus: http.StatusOK, want: []string{testNodeId(2) + " errored", testNodeId(1) + " failed"}},
+		{name: "limit", req: HermeticityViolationsRequest{Limit: 1}, wantStatus: http.StatusOK, want: []string{testNodeId(2) + " errored"}},
+		{name: "negative limit", req: HermeticityViolationsRequest{Limit: -1}, wantStatus: http.StatusUnprocessableEntity},
+	}
+	var newest int64
+	for _, tt := range tests {
+		var res HermeticityViolationsResponse
+		status := ts.call(ts.public, "/api/v1/hermeticity-violations", ts.adminToken, tt.req, &res)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		got := []string{}
+		for _, v := range res.Violations {
+			if v.DepHash != testDepHash(1) || v.PassedAt == 0 || v.DetectedAt == 0 {
+				t.Errorf("%s: %+v", tt.name, v)
+			}
+			got = append(got, v.NodeId+" "+v.Outcome)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: violations = %v, want %v", tt.name, got, tt.want)
+		}
+		newest = res.Violations[0].Id
+	}
+
+	var res HermeticityViolationsResponse
+	ts.call(ts.public, "/api/v1/hermeticity-violations", ts.adminToken, HermeticityViolationsRequest{BeforeId: newest}, &res)
+	if len(res.Violations) != 1 || res.Violations[0].NodeId != testNodeId(1) {
+		t.Errorf("before %d: %+v", newest, res.Violations)
+	}
+}
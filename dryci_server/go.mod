@@ -2,7 +2,11 @@ module github.com/wazzaps/dryci_server
 
 go 1.22.5
 
-require zombiezen.com/go/sqlite v1.3.0
+require (
+	github.com/klauspost/compress v1.18.0
+	google.golang.org/protobuf v1.36.0
+	zombiezen.com/go/sqlite v1.3.0
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
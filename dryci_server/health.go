@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// If there's queued work but no batch finished for this long, the background worker is stuck
+const BG_WEDGED_AFTER = 30 * time.Second
+
+func (s *ApiServer) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fullWrite(w, "ok\n")
+}
+
+type ReadyzResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (s *ApiServer) checkDb(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	db, err := s.dbPool.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("no database connection available: %w", err)
+	}
+	defer s.dbPool.Put(db)
+
+	expected := latestMigrationVersion()
+	return s.forEachDb(ctx, db, func(name string, db *sqlite.Conn) error {
+		version, err := GetSchemaVersion(db)
+		if err != nil {
+			return err
+		}
+		if version != expected {
+			return fmt.Errorf("schema version %d, expected %d", version, expected)
+		}
+		return nil
+	})
+}
+
+func (s *ApiServer) checkBackgroundWorker() error {
+	for i, w := range s.allWorkers() {
+		queued := len(w.queue)
+		sinceLastBatch := time.Since(time.Unix(0, w.lastBatch.Load()))
+		if queued > 0 && sinceLastBatch > BG_WEDGED_AFTER {
+			return fmt.Errorf("worker %d: %d tasks queued but no batch processed for %v", i, queued, sinceLastBatch.Round(time.Second))
+		}
+		// Each worker has its own queue of BG_QUEUE_SIZE, and enqueue blocks when it's full
+		if queued > *readyMaxQueue {
+			return fmt.Errorf("worker %d: %d tasks queued (max %d)", i, queued, *readyMaxQueue)
+		}
+	}
+	return nil
+}
+
+func (s *ApiServer) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"database":          s.checkDb(r.Context()),
+		"background_worker": s.checkBackgroundWorker(),
+	}
+
+	res := ReadyzResponse{Ready: true, Checks: map[string]string{}}
+	for name, err := range checks {
+		if err != nil {
+			res.Ready = false
+			res.Checks[name] = err.Error()
+		} else {
+			res.Checks[name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !res.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+type VersionResponse struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path"`
+	Build     map[string]string `json:"build"`
+	Deps      map[string]string `json:"deps"`
+}
+
+// getVersionInfo is the structured counterpart of getFullVersion.
+func getVersionInfo() VersionResponse {
+	info := VersionResponse{
+		Version: VERSION,
+		Build:   map[string]string{},
+		Deps:    map[string]string{},
+	}
+	build_info, ok := debug.ReadBuildInfo()
+	if ok {
+		info.GoVersion = build_info.GoVersion
+		info.Path = build_info.Path
+		for _, setting := range build_info.Settings {
+			info.Build[setting.Key] = setting.Value
+		}
+		for _, dep := range build_info.Deps {
+			info.Deps[dep.Path] = dep.Version
+		}
+	}
+
+	// commit_info.txt uses the same "build\tkey=value" format as debug.BuildInfo
+	scanner := bufio.NewScanner(bytes.NewReader(commit_info))
+	for scanner.Scan() {
+		line, isBuild := strings.CutPrefix(scanner.Text(), "build\t")
+		if !isBuild {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if found {
+			info.Build[key] = value
+		}
+	}
+	return info
+}
+
+func (s *ApiServer) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getVersionInfo())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestHealthz(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.do(ts.admin, "GET", "/healthz", "", nil, nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("/healthz = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer func(max int) { *readyMaxQueue = max }(*readyMaxQueue)
+	*readyMaxQueue = 2
+	tests := []struct {
+		name       string
+		setup      func(ts *testServer)
+		wantChecks map[string]string
+	}{
+		{
+			name:       "ready",
+			setup:      func(ts *testServer) {},
+			wantChecks: map[string]string{"database": "ok", "background_worker": "ok"},
+		},
+		{
+			name: "queue under the limit",
+			setup: func(ts *testServer) {
+				ts.bgWorkers[0].queue <- nil
+				ts.bgWorkers[0].queue <- nil
+			},
+			wantChecks: map[string]string{"database": "ok", "background_worker": "ok"},
+		},
+		{
+			name: "each worker's queue is under the limit",
+			setup: func(ts *testServer) {
+				ts.bgWorkers = newBackgroundWorkers(2, ts.dbPool)
+				for i := 0; i < 4; i++ {
+					ts.bgWorkers[i%2].queue <- nil
+				}
+			},
+			wantChecks: map[string]string{"database": "ok", "background_worker": "ok"},
+		},
+		{
+			name: "queue over the limit",
+			setup: func(ts *testServer) {
+				ts.bgWorkers = newBackgroundWorkers(2, ts.dbPool)
+				for i := 0; i < 3; i++ {
+					ts.bgWorkers[1].queue <- nil
+				}
+			},
+			wantChecks: map[string]string{"database": "ok", "background_worker": "worker 1: 3 tasks queued (max 2)"},
+		},
+		{
+			name: "idle worker isn't wedged",
+			setup: func(ts *testServer) {
+				ts.bgWorkers[0].lastBatch.Store(time.Now().Add(-time.Hour).UnixNano())
+			},
+			wantChecks: map[string]string{"database": "ok", "background_worker": "ok"},
+		},
+		{
+			name: "wedged worker",
+			setup: func(ts *testServer) {
+				ts.bgWorkers[0].queue <- nil
+				ts.bgWorkers[0].lastBatch.Store(time.Now().Add(-time.Hour).UnixNano())
+			},
+			wantChecks: map[string]string{"database": "ok", "background_worker": "worker 0: 1 tasks queued but no batch processed for 1h0m0s"},
+		},
+		{
+			name: "newer schema",
+			setup: func(ts *testServer) {
+				ts.withConn(func(db *sqlite.Conn) {
+					err := sqlitex.Execute(db, "UPDATE settings SET value = value + 1 WHERE key = 'schema_version'", nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
+			},
+			wantChecks: map[string]string{"background_worker": "ok"},
+		},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t)
+		tt.setup(ts)
+		rec := ts.do(ts.admin, "GET", "/readyz", "", nil, nil)
+		var res ReadyzResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatalf("%s: failed to decode %q: %v", tt.name, rec.Body.String(), err)
+		}
+		wantReady := true
+		for _, check := range tt.wantChecks {
+			wantReady = wantReady && check == "ok"
+		}
+		if _, ok := tt.wantChecks["database"]; !ok {
+			wantReady = false
+			want := fmt.Sprintf("schema version %d, expected %d", latestMigrationVersion()+1, latestMigrationVersion())
+			if res.Checks["database"] != want {
+				t.Errorf("%s: database check = %q", tt.name, res.Checks["database"])
+			}
+			delete(res.Checks, "database")
+		}
+		wantStatus := http.StatusOK
+		if !wantReady {
+			wantStatus = http.StatusServiceUnavailable
+		}
+		if rec.Code != wantStatus || res.Ready != wantReady {
+			t.Errorf("%s: /readyz = %d, ready %v, want %d", tt.name, rec.Code, res.Ready, wantStatus)
+		}
+		for name, want := range tt.wantChecks {
+			if res.Checks[name] != want {
+				t.Errorf("%s: %s check = %q, want %q", tt.name, name, res.Checks[name], want)
+			}
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.do(ts.public, "GET", "/api/v1/version", "", nil, nil)
+	var res VersionResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("failed to decode %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusOK || res.Version != VERSION || res.Build == nil || res.Deps == nil {
+		t.Errorf("/api/v1/version = %d, %+v", rec.Code, res)
+	}
+}
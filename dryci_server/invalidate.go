@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const MAX_INVALIDATE_NODE_IDS_PER_REQUEST = 10000
+
+// Rolls back a dry run's transaction
+var errDryRun = errors.New("dry run")
+
+type InvalidateRequest struct {
+	// The namespace to invalidate, only on /admin/api/v1/invalidate
+	UserId int `json:"user_id,omitempty"`
+	// Whole test file hashes
+	TestFileHashes []string `json:"test_file_hashes,omitempty"`
+	// Node ids of a test file hash
+	NodeIdsPerTestFile map[string][]string `json:"node_ids_per_test_file,omitempty"`
+	// Node ids published with this token, see token_id of /admin/api/v1/create-token
+	TokenId int64 `json:"token_id,omitempty"`
+	// Node ids published with this run_id
+	RunId string `json:"run_id,omitempty"`
+	// Test file hashes last published before this unix timestamp
+	OlderThan int64 `json:"older_than,omitempty"`
+	// Report what would be removed without removing it
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+type InvalidateResponse struct {
+	Invalidated []InvalidatedResults `json:"invalidated"`
+	NodeIdCount int                  `json:"node_id_count"`
+	DryRun      bool                 `json:"dry_run"`
+}
+
+const INVALIDATE_DOC = `Remove cached passes, so the tests run again. Fields select what to remove and add up: a node ID is removed if
+any of them matches. At least one is required. Only the caller's own results are affected, admins may invalidate any
+user's with /admin/api/v1/invalidate. Publishes accepted before the request are applied before the removal, so they
+don't add back what it removes.
+
+With dry_run, nothing is removed and the response lists what would be. Test file hashes that lose all of their node IDs
+are reported as whole, without listing them.
+
+Example request:
+    {
+        "node_ids_per_test_file": {
+            "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6": ["0c5e3ad4ad0d6ca5f6e53bde2ce94d50"]
+        },
+        "run_id": "4f1c0e2a9d7b4c55",
+        "dry_run": true
+    }
+
+Example response:
+    {
+        "invalidated": [
+            {
+                "dep_hash": "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6",
+                "whole": false,
+                "node_id_count": 1,
+                "node_ids": ["0c5e3ad4ad0d6ca5f6e53bde2ce94d50"]
+            }
+        ],
+        "node_id_count": 1,
+        "dry_run": true
+    }`
+
+func (s *ApiServer) InvalidateHandler(db *sqlite.Conn, req *InvalidateRequest, res *InvalidateResponse, auth AuthInfo) error {
+	if req.UserId != 0 && req.UserId != auth.UserId {
+		return HttpErrWrap(http.StatusForbidden, "Use /admin/api/v1/invalidate for other users", fmt.Errorf("user %d invalidating user %d", auth.UserId, req.UserId)).WithErrorCode("forbidden")
+	}
+	return s.invalidate(auth.UserId, req, res)
+}
+
+func (s *ApiServer) AdminInvalidateHandler(db *sqlite.Conn, req *InvalidateRequest, res *InvalidateResponse, _ AuthInfo) error {
+	exists, err := UserExists(db, req.UserId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return HttpErrWrap(http.StatusNotFound, "User Not Found", fmt.Errorf("no user %d", req.UserId))
+	}
+	return s.invalidate(req.UserId, req, res)
+}
+
+func (s *ApiServer) invalidate(userId int, req *InvalidateRequest, res *InvalidateResponse) error {
+	if len(req.TestFileHashes) == 0 && len(req.NodeIdsPerTestFile) == 0 && req.TokenId == 0 && req.RunId == "" && req.OlderThan == 0 {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Nothing selected to invalidate", fmt.Errorf("empty invalidate request")).WithErrorCode("empty_selector")
+	}
+	if req.OlderThan < 0 {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid older_than", fmt.Errorf("negative older_than %d", req.OlderThan))
+	}
+	err := validateDepHashes(req.TestFileHashes)
+	if err != nil {
+		return err
+	}
+	nodeIdCount := 0
+	for depHash, nodeIds := range req.NodeIdsPerTestFile {
+		err := validateDepHashes([]string{depHash})
+		if err != nil {
+			return err
+		}
+		for _, nodeId := range nodeIds {
+			if len(nodeId) != NODEID_HASH_HEX_SIZE || !isHex(nodeId) {
+				return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid node id", fmt.Errorf("invalid node_id %q", nodeId)).WithErrorCode("invalid_node_id")
+			}
+		}
+		nodeIdCount += len(nodeIds)
+	}
+	if selected := nodeIdCount + len(req.TestFileHashes); selected > MAX_INVALIDATE_NODE_IDS_PER_REQUEST {
+		return HttpErrWrap(http.StatusRequestEntityTooLarge, "Too many node ids", fmt.Errorf("%d node ids and test files to invalidate", selected)).WithErrorCode("too_many_node_ids")
+	}
+
+	sel := ResultsSelector{
+		DepHashes: req.TestFileHashes,
+		NodeIds:   req.NodeIdsPerTestFile,
+		TokenId:   req.TokenId,
+		RunId:     req.RunId,
+		OlderThan: req.OlderThan,
+	}
+	invalidated, err := s.removeResults(userId, req.DryRun, func(rdb *sqlite.Conn, version int64) ([]InvalidatedResults, []string, error) {
+		invalidated, err := InvalidateResults(rdb, userId, version, sel)
+		return invalidated, nil, err
+	})
+	if err != nil {
+		return err
+	}
+	*res = InvalidateResponse{Invalidated: invalidated, NodeIdCount: countNodeIds(invalidated), DryRun: req.DryRun}
+	return nil
+}
+
+// removeResults runs remove on the user's results worker and waits for it to be committed,
+// or runs it in a transaction of its own that's rolled back if dryRun. Besides what it
+// removed, remove returns the dep hashes it otherwise changed.
+func (s *ApiServer) removeResults(
+	userId int,
+	dryRun bool,
+	remove func(rdb *sqlite.Conn, version int64) (removed []InvalidatedResults, changed []string, err error),
+) ([]InvalidatedResults, error) {
+	if !dryRun {
+		task := &removeResultsTask{userId: userId, remove: remove, done: make(chan error, 1)}
+		s.enqueue(task)
+		err := <-task.done
+		if err != nil {
+			return nil, err
+		}
+		return task.removed, nil
+	}
+
+	var removed []InvalidatedResults
+	err := s.withResultsConn(userId, func(rdb *sqlite.Conn) error {
+		return s.changeResults(rdb, userId, func(version int64) ([]string, error) {
+			var err error
+			removed, _, err = remove(rdb, version)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errDryRun
+		})
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func countNodeIds(results []InvalidatedResults) int {
+	count := 0
+	for _, entry := range results {
+		count += entry.NodeIdCount
+	}
+	return count
+}
+
+type RevertRequest struct {
+	// The namespace to revert in, only on /admin/api/v1/revert
+	UserId int `json:"user_id,omitempty"`
+	// The token and run to revert, at least one is required. With both, only the token's
+	// publishes in the run are reverted.
+	TokenId int64  `json:"token_id,omitempty"`
+	RunId   string `json:"run_id,omitempty"`
+	// Report what would be removed without removing it
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+type RevertResponse struct {
+	Reverted    []InvalidatedResults `json:"reverted"`
+	NodeIdCount int                  `json:"node_id_count"`
+	// Node ids also published by another token or run, which stay cached
+	KeptNodeIdCount int  `json:"kept_node_id_count"`
+	DryRun          bool `json:"dry_run"`
+}
+
+const REVERT_DOC = `Undo everything a token or run published, e.g. a misconfigured runner's, across all test file hashes at once.
+Node IDs that another token or run also published stay cached, unlike with /api/v1/invalidate. Node IDs published
+before provenance was recorded aren't affected. See /api/v1/provenance to find what a token or run published.
+
+Example request:
+    {"run_id": "4f1c0e2a9d7b4c55", "dry_run": true}
+
+Example response:
+    {
+        "reverted": [
+            {
+                "dep_hash": "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6",
+                "whole": true,
+                "node_id_count": 12
+            }
+        ],
+        "node_id_count": 12,
+        "kept_node_id_count": 3,
+        "dry_run": true
+    }`
+
+func (s *ApiServer) RevertHandler(db *sqlite.Conn, req *RevertRequest, res *RevertResponse, auth AuthInfo) error {
+	if req.UserId != 0 && req.UserId != auth.UserId {
+		return HttpErrWrap(http.StatusForbidden, "Use /admin/api/v1/revert for other users", fmt.Errorf("user %d reverting in user %d", auth.UserId, req.UserId)).WithErrorCode("forbidden")
+	}
+	return s.revert(auth.UserId, req, res)
+}
+
+func (s *ApiServer) AdminRevertHandler(db *sqlite.Conn, req *RevertRequest, res *RevertResponse, _ AuthInfo) error {
+	exists, err := UserExists(db, req.UserId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return HttpErrWrap(http.StatusNotFound, "User Not Found", fmt.Errorf("no user %d", req.UserId))
+	}
+	return s.revert(req.UserId, req, res)
+}
+
+func (s *ApiServer) revert(userId int, req *RevertRequest, res *RevertResponse) error {
+	if req.TokenId == 0 && req.RunId == "" {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "A token_id or run_id is required", fmt.Errorf("empty revert request")).WithErrorCode("empty_selector")
+	}
+	kept := 0
+	reverted, err := s.removeResults(userId, req.DryRun, func(rdb *sqlite.Conn, version int64) (reverted []InvalidatedResults, bumped []string, err error) {
+		reverted, kept, bumped, err = RevertProvenance(rdb, userId, version, req.TokenId, req.RunId)
+		return reverted, bumped, err
+	})
+	if err != nil {
+		return err
+	}
+	*res = RevertResponse{Reverted: reverted, NodeIdCount: countNodeIds(reverted), KeptNodeIdCount: kept, DryRun: req.DryRun}
+	return nil
+}
+
+type ProvenanceRequest struct {
+	// Filters, empty ones match everything
+	TestFileHashes []string `json:"test_file_hashes,omitempty"`
+	TokenId        int64    `json:"token_id,omitempty"`
+	RunId          string   `json:"run_id,omitempty"`
+	// Defaults to 100
+	Limit int `json:"limit,omitempty"`
+}
+
+type ProvenanceResponse struct {
+	Entries []ProvenanceEntry `json:"entries"`
+}
+
+func (s *ApiServer) ProvenanceHandler(db *sqlite.Conn, req *ProvenanceRequest, res *ProvenanceResponse, auth AuthInfo) error {
+	limit, err := validateLimit(req.Limit, MAX_LIST_LIMIT)
+	if err == nil {
+		err = validateDepHashes(req.TestFileHashes)
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []ProvenanceEntry
+	err = s.withResultsDb(db, auth.UserId, func(rdb *sqlite.Conn) (err error) {
+		entries, err = ListProvenance(rdb, auth.UserId, req.TestFileHashes, req.TokenId, req.RunId, limit)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*res = ProvenanceResponse{Entries: entries}
+	return nil
+}
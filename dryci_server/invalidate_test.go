@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// tokenId returns the id of a token, as returned by /admin/api/v1/create-token.
+func (ts *testServer) tokenId(token string) int64 {
+	ts.t.Helper()
+	var auth AuthInfo
+	ts.withConn(func(db *sqlite.Conn) {
+		var err error
+		auth, err = AuthUser(db, token)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+	})
+	return auth.TokenId
+}
+
+func TestInvalidate(t *testing.T) {
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	var other CreateTokenResponse
+	ts.call(ts.admin, "/admin/api/v1/create-token", ts.adminToken, CreateTokenRequest{UserId: userId}, &other)
+	publish := func(token string, runId string, tests map[string][]string) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", token, PublishRequest{PassedNodeIdsPerTestFile: tests, RunId: runId}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+	}
+	reset := func() {
+		t.Helper()
+		ts.callApplying(ts.public, "/api/v1/invalidate", token, InvalidateRequest{OlderThan: time.Now().Unix() + 60}, nil)
+		publish(token, "run-1", map[string][]string{testDepHash(1): {testNodeId(1), testNodeId(2)}})
+		publish(other.Token, "run-2", map[string][]string{testDepHash(1): {testNodeId(3)}, testDepHash(2): {testNodeId(1)}})
+		// Published without a token, like some older queued tasks
+		ts.enqueue(ts.newPublishTask(AuthInfo{UserId: userId}, map[string][]string{testDepHash(3): {testNodeId(1)}}))
+		ts.applyBackground()
+	}
+
+	tests := []struct {
+		name string
+		req  InvalidateRequest
+		// "dep_hash whole/node_ids" of each invalidated dep hash
+		want []string
+		// Passed node ids of dep hashes 1 to 3 afterwards
+		wantPassed [][]string
+	}{
+		{
+			name:       "dry run",
+			req:        InvalidateRequest{TokenId: other.TokenId, DryRun: true},
+			want:       []string{testDepHash(1) + " [" + testNodeId(3) + "]", testDepHash(2) + " whole"},
+			wantPassed: [][]string{{testNodeId(1), testNodeId(2), testNodeId(3)}, {testNodeId(1)}, {testNodeId(1)}},
+		},
+		{
+			name:       "token",
+			req:        InvalidateRequest{TokenId: other.TokenId},
+			want:       []string{testDepHash(1) + " [" + testNodeId(3) + "]", testDepHash(2) + " whole"},
+			wantPassed: [][]string{{testNodeId(1), testNodeId(2)}, nil, {testNodeId(1)}},
+		},
+		{
+			name:       "run doesn't match publishes without a token",
+			req:        InvalidateRequest{RunId: "run-1"},
+			want:       []string{testDepHash(1) + " [" + testNodeId(1) + " " + testNodeId(2) + "]"},
+			wantPassed: [][]string{{testNodeId(3)}, {testNodeId(1)}, {testNodeId(1)}},
+		},
+		{
+			name:       "node ids",
+			req:        InvalidateRequest{NodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(2), testNodeId(9)}}},
+			want:       []string{testDepHash(1) + " [" + testNodeId(2) + "]"},
+			wantPassed: [][]string{{testNodeId(1), testNodeId(3)}, {testNodeId(1)}, {testNodeId(1)}},
+		},
+		{
+			name:       "selectors add up",
+			req:        InvalidateRequest{TestFileHashes: []string{testDepHash(3)}, RunId: "run-2"},
+			want:       []string{testDepHash(1) + " [" + testNodeId(3) + "]", testDepHash(2) + " whole", testDepHash(3) + " whole"},
+			wantPassed: [][]string{{testNodeId(1), testNodeId(2)}, nil, nil},
+		},
+		{
+			name:       "nothing older",
+			req:        InvalidateRequest{OlderThan: 1},
+			want:       []string{},
+			wantPassed: [][]string{{testNodeId(1), testNodeId(2), testNodeId(3)}, {testNodeId(1)}, {testNodeId(1)}},
+		},
+	}
+	for _, tt := range tests {
+		reset()
+		// Warm up the cache, which the invalidation must update
+		ts.queryPassed(token, testDepHash(1), testDepHash(2), testDepHash(3))
+		var res InvalidateResponse
+		status := ts.callApplying(ts.public, "/api/v1/invalidate", token, tt.req, &res)
+		if status != http.StatusOK {
+			t.Errorf("%s: invalidate = %d", tt.name, status)
+			continue
+		}
+		got := []string{}
+		count := 0
+		for _, entry := range res.Invalidated {
+			if entry.Whole {
+				got = append(got, entry.DepHash+" whole")
+			} else {
+				got = append(got, fmt.Sprint(entry.DepHash, " ", entry.NodeIds))
+			}
+			count += entry.NodeIdCount
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || res.NodeIdCount != count || res.DryRun != tt.req.DryRun {
+			t.Errorf("%s: invalidated %v (%+v), want %v", tt.name, got, res, tt.want)
+		}
+		passed := ts.queryPassed(token, testDepHash(1), testDepHash(2), testDepHash(3))
+		if fmt.Sprint(passed) != fmt.Sprint(tt.wantPassed) {
+			t.Errorf("%s: passed = %v, want %v", tt.name, passed, tt.wantPassed)
+		}
+	}
+
+	// Admins invalidate any user's results
+	reset()
+	var res InvalidateResponse
+	status := ts.callApplying(ts.admin, "/admin/api/v1/invalidate", ts.adminToken, InvalidateRequest{UserId: userId, TestFileHashes: []string{testDepHash(2)}}, &res)
+	if status != http.StatusOK || res.NodeIdCount != 1 {
+		t.Errorf("admin invalidate = %d, %+v", status, res)
+	}
+
+	tooMany := map[string][]string{testDepHash(1): {}}
+	for i := 0; i < MAX_INVALIDATE_NODE_IDS_PER_REQUEST+1; i++ {
+		tooMany[testDepHash(1)] = append(tooMany[testDepHash(1)], testNodeId(i))
+	}
+	maxNodeIds := map[string][]string{testDepHash(1): tooMany[testDepHash(1)][:MAX_INVALIDATE_NODE_IDS_PER_REQUEST]}
+	errTests := []struct {
+		name       string
+		admin      bool
+		req        InvalidateRequest
+		wantStatus int
+	}{
+		{name: "empty", req: InvalidateRequest{DryRun: true}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "other user", req: InvalidateRequest{UserId: 1, RunId: "run-1"}, wantStatus: http.StatusForbidden},
+		{name: "negative older_than", req: InvalidateRequest{OlderThan: -1}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid dep hash", req: InvalidateRequest{TestFileHashes: []string{"abc"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid node id", req: InvalidateRequest{NodeIdsPerTestFile: map[string][]string{testDepHash(1): {"abc"}}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "node id that isn't hex", req: InvalidateRequest{NodeIdsPerTestFile: map[string][]string{testDepHash(1): {strings.Repeat("z", NODEID_HASH_HEX_SIZE)}}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "too many node ids", req: InvalidateRequest{NodeIdsPerTestFile: tooMany}, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "too many node ids and test files", req: InvalidateRequest{TestFileHashes: []string{testDepHash(2)}, NodeIdsPerTestFile: maxNodeIds}, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "admin of unknown user", admin: true, req: InvalidateRequest{UserId: 9999, RunId: "run-1"}, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range errTests {
+		mux, path, token := ts.public, "/api/v1/invalidate", token
+		if tt.admin {
+			mux, path, token = ts.admin, "/admin/api/v1/invalidate", ts.adminToken
+		}
+		status := ts.callApplying(mux, path, token, tt.req, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+}
+
+func TestRevert(t *testing.T) {
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	var other CreateTokenResponse
+	ts.call(ts.admin, "/admin/api/v1/create-token", ts.adminToken, CreateTokenRequest{UserId: userId}, &other)
+	publish := func(token string, runId string, tests map[string][]string) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", token, PublishRequest{PassedNodeIdsPerTestFile: tests, RunId: runId}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	publish(token, "run-1", map[string][]string{testDepHash(1): {testNodeId(1), testNodeId(2)}})
+	publish(other.Token, "run-2", map[string][]string{testDepHash(1): {testNodeId(2), testNodeId(3)}, testDepHash(2): {testNodeId(1)}})
+	publish(other.Token, "run-3", map[string][]string{testDepHash(2): {testNodeId(2)}})
+
+	tests := []struct {
+		name        string
+		req         RevertRequest
+		wantReverts []string
+		wantKept    int
+		// Passed node ids of dep hashes 1 and 2 afterwards
+		wantPassed [][]string
+	}{
+		{
+			name:        "dry run",
+			req:         RevertRequest{RunId: "run-2", DryRun: true},
+			wantReverts: []string{testDepHash(1) + " [" + testNodeId(3) + "]", testDepHash(2) + " [" + testNodeId(1) + "]"},
+			wantKept:    1,
+			wantPassed:  [][]string{{testNodeId(1), testNodeId(2), testNodeId(3)}, {testNodeId(1), testNodeId(2)}},
+		},
+		{
+			name:        "token and run",
+			req:         RevertRequest{TokenId: other.TokenId, RunId: "run-3"},
+			wantReverts: []string{testDepHash(2) + " [" + testNodeId(2) + "]"},
+			wantPassed:  [][]string{{testNodeId(1), testNodeId(2), testNodeId(3)}, {testNodeId(1)}},
+		},
+		{
+			name:        "run",
+			req:         RevertRequest{RunId: "run-2"},
+			wantReverts: []string{testDepHash(1) + " [" + testNodeId(3) + "]", testDepHash(2) + " whole"},
+			wantKept:    1,
+			wantPassed:  [][]string{{testNodeId(1), testNodeId(2)}, nil},
+		},
+		{
+			// The other token's provenance of node id 2 is gone, so it's only the first token's
+			name:        "token",
+			req:         RevertRequest{TokenId: ts.tokenId(token)},
+			wantReverts: []string{testDepHash(1) + " whole"},
+			wantPassed:  [][]string{nil, nil},
+		},
+	}
+	for _, tt := range tests {
+		var res RevertResponse
+		status := ts.callApplying(ts.public, "/api/v1/revert", token, tt.req, &res)
+		if status != http.StatusOK {
+			t.Errorf("%s: revert = %d", tt.name, status)
+			continue
+		}
+		got := []string{}
+		for _, entry := range res.Reverted {
+			if entry.Whole {
+				got = append(got, entry.DepHash+" whole")
+			} else {
+				got = append(got, fmt.Sprint(entry.DepHash, " ", entry.NodeIds))
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.wantReverts) || res.KeptNodeIdCount != tt.wantKept || res.NodeIdCount != countNodeIds(res.Reverted) {
+			t.Errorf("%s: reverted %v (%+v), want %v and %d kept", tt.name, got, res, tt.wantReverts, tt.wantKept)
+		}
+		passed := ts.queryPassed(token, testDepHash(1), testDepHash(2))
+		if fmt.Sprint(passed) != fmt.Sprint(tt.wantPassed) {
+			t.Errorf("%s: passed = %v, want %v", tt.name, passed, tt.wantPassed)
+		}
+	}
+
+	errTests := []struct {
+		name       string
+		admin      bool
+		req        RevertRequest
+		wantStatus int
+	}{
+		{name: "empty", req: RevertRequest{DryRun: true}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "other user", req: RevertRequest{UserId: 1, RunId: "run-1"}, wantStatus: http.StatusForbidden},
+		{name: "admin", admin: true, req: RevertRequest{UserId: userId, RunId: "run-1"}, wantStatus: http.StatusOK},
+		{name: "admin of unknown user", admin: true, req: RevertRequest{UserId: 9999, RunId: "run-1"}, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range errTests {
+		mux, path, token := ts.public, "/api/v1/revert", token
+		if tt.admin {
+			mux, path, token = ts.admin, "/admin/api/v1/revert", ts.adminToken
+		}
+		status := ts.callApplying(mux, path, token, tt.req, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+}
+
+func TestRemovalsAfterQueuedPublishes(t *testing.T) {
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	publish := func(runId string, depHash string, nodeIds ...string) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", token, PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{depHash: nodeIds}, RunId: runId}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+	}
+
+	// Publishes on both sides of a removal in one batch aren't merged across it
+	publish("", testDepHash(1), testNodeId(1), testNodeId(2))
+	removal := &removeResultsTask{
+		userId: userId,
+		remove: func(rdb *sqlite.Conn, version int64) ([]InvalidatedResults, []string, error) {
+			removed, err := InvalidateResults(rdb, userId, version, ResultsSelector{DepHashes: []string{testDepHash(1)}})
+			return removed, nil, err
+		},
+		done: make(chan error, 1),
+	}
+	ts.enqueue(removal)
+	publish("", testDepHash(1), testNodeId(3))
+	ts.applyBackground()
+	if err := <-removal.done; err != nil || countNodeIds(removal.removed) != 2 {
+		t.Errorf("removal = %v, removed %+v", err, removal.removed)
+	}
+	if got := ts.queryPassed(token, testDepHash(1)); fmt.Sprint(got) != fmt.Sprint([][]string{{testNodeId(3)}}) {
+		t.Errorf("passed = %v, want only the node id published after the removal", got)
+	}
+
+	// Still queued when the requests come in
+	publish("run-1", testDepHash(2), testNodeId(1))
+	var reverted RevertResponse
+	status := ts.callApplying(ts.public, "/api/v1/revert", token, RevertRequest{RunId: "run-1"}, &reverted)
+	if status != http.StatusOK || reverted.NodeIdCount != 1 {
+		t.Errorf("revert = %d, %+v", status, reverted)
+	}
+	publish("", testDepHash(3), testNodeId(1))
+	var invalidated InvalidateResponse
+	status = ts.callApplying(ts.public, "/api/v1/invalidate", token, InvalidateRequest{TestFileHashes: []string{testDepHash(3)}}, &invalidated)
+	if status != http.StatusOK || invalidated.NodeIdCount != 1 {
+		t.Errorf("invalidate = %d, %+v", status, invalidated)
+	}
+	if got := ts.queryPassed(token, testDepHash(2), testDepHash(3)); fmt.Sprint(got) != "[[] []]" {
+		t.Errorf("passed = %v, want nothing", got)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.createUser("user@example.com", false)
+	publish := func(runId string, tests map[string][]string) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", token, PublishRequest{PassedNodeIdsPerTestFile: tests, RunId: runId}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	publish("run-1", map[string][]string{testDepHash(1): {testNodeId(1)}, testDepHash(2): {testNodeId(1)}})
+	publish("run-2", map[string][]string{testDepHash(1): {testNodeId(1)}})
+
+	tests := []struct {
+		name       string
+		req        ProvenanceRequest
+		wantStatus int
+		// "dep_hash node_id run_id" of each entry
+		want []string
+	}{
+		{name: "dep hash", req: ProvenanceRequest{TestFileHashes: []string{testDepHash(2)}}, wantStatus: http.StatusOK, want: []string{testDepHash(2) + " " + testNodeId(1) + " run-1"}},
+		{name: "run", req: ProvenanceRequest{RunId: "run-2"}, wantStatus: http.StatusOK, want: []string{testDepHash(1) + " " + testNodeId(1) + " run-2"}},
+		{name: "token", req: ProvenanceRequest{TokenId: ts.tokenId(token), Limit: 1}, wantStatus: http.StatusOK},
+		{name: "other token", req: ProvenanceRequest{TokenId: ts.tokenId(ts.adminToken)}, wantStatus: http.StatusOK, want: []string{}},
+		{name: "invalid dep hash", req: ProvenanceRequest{TestFileHashes: []string{"abc"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "limit too large", req: ProvenanceRequest{Limit: MAX_LIST_LIMIT + 1}, wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		var res ProvenanceResponse
+		status := ts.call(ts.public, "/api/v1/provenance", token, tt.req, &res)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		if tt.want == nil {
+			if len(res.Entries) != tt.req.Limit {
+				t.Errorf("%s: %d entries, want %d", tt.name, len(res.Entries), tt.req.Limit)
+			}
+			continue
+		}
+		got := []string{}
+		for _, entry := range res.Entries {
+			if entry.PublishedAt == 0 {
+				t.Errorf("%s: %+v", tt.name, entry)
+			}
+			got = append(got, entry.DepHash+" "+entry.NodeId+" "+entry.RunId)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: provenance = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The gc job deletes old provenance, the results stay
+	ts.withConn(func(db *sqlite.Conn) {
+		userIds, err := OldProvenanceUsers(db, time.Now().Add(time.Hour))
+		if err != nil || len(userIds) != 1 {
+			t.Fatalf("OldProvenanceUsers = %v, %v", userIds, err)
+		}
+		err = ts.changeResults(db, userIds[0], func(version int64) ([]string, error) {
+			return DeleteOldProvenance(db, userIds[0], version, time.Now().Add(time.Hour))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	var res ProvenanceResponse
+	ts.call(ts.public, "/api/v1/provenance", token, ProvenanceRequest{}, &res)
+	if len(res.Entries) != 0 || len(ts.queryPassed(token, testDepHash(1))[0]) != 1 {
+		t.Errorf("after gc: provenance = %+v", res.Entries)
+	}
+}
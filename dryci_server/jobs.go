@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// A job's lease outlives a crashed server by this much. Running jobs renew it every
+// JOB_LEASE_RENEW_INTERVAL, so it doesn't need to be longer than the job.
+const JOB_LEASE = 2 * time.Minute
+const JOB_LEASE_RENEW_INTERVAL = JOB_LEASE / 4
+
+// Usage rows older than this are rolled up into hourly rows
+const USAGE_ROLLUP_AFTER = 24 * time.Hour
+
+const DEFAULT_JOB_SCHEDULES = "gc=@daily; usage_rollup=@hourly; wal_checkpoint=@every 5m; vacuum=0 4 * * 0; integrity_check=30 4 * * *"
+
+type Job struct {
+	Name string
+	// Empty if the job only runs when triggered
+	Spec     string
+	schedule Schedule
+	run      func(ctx context.Context, db *sqlite.Conn) error
+	running  atomic.Bool
+}
+
+// Scheduler runs maintenance jobs on their schedules. A job never runs twice at once: within
+// a server thanks to Job.running, and across servers sharing the database thanks to a lease
+// in the jobs table.
+type Scheduler struct {
+	dbPool *sqlitex.Pool
+	jobs   []*Job
+	// Identifies this server in job leases
+	owner  string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	// Zero for jobs without a schedule
+	nextRun map[string]time.Time
+}
+
+// parseJobSchedules parses "name=spec; name=spec", where spec is a schedule or "off".
+func parseJobSchedules(specs string) (map[string]string, error) {
+	schedules := map[string]string{}
+	for _, entry := range strings.Split(specs, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, spec, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("job schedule %q isn't name=spec", entry)
+		}
+		schedules[strings.TrimSpace(name)] = strings.TrimSpace(spec)
+	}
+	return schedules, nil
+}
+
+// NewScheduler creates a scheduler for the maintenance jobs, with `specs` overriding the
+// default schedules.
+func (s *ApiServer) NewScheduler(specs string) (*Scheduler, error) {
+	runs := map[string]func(ctx context.Context, db *sqlite.Conn) error{
+		"gc":              s.gcJob,
+		"usage_rollup":    usageRollupJob,
+		"vacuum":          s.vacuumJob,
+		"wal_checkpoint":  s.walCheckpointJob,
+		"integrity_check": s.integrityCheckJob,
+	}
+
+	schedules, err := parseJobSchedules(DEFAULT_JOB_SCHEDULES)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := parseJobSchedules(specs)
+	if err != nil {
+		return nil, err
+	}
+	for name, spec := range overrides {
+		if runs[name] == nil {
+			return nil, fmt.Errorf("unknown job %q", name)
+		}
+		schedules[name] = spec
+	}
+
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate scheduler id: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := &Scheduler{
+		dbPool:  s.dbPool,
+		owner:   hex.EncodeToString(b),
+		ctx:     ctx,
+		cancel:  cancel,
+		nextRun: map[string]time.Time{},
+	}
+	for name, run := range runs {
+		job := &Job{Name: name, run: run}
+		if spec := schedules[name]; spec != "off" {
+			job.Spec = spec
+			job.schedule, err = ParseSchedule(spec)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("job %s: %w", name, err)
+			}
+		}
+		sc.jobs = append(sc.jobs, job)
+	}
+	sort.Slice(sc.jobs, func(i, j int) bool { return sc.jobs[i].Name < sc.jobs[j].Name })
+	return sc, nil
+}
+
+func (sc *Scheduler) job(name string) *Job {
+	for _, job := range sc.jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+func (sc *Scheduler) NextRun(name string) time.Time {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.nextRun[name]
+}
+
+// Run triggers jobs on their schedules until Stop is called.
+func (sc *Scheduler) Run() {
+	sc.mu.Lock()
+	now := time.Now()
+	for _, job := range sc.jobs {
+		if job.schedule != nil {
+			sc.nextRun[job.Name] = job.schedule.Next(now)
+		}
+	}
+	sc.mu.Unlock()
+
+	for {
+		sc.mu.Lock()
+		next := time.Time{}
+		for _, t := range sc.nextRun {
+			if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+		sc.mu.Unlock()
+
+		wait := 9999 * time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		select {
+		case <-sc.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		now := time.Now()
+		sc.mu.Lock()
+		for _, job := range sc.jobs {
+			if t := sc.nextRun[job.Name]; !t.IsZero() && !t.After(now) {
+				if !sc.Trigger(job) {
+					slog.Warn("Skipping job, the previous run is still going", "job", job.Name)
+				}
+				sc.nextRun[job.Name] = job.schedule.Next(now)
+			}
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// Trigger starts the job in the background, returning false if it's already running.
+func (sc *Scheduler) Trigger(job *Job) bool {
+	if !job.running.CompareAndSwap(false, true) {
+		return false
+	}
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		defer job.running.Store(false)
+		sc.runJob(job)
+	}()
+	return true
+}
+
+func (sc *Scheduler) runJob(job *Job) {
+	logger := slog.With("job", job.Name)
+	db, err := sc.dbPool.Take(sc.ctx)
+	if err != nil {
+		logger.Error("Failed to take database connection for job", "err", err)
+		return
+	}
+	defer sc.dbPool.Put(db)
+
+	var acquired bool
+	err = DbTxn(db, true, func() error {
+		acquired, err = AcquireJobLease(db, job.Name, sc.owner, JOB_LEASE)
+		return err
+	})
+	if err != nil {
+		logger.Error("Failed to start job", "err", err)
+		return
+	}
+	if !acquired {
+		logger.Info("Skipping job, another server is running it")
+		return
+	}
+
+	logger.Info("Running job")
+	start := time.Now()
+	renewCtx, stopRenewing := context.WithCancel(sc.ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		sc.renewLease(renewCtx, job)
+	}()
+	db.SetInterrupt(sc.ctx.Done())
+	jobErr := job.run(sc.ctx, db)
+	db.SetInterrupt(nil)
+	stopRenewing()
+	<-renewed
+	duration := time.Since(start)
+	jobSeconds.Add(duration.Seconds(), job.Name)
+	if jobErr != nil {
+		logger.Error("Job failed", "duration", duration, "err", jobErr)
+		jobRunsTotal.Inc(job.Name, "error")
+	} else {
+		logger.Info("Job finished", "duration", duration)
+		jobRunsTotal.Inc(job.Name, "ok")
+	}
+
+	err = FinishJob(db, job.Name, sc.owner, duration, jobErr)
+	if err != nil {
+		logger.Error("Failed to record job status", "err", err)
+	}
+}
+
+// renewLease keeps the job's lease from expiring until ctx is done.
+func (sc *Scheduler) renewLease(ctx context.Context, job *Job) {
+	ticker := time.NewTicker(JOB_LEASE_RENEW_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		db, err := sc.dbPool.Take(ctx)
+		if err != nil {
+			return
+		}
+		var renewed bool
+		err = DbTxn(db, true, func() error {
+			renewed, err = RenewJobLease(db, job.Name, sc.owner, JOB_LEASE)
+			return err
+		})
+		sc.dbPool.Put(db)
+		if err != nil {
+			slog.Error("Failed to renew job lease", "job", job.Name, "err", err)
+		} else if !renewed {
+			slog.Warn("Lost job lease", "job", job.Name)
+		}
+	}
+}
+
+// Stop interrupts running jobs and waits for them to finish.
+func (sc *Scheduler) Stop() {
+	sc.cancel()
+	sc.wg.Wait()
+}
+
+// -- Jobs --
+
+// gcJob deletes test results and what's recorded about them (failures, hermeticity violations,
+// canary scores, provenance) once older than -result-ttl or expired, scopes not published to within
+// -scope-ttl, runs older than -run-ttl, and abandoned publish sessions.
+func (s *ApiServer) gcJob(ctx context.Context, db *sqlite.Conn) error {
+	now := time.Now()
+	if *resultTtl > 0 {
+		err := s.forEachResultsDb(ctx, db, func(name string, rdb *sqlite.Conn) error {
+			deleted, err := s.deleteResults(rdb, "accessed_at < ?", now.Add(-*resultTtl).Unix())
+			if err != nil {
+				return err
+			}
+			slog.Info("Deleted old test results", "db", name, "count", len(deleted))
+
+			for _, gc := range []struct {
+				what   string
+				delete func(db *sqlite.Conn, before time.Time) (int, error)
+			}{
+				{"test failures", DeleteStaleTestFailures},
+				{"hermeticity violations", DeleteOldHermeticityViolations},
+				{"canary scores", DeleteOldCanaryScores},
+			} {
+				var count int
+				err = DbTxn(rdb, true, func() (err error) {
+					count, err = gc.delete(rdb, now.Add(-*resultTtl))
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				slog.Info("Deleted old "+gc.what, "db", name, "count", count)
+			}
+
+			userIds, err := OldProvenanceUsers(rdb, now.Add(-*resultTtl))
+			if err != nil {
+				return err
+			}
+			for _, userId := range userIds {
+				err = s.changeResults(rdb, userId, func(version int64) ([]string, error) {
+					return DeleteOldProvenance(rdb, userId, version, now.Add(-*resultTtl))
+				})
+				if err != nil {
+					return err
+				}
+			}
+			slog.Info("Deleted old provenance", "db", name, "users", len(userIds))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.forEachResultsDb(ctx, db, func(name string, rdb *sqlite.Conn) error {
+		deleted, err := s.deleteResults(rdb, "expires_at <= ?", now.Unix())
+		if err != nil {
+			return err
+		}
+		slog.Info("Deleted expired test results", "db", name, "count", len(deleted))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *scopeTtl > 0 {
+		fallbacks, err := ListScopeFallbacks(db)
+		if err != nil {
+			return err
+		}
+		where, args := scopeGcWhere(fallbacks, now.Add(-*scopeTtl).Unix())
+		err = s.forEachResultsDb(ctx, db, func(name string, rdb *sqlite.Conn) error {
+			deleted, err := s.deleteResults(rdb, where, args...)
+			if err != nil {
+				return err
+			}
+			slog.Info("Deleted inactive scopes", "db", name, "count", len(deleted))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if *runTtl > 0 {
+		var runs int
+		err := DbTxn(db, true, func() (err error) {
+			runs, err = DeleteOldRuns(db, now.Add(-*runTtl))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		slog.Info("Deleted old runs", "count", runs)
+	}
+
+	var sessions int
+	err = DbTxn(db, true, func() (err error) {
+		sessions, err = DeleteExpiredPublishSessions(db, now)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Deleted expired publish sessions", "count", sessions)
+	return nil
+}
+
+func usageRollupJob(ctx context.Context, db *sqlite.Conn) error {
+	var merged int
+	err := DbTxn(db, true, func() (err error) {
+		merged, err = RollupUsage(db, time.Now().Add(-USAGE_ROLLUP_AFTER))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Rolled up usage", "rows_removed", merged)
+	return nil
+}
+
+func (s *ApiServer) vacuumJob(ctx context.Context, db *sqlite.Conn) error {
+	return s.forEachDb(ctx, db, func(name string, db *sqlite.Conn) error {
+		return Vacuum(db)
+	})
+}
+
+func (s *ApiServer) walCheckpointJob(ctx context.Context, db *sqlite.Conn) error {
+	return s.forEachDb(ctx, db, func(name string, db *sqlite.Conn) error {
+		busy, err := CheckpointWal(db)
+		if err != nil {
+			return err
+		}
+		if busy {
+			// Not an error, readers were using the end of the WAL. The next run will catch up.
+			slog.Info("WAL checkpoint incomplete, the database is busy", "db", name)
+		}
+		return nil
+	})
+}
+
+func (s *ApiServer) integrityCheckJob(ctx context.Context, db *sqlite.Conn) error {
+	return s.forEachDb(ctx, db, func(name string, db *sqlite.Conn) error {
+		problems, err := CheckIntegrity(db)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d integrity problems, first: %s", len(problems), problems[0])
+		}
+		return nil
+	})
+}
+
+// -- Admin API --
+
+type ListJobsRequest struct {
+}
+
+type JobInfo struct {
+	Name string `json:"name"`
+	// Empty if the job only runs when triggered
+	Schedule  string    `json:"schedule"`
+	NextRunAt int64     `json:"next_run_at,omitempty"`
+	Status    JobStatus `json:"status"`
+}
+
+type ListJobsResponse struct {
+	Jobs []JobInfo `json:"jobs"`
+}
+
+func (s *ApiServer) ListJobsHandler(db *sqlite.Conn, req *ListJobsRequest, res *ListJobsResponse, _ AuthInfo) error {
+	statuses, err := GetJobStatuses(db)
+	if err != nil {
+		return err
+	}
+	jobs := []JobInfo{}
+	for _, job := range s.scheduler.jobs {
+		info := JobInfo{Name: job.Name, Schedule: job.Spec, Status: statuses[job.Name]}
+		if next := s.scheduler.NextRun(job.Name); !next.IsZero() {
+			info.NextRunAt = next.Unix()
+		}
+		// The lease may be held by another server
+		info.Status.Running = info.Status.Running || job.running.Load()
+		jobs = append(jobs, info)
+	}
+	*res = ListJobsResponse{Jobs: jobs}
+	return nil
+}
+
+type RunJobRequest struct {
+	Name string `json:"name"`
+}
+
+type RunJobResponse struct {
+}
+
+func (s *ApiServer) RunJobHandler(db *sqlite.Conn, req *RunJobRequest, res *RunJobResponse, _ AuthInfo) error {
+	*res = RunJobResponse{}
+	job := s.scheduler.job(req.Name)
+	if job == nil {
+		return HttpErrWrap(http.StatusNotFound, "Job Not Found", fmt.Errorf("no job %q", req.Name)).WithErrorCode("job_not_found")
+	}
+	if !s.scheduler.Trigger(job) {
+		return HttpErrWrap(http.StatusConflict, "Job is already running", fmt.Errorf("job %s already running", req.Name)).WithErrorCode("job_running")
+	}
+	return nil
+}
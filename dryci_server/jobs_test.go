@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestParseJobSchedules(t *testing.T) {
+	tests := []struct {
+		specs   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{specs: "", want: map[string]string{}},
+		{specs: "gc=@daily", want: map[string]string{"gc": "@daily"}},
+		{specs: " gc = @daily ; vacuum=off;", want: map[string]string{"gc": "@daily", "vacuum": "off"}},
+		{specs: "vacuum=0 4 * * 0", want: map[string]string{"vacuum": "0 4 * * 0"}},
+		{specs: "gc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseJobSchedules(tt.specs)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseJobSchedules(%q) = %v, want an error", tt.specs, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseJobSchedules(%q) = %v, %v, want %v", tt.specs, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		specs string
+		// Expected schedule of some jobs
+		want    map[string]string
+		wantErr bool
+	}{
+		{specs: "", want: map[string]string{"gc": "@daily", "vacuum": "0 4 * * 0"}},
+		{specs: "gc=@every 1h", want: map[string]string{"gc": "@every 1h", "vacuum": "0 4 * * 0"}},
+		{specs: "vacuum=off", want: map[string]string{"gc": "@daily", "vacuum": ""}},
+		{specs: "nope=@daily", wantErr: true},
+		{specs: "gc=not a schedule", wantErr: true},
+	}
+	for _, tt := range tests {
+		sc, err := ts.NewScheduler(tt.specs)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewScheduler(%q) succeeded, want an error", tt.specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewScheduler(%q) failed: %v", tt.specs, err)
+			continue
+		}
+		for name, want := range tt.want {
+			job := sc.job(name)
+			if job == nil || job.Spec != want || (job.schedule == nil) != (want == "") {
+				t.Errorf("NewScheduler(%q): job %s = %+v, want schedule %q", tt.specs, name, job, want)
+			}
+		}
+		sc.Stop()
+	}
+}
+
+func TestJobLease(t *testing.T) {
+	ts := newTestServer(t)
+	tests := []struct {
+		name         string
+		owner        string
+		lease        time.Duration
+		finish       bool
+		renew        bool
+		wantAcquired bool
+		wantRunning  bool
+	}{
+		{name: "first server", owner: "a", lease: time.Hour, wantAcquired: true, wantRunning: true},
+		{name: "second server", owner: "b", lease: time.Hour, wantRunning: true},
+		{name: "second server can't renew it", owner: "b", lease: -time.Hour, renew: true, wantRunning: true},
+		{name: "second server can't finish it", owner: "b", finish: true, wantRunning: true},
+		{name: "first server finishes", owner: "a", finish: true},
+		{name: "second server after it finished", owner: "b", lease: -time.Hour, wantAcquired: true},
+		{name: "after the lease expired", owner: "a", lease: time.Hour, wantAcquired: true, wantRunning: true},
+		{name: "first server renews it", owner: "a", lease: time.Minute, renew: true, wantAcquired: true, wantRunning: true},
+		{name: "renewed past its expiry", owner: "a", lease: -time.Minute, renew: true, wantAcquired: true},
+	}
+	for _, tt := range tests {
+		ts.withConn(func(db *sqlite.Conn) {
+			var acquired bool
+			err := DbTxn(db, true, func() (err error) {
+				if tt.finish {
+					return FinishJob(db, "gc", tt.owner, time.Second, fmt.Errorf("failed"))
+				}
+				if tt.renew {
+					acquired, err = RenewJobLease(db, "gc", tt.owner, tt.lease)
+					return err
+				}
+				acquired, err = AcquireJobLease(db, "gc", tt.owner, tt.lease)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acquired != tt.wantAcquired {
+				t.Errorf("%s: acquired = %v, want %v", tt.name, acquired, tt.wantAcquired)
+			}
+			statuses, err := GetJobStatuses(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if statuses["gc"].Running != tt.wantRunning {
+				t.Errorf("%s: status = %+v, want running %v", tt.name, statuses["gc"], tt.wantRunning)
+			}
+			if tt.finish && !tt.wantRunning && (statuses["gc"].LastStatus != "error" || statuses["gc"].LastError != "failed") {
+				t.Errorf("%s: status = %+v", tt.name, statuses["gc"])
+			}
+		})
+	}
+}
+
+func TestRollupUsage(t *testing.T) {
+	ts := newTestServer(t)
+	hour := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	type usageRow struct {
+		timestamp int64
+		userId    int
+		count     int
+	}
+	ts.withConn(func(db *sqlite.Conn) {
+		err := DbTxn(db, true, func() error {
+			for _, row := range []struct {
+				at     time.Time
+				userId int
+			}{
+				{at: hour, userId: 1},
+				{at: hour.Add(time.Minute), userId: 1},
+				{at: hour.Add(59 * time.Minute), userId: 1},
+				{at: hour.Add(time.Minute), userId: 2},
+				{at: hour.Add(time.Hour + time.Minute), userId: 1},
+				// After the cutoff
+				{at: hour.Add(3*time.Hour + time.Minute), userId: 1},
+			} {
+				err := RecordUsage(db, row.userId, USAGE_PUBLISH, row.at)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, wantRemoved := range []int{1, 0} {
+			var removed int
+			err = DbTxn(db, true, func() (err error) {
+				removed, err = RollupUsage(db, hour.Add(3*time.Hour))
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != wantRemoved {
+				t.Errorf("removed %d rows, want %d", removed, wantRemoved)
+			}
+		}
+
+		got := []usageRow{}
+		err = sqlitex.Execute(db, "SELECT timestamp, user_id, SUM(count) FROM user_usage GROUP BY timestamp, user_id ORDER BY timestamp, user_id", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				got = append(got, usageRow{stmt.ColumnInt64(0), stmt.ColumnInt(1), stmt.ColumnInt(2)})
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []usageRow{
+			{hour.Unix(), 1, 3},
+			{hour.Unix(), 2, 1},
+			{hour.Add(time.Hour).Unix(), 1, 1},
+			{hour.Add(3*time.Hour + time.Minute).Unix(), 1, 1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("usage = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestJobEndpoints(t *testing.T) {
+	ts := newTestServer(t)
+	var err error
+	ts.scheduler, err = ts.NewScheduler("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.scheduler.Stop()
+
+	tests := []struct {
+		name       string
+		job        string
+		wantStatus int
+	}{
+		{name: "unknown job", job: "nope", wantStatus: http.StatusNotFound},
+		{name: "run a job", job: "usage_rollup", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		status := ts.call(ts.admin, "/admin/api/v1/run-job", ts.adminToken, RunJobRequest{Name: tt.job}, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: run-job = %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+	ts.scheduler.wg.Wait()
+
+	var res ListJobsResponse
+	status := ts.call(ts.admin, "/admin/api/v1/list-jobs", ts.adminToken, ListJobsRequest{}, &res)
+	if status != http.StatusOK || len(res.Jobs) != len(ts.scheduler.jobs) {
+		t.Fatalf("list-jobs = %d, %+v", status, res)
+	}
+	for _, job := range res.Jobs {
+		ran := job.Name == "usage_rollup"
+		if job.Status.Running || (job.Status.LastStatus == "ok") != ran {
+			t.Errorf("job %s = %+v", job.Name, job)
+		}
+	}
+}
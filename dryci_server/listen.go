@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Listener specs accepted by `-listen` (comma separated):
+//
+//	127.0.0.1:8080      TCP address
+//	unix:/run/dryci.sock  Unix domain socket, created (and removed on exit) by us
+//	systemd             All sockets passed via systemd socket activation
+//	systemd:NAME        Sockets passed via systemd with FileDescriptorName=NAME
+const SYSTEMD_LISTEN_FDS_START = 3
+
+type systemdFd struct {
+	name  string
+	file  *os.File
+	taken bool
+}
+
+var systemdFdsOnce sync.Once
+var systemdFds []*systemdFd
+var systemdFdsErr error
+
+// loadSystemdFds parses the socket activation environment (see sd_listen_fds(3)).
+// The environment is cleared afterwards so child processes don't inherit it.
+func loadSystemdFds() ([]*systemdFd, error) {
+	systemdFdsOnce.Do(func() {
+		defer os.Unsetenv("LISTEN_PID")
+		defer os.Unsetenv("LISTEN_FDS")
+		defer os.Unsetenv("LISTEN_FDNAMES")
+
+		pidStr := os.Getenv("LISTEN_PID")
+		fdsStr := os.Getenv("LISTEN_FDS")
+		if pidStr == "" || fdsStr == "" {
+			return
+		}
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			systemdFdsErr = fmt.Errorf("invalid LISTEN_PID %q: %w", pidStr, err)
+			return
+		}
+		if pid != os.Getpid() {
+			// Meant for another process
+			return
+		}
+		count, err := strconv.Atoi(fdsStr)
+		if err != nil || count < 0 {
+			systemdFdsErr = fmt.Errorf("invalid LISTEN_FDS %q", fdsStr)
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+		for i := 0; i < count; i++ {
+			fd := SYSTEMD_LISTEN_FDS_START + i
+			syscall.CloseOnExec(fd)
+			name := "unknown"
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			systemdFds = append(systemdFds, &systemdFd{
+				name: name,
+				file: os.NewFile(uintptr(fd), "systemd:"+name),
+			})
+		}
+	})
+	return systemdFds, systemdFdsErr
+}
+
+func openSystemdListeners(name string) ([]net.Listener, error) {
+	fds, err := loadSystemdFds()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := []net.Listener{}
+	for _, fd := range fds {
+		if fd.taken || (name != "" && fd.name != name) {
+			continue
+		}
+		l, err := net.FileListener(fd.file)
+		if err != nil {
+			return nil, fmt.Errorf("inherited fd %q is not a listening socket: %w", fd.name, err)
+		}
+		fd.file.Close()
+		fd.taken = true
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		if name == "" {
+			return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_FDS)")
+		}
+		return nil, fmt.Errorf("no socket named %q passed by systemd (LISTEN_FDNAMES)", name)
+	}
+	return listeners, nil
+}
+
+func openUnixListener(path string) (net.Listener, error) {
+	// Clean up a stale socket left behind by a crashed process, but never anything else
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("refusing to replace non-socket file %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, fs.FileMode(*unixSocketMode))
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to chmod socket %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// openListeners opens every listener described by a comma-separated list of specs.
+func openListeners(specs string) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		if spec == "systemd" || strings.HasPrefix(spec, "systemd:") {
+			name, _ := strings.CutPrefix(strings.TrimPrefix(spec, "systemd"), ":")
+			ls, err := openSystemdListeners(name)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			listeners = append(listeners, ls...)
+		} else if path, isUnix := strings.CutPrefix(spec, "unix:"); isUnix {
+			l, err := openUnixListener(path)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("failed to listen on %s: %w", spec, err)
+			}
+			listeners = append(listeners, l)
+		} else {
+			l, err := net.Listen("tcp", spec)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("failed to listen on %s: %w", spec, err)
+			}
+			listeners = append(listeners, l)
+		}
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listeners specified")
+	}
+	return listeners, nil
+}
+
+func listenerNames(listeners []net.Listener) string {
+	names := make([]string, len(listeners))
+	for i, l := range listeners {
+		names[i] = l.Addr().Network() + ":" + l.Addr().String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// serveListeners serves on all listeners in the background. The first fatal error
+// (other than a graceful shutdown) is reported on the returned channel.
+func serveListeners(server *http.Server, listeners []net.Listener) <-chan error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			err := server.Serve(l)
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("serving on %s: %w", l.Addr(), err)
+			}
+		}(l)
+	}
+	return errs
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	dir := t.TempDir()
+	notSocket := filepath.Join(dir, "file")
+	err := os.WriteFile(notSocket, []byte("keep me"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := net.Listen("unix", filepath.Join(dir, "stale.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	tests := []struct {
+		specs       string
+		wantNetwork []string
+		wantErr     string
+	}{
+		{specs: "127.0.0.1:0", wantNetwork: []string{"tcp"}},
+		{specs: "unix:" + filepath.Join(dir, "a.sock"), wantNetwork: []string{"unix"}},
+		{specs: " 127.0.0.1:0 , unix:" + filepath.Join(dir, "b.sock") + ",", wantNetwork: []string{"tcp", "unix"}},
+		{specs: "unix:" + filepath.Join(dir, "stale.sock"), wantNetwork: []string{"unix"}},
+		{specs: "unix:" + notSocket, wantErr: "refusing to replace non-socket file"},
+		{specs: "127.0.0.1:0,unix:" + notSocket, wantErr: "refusing to replace non-socket file"},
+		{specs: "unix:" + filepath.Join(dir, "missing", "c.sock"), wantErr: "failed to listen"},
+		{specs: "not-an-address", wantErr: "failed to listen"},
+		{specs: "systemd", wantErr: "no sockets passed by systemd"},
+		{specs: "", wantErr: "no listeners specified"},
+		{specs: " , ", wantErr: "no listeners specified"},
+	}
+	for _, tt := range tests {
+		listeners, err := openListeners(tt.specs)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("openListeners(%q) = %v, want error containing %q", tt.specs, err, tt.wantErr)
+			}
+			closeListeners(listeners)
+			continue
+		}
+		if err != nil {
+			t.Errorf("openListeners(%q) failed: %v", tt.specs, err)
+			continue
+		}
+		networks := []string{}
+		for _, l := range listeners {
+			networks = append(networks, l.Addr().Network())
+		}
+		if strings.Join(networks, ",") != strings.Join(tt.wantNetwork, ",") {
+			t.Errorf("openListeners(%q) opened %v, want %v", tt.specs, networks, tt.wantNetwork)
+		}
+		closeListeners(listeners)
+	}
+
+	content, err := os.ReadFile(notSocket)
+	if err != nil || string(content) != "keep me" {
+		t.Errorf("non-socket file was touched: %q, %v", content, err)
+	}
+}
+
+func TestUnixSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dryci.sock")
+	listeners, err := openListeners("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != os.FileMode(*unixSocketMode) {
+		t.Errorf("socket mode = %o, want %o", info.Mode().Perm(), *unixSocketMode)
+	}
+}
+
+func TestOpenSystemdListeners(t *testing.T) {
+	_, err := loadSystemdFds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := func(name string) *systemdFd {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		file, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &systemdFd{name: name, file: file}
+	}
+	defer func(fds []*systemdFd) { systemdFds = fds }(systemdFds)
+
+	tests := []struct {
+		names   []string
+		specs   string
+		wantErr bool
+		want    int
+	}{
+		{names: []string{"web", "admin"}, specs: "systemd", want: 2},
+		{names: []string{"web", "admin"}, specs: "systemd:admin", want: 1},
+		{names: []string{"web", "web"}, specs: "systemd:web", want: 2},
+		{names: []string{"web"}, specs: "systemd:admin", wantErr: true},
+		// Each socket is only handed out once
+		{names: []string{"web", "admin"}, specs: "systemd:admin,systemd", want: 2},
+		{names: []string{"web"}, specs: "systemd:web,systemd:web", wantErr: true},
+	}
+	for _, tt := range tests {
+		systemdFds = nil
+		for _, name := range tt.names {
+			systemdFds = append(systemdFds, fake(name))
+		}
+		listeners, err := openListeners(tt.specs)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v %q succeeded, want an error", tt.names, tt.specs)
+			}
+		} else if err != nil {
+			t.Errorf("%v %q failed: %v", tt.names, tt.specs, err)
+		} else if len(listeners) != tt.want {
+			t.Errorf("%v %q opened %d listeners, want %d", tt.names, tt.specs, len(listeners), tt.want)
+		}
+		closeListeners(listeners)
+		for _, fd := range systemdFds {
+			fd.file.Close()
+		}
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dryci.sock")
+	listeners, err := openListeners("127.0.0.1:0,unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	errs := serveListeners(server, listeners)
+
+	clients := map[string]*http.Client{
+		"http://" + listeners[0].Addr().String(): http.DefaultClient,
+		"http://unix": {Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}},
+	}
+	for url, client := range clients {
+		res, err := client.Get(url)
+		if err != nil {
+			t.Errorf("GET %s failed: %v", url, err)
+			continue
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("GET %s = %q", url, body)
+		}
+	}
+
+	err = server.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("serving failed: %v", err)
+	default:
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket wasn't removed on shutdown: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var accessLog *slog.Logger
+
+func newLogHandler(w io.Writer, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", *logFormat)
+	}
+}
+
+// setupLogging configures the default logger (which also captures the `log` package) and
+// the access log, based on the flags.
+func setupLogging() error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(*logLevel))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", *logLevel, err)
+	}
+	handler, err := newLogHandler(os.Stderr, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if *accessLogPath != "" {
+		var out io.Writer = os.Stdout
+		if *accessLogPath != "-" {
+			f, err := os.OpenFile(*accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+			if err != nil {
+				return fmt.Errorf("failed to open access log: %w", err)
+			}
+			out = f
+		}
+		handler, err := newLogHandler(out, slog.LevelInfo)
+		if err != nil {
+			return err
+		}
+		accessLog = slog.New(handler)
+	}
+	return nil
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// -- Request context --
+
+const MAX_REQUEST_ID_LEN = 128
+
+type requestInfoKey struct{}
+
+// requestInfo is filled in as the request is handled, and read by the logs at the end.
+type requestInfo struct {
+	RequestId   string
+	UserId      int
+	TokenPrefix string
+}
+
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return &requestInfo{UserId: -1}
+	}
+	return info
+}
+
+func requestId(r *http.Request) string {
+	return getRequestInfo(r).RequestId
+}
+
+// requestLogger returns the default logger annotated with the request's correlation fields.
+func requestLogger(r *http.Request) *slog.Logger {
+	info := getRequestInfo(r)
+	logger := slog.Default().With("request_id", info.RequestId, "path", r.URL.Path)
+	if info.UserId != -1 {
+		logger = logger.With("user_id", info.UserId, "token_prefix", info.TokenPrefix)
+	}
+	return logger
+}
+
+func setRequestAuth(r *http.Request, auth AuthInfo, token string) {
+	info := getRequestInfo(r)
+	info.UserId = auth.UserId
+	info.TokenPrefix = tokenPrefix(token)
+}
+
+// tokenPrefix is enough of a token to identify it in logs without leaking it.
+func tokenPrefix(token string) string {
+	const prefixLen = len("dryci-") + 4
+	if len(token) <= prefixLen {
+		return token
+	}
+	return token[:prefixLen]
+}
+
+func genRequestId() string {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		fatal("Failed to generate random bytes", "err", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > MAX_REQUEST_ID_LEN {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func clientIp(r *http.Request) string {
+	if *trustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Unix sockets have no port (or no address at all)
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// instrumentHandler assigns a request id, and records metrics and the access log per
+// route pattern (not per path, to bound cardinality).
+func instrumentHandler(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		info := &requestInfo{RequestId: r.Header.Get("X-Request-Id"), UserId: -1}
+		if !validRequestId(info.RequestId) {
+			info.RequestId = genRequestId()
+		}
+		w.Header().Set("X-Request-Id", info.RequestId)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &responseRecorder{ResponseWriter: w}
+
+		handler(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		duration := time.Since(start)
+		httpRequestsTotal.Inc(route, fmt.Sprint(rec.status))
+		httpRequestSeconds.Add(duration.Seconds(), route)
+
+		if accessLog != nil {
+			accessLog.LogAttrs(
+				r.Context(),
+				slog.LevelInfo,
+				"request",
+				slog.String("request_id", info.RequestId),
+				slog.String("client_ip", clientIp(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("route", route),
+				slog.Int("status", rec.status),
+				slog.Int64("bytes_in", body.n),
+				slog.Int64("bytes_out", rec.bytes),
+				slog.Duration("duration", duration),
+				slog.Int("user_id", info.UserId),
+				slog.String("token_prefix", info.TokenPrefix),
+				slog.String("user_agent", r.UserAgent()),
+			)
+		}
+	}
+}
+
+func handleRoute(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, instrumentHandler(pattern, handler))
+}
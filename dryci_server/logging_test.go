@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestId(t *testing.T) {
+	ts := newTestServer(t)
+	generated := regexp.MustCompile("^[0-9a-f]{24}$")
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: ""},
+		{header: "abc-123", want: "abc-123"},
+		{header: "has space", want: ""},
+		{header: "café", want: ""},
+		{header: strings.Repeat("x", MAX_REQUEST_ID_LEN), want: strings.Repeat("x", MAX_REQUEST_ID_LEN)},
+		{header: strings.Repeat("x", MAX_REQUEST_ID_LEN+1), want: ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.header != "" {
+			header.Set("X-Request-Id", tt.header)
+		}
+		// Errors carry the request id too
+		rec := ts.do(ts.public, "POST", "/api/v1/query-passed", "", []byte("{}"), header)
+		got := rec.Header().Get("X-Request-Id")
+		if tt.want == "" && !generated.MatchString(got) {
+			t.Errorf("X-Request-Id %q: got %q, want a generated id", tt.header, got)
+		} else if tt.want != "" && got != tt.want {
+			t.Errorf("X-Request-Id %q: got %q", tt.header, got)
+		}
+		if !strings.Contains(rec.Body.String(), got) {
+			t.Errorf("X-Request-Id %q: error %q doesn't contain the request id", tt.header, rec.Body.String())
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	ts := newTestServer(t)
+	var out bytes.Buffer
+	defer func(l *slog.Logger) { accessLog = l }(accessLog)
+	accessLog = slog.New(slog.NewJSONHandler(&out, nil))
+
+	header := http.Header{"X-Request-Id": {"req-1"}, "User-Agent": {"pytest-dryci"}}
+	rec := ts.do(ts.public, "POST", "/api/v1/query-passed", ts.adminToken, []byte(`{"test_file_hashes":[]}`), header)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("query-passed = %d %s", rec.Code, rec.Body.String())
+	}
+	ts.do(ts.public, "POST", "/api/v1/query-passed", "", nil, http.Header{"X-Request-Id": {"req-2"}})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d access log lines, want 2:\n%s", len(lines), out.String())
+	}
+	var entry map[string]interface{}
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"msg":          "request",
+		"request_id":   "req-1",
+		"method":       "POST",
+		"path":         "/api/v1/query-passed",
+		"route":        "POST /api/v1/query-passed",
+		"status":       float64(200),
+		"bytes_in":     float64(len(`{"test_file_hashes":[]}`)),
+		"bytes_out":    float64(rec.Body.Len()),
+		"client_ip":    "192.0.2.1",
+		"user_agent":   "pytest-dryci",
+		"token_prefix": tokenPrefix(ts.adminToken),
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("access log %s = %v, want %v", key, entry[key], value)
+		}
+	}
+	if entry["user_id"] == float64(-1) {
+		t.Errorf("access log has no user_id: %v", entry)
+	}
+
+	err = json.Unmarshal([]byte(lines[1]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["request_id"] != "req-2" || entry["status"] != float64(401) || entry["user_id"] != float64(-1) || entry["token_prefix"] != "" {
+		t.Errorf("unauthenticated access log = %v", entry)
+	}
+}
+
+func TestTokenPrefix(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{token: "", want: ""},
+		{token: "dryci-ab", want: "dryci-ab"},
+		{token: "dryci-abcd", want: "dryci-abcd"},
+		{token: "dryci-abcdefghijklmnop", want: "dryci-abcd"},
+	}
+	for _, tt := range tests {
+		if got := tokenPrefix(tt.token); got != tt.want {
+			t.Errorf("tokenPrefix(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	defer func(trust bool) { *trustForwardedFor = trust }(*trustForwardedFor)
+	tests := []struct {
+		remoteAddr    string
+		forwardedFor  string
+		trustForwards bool
+		want          string
+	}{
+		{remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{remoteAddr: "[::1]:1234", want: "::1"},
+		{remoteAddr: "@", want: "@"},
+		{remoteAddr: "", want: ""},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "203.0.113.7", want: "10.0.0.1"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "203.0.113.7", trustForwards: true, want: "203.0.113.7"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: " 203.0.113.7 , 10.0.0.2", trustForwards: true, want: "203.0.113.7"},
+		{remoteAddr: "10.0.0.1:1234", trustForwards: true, want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		*trustForwardedFor = tt.trustForwards
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := clientIp(r); got != tt.want {
+			t.Errorf("clientIp(%q, %q, trusted=%v) = %q, want %q", tt.remoteAddr, tt.forwardedFor, tt.trustForwards, got, tt.want)
+		}
+	}
+}
@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
 	"runtime/debug"
+	"sync"
+	"syscall"
 	"time"
 
 	"zombiezen.com/go/sqlite"
@@ -17,6 +25,8 @@ import (
 
 const VERSION = "1.0.0"
 
+const BG_QUEUE_SIZE = 16 * 1024
+
 //go:generate ./gen_commit_info.sh
 //go:embed commit_info.txt
 var commit_info []byte
@@ -28,7 +38,30 @@ var migrations embed.FS
 
 // TODO: make env vars instead?
 var dbPath = flag.String("db", "dryci.db", "Path to the SQLite database file")
-var listenAddr = flag.String("listen", "127.0.0.1:8080", "Address to listen on")
+var listenAddr = flag.String("listen", "127.0.0.1:8080", "Comma-separated addresses to listen on: host:port, unix:/path/to.sock, systemd or systemd:NAME")
+var adminListenAddr = flag.String("admin-listen", "", "Comma-separated addresses for the admin listener (same format as -listen). If empty, admin routes are served on -listen")
+var adminOpenDebug = flag.Bool("admin-open-debug", false, "Serve metrics and pprof on the admin listener without a superuser token")
+var readyMaxQueue = flag.Int("ready-max-queue", BG_QUEUE_SIZE*3/4, "Report not ready when more background tasks than this are queued for one worker")
+var logLevel = flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "Log format: text or json")
+var accessLogPath = flag.String("access-log", "", "Where to write the access log: a file path, - for stdout, or empty to disable")
+var trustForwardedFor = flag.Bool("trust-forwarded-for", false, "Take the client IP from X-Forwarded-For (only behind a trusted reverse proxy)")
+var streamTimeout = flag.Duration("stream-timeout", 30*time.Second, "Longest pause allowed between lines of a streaming publish")
+var publishSessionTtl = flag.Duration("publish-session-ttl", 24*time.Hour, "How long an uncommitted publish session is kept")
+var bloomFpRate = flag.Float64("bloom-fp-rate", 0.001, "Default false positive rate of /api/v1/query-passed-bloom filters")
+var bgWorkers = flag.Int("bg-workers", 1, "Number of background workers applying writes, tasks are sharded between them by user")
+var bgMaxAttempts = flag.Int("bg-max-attempts", 3, "How many times a background task is tried before it's moved to the dead letter table")
+var resultCacheSize = flag.Int("result-cache-size", 1024*1024, "How many node ids to keep in the in-memory query cache, 0 to disable")
+var jobSchedules = flag.String("jobs", "", "Maintenance job schedules overriding the defaults, e.g. \"gc=0 3 * * *; vacuum=off\" (defaults: "+DEFAULT_JOB_SCHEDULES+")")
+var resultShards = flag.Int("result-shards", 0, "Store test results in this many SQLite files next to -db, each with its own background worker. Users are assigned to shards by id. Can't be changed once set")
+var canaryRate = flag.Float64("canary-rate", 0, "Fraction of cached node ids withheld from runs that send a run_id, to check cached passes still hold. Namespace policies override it")
+var runTtl = flag.Duration("run-ttl", 90*24*time.Hour, "The gc job deletes runs that weren't seen for this long, 0 to keep them forever")
+var scopeFallbacks = flag.String("scope-fallbacks", "", "Comma-separated scopes whose results queries with another scope also see, before the unscoped results. Namespace policies override it")
+var scopeTtl = flag.Duration("scope-ttl", 14*24*time.Hour, "The gc job deletes the results of scopes that weren't published for this long, except fallback scopes. 0 to only apply -result-ttl")
+var resultTtl = flag.Duration("result-ttl", 90*24*time.Hour, "The gc job deletes test results that weren't published for this long, and provenance older than it, 0 to keep them forever")
+var queryMaxAge = flag.Duration("query-max-age", 0, "Queries without a max_age ignore test results that weren't published for this long, 0 for no limit. Namespace policies override it")
+var unixSocketMode = flag.Uint("unix-socket-mode", 0660, "Permissions of Unix domain sockets created by -listen")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests when shutting down")
 var showVersion = flag.Bool("version", false, "Show version information")
 var dbDowngrade = flag.Int("db-downgrade", -1, "Downgrade the database schema to the specified version before applying migrations (destructive!)")
 
@@ -41,127 +74,295 @@ func getFullVersion() string {
 	return fmt.Sprintf("version\t%s\n%s%s", VERSION, build_info_str, commit_info)
 }
 
-type UsageRecord struct {
-	Timestamp time.Time
-	UserId    int
-	Usage     Usage
-}
-
 type ApiServer struct {
-	dbPool        *sqlitex.Pool
-	bgProcessChan chan interface{}
+	dbPool *sqlitex.Pool
+	// Empty unless -result-shards is set
+	resultShards []*resultShard
+	bgWorkers    []*backgroundWorker
+	resultCache  *ResultCache
+	scheduler    *Scheduler
 }
 
 type QueryPassedRequest struct {
 	TestFileHashes []string `json:"test_file_hashes"`
+	// Only return node ids of test file hashes that changed after this version
+	Since int64 `json:"since,omitempty"`
+	// Identifies the CI run, to withhold canaries from it. Send the same one to /api/v1/publish.
+	RunId string `json:"run_id,omitempty"`
+	// E.g. the branch, to also see what was published with the same scope
+	Scope string `json:"scope,omitempty"`
+	// Ignore test file hashes last published (any of their node ids) more than this many seconds
+	// ago, defaults to the namespace's
+	MaxAge int64 `json:"max_age,omitempty"`
 }
 
 type QueryPassedResponse struct {
+	// null for test file hashes that didn't change since `since`
 	NodeIds [][]string `json:"node_ids"`
+	// Canaries per test file hash, cached node ids that were left out so the run tests them again
+	Withheld [][]string `json:"withheld,omitempty"`
+	// Pass as `since` next time to only get what changed
+	Version int64 `json:"version"`
+	etag    string
 }
 
-func (s *ApiServer) QueryPassedHandler(db *sqlite.Conn, req *QueryPassedRequest, res *QueryPassedResponse, userId int) error {
-	nodeIds, err := QueryPassedTestHashes(db, userId, req.TestFileHashes)
+func (res QueryPassedResponse) ETag() string {
+	return res.etag
+}
+
+const QUERY_PASSED_DOC = `Query successful node IDs for a list of test file hashes (dep-hashes).
+Returns a list of lists of node IDs, one list per test file hash.
+
+To avoid downloading the same node IDs again, pass the returned version as "since" next time: test file hashes that
+didn't change since then get null instead of their node IDs (unknown ones always get []). The response also has an ETag,
+send it in If-None-Match to get 304 Not Modified if none of the requested test file hashes changed.
+
+With a run_id and a canary rate set for the namespace, a deterministic sample of the cached node IDs is left out of
+node_ids and listed in withheld instead, so the run re-runs them (see /api/v1/hermeticity-confidence). Withheld node IDs
+are listed even for unchanged test file hashes: clients reusing node IDs from a previous response must run them too.
+
+With a scope, e.g. the branch, the node IDs published with that scope are returned along with those of the fallback
+scopes (the namespace policy's scope_fallbacks, or -scope-fallbacks, e.g. main) and the unscoped ones. Scopes that
+aren't published to for a while are deleted, except the fallback scopes.
+
+If the namespace policy has a trust policy, only node IDs published by a token with its token_labels, or by its quorum of
+distinct tokens, are returned. Node IDs published before the server recorded who published them are never trusted, so
+they are hidden until published again.
+
+Test file hashes last published more than max_age seconds ago (or the namespace's max_age, or -query-max-age), or whose
+publisher's TTL ran out, are returned like unknown ones, with an empty list even if they didn't change since "since".
+max_age applies to whole test file hashes, not node IDs: publishing any node ID of a test file hash keeps all of its
+node IDs, since node IDs that age out on their own wouldn't change the version that "since" relies on.
+
+Example request:
+    {
+        "test_file_hashes": [
+            "ed69bb4aa4547f7d83799875d800d4158a125c2316fe1bddb6a6a79ad8611b48",
+            "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6"
+        ],
+        "since": 41
+    }
+
+Example response:
+    {
+        "node_ids": [
+            ["1b643e95eed492e780a485f9c40dc15b", "6a0f78ba19acfef983e2d11ef7b6f54c", "546afde6eb0c7304bdb39e4d839a4025"],
+            null
+        ],
+        "version": 42
+    }`
+
+func (s *ApiServer) QueryPassedHandler(db *sqlite.Conn, req *QueryPassedRequest, res *QueryPassedResponse, auth AuthInfo) error {
+	err := validateRunField("run_id", req.RunId)
+	if err == nil {
+		err = validateScope(req.Scope)
+	}
+	if err == nil {
+		err = validateMaxAge(req.MaxAge)
+	}
+	if err == nil {
+		err = validateDepHashes(req.TestFileHashes)
+	}
+	if err != nil {
+		return err
+	}
+	rate := 0.0
+	if req.RunId != "" {
+		rate, err = s.canaryRate(db, auth.UserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	var version int64
+	var since int64
+	var nodeIds [][]string
+	var versions []int64
+	var keys []string
+	var keyVersions []int64
+	scopes, err := s.scopeChain(db, auth.UserId, req.Scope)
+	if err != nil {
+		return err
+	}
+	minPublishedAt, err := s.minPublishedAt(db, auth.UserId, req.MaxAge)
+	if err != nil {
+		return err
+	}
+	err = s.withResultsDb(db, auth.UserId, func(rdb *sqlite.Conn) (err error) {
+		version, err = GetResultsVersion(rdb, auth.UserId)
+		if err != nil {
+			return err
+		}
+		since = req.Since
+		if since > version {
+			// The client's version is from a different database, it has nothing in common with ours
+			since = 0
+		}
+		trust, err := s.trustFilter(db, auth.UserId)
+		if err != nil {
+			return err
+		}
+		nodeIds, versions, keys, keyVersions, err = s.queryScoped(rdb, auth.UserId, version, req.TestFileHashes, scopes, trust, minPublishedAt)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	*res = QueryPassedResponse{NodeIds: nodeIds}
+
+	s.recordRunActivity(auth, req.RunId, RunActivity{Queries: 1})
+
+	var withheld [][]string
+	canaries := ""
+	if rate > 0 {
+		nodeIds, withheld = withholdCanaries(req.RunId, rate, req.TestFileHashes, nodeIds)
+		canaries = fmt.Sprintf("%g@%s", rate, req.RunId)
+	}
+	omitUnchanged(nodeIds, versions, since)
+	*res = QueryPassedResponse{
+		NodeIds:  nodeIds,
+		Withheld: withheld,
+		Version:  version,
+		etag:     queryPassedETag(auth.UserId, keys, keyVersions, since, canaries),
+	}
 	return nil
 }
 
+// queryPassedETag identifies a response by the versions of the rows it contains, and the
+// canary sample if any.
+func queryPassedETag(userId int, depHashes []string, versions []int64, since int64, canaries string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d", userId, since)
+	if canaries != "" {
+		fmt.Fprintf(h, ":canaries=%s", canaries)
+	}
+	for i, depHash := range depHashes {
+		fmt.Fprintf(h, ":%s=%d", depHash, versions[i])
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
 type PublishRequest struct {
 	PassedNodeIdsPerTestFile map[string][]string `json:"passed_node_ids_per_test_file"`
-	TotalTestCount           int                 `json:"total_test_count"`
-	PassedTestCount          int                 `json:"passed_test_count"`
-	FailedTestCount          int                 `json:"failed_test_count"`
-	SkippedTestCount         int                 `json:"skipped_test_count"`
-	SkippedByCacheTestCount  int                 `json:"skipped_by_cache_test_count"`
+	// Node ids whose test failed, or errored in setup/teardown, used to find flaky tests
+	FailedNodeIdsPerTestFile  map[string][]string `json:"failed_node_ids_per_test_file,omitempty"`
+	ErroredNodeIdsPerTestFile map[string][]string `json:"errored_node_ids_per_test_file,omitempty"`
+	// The run_id sent to /api/v1/query-passed, to check its canaries
+	RunId string `json:"run_id,omitempty"`
+	// The scope sent to /api/v1/query-passed, passes are only seen by queries with this scope
+	// (or a scope falling back to it)
+	Scope string `json:"scope,omitempty"`
+	// Seconds until the passes of a test file hash expire, replacing the TTL of earlier publishes.
+	// Test file hashes without one don't expire, besides -result-ttl.
+	TtlPerTestFile          map[string]int64 `json:"ttl_per_test_file,omitempty"`
+	TotalTestCount          int              `json:"total_test_count"`
+	PassedTestCount         int              `json:"passed_test_count"`
+	FailedTestCount         int              `json:"failed_test_count"`
+	SkippedTestCount        int              `json:"skipped_test_count"`
+	SkippedByCacheTestCount int              `json:"skipped_by_cache_test_count"`
 }
 
 type PublishResponse struct {
 }
 
-type UserPublishRequest struct {
-	Req    *PublishRequest
-	UserId int
-}
-
-func (s *ApiServer) PublishHandler(_ *sqlite.Conn, req *PublishRequest, res *PublishResponse, userId int) error {
-	*res = PublishResponse{}
-	s.bgProcessChan <- UserPublishRequest{Req: req, UserId: userId}
-	return nil
-}
-
-func (s *ApiServer) ApiDocHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-	fullWrite(w, `Welcome to the DryCI API Documentation!
-
---- GET /api/ ---------------------------------------------------------------------------------------------------------
-    Human-readable API documentation
-
-
---- POST /api/v1/query-passed -----------------------------------------------------------------------------------------
-    Query successful node IDs for a list of test file hashes (dep-hashes).
-    Returns a list of lists of node IDs, one list per test file hash.
-
-    Example request:
-        {
-            "test_file_hashes": [
-                "ed69bb4aa4547f7d83799875d800d4158a125c2316fe1bddb6a6a79ad8611b48",
-                "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6"
-            ]
-        }
-    
-    Example response:
-        {
-            "node_ids": [
-                ["1b643e95eed492e780a485f9c40dc15b", "6a0f78ba19acfef983e2d11ef7b6f54c", "546afde6eb0c7304bdb39e4d839a4025"],
-                ["12c2461ddf13d3a84755044f8fb93513", "3b8854ee811b571e97c73038e40b8b8b", "97b36957762247ce0a1077109bca3d22"]
+const PUBLISH_DOC = `Publish successful test node ids for a run. The node ids are grouped by the test file hash (dep-hash).
+Failed and errored node ids may be published the same way, they aren't cached but are used to find flaky tests (see /api/v1/flaky).
+A failure of a node ID that's cached as passed under the same test file hash removes it from the cache (see /api/v1/hermeticity-violations).
+With a scope, the passes are only returned to queries with the same scope, or falling back to it, and failures also remove
+the node IDs from the fallback scopes and unscoped results.
+Test file hashes in ttl_per_test_file expire that many seconds later, queries then ignore them until they're published again.
+
+Example request:
+    {
+        "passed_node_ids_per_test_file": {
+            "ed69bb4aa4547f7d83799875d800d4158a125c2316fe1bddb6a6a79ad8611b48": [
+                "1b643e95eed492e780a485f9c40dc15b", "6a0f78ba19acfef983e2d11ef7b6f54c", "546afde6eb0c7304bdb39e4d839a4025"
+            ],
+            "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6": [
+                "12c2461ddf13d3a84755044f8fb93513", "3b8854ee811b571e97c73038e40b8b8b", "97b36957762247ce0a1077109bca3d22"
             ]
+        },
+        "failed_node_ids_per_test_file": {
+            "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6": ["0c5e3ad4ad0d6ca5f6e53bde2ce94d50"]
         }
+    }
 
+Example response:
+    {}`
 
---- POST /api/v1/publish ----------------------------------------------------------------------------------------------
-    Publish successful test node ids for a run. The node ids are grouped by the test file hash (dep-hash).
-
-    Example request:
-        {
-            "passed_node_ids_per_test_file": {
-                "ed69bb4aa4547f7d83799875d800d4158a125c2316fe1bddb6a6a79ad8611b48": [
-                    "1b643e95eed492e780a485f9c40dc15b", "6a0f78ba19acfef983e2d11ef7b6f54c", "546afde6eb0c7304bdb39e4d839a4025"
-                ],
-                "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6": [
-                    "12c2461ddf13d3a84755044f8fb93513", "3b8854ee811b571e97c73038e40b8b8b", "97b36957762247ce0a1077109bca3d22"
-                ]
-            }
-        }
-    
-    Example response:
-        {}
-`)
-}
-
-func (s *ApiServer) backgroundHandler(db *sqlite.Conn, items []interface{}) {
-	start := time.Now()
-	for _, item := range items {
-		switch item := item.(type) {
-		case UsageRecord:
-			err := RecordUsage(db, item.UserId, item.Usage, item.Timestamp)
-			if err != nil {
-				log.Printf("Failed to record usage: %v", err)
-				continue
-			}
-		case UserPublishRequest:
-			err := PublishTestHashes(db, item.UserId, item.Req.PassedNodeIdsPerTestFile)
-			if err != nil {
-				log.Printf("Failed to publish test results: %v", err)
-				continue
-			}
-		default:
-			log.Printf("Unknown background task type: %T", item)
+func (s *ApiServer) PublishHandler(db *sqlite.Conn, req *PublishRequest, res *PublishResponse, auth AuthInfo) error {
+	for _, tests := range []map[string][]string{req.PassedNodeIdsPerTestFile, req.FailedNodeIdsPerTestFile, req.ErroredNodeIdsPerTestFile} {
+		err := ValidateTestHashes(tests)
+		if err != nil {
+			return err
 		}
 	}
-	log.Printf("Processed %d background tasks in %v", len(items), time.Since(start))
+	err := validateRunField("run_id", req.RunId)
+	if err == nil {
+		err = validateScope(req.Scope)
+	}
+	if err == nil {
+		err = validateTtls(req.TtlPerTestFile)
+	}
+	if err != nil {
+		return err
+	}
+	*res = PublishResponse{}
+	task := s.newPublishTask(auth, req.PassedNodeIdsPerTestFile)
+	task.Failed = req.FailedNodeIdsPerTestFile
+	task.Errored = req.ErroredNodeIdsPerTestFile
+	task.Ttls = req.TtlPerTestFile
+	err = s.setPublishTaskRun(db, task, req.Scope, req.RunId)
+	if err != nil {
+		return err
+	}
+	s.enqueue(task)
+	s.recordRunActivity(auth, req.RunId, RunActivity{
+		Publishes: 1,
+		TestCounts: RunTestCounts{
+			Total:          req.TotalTestCount,
+			Passed:         req.PassedTestCount,
+			Failed:         req.FailedTestCount,
+			Skipped:        req.SkippedTestCount,
+			SkippedByCache: req.SkippedByCacheTestCount,
+		},
+	})
+	return nil
+}
+
+func registerPublicRoutes(mux *http.ServeMux, s *ApiServer) {
+	handleRoute(mux, "GET /", s.ApiDocHandler)
+	handleRoute(mux, "GET /api", s.ApiDocHandler)
+	handleRoute(mux, "GET /api/openapi.json", s.OpenApiHandler)
+	handleDocumented[VersionResponse](mux, "GET /api/v1/version", "Server version and build information.", s.VersionHandler)
+	handleApi(mux, "POST /api/v1/query-passed", QUERY_PASSED_DOC, jsonApi(s, false, USAGE_QUERY, s.QueryPassedHandler))
+	handleApi(mux, "POST /api/v1/query-passed-bloom", QUERY_PASSED_BLOOM_DOC, jsonApi(s, false, USAGE_QUERY, s.QueryPassedBloomHandler))
+	handleApi(mux, "POST /api/v1/publish", PUBLISH_DOC, jsonApi(s, false, USAGE_PUBLISH, s.PublishHandler))
+	handleApi(mux, "POST /api/v1/runs/begin", BEGIN_RUN_DOC, jsonApi(s, false, USAGE_PUBLISH, s.BeginRunHandler))
+	handleApi(mux, "POST /api/v1/runs/end", "End a run, recording its outcome. Runs that didn't begin are created.", jsonApi(s, false, USAGE_PUBLISH, s.EndRunHandler))
+	handleApi(mux, "POST /api/v1/runs/list", "List runs, most recently started first.", jsonApi(s, false, USAGE_QUERY, s.ListRunsHandler))
+	handleApi(mux, "POST /api/v1/quarantine/list", "List the node IDs and test file hashes that always run, see /api/v1/quarantine/add.", jsonApi(s, false, USAGE_QUERY, s.ListQuarantineHandler))
+	handleApi(mux, "POST /api/v1/quarantine/add", ADD_QUARANTINE_DOC, jsonApi(s, false, USAGE_PUBLISH, s.AddQuarantineHandler))
+	handleApi(mux, "POST /api/v1/quarantine/remove", "Remove quarantine entries, matched by dep_hash and node_id.", jsonApi(s, false, USAGE_PUBLISH, s.RemoveQuarantineHandler))
+	handleApi(mux, "POST /api/v1/invalidate", INVALIDATE_DOC, jsonApi(s, false, USAGE_PUBLISH, s.InvalidateHandler))
+	handleApi(mux, "POST /api/v1/revert", REVERT_DOC, jsonApi(s, false, USAGE_PUBLISH, s.RevertHandler))
+	handleApi(mux, "POST /api/v1/provenance", "List which token and run published node IDs, most recent first.", jsonApi(s, false, USAGE_QUERY, s.ProvenanceHandler))
+	handleApi(mux, "POST /api/v1/flaky", FLAKY_DOC, jsonApi(s, false, USAGE_QUERY, s.FlakyHandler))
+	handleApi(mux, "POST /api/v1/hermeticity-confidence", HERMETICITY_CONFIDENCE_DOC, jsonApi(s, false, USAGE_QUERY, s.HermeticityConfidenceHandler))
+	handleApi(mux, "POST /api/v1/hermeticity-violations", HERMETICITY_VIOLATIONS_DOC, jsonApi(s, false, USAGE_QUERY, s.HermeticityViolationsHandler))
+	handleRoute(mux, "POST /dryci.v1.DryciService/QueryPassed", connectOnly(http.HandlerFunc(jsonApi(s, false, USAGE_QUERY, s.QueryPassedHandler))))
+	handleRoute(mux, "POST /dryci.v1.DryciService/Publish", connectOnly(http.HandlerFunc(jsonApi(s, false, USAGE_PUBLISH, s.PublishHandler))))
+
+	addApiDoc("POST /api/v1/publish-stream", PUBLISH_STREAM_DOC, apiDoc{
+		Auth:               true,
+		Request:            reflect.TypeFor[PublishStreamLine](),
+		RequestContentType: "application/x-ndjson",
+		Response:           reflect.TypeFor[PublishStreamResponse](),
+	})
+	handleRoute(mux, "POST /api/v1/publish-stream", s.PublishStreamHandler)
+	handleApi(mux, "POST /api/v1/publish-session/begin", "Begin a resumable publish session.", jsonApi(s, true, USAGE_PUBLISH, s.PublishSessionBeginHandler))
+	handleApi(mux, "POST /api/v1/publish-session/append", "Upload one numbered chunk of a publish session. Re-sending a chunk is harmless.", jsonApi(s, true, USAGE_PUBLISH, s.PublishSessionAppendHandler))
+	handleApi(mux, "POST /api/v1/publish-session/status", "List the chunks a publish session has received, to resume an interrupted upload.", jsonApi(s, false, USAGE_PUBLISH, s.PublishSessionStatusHandler))
+	handleApi(mux, "POST /api/v1/publish-session/commit", "Publish all chunks of a session and close it.", jsonApi(s, false, USAGE_PUBLISH, s.PublishSessionCommitHandler))
 }
 
 func main() {
@@ -171,53 +372,159 @@ func main() {
 		fmt.Println(getFullVersion())
 		return
 	}
-	log.Printf("dryci_server v%s", VERSION)
+	err := setupLogging()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %v\n", err)
+		os.Exit(2)
+	}
+	slog.Info("dryci_server starting", "version", VERSION)
 
 	// Open the DB
-	dbPool, err := OpenDbPool()
+	dbPool, err := OpenDbPool(*dbPath)
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		fatal("Failed to open database", "err", err)
 	}
 	defer dbPool.Close()
 
 	// Perform migrations
-	err = MigrateDb(dbPool, *dbDowngrade)
+	err = MigrateDb(dbPool, *dbDowngrade, true)
 	if err != nil {
-		log.Fatalf("Failed to migrate database: %v", err)
+		fatal("Failed to migrate database", "err", err)
+	}
+	err = func() error {
+		db, err := dbPool.Take(context.Background())
+		if err != nil {
+			return err
+		}
+		defer dbPool.Put(db)
+		return DbTxn(db, true, func() error {
+			return CheckResultShards(db, *resultShards)
+		})
+	}()
+	if err != nil {
+		fatal("Invalid -result-shards", "err", err)
+	}
+	shards, err := openResultShards(*resultShards)
+	if err != nil {
+		fatal("Failed to open result shards", "err", err)
+	}
+	defer closeResultShards(shards)
+
+	// Open the listeners before doing anything else, so bad flags fail fast
+	listeners, err := openListeners(*listenAddr)
+	if err != nil {
+		fatal("Failed to open listeners", "err", err)
+	}
+	adminListeners := []net.Listener{}
+	if *adminListenAddr != "" {
+		adminListeners, err = openListeners(*adminListenAddr)
+		if err != nil {
+			fatal("Failed to open admin listeners", "err", err)
+		}
 	}
 
 	// Start the server
 	api_server := ApiServer{
-		dbPool:        dbPool,
-		bgProcessChan: make(chan interface{}, 16*1024),
+		dbPool:       dbPool,
+		resultShards: shards,
+		bgWorkers:    newBackgroundWorkers(*bgWorkers, dbPool),
+		resultCache:  NewResultCache(*resultCacheSize),
 	}
+	api_server.scheduler, err = api_server.NewScheduler(*jobSchedules)
+	if err != nil {
+		fatal("Invalid -jobs", "err", err)
+	}
+	NewGaugeFunc("dryci_background_queue_length", "Background tasks waiting to be processed.", func() float64 {
+		return float64(api_server.queuedTasks())
+	})
+	NewGaugeFunc("dryci_result_cache_entries", "Dep hashes held by the query cache.", func() float64 {
+		entries, _ := api_server.resultCache.Size()
+		return float64(entries)
+	})
+	NewGaugeFunc("dryci_result_cache_node_ids", "Node ids held by the query cache.", func() float64 {
+		_, nodeIds := api_server.resultCache.Size()
+		return float64(nodeIds)
+	})
+
+	publicMux := http.NewServeMux()
+	registerPublicRoutes(publicMux, &api_server)
 	http_server := http.Server{
-		Addr:              *listenAddr,
+		Handler:           publicMux,
 		ReadTimeout:       2 * time.Second,
 		ReadHeaderTimeout: 2 * time.Second,
 		WriteTimeout:      2 * time.Second,
 		IdleTimeout:       10 * time.Second,
 	}
-	http.HandleFunc("GET /", api_server.ApiDocHandler)
-	http.HandleFunc("GET /api", api_server.ApiDocHandler)
-	http.HandleFunc("POST /api/v1/query-passed", jsonApi(&api_server, false, USAGE_QUERY, api_server.QueryPassedHandler))
-	http.HandleFunc("POST /api/v1/publish", jsonApi(&api_server, false, USAGE_PUBLISH, api_server.PublishHandler))
+
+	var admin_server *http.Server
+	if len(adminListeners) > 0 {
+		adminMux := http.NewServeMux()
+		registerAdminRoutes(adminMux, &api_server, *adminOpenDebug)
+		admin_server = &http.Server{
+			Handler:           adminMux,
+			ReadTimeout:       10 * time.Second,
+			ReadHeaderTimeout: 2 * time.Second,
+			// Long enough for CPU profiles and traces
+			WriteTimeout: 5 * time.Minute,
+			IdleTimeout:  10 * time.Second,
+		}
+	} else {
+		registerAdminRoutes(publicMux, &api_server, false)
+	}
 
 	// Start background goroutines
 	done := make(chan struct{})
-	bgDb, err := dbPool.Take(context.Background())
+	var workersDone sync.WaitGroup
+	for _, worker := range api_server.allWorkers() {
+		bgDb, err := worker.dbPool.Take(context.Background())
+		if err != nil {
+			fatal("Failed to take database connection for background worker", "err", err)
+		}
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			api_server.runBackgroundWorker(worker, done, bgDb, 100*time.Millisecond)
+			worker.dbPool.Put(bgDb)
+		}()
+	}
+	go api_server.scheduler.Run()
+
+	slog.Info("Listening", "addrs", listenerNames(listeners))
+	serveErrs := serveListeners(&http_server, listeners)
+	var adminServeErrs <-chan error
+	if admin_server != nil {
+		slog.Info("Admin listening", "addrs", listenerNames(adminListeners))
+		adminServeErrs = serveListeners(admin_server, adminListeners)
+	}
+
+	// Wait for a shutdown signal. Under systemd socket activation the listening sockets
+	// stay open in systemd across restarts, so no connections are refused meanwhile.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+	case err := <-serveErrs:
+		slog.Error("Server failed, shutting down", "err", err)
+	case err := <-adminServeErrs:
+		slog.Error("Admin server failed, shutting down", "err", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err = http_server.Shutdown(ctx)
 	if err != nil {
-		log.Fatalf("Failed to take database connection for background committer: %v", err)
-	}
-	go batchedBackgroundWorker(
-		api_server.bgProcessChan,
-		done,
-		bgDb,
-		100*time.Millisecond,
-		api_server.backgroundHandler,
-	)
-
-	log.Printf("Listening on %s", *listenAddr)
-	http_server.ListenAndServe()
+		slog.Warn("Failed to shut down gracefully", "err", err)
+	}
+	if admin_server != nil {
+		err = admin_server.Shutdown(ctx)
+		if err != nil {
+			slog.Warn("Failed to shut down admin server gracefully", "err", err)
+		}
+	}
+
+	// Interrupt maintenance jobs, then flush pending background work
+	api_server.scheduler.Stop()
 	close(done)
+	workersDone.Wait()
 }
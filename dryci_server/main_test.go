@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// testServer is an ApiServer on a temporary database, serving the routes of main.
+type testServer struct {
+	*ApiServer
+	t      *testing.T
+	public *http.ServeMux
+	admin  *http.ServeMux
+	// Token of a superuser
+	adminToken string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dbPool, err := OpenDbPool(filepath.Join(t.TempDir(), "dryci.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbPool.Close() })
+	err = MigrateDb(dbPool, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{
+		ApiServer: &ApiServer{
+			dbPool:      dbPool,
+			bgWorkers:   newBackgroundWorkers(1, dbPool),
+			resultCache: NewResultCache(1024),
+		},
+		t:      t,
+		public: http.NewServeMux(),
+		admin:  http.NewServeMux(),
+	}
+	// Routes add themselves to the documentation as they're registered
+	apiDocs = []apiDoc{}
+	registerPublicRoutes(ts.public, ts.ApiServer)
+	registerAdminRoutes(ts.admin, ts.ApiServer, false)
+	_, ts.adminToken = ts.createUser("admin@example.com", true)
+	return ts
+}
+
+func (ts *testServer) withConn(f func(db *sqlite.Conn)) {
+	ts.t.Helper()
+	db, err := ts.dbPool.Take(context.Background())
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer ts.dbPool.Put(db)
+	f(db)
+}
+
+// createUser creates a user with a token.
+func (ts *testServer) createUser(email string, superuser bool) (int, string) {
+	ts.t.Helper()
+	var userId int
+	var token string
+	ts.withConn(func(db *sqlite.Conn) {
+		err := DbTxn(db, true, func() (err error) {
+			userId, err = CreateUser(db, email, "", superuser)
+			if err != nil {
+				return err
+			}
+			token, _, err = CreateUserToken(db, userId, 0, nil)
+			return err
+		})
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+	})
+	return userId, token
+}
+
+// do sends a request to the mux, with a bearer token unless it's empty.
+func (ts *testServer) do(mux http.Handler, method string, path string, token string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// call sends a JSON request to the mux and decodes a successful response into `res`,
+// returning the status code.
+func (ts *testServer) call(mux http.Handler, path string, token string, req interface{}, res interface{}) int {
+	ts.t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	rec := ts.do(mux, "POST", path, token, body, nil)
+	if rec.Code == http.StatusOK && res != nil {
+		err = json.Unmarshal(rec.Body.Bytes(), res)
+		if err != nil {
+			ts.t.Fatalf("%s: failed to decode %q: %v", path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// applyBackground applies the queued tasks like the background workers would, including
+// their retries.
+// callApplying is call for requests that wait on a background worker, applying background
+// tasks until the request is done.
+func (ts *testServer) callApplying(mux http.Handler, path string, token string, req interface{}, res interface{}) int {
+	ts.t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- ts.do(mux, "POST", path, token, body, nil)
+	}()
+	for {
+		select {
+		case rec := <-done:
+			if rec.Code == http.StatusOK && res != nil {
+				err = json.Unmarshal(rec.Body.Bytes(), res)
+				if err != nil {
+					ts.t.Fatalf("%s: failed to decode %q: %v", path, rec.Body.String(), err)
+				}
+			}
+			return rec.Code
+		case <-time.After(time.Millisecond):
+			ts.applyBackground()
+		}
+	}
+}
+
+func (ts *testServer) applyBackground() {
+	ts.t.Helper()
+	for _, w := range ts.allWorkers() {
+		tasks := []queuedTask{}
+		for len(w.queue) > 0 {
+			tasks = append(tasks, queuedTask{task: <-w.queue})
+		}
+		db, err := w.dbPool.Take(context.Background())
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		for len(tasks) > 0 {
+			tasks = ts.applyBatch(db, tasks)
+		}
+		w.dbPool.Put(db)
+	}
+}
+
+func TestQueryPassedSince(t *testing.T) {
+	ts := newTestServer(t)
+	publish := func(depHash string, nodeIds ...string) {
+		ts.call(ts.public, "/api/v1/publish", ts.adminToken, PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{depHash: nodeIds}}, nil)
+		ts.applyBackground()
+	}
+	query := func(since int64, ifNoneMatch string) (*httptest.ResponseRecorder, QueryPassedResponse) {
+		body, _ := json.Marshal(QueryPassedRequest{TestFileHashes: []string{testDepHash(1), testDepHash(2), testDepHash(3)}, Since: since})
+		rec := ts.do(ts.public, "POST", "/api/v1/query-passed", ts.adminToken, body, http.Header{"If-None-Match": {ifNoneMatch}})
+		var res QueryPassedResponse
+		if rec.Code == http.StatusOK {
+			json.Unmarshal(rec.Body.Bytes(), &res)
+		}
+		return rec, res
+	}
+
+	rec, res := query(0, "")
+	if res.Version != 0 || rec.Header().Get("ETag") == "" {
+		t.Errorf("before publishing: version %d, ETag %q", res.Version, rec.Header().Get("ETag"))
+	}
+	publish(testDepHash(1), testNodeId(1))
+	publish(testDepHash(2), testNodeId(2))
+	rec, res = query(0, "")
+	etag := rec.Header().Get("ETag")
+	if res.Version != 2 || len(res.NodeIds[0]) != 1 || len(res.NodeIds[1]) != 1 || res.NodeIds[2] == nil {
+		t.Errorf("since 0: %+v", res)
+	}
+
+	tests := []struct {
+		name        string
+		since       int64
+		ifNoneMatch string
+		wantStatus  int
+		// Which dep hashes get node ids rather than null
+		wantChanged []bool
+	}{
+		{name: "since the first publish", since: 1, wantStatus: http.StatusOK, wantChanged: []bool{false, true, true}},
+		{name: "since the latest publish", since: 2, wantStatus: http.StatusOK, wantChanged: []bool{false, false, true}},
+		{name: "since a version from another database", since: 99, wantStatus: http.StatusOK, wantChanged: []bool{true, true, true}},
+		{name: "etag matches", ifNoneMatch: etag, wantStatus: http.StatusNotModified},
+		{name: "weak etag matches", ifNoneMatch: `"x", ` + strings.TrimPrefix(etag, "W/"), wantStatus: http.StatusNotModified},
+		{name: "any etag", ifNoneMatch: "*", wantStatus: http.StatusNotModified},
+		{name: "etag of another query", since: 1, ifNoneMatch: etag, wantStatus: http.StatusOK, wantChanged: []bool{false, true, true}},
+	}
+	for _, tt := range tests {
+		rec, res := query(tt.since, tt.ifNoneMatch)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+			continue
+		}
+		if rec.Header().Get("Cache-Control") != "private, no-cache" {
+			t.Errorf("%s: Cache-Control = %q", tt.name, rec.Header().Get("Cache-Control"))
+		}
+		for i, want := range tt.wantChanged {
+			if (res.NodeIds[i] != nil) != want {
+				t.Errorf("%s: node ids of dep hash %d = %v, want changed %v", tt.name, i, res.NodeIds[i], want)
+			}
+		}
+	}
+
+	// Publishing changes the ETag
+	publish(testDepHash(1), testNodeId(3))
+	rec, _ = query(0, etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("after publishing: status %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestBackgroundBatch(t *testing.T) {
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	publish := func(tests map[string][]string) {
+		ts.enqueue(ts.newPublishTask(AuthInfo{UserId: userId}, tests))
+	}
+	publish(map[string][]string{testDepHash(1): {testNodeId(1), testNodeId(2)}})
+	publish(map[string][]string{testDepHash(1): {testNodeId(2), testNodeId(3)}, testDepHash(2): {testNodeId(4)}})
+	// Publishes are validated by their handlers, these bypass them to fail in the background
+	publish(map[string][]string{testDepHash(3): {testNodeId(5), "short"}})
+	publish(map[string][]string{"short": {testNodeId(6)}})
+	ts.enqueue(&UsageRecord{Timestamp: time.Now(), UserId: userId, Usage: USAGE_PUBLISH})
+	ts.applyBackground()
+
+	var res QueryPassedResponse
+	ts.call(ts.public, "/api/v1/query-passed", token, QueryPassedRequest{TestFileHashes: []string{testDepHash(1), testDepHash(2), testDepHash(3)}}, &res)
+	for _, nodeIds := range res.NodeIds {
+		sort.Strings(nodeIds)
+	}
+	want := [][]string{{testNodeId(1), testNodeId(2), testNodeId(3)}, {testNodeId(4)}, {}}
+	if fmt.Sprint(res.NodeIds) != fmt.Sprint(want) {
+		t.Errorf("passed = %v, want %v", res.NodeIds, want)
+	}
+	// The whole batch is one publish
+	if res.Version != 1 {
+		t.Errorf("version = %d, want 1", res.Version)
+	}
+
+	usage := 0
+	ts.withConn(func(db *sqlite.Conn) {
+		err := sqlitex.Execute(db, "SELECT COUNT(*) FROM user_usage WHERE user_id = ?", &sqlitex.ExecOptions{
+			Args: []interface{}{userId},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				usage = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if usage == 0 {
+		t.Errorf("usage wasn't recorded")
+	}
+}
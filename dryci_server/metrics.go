@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Minimal Prometheus text exposition, enough for counters and gauges without pulling in
+// the whole client library.
+
+type metric interface {
+	writeMetric(w io.Writer)
+}
+
+var metricsMu sync.Mutex
+var metricsRegistry = []metric{}
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsRegistry = append(metricsRegistry, m)
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	registerMetric(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) writeMetric(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, strings.Split(key, "\xff")), formatFloat(c.values[key]))
+	}
+}
+
+type GaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+func NewGaugeFunc(name string, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, f: f}
+	registerMetric(g)
+	return g
+}
+
+func (g *GaugeFunc) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.f()))
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range metricsRegistry {
+		m.writeMetric(w)
+	}
+}
+
+// -- Metrics --
+
+var httpRequestsTotal = NewCounterVec("dryci_http_requests_total", "HTTP requests handled.", "route", "status")
+var httpRequestSeconds = NewCounterVec("dryci_http_request_duration_seconds_total", "Total time spent handling HTTP requests.", "route")
+var bgTasksTotal = NewCounterVec("dryci_background_tasks_total", "Background tasks processed.", "kind", "result")
+var bgTaskSeconds = NewCounterVec("dryci_background_task_duration_seconds_total", "Total time spent applying background tasks.", "kind")
+var bgBatchesTotal = NewCounterVec("dryci_background_batches_total", "Background batches committed.", "result")
+var bgBatchSeconds = NewCounterVec("dryci_background_batch_duration_seconds_total", "Total time spent committing background batches.")
+var resultCacheTotal = NewCounterVec("dryci_result_cache_lookups_total", "Query cache lookups, per dep hash.", "result")
+var hermeticityViolationsTotal = NewCounterVec("dryci_hermeticity_violations_total", "Cached passes contradicted by a failure under the same dep hash.")
+var jobRunsTotal = NewCounterVec("dryci_job_runs_total", "Maintenance job runs.", "job", "result")
+var jobSeconds = NewCounterVec("dryci_job_duration_seconds_total", "Total time spent running maintenance jobs.", "job")
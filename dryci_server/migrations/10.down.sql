@@ -0,0 +1,14 @@
+DROP TABLE test_provenance;
+
+CREATE TABLE api_tokens_old (
+    token TEXT PRIMARY KEY NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    expires_at INTEGER,
+    disabled_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO api_tokens_old (token, user_id, created_at, expires_at, disabled_at)
+    SELECT token, user_id, created_at, expires_at, disabled_at FROM api_tokens;
+DROP TABLE api_tokens;
+ALTER TABLE api_tokens_old RENAME TO api_tokens;
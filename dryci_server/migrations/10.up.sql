@@ -0,0 +1,28 @@
+-- Give tokens a stable id to record what they published, the implicit rowid may change on VACUUM
+CREATE TABLE api_tokens_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    token TEXT NOT NULL UNIQUE,
+    user_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    expires_at INTEGER,
+    disabled_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO api_tokens_new (id, token, user_id, created_at, expires_at, disabled_at)
+    SELECT rowid, token, user_id, created_at, expires_at, disabled_at FROM api_tokens;
+DROP TABLE api_tokens;
+ALTER TABLE api_tokens_new RENAME TO api_tokens;
+
+-- Which token and run published each node id of test_results, run_id is '' if not given
+CREATE TABLE test_provenance (
+    user_id INTEGER NOT NULL,
+    dep_hash TEXT NOT NULL,
+    node_id TEXT NOT NULL,
+    token_id INTEGER NOT NULL,
+    run_id TEXT NOT NULL,
+    published_at INTEGER NOT NULL,
+    PRIMARY KEY (user_id, dep_hash, node_id, token_id, run_id)
+) WITHOUT ROWID;
+
+CREATE INDEX test_provenance_token_id ON test_provenance (user_id, token_id);
+CREATE INDEX test_provenance_run_id ON test_provenance (user_id, run_id);
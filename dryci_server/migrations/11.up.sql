@@ -0,0 +1,31 @@
+-- Ties the queries and publishes sent with a run_id together, with the metadata of /api/v1/runs/begin
+CREATE TABLE runs (
+    user_id INTEGER NOT NULL,
+    run_id TEXT NOT NULL,
+    -- The token that first used the run
+    token_id INTEGER NOT NULL,
+    commit_sha TEXT NOT NULL DEFAULT '',
+    branch TEXT NOT NULL DEFAULT '',
+    ci_provider TEXT NOT NULL DEFAULT '',
+    ci_job TEXT NOT NULL DEFAULT '',
+    environment TEXT NOT NULL DEFAULT '',
+    -- JSON object of arbitrary string labels
+    labels TEXT NOT NULL DEFAULT '{}',
+    started_at INTEGER NOT NULL,
+    last_seen_at INTEGER NOT NULL,
+    ended_at INTEGER,
+    outcome TEXT NOT NULL DEFAULT '',
+    query_count INTEGER NOT NULL DEFAULT 0,
+    publish_count INTEGER NOT NULL DEFAULT 0,
+    -- Totals of the counts sent to /api/v1/publish
+    total_test_count INTEGER NOT NULL DEFAULT 0,
+    passed_test_count INTEGER NOT NULL DEFAULT 0,
+    failed_test_count INTEGER NOT NULL DEFAULT 0,
+    skipped_test_count INTEGER NOT NULL DEFAULT 0,
+    skipped_by_cache_test_count INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, run_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+) WITHOUT ROWID;
+
+CREATE INDEX runs_started_at ON runs (user_id, started_at);
+CREATE INDEX runs_last_seen_at ON runs (last_seen_at);
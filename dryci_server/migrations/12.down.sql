@@ -0,0 +1 @@
+ALTER TABLE namespace_policies DROP COLUMN scope_fallbacks;
@@ -0,0 +1,2 @@
+-- JSON array of the scopes consulted after a query's own scope, see -scope-fallbacks
+ALTER TABLE namespace_policies ADD COLUMN scope_fallbacks TEXT;
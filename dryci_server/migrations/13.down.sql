@@ -0,0 +1,2 @@
+ALTER TABLE namespace_policies DROP COLUMN trust;
+ALTER TABLE api_tokens DROP COLUMN labels;
@@ -0,0 +1,4 @@
+-- JSON object of string labels, set when the token is created, matched by trust policies
+ALTER TABLE api_tokens ADD COLUMN labels TEXT NOT NULL DEFAULT '{}';
+-- JSON trust policy, see TrustPolicy
+ALTER TABLE namespace_policies ADD COLUMN trust TEXT;
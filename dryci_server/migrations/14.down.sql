@@ -0,0 +1,3 @@
+ALTER TABLE namespace_policies DROP COLUMN max_age;
+DROP INDEX test_results_expires_at;
+ALTER TABLE test_results DROP COLUMN expires_at;
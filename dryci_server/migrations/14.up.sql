@@ -0,0 +1,5 @@
+-- Unix timestamp after which the row is ignored and deleted by the gc job, NULL for never
+ALTER TABLE test_results ADD COLUMN expires_at INTEGER;
+CREATE INDEX test_results_expires_at ON test_results(expires_at) WHERE expires_at IS NOT NULL;
+-- Default max_age of queries, in seconds
+ALTER TABLE namespace_policies ADD COLUMN max_age INTEGER;
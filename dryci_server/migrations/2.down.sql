@@ -0,0 +1,2 @@
+DROP TABLE publish_session_chunks;
+DROP TABLE publish_sessions;
\ No newline at end of file
@@ -0,0 +1,15 @@
+CREATE TABLE publish_sessions (
+    id TEXT PRIMARY KEY NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    expires_at INTEGER NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE publish_session_chunks (
+    session_id TEXT NOT NULL,
+    chunk_index INTEGER NOT NULL,
+    node_ids_per_test_file BLOB NOT NULL,
+    PRIMARY KEY (session_id, chunk_index),
+    FOREIGN KEY (session_id) REFERENCES publish_sessions(id) ON DELETE CASCADE
+) WITHOUT ROWID;
@@ -0,0 +1,2 @@
+ALTER TABLE test_results DROP COLUMN version;
+DROP TABLE result_versions;
\ No newline at end of file
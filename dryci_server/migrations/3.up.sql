@@ -0,0 +1,10 @@
+-- Bumped on every publish, so clients can ask what changed since the version they last saw
+CREATE TABLE result_versions (
+    user_id INTEGER PRIMARY KEY NOT NULL,
+    version INTEGER NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE test_results ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+INSERT INTO result_versions (user_id, version) SELECT DISTINCT user_id, 1 FROM test_results;
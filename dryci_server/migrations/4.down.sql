@@ -0,0 +1 @@
+DROP TABLE dead_letter_tasks;
\ No newline at end of file
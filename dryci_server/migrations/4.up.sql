@@ -0,0 +1,10 @@
+-- Background tasks that kept failing, kept for inspection and retrying
+CREATE TABLE dead_letter_tasks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    kind TEXT NOT NULL,
+    shard_key INTEGER NOT NULL,
+    payload BLOB NOT NULL,
+    error TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
@@ -0,0 +1,12 @@
+-- Maintenance jobs run by the scheduler. running_owner holds a lease so only one server
+-- runs a job at a time.
+CREATE TABLE jobs (
+    name TEXT PRIMARY KEY NOT NULL,
+    running_owner TEXT,
+    lease_expires_at INTEGER,
+    last_started_at INTEGER,
+    last_finished_at INTEGER,
+    last_status TEXT,
+    last_error TEXT,
+    last_duration_ms INTEGER
+) WITHOUT ROWID;
@@ -0,0 +1,12 @@
+-- Node ids that failed or errored at least once, and how their later runs went
+CREATE TABLE test_failures (
+    user_id INTEGER NOT NULL,
+    dep_hash TEXT NOT NULL,
+    node_id TEXT NOT NULL,
+    pass_count INTEGER NOT NULL DEFAULT 0,
+    fail_count INTEGER NOT NULL DEFAULT 0,
+    error_count INTEGER NOT NULL DEFAULT 0,
+    last_passed_at INTEGER,
+    last_failed_at INTEGER NOT NULL,
+    PRIMARY KEY (user_id, dep_hash, node_id)
+) WITHOUT ROWID;
@@ -0,0 +1 @@
+DROP TABLE hermeticity_violations;
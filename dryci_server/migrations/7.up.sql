@@ -0,0 +1,15 @@
+-- Node ids that failed under a dep hash they were cached as passed for, so the dep hash
+-- doesn't capture everything the test depends on
+CREATE TABLE hermeticity_violations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INTEGER NOT NULL,
+    dep_hash TEXT NOT NULL,
+    node_id TEXT NOT NULL,
+    -- "failed" or "errored"
+    outcome TEXT NOT NULL,
+    -- When the cached pass was last published
+    passed_at INTEGER NOT NULL,
+    detected_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE INDEX hermeticity_violations_user_id ON hermeticity_violations (user_id, id);
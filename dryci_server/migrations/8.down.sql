@@ -0,0 +1,2 @@
+DROP TABLE canary_scores;
+DROP TABLE namespace_policies;
@@ -0,0 +1,17 @@
+-- Per-namespace (user) settings, NULL columns use the server's defaults
+CREATE TABLE namespace_policies (
+    user_id INTEGER PRIMARY KEY NOT NULL,
+    canary_rate REAL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Cached node ids withheld from a run as canaries, and whether the run confirmed or
+-- contradicted them
+CREATE TABLE canary_scores (
+    user_id INTEGER NOT NULL,
+    dep_hash TEXT NOT NULL,
+    confirmed INTEGER NOT NULL DEFAULT 0,
+    contradicted INTEGER NOT NULL DEFAULT 0,
+    last_sampled_at INTEGER NOT NULL,
+    PRIMARY KEY (user_id, dep_hash)
+) WITHOUT ROWID;
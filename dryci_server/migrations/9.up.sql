@@ -0,0 +1,10 @@
+-- Node ids and dep hashes that are never reported as passed, so they always run. An entry has
+-- a dep hash, a node id (matching it under any dep hash) or both; the other is ''.
+CREATE TABLE quarantine (
+    user_id INTEGER NOT NULL,
+    dep_hash TEXT NOT NULL DEFAULT '',
+    node_id TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (user_id, dep_hash, node_id)
+) WITHOUT ROWID;
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// JsonApiHandler is a jsonApi handler that remembers its request/response types, so its
+// route can be documented.
+type JsonApiHandler[INP interface{}, OUT interface{}] http.HandlerFunc
+
+type apiDoc struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Auth        bool
+	Superuser   bool
+	Request     reflect.Type
+	// Defaults to application/json
+	RequestContentType string
+	Response           reflect.Type
+}
+
+var apiDocs = []apiDoc{}
+
+func splitPattern(pattern string) (method string, path string) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		return "GET", pattern
+	}
+	return method, path
+}
+
+// addApiDoc adds a route to the API documentation. The first line of `doc` is the summary,
+// the rest is the description.
+func addApiDoc(pattern string, doc string, d apiDoc) {
+	d.Method, d.Path = splitPattern(pattern)
+	summary, description, _ := strings.Cut(doc, "\n")
+	d.Summary = summary
+	d.Description = strings.TrimSpace(description)
+	apiDocs = append(apiDocs, d)
+}
+
+// handleApi registers a jsonApi route and adds it to the API documentation.
+func handleApi[INP interface{}, OUT interface{}](mux *http.ServeMux, pattern string, doc string, handler JsonApiHandler[INP, OUT]) {
+	_, path := splitPattern(pattern)
+	addApiDoc(pattern, doc, apiDoc{
+		Auth:      true,
+		Superuser: strings.HasPrefix(path, "/admin/"),
+		Request:   reflect.TypeFor[INP](),
+		Response:  reflect.TypeFor[OUT](),
+	})
+	handleRoute(mux, pattern, http.HandlerFunc(handler))
+}
+
+// handleDocumented registers a non-jsonApi route that returns JSON without authentication.
+func handleDocumented[OUT interface{}](mux *http.ServeMux, pattern string, doc string, handler http.HandlerFunc) {
+	addApiDoc(pattern, doc, apiDoc{Response: reflect.TypeFor[OUT]()})
+	handleRoute(mux, pattern, handler)
+}
+
+// -- OpenAPI generation --
+
+type openApiSchemas map[string]interface{}
+
+func (schemas openApiSchemas) schemaFor(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemas.schemaFor(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemas.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemas.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if _, exists := schemas[t.Name()]; !exists {
+			schemas[t.Name()] = nil // Placeholder, in case of recursion
+			schemas[t.Name()] = schemas.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (schemas openApiSchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemas.schemaFor(field.Type)
+	}
+	// Missing fields decode as their zero value, so nothing is strictly required
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+func buildOpenApi() map[string]interface{} {
+	schemas := openApiSchemas{}
+	errorResponse := map[string]interface{}{
+		"description": "Error, see `ErrorResponse.error.code`",
+		"content":     jsonContent(schemas.schemaFor(reflect.TypeFor[ErrorResponse]())),
+	}
+
+	paths := map[string]interface{}{}
+	for _, doc := range apiDocs {
+		op := map[string]interface{}{
+			"summary":     doc.Summary,
+			"operationId": strings.ToLower(doc.Method) + strings.ReplaceAll(strings.ReplaceAll(doc.Path, "/", "_"), "-", "_"),
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Success",
+					"content":     jsonContent(schemas.schemaFor(doc.Response)),
+				},
+				"default": errorResponse,
+			},
+		}
+		if doc.Description != "" {
+			op["description"] = doc.Description
+		}
+		if doc.Request != nil {
+			content := jsonContent(schemas.schemaFor(doc.Request))
+			if doc.RequestContentType != "" {
+				content = map[string]interface{}{
+					doc.RequestContentType: map[string]interface{}{"schema": schemas.schemaFor(doc.Request)},
+				}
+			}
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  content,
+			}
+		}
+		if doc.Auth {
+			op["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}}
+		} else {
+			op["security"] = []interface{}{}
+		}
+		if doc.Superuser {
+			op["tags"] = []string{"admin"}
+		}
+
+		pathItem, ok := paths[doc.Path].(map[string]interface{})
+		if !ok {
+			pathItem = map[string]interface{}{}
+			paths[doc.Path] = pathItem
+		}
+		pathItem[strings.ToLower(doc.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "DryCI API",
+			"version": VERSION,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []string{}}},
+	}
+}
+
+func (s *ApiServer) OpenApiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(buildOpenApi())
+}
+
+func (s *ApiServer) ApiDocHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	var sb strings.Builder
+	sb.WriteString("Welcome to the DryCI API Documentation!\n\n")
+	sb.WriteString("A machine-readable OpenAPI 3 description is available at /api/openapi.json\n")
+	sb.WriteString("Errors are returned as JSON: {\"error\": {\"code\", \"message\", \"request_id\", \"retryable\"}}\n")
+	sb.WriteString("Query and publish are also available as a protobuf Connect service, see proto/dryci/v1/dryci.proto\n\n")
+	for _, doc := range apiDocs {
+		title := fmt.Sprintf("--- %s %s ", doc.Method, doc.Path)
+		sb.WriteString(title + strings.Repeat("-", max(3, 119-len(title))) + "\n")
+		sb.WriteString("    " + doc.Summary + "\n")
+		if doc.Description != "" {
+			for _, line := range strings.Split(doc.Description, "\n") {
+				sb.WriteString(strings.TrimRight("    "+line, " ") + "\n")
+			}
+		}
+		if doc.Superuser {
+			sb.WriteString("    Requires a superuser token.\n")
+		}
+		sb.WriteString("\n\n")
+	}
+	fullWrite(w, sb.String())
+}
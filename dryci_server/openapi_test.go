@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenApi(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.do(ts.public, "GET", "/api/openapi.json", "", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/api/openapi.json = %d", rec.Code)
+	}
+	var doc struct {
+		OpenApi string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Summary     string                 `json:"summary"`
+			OperationId string                 `json:"operationId"`
+			Security    []map[string][]string  `json:"security"`
+			Tags        []string               `json:"tags"`
+			RequestBody map[string]interface{} `json:"requestBody"`
+			Responses   map[string]interface{} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenApi != "3.0.3" {
+		t.Errorf("openapi = %q", doc.OpenApi)
+	}
+
+	tests := []struct {
+		method        string
+		path          string
+		wantAuth      bool
+		wantAdmin     bool
+		wantRequest   bool
+		wantOperation string
+	}{
+		{method: "post", path: "/api/v1/query-passed", wantAuth: true, wantRequest: true, wantOperation: "post_api_v1_query_passed"},
+		{method: "post", path: "/api/v1/publish", wantAuth: true, wantRequest: true, wantOperation: "post_api_v1_publish"},
+		{method: "get", path: "/api/v1/version", wantOperation: "get_api_v1_version"},
+		{method: "post", path: "/admin/api/v1/create-user", wantAuth: true, wantAdmin: true, wantRequest: true, wantOperation: "post_admin_api_v1_create_user"},
+	}
+	for _, tt := range tests {
+		op, ok := doc.Paths[tt.path][tt.method]
+		if !ok {
+			t.Errorf("%s %s isn't documented", tt.method, tt.path)
+			continue
+		}
+		if op.OperationId != tt.wantOperation || op.Summary == "" {
+			t.Errorf("%s %s: operationId %q, summary %q", tt.method, tt.path, op.OperationId, op.Summary)
+		}
+		if (len(op.Security) > 0) != tt.wantAuth || (len(op.Tags) > 0) != tt.wantAdmin || (op.RequestBody != nil) != tt.wantRequest {
+			t.Errorf("%s %s: security %v, tags %v, request body %v", tt.method, tt.path, op.Security, op.Tags, op.RequestBody)
+		}
+		if op.Responses["200"] == nil || op.Responses["default"] == nil {
+			t.Errorf("%s %s: responses %v", tt.method, tt.path, op.Responses)
+		}
+	}
+
+	// Schemas use the JSON field names
+	for schema, fields := range map[string][]string{
+		"QueryPassedRequest": {"test_file_hashes"},
+		"PublishRequest":     {"passed_node_ids_per_test_file", "total_test_count"},
+		"ErrorBody":          {"code", "message", "request_id", "retryable"},
+	} {
+		for _, field := range fields {
+			if doc.Components.Schemas[schema].Properties[field] == nil {
+				t.Errorf("schema %s has no %s: %v", schema, field, doc.Components.Schemas[schema])
+			}
+		}
+	}
+}
+
+func TestApiDoc(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.do(ts.public, "GET", "/api", "", nil, nil)
+	body := rec.Body.String()
+	for _, want := range []string{
+		"--- POST /api/v1/query-passed ---",
+		"--- POST /admin/api/v1/create-user ---",
+		"    Requires a superuser token.",
+		"/api/openapi.json",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/api doesn't contain %q", want)
+		}
+	}
+}
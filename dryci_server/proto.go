@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Hand-written codecs for the messages in proto/dryci/v1/dryci.proto. The proto messages
+// decode straight into the JSON API's request/response structs, so both protocols share
+// jsonApi and the handlers; only the hex <-> raw bytes conversion differs.
+
+const PROTO_CONTENT_TYPE = "application/proto"
+const DEP_HASH_SIZE = DEP_HASH_HEX_SIZE / 2
+const NODEID_HASH_SIZE = NODEID_HASH_HEX_SIZE / 2
+
+type protoUnmarshaler interface {
+	UnmarshalProto(b []byte) error
+}
+
+type protoMarshaler interface {
+	MarshalProto() ([]byte, error)
+}
+
+func isProtoRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == PROTO_CONTENT_TYPE
+}
+
+// connectOnly serves a jsonApi handler as a Connect unary RPC, which must use the binary codec.
+func connectOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isProtoRequest(r) {
+			sendError(w, r, HttpErrWrap(
+				http.StatusUnsupportedMediaType,
+				"Unsupported Content-Type, use "+PROTO_CONTENT_TYPE,
+				fmt.Errorf("unsupported content type %q", r.Header.Get("Content-Type")),
+			).WithErrorCode("unsupported_content_type"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// connectErrorCode maps HTTP statuses to Connect error codes, see
+// https://connectrpc.com/docs/protocol#error-codes
+func connectErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusUnsupportedMediaType:
+		return "invalid_argument"
+	case http.StatusUnauthorized:
+		return "unauthenticated"
+	case http.StatusForbidden:
+		return "permission_denied"
+	case http.StatusNotFound, http.StatusGone:
+		return "not_found"
+	case http.StatusConflict:
+		return "already_exists"
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return "resource_exhausted"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	default:
+		return "internal"
+	}
+}
+
+type ConnectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func sendConnectError(w http.ResponseWriter, r *http.Request, hc HttpCode) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(hc.Code())
+	json.NewEncoder(w).Encode(ConnectError{
+		Code:    connectErrorCode(hc.Code()),
+		Message: fmt.Sprintf("%s (%s, request id %s)", hc.Message(), hc.ErrorCode(), requestId(r)),
+	})
+}
+
+// -- Wire helpers --
+
+// consumeFields calls f for every field in a message. f returns the number of bytes it
+// consumed, or 0 to skip an unknown field.
+func consumeFields(b []byte, f func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := f(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeBytesField(typ protowire.Type, b []byte, out *[]byte) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, fmt.Errorf("unexpected wire type %d for bytes field", typ)
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*out = v
+	return n, nil
+}
+
+func consumeStringField(typ protowire.Type, b []byte, out *string) (int, error) {
+	var raw []byte
+	n, err := consumeBytesField(typ, b, &raw)
+	*out = string(raw)
+	return n, err
+}
+
+func consumeVarintField(typ protowire.Type, b []byte, out *int) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("unexpected wire type %d for varint field", typ)
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*out = int(int64(v))
+	return n, nil
+}
+
+func consumeVarintField64(typ protowire.Type, b []byte, out *int64) (int, error) {
+	var v int
+	n, err := consumeVarintField(typ, b, &v)
+	*out = int64(v)
+	return n, err
+}
+
+func depHashToHex(b []byte) (string, error) {
+	if len(b) != DEP_HASH_SIZE {
+		return "", HttpErrWrap(http.StatusUnprocessableEntity, "Invalid test file hash", fmt.Errorf("invalid dep_hash length %d", len(b))).WithErrorCode("invalid_dep_hash")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func nodeIdsToHex(b []byte) ([]string, error) {
+	if len(b)%NODEID_HASH_SIZE != 0 {
+		return nil, HttpErrWrap(http.StatusUnprocessableEntity, "Invalid node id", fmt.Errorf("node_ids length %d not a multiple of %d", len(b), NODEID_HASH_SIZE)).WithErrorCode("invalid_node_id")
+	}
+	nodeIds := make([]string, 0, len(b)/NODEID_HASH_SIZE)
+	for i := 0; i < len(b); i += NODEID_HASH_SIZE {
+		nodeIds = append(nodeIds, hex.EncodeToString(b[i:i+NODEID_HASH_SIZE]))
+	}
+	return nodeIds, nil
+}
+
+// nodeIdsFromHex packs node ids into bytes. Ids that aren't hex, which only rows published
+// before publishes were checked for it may hold, are left out rather than failing the response.
+func nodeIdsFromHex(nodeIds []string) []byte {
+	b := make([]byte, 0, len(nodeIds)*NODEID_HASH_SIZE)
+	for _, nodeId := range nodeIds {
+		raw, err := hex.DecodeString(nodeId)
+		if err != nil || len(raw) != NODEID_HASH_SIZE {
+			slog.Warn("Skipping invalid stored node id", "node_id", nodeId)
+			continue
+		}
+		b = append(b, raw...)
+	}
+	return b
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// -- Messages --
+
+func (req *QueryPassedRequest) UnmarshalProto(b []byte) error {
+	*req = QueryPassedRequest{TestFileHashes: []string{}}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			var raw []byte
+			n, err := consumeBytesField(typ, b, &raw)
+			if err != nil {
+				return 0, err
+			}
+			depHash, err := depHashToHex(raw)
+			if err != nil {
+				return 0, err
+			}
+			req.TestFileHashes = append(req.TestFileHashes, depHash)
+			return n, nil
+		case 2:
+			return consumeVarintField64(typ, b, &req.Since)
+		case 3:
+			return consumeStringField(typ, b, &req.RunId)
+		case 4:
+			return consumeStringField(typ, b, &req.Scope)
+		case 5:
+			return consumeVarintField64(typ, b, &req.MaxAge)
+		}
+		return 0, nil
+	})
+}
+
+func (res QueryPassedResponse) MarshalProto() ([]byte, error) {
+	b := []byte{}
+	for i, nodeIds := range res.NodeIds {
+		raw := nodeIdsFromHex(nodeIds)
+		var entry []byte
+		if len(raw) > 0 {
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, raw)
+		}
+		if nodeIds == nil {
+			entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+			entry = protowire.AppendVarint(entry, 1)
+		}
+		if res.Withheld != nil && len(res.Withheld[i]) > 0 {
+			withheld := nodeIdsFromHex(res.Withheld[i])
+			entry = protowire.AppendTag(entry, 3, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, withheld)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if res.Version != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(res.Version))
+	}
+	return b, nil
+}
+
+// consumeTestFileNodeIds decodes a TestFileNodeIds message into `tests`.
+func consumeTestFileNodeIds(typ protowire.Type, b []byte, tests map[string][]string) (int, error) {
+	var entry []byte
+	n, err := consumeBytesField(typ, b, &entry)
+	if err != nil {
+		return 0, err
+	}
+	var depHash string
+	var nodeIds []string
+	err = consumeFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var raw []byte
+		switch num {
+		case 1:
+			n, err := consumeBytesField(typ, b, &raw)
+			if err == nil {
+				depHash, err = depHashToHex(raw)
+			}
+			return n, err
+		case 2:
+			n, err := consumeBytesField(typ, b, &raw)
+			if err == nil {
+				nodeIds, err = nodeIdsToHex(raw)
+			}
+			return n, err
+		}
+		return 0, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if depHash == "" {
+		return 0, fmt.Errorf("missing test_file_hash")
+	}
+	tests[depHash] = append(tests[depHash], nodeIds...)
+	return n, nil
+}
+
+// consumeTestFileTtl decodes a TestFileTtl message into `ttls`.
+func consumeTestFileTtl(typ protowire.Type, b []byte, ttls map[string]int64) (int, error) {
+	var entry []byte
+	n, err := consumeBytesField(typ, b, &entry)
+	if err != nil {
+		return 0, err
+	}
+	var depHash string
+	var ttl int64
+	err = consumeFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			var raw []byte
+			n, err := consumeBytesField(typ, b, &raw)
+			if err == nil {
+				depHash, err = depHashToHex(raw)
+			}
+			return n, err
+		case 2:
+			return consumeVarintField64(typ, b, &ttl)
+		}
+		return 0, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if depHash == "" {
+		return 0, fmt.Errorf("missing test_file_hash")
+	}
+	ttls[depHash] = ttl
+	return n, nil
+}
+
+func (req *PublishRequest) UnmarshalProto(b []byte) error {
+	*req = PublishRequest{
+		PassedNodeIdsPerTestFile:  map[string][]string{},
+		FailedNodeIdsPerTestFile:  map[string][]string{},
+		ErroredNodeIdsPerTestFile: map[string][]string{},
+		TtlPerTestFile:            map[string]int64{},
+	}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeTestFileNodeIds(typ, b, req.PassedNodeIdsPerTestFile)
+		case 2:
+			return consumeVarintField(typ, b, &req.TotalTestCount)
+		case 3:
+			return consumeVarintField(typ, b, &req.PassedTestCount)
+		case 4:
+			return consumeVarintField(typ, b, &req.FailedTestCount)
+		case 5:
+			return consumeVarintField(typ, b, &req.SkippedTestCount)
+		case 6:
+			return consumeVarintField(typ, b, &req.SkippedByCacheTestCount)
+		case 7:
+			return consumeTestFileNodeIds(typ, b, req.FailedNodeIdsPerTestFile)
+		case 8:
+			return consumeTestFileNodeIds(typ, b, req.ErroredNodeIdsPerTestFile)
+		case 9:
+			return consumeStringField(typ, b, &req.RunId)
+		case 10:
+			return consumeStringField(typ, b, &req.Scope)
+		case 11:
+			return consumeTestFileTtl(typ, b, req.TtlPerTestFile)
+		}
+		return 0, nil
+	})
+}
+
+func (res PublishResponse) MarshalProto() ([]byte, error) {
+	return []byte{}, nil
+}
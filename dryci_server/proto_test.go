@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestQueryPassedRequestUnmarshalProto(t *testing.T) {
+	depA := strings.Repeat("a", DEP_HASH_HEX_SIZE)
+	depB := strings.Repeat("0b", DEP_HASH_SIZE)
+	tests := []struct {
+		name    string
+		msg     func() []byte
+		want    QueryPassedRequest
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			msg:  func() []byte { return nil },
+			want: QueryPassedRequest{TestFileHashes: []string{}},
+		},
+		{
+			name: "all fields",
+			msg: func() []byte {
+				b := appendBytesField(nil, 1, mustDecodeHex(t, depA))
+				b = appendBytesField(b, 1, mustDecodeHex(t, depB))
+				return appendVarintField(b, 2, 42)
+			},
+			want: QueryPassedRequest{TestFileHashes: []string{depA, depB}, Since: 42},
+		},
+		{
+			name: "unknown fields are skipped",
+			msg: func() []byte {
+				b := appendVarintField(nil, 99, 7)
+				b = appendBytesField(b, 98, []byte("ignored"))
+				return appendBytesField(b, 1, mustDecodeHex(t, depA))
+			},
+			want: QueryPassedRequest{TestFileHashes: []string{depA}},
+		},
+		{
+			name:    "short dep hash",
+			msg:     func() []byte { return appendBytesField(nil, 1, []byte{1, 2, 3}) },
+			wantErr: true,
+		},
+		{
+			name:    "wrong wire type",
+			msg:     func() []byte { return appendVarintField(nil, 1, 1) },
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			msg:     func() []byte { return appendBytesField(nil, 1, mustDecodeHex(t, depA))[:10] },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		var req QueryPassedRequest
+		err := req.UnmarshalProto(tt.msg())
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: UnmarshalProto succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: UnmarshalProto failed: %v", tt.name, err)
+		} else if !reflect.DeepEqual(req, tt.want) {
+			t.Errorf("%s: UnmarshalProto = %+v, want %+v", tt.name, req, tt.want)
+		}
+	}
+}
+
+func TestQueryPassedResponseMarshalProto(t *testing.T) {
+	node1 := strings.Repeat("1", NODEID_HASH_HEX_SIZE)
+	node2 := strings.Repeat("2f", NODEID_HASH_SIZE)
+	tests := []struct {
+		name string
+		res  QueryPassedResponse
+		want func() []byte
+	}{
+		{
+			name: "empty",
+			res:  QueryPassedResponse{NodeIds: [][]string{}},
+			want: func() []byte { return []byte{} },
+		},
+		{
+			name: "node ids, unchanged and version",
+			res:  QueryPassedResponse{NodeIds: [][]string{{node1, node2}, nil, {}}, Version: 300},
+			want: func() []byte {
+				b := appendBytesField(nil, 1, appendBytesField(nil, 1, mustDecodeHex(t, node1+node2)))
+				b = appendBytesField(b, 1, appendVarintField(nil, 2, 1))
+				b = appendBytesField(b, 1, nil)
+				return appendVarintField(b, 2, 300)
+			},
+		},
+		{
+			name: "invalid stored node ids are skipped",
+			res:  QueryPassedResponse{NodeIds: [][]string{{"not-hex", node1, "abcd"}}},
+			want: func() []byte {
+				return appendBytesField(nil, 1, appendBytesField(nil, 1, mustDecodeHex(t, node1)))
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.res.MarshalProto()
+		if err != nil {
+			t.Errorf("%s: MarshalProto failed: %v", tt.name, err)
+		} else if want := tt.want(); !bytes.Equal(got, want) {
+			t.Errorf("%s: MarshalProto = %x, want %x", tt.name, got, want)
+		}
+	}
+}
+
+func TestPublishRequestUnmarshalProto(t *testing.T) {
+	depA := strings.Repeat("a", DEP_HASH_HEX_SIZE)
+	node1 := strings.Repeat("1", NODEID_HASH_HEX_SIZE)
+	node2 := strings.Repeat("2", NODEID_HASH_HEX_SIZE)
+	testFile := func(depHash string, nodeIds string) []byte {
+		entry := appendBytesField(nil, 1, mustDecodeHex(t, depHash))
+		return appendBytesField(entry, 2, mustDecodeHex(t, nodeIds))
+	}
+	empty := func() PublishRequest {
+		return PublishRequest{
+			PassedNodeIdsPerTestFile:  map[string][]string{},
+			FailedNodeIdsPerTestFile:  map[string][]string{},
+			ErroredNodeIdsPerTestFile: map[string][]string{},
+			TtlPerTestFile:            map[string]int64{},
+		}
+	}
+	tests := []struct {
+		name    string
+		msg     func() []byte
+		want    func() PublishRequest
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			msg:  func() []byte { return nil },
+			want: empty,
+		},
+		{
+			name: "all fields",
+			msg: func() []byte {
+				b := appendBytesField(nil, 1, testFile(depA, node1))
+				b = appendBytesField(b, 1, testFile(depA, node2))
+				b = appendVarintField(b, 2, 10)
+				b = appendVarintField(b, 3, 5)
+				b = appendVarintField(b, 4, 2)
+				b = appendVarintField(b, 5, 1)
+				b = appendVarintField(b, 6, 2)
+				b = appendBytesField(b, 7, testFile(depA, node2))
+				b = appendBytesField(b, 8, testFile(depA, node1))
+				ttl := appendBytesField(nil, 1, mustDecodeHex(t, depA))
+				return appendBytesField(b, 11, appendVarintField(ttl, 2, 3600))
+			},
+			want: func() PublishRequest {
+				req := empty()
+				req.PassedNodeIdsPerTestFile[depA] = []string{node1, node2}
+				req.FailedNodeIdsPerTestFile[depA] = []string{node2}
+				req.ErroredNodeIdsPerTestFile[depA] = []string{node1}
+				req.TtlPerTestFile[depA] = 3600
+				req.TotalTestCount = 10
+				req.PassedTestCount = 5
+				req.FailedTestCount = 2
+				req.SkippedTestCount = 1
+				req.SkippedByCacheTestCount = 2
+				return req
+			},
+		},
+		{
+			name: "partial node id",
+			msg: func() []byte {
+				entry := appendBytesField(nil, 1, mustDecodeHex(t, depA))
+				entry = appendBytesField(entry, 2, []byte{1, 2, 3})
+				return appendBytesField(nil, 1, entry)
+			},
+			wantErr: true,
+		},
+		{
+			name:    "missing test file hash",
+			msg:     func() []byte { return appendBytesField(nil, 1, appendBytesField(nil, 2, mustDecodeHex(t, node1))) },
+			wantErr: true,
+		},
+		{
+			name:    "short dep hash",
+			msg:     func() []byte { return appendBytesField(nil, 1, appendBytesField(nil, 1, []byte{0xaa})) },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		var req PublishRequest
+		err := req.UnmarshalProto(tt.msg())
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: UnmarshalProto succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: UnmarshalProto failed: %v", tt.name, err)
+		} else if want := tt.want(); !reflect.DeepEqual(req, want) {
+			t.Errorf("%s: UnmarshalProto = %+v, want %+v", tt.name, req, want)
+		}
+	}
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	ts := newTestServer(t)
+	depA := strings.Repeat("a", DEP_HASH_HEX_SIZE)
+	node1 := strings.Repeat("1", NODEID_HASH_HEX_SIZE)
+	proto := http.Header{"Content-Type": {PROTO_CONTENT_TYPE}}
+
+	entry := appendBytesField(nil, 1, mustDecodeHex(t, depA))
+	entry = appendBytesField(entry, 2, mustDecodeHex(t, node1))
+	rec := ts.do(ts.public, "POST", "/dryci.v1.DryciService/Publish", ts.adminToken, appendBytesField(nil, 1, entry), proto)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != PROTO_CONTENT_TYPE {
+		t.Fatalf("Publish = %d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+	ts.applyBackground()
+
+	query := appendBytesField(nil, 1, mustDecodeHex(t, depA))
+	want := appendBytesField(nil, 1, appendBytesField(nil, 1, mustDecodeHex(t, node1)))
+	want = appendVarintField(want, 2, 1)
+	for _, path := range []string{"/dryci.v1.DryciService/QueryPassed", "/api/v1/query-passed"} {
+		rec = ts.do(ts.public, "POST", path, ts.adminToken, query, proto)
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Errorf("%s = %d %x, want %x", path, rec.Code, rec.Body.Bytes(), want)
+		}
+	}
+
+	// Unknown fields of 16 bytes, so the limit falls between two of them and the message up to
+	// it decodes
+	unknown := appendBytesField(nil, 15, make([]byte, 14))
+	tooLarge := bytes.Repeat(unknown, MAX_REQUEST_BODY_BYTES/len(unknown)+1)
+	tests := []struct {
+		name        string
+		path        string
+		token       string
+		contentType string
+		body        []byte
+		wantStatus  int
+		wantCode    string
+	}{
+		{name: "json on a connect route", path: "/dryci.v1.DryciService/QueryPassed", token: ts.adminToken, contentType: "application/json", body: []byte(`{}`), wantStatus: 415},
+		{name: "no token", path: "/dryci.v1.DryciService/QueryPassed", contentType: PROTO_CONTENT_TYPE, wantStatus: 401, wantCode: "unauthenticated"},
+		{name: "malformed message", path: "/dryci.v1.DryciService/QueryPassed", token: ts.adminToken, contentType: PROTO_CONTENT_TYPE, body: query[:10], wantStatus: 422, wantCode: "invalid_argument"},
+		{name: "no proto codec", path: "/api/v1/publish-session/begin", token: ts.adminToken, contentType: PROTO_CONTENT_TYPE, wantStatus: 415, wantCode: "invalid_argument"},
+		{name: "too large", path: "/dryci.v1.DryciService/QueryPassed", token: ts.adminToken, contentType: PROTO_CONTENT_TYPE, body: tooLarge, wantStatus: 413},
+	}
+	for _, tt := range tests {
+		rec := ts.do(ts.public, "POST", tt.path, tt.token, tt.body, http.Header{"Content-Type": {tt.contentType}})
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+		if tt.wantCode != "" {
+			var res ConnectError
+			json.Unmarshal(rec.Body.Bytes(), &res)
+			if res.Code != tt.wantCode || !strings.Contains(res.Message, rec.Header().Get("X-Request-Id")) {
+				t.Errorf("%s: error = %+v", tt.name, res)
+			}
+		}
+	}
+}
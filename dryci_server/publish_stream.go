@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// A single NDJSON line may hold up to MAX_NODEIDS_PER_DEP node ids, plus some slack
+const MAX_NDJSON_LINE_BYTES = 2*DEP_HASH_HEX_SIZE + MAX_NODEIDS_PER_DEP*(NODEID_HASH_HEX_SIZE+4) + 1024
+
+// Dep hashes per background task, so a huge stream doesn't become one huge write
+const STREAM_BATCH_DEP_HASHES = 512
+
+// -- Streaming publish (NDJSON) --
+
+type PublishStreamLine struct {
+	DepHash string   `json:"dep_hash"`
+	NodeIds []string `json:"node_ids"`
+	// Like failed_node_ids_per_test_file, errored_node_ids_per_test_file and ttl_per_test_file
+	// of /api/v1/publish, for this dep-hash
+	FailedNodeIds  []string `json:"failed_node_ids,omitempty"`
+	ErroredNodeIds []string `json:"errored_node_ids,omitempty"`
+	Ttl            int64    `json:"ttl,omitempty"`
+}
+
+type PublishStreamResponse struct {
+	DepHashCount int `json:"dep_hash_count"`
+	NodeIdCount  int `json:"node_id_count"`
+}
+
+const PUBLISH_STREAM_DOC = `Publish test results as a stream of newline-delimited JSON, one dep-hash per line: its passed node_ids, and
+optionally its failed_node_ids, errored_node_ids and ttl, like the fields of /api/v1/publish.
+Unlike /api/v1/publish there is no total size limit, and the body may take up to -stream-timeout between lines.
+Lines are published in batches as they arrive, so if the stream is cut off the lines before the cut are kept.
+Use a publish session instead if you need to resume an interrupted upload.
+The scope and run_id fields of /api/v1/publish are passed as query parameters, e.g. /api/v1/publish-stream?scope=main&run_id=1234.
+
+Example request:
+    {"dep_hash": "ed69bb4aa4547f7d83799875d800d4158a125c2316fe1bddb6a6a79ad8611b48", "node_ids": ["1b643e95eed492e780a485f9c40dc15b"]}
+    {"dep_hash": "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6", "node_ids": ["12c2461ddf13d3a84755044f8fb93513"]}
+
+Example response:
+    {"dep_hash_count": 2, "node_id_count": 2}`
+
+func (s *ApiServer) PublishStreamHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	auth, err := s.authenticate(r)
+	if err != nil {
+		sendResponse(w, r, nil, err, start)
+		return
+	}
+	s.enqueue(&UsageRecord{
+		Timestamp: time.Now(),
+		UserId:    auth.UserId,
+		Usage:     USAGE_PUBLISH,
+	})
+
+	scope := r.URL.Query().Get("scope")
+	runId := r.URL.Query().Get("run_id")
+	err = validateScope(scope)
+	if err == nil {
+		err = validateRunField("run_id", runId)
+	}
+	run := PublishTask{UserId: auth.UserId}
+	if err == nil {
+		err = s.withConn(s.dbPool, func(db *sqlite.Conn) error {
+			return s.setPublishTaskRun(db, &run, scope, runId)
+		})
+	}
+	if err != nil {
+		sendResponse(w, r, nil, err, start)
+		return
+	}
+
+	body, err := decodeRequestBody(r)
+	if err != nil {
+		sendResponse(w, r, nil, err, start)
+		return
+	}
+	defer body.Close()
+
+	// The server-wide timeouts are sized for small requests, keep extending them while data flows
+	rc := http.NewResponseController(w)
+	extendDeadline := func() {
+		rc.SetReadDeadline(time.Now().Add(*streamTimeout))
+		rc.SetWriteDeadline(time.Now().Add(*streamTimeout + 2*time.Second))
+	}
+	extendDeadline()
+
+	res := PublishStreamResponse{}
+	var batch *PublishTask
+	batchLines := 0
+	flush := func() {
+		if batch != nil {
+			s.enqueue(batch)
+			batch, batchLines = nil, 0
+		}
+	}
+
+	reader := bufio.NewReaderSize(body, 64*1024)
+	for lineNo := 1; ; lineNo++ {
+		line, err := readLine(reader, MAX_NDJSON_LINE_BYTES)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			flush()
+			sendResponse(w, r, nil, HttpErrWrap(http.StatusUnprocessableEntity, fmt.Sprintf("Failed to read line %d", lineNo), err).WithErrorCode("invalid_request"), start)
+			return
+		}
+		extendDeadline()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry PublishStreamLine
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&entry)
+		for _, nodeIds := range [][]string{entry.NodeIds, entry.FailedNodeIds, entry.ErroredNodeIds} {
+			if err == nil {
+				err = ValidateTestHashes(map[string][]string{entry.DepHash: nodeIds})
+			}
+		}
+		if err == nil && entry.Ttl != 0 {
+			err = validateTtls(map[string]int64{entry.DepHash: entry.Ttl})
+		}
+		if err != nil {
+			flush()
+			var hc HttpCode
+			if errors.As(err, &hc) {
+				err = HttpErrWrap(hc.Code(), fmt.Sprintf("%s on line %d", hc.Message(), lineNo), err).WithErrorCode(hc.ErrorCode())
+			} else {
+				err = HttpErrWrap(http.StatusUnprocessableEntity, fmt.Sprintf("Invalid JSON on line %d", lineNo), err).WithErrorCode("invalid_request")
+			}
+			sendResponse(w, r, nil, err, start)
+			return
+		}
+
+		// Lines are merged like separate publishes, see PublishTask.Merge
+		linePublish := &PublishTask{
+			Tests:   map[string][]string{entry.DepHash: entry.NodeIds},
+			Failed:  map[string][]string{entry.DepHash: entry.FailedNodeIds},
+			Errored: map[string][]string{entry.DepHash: entry.ErroredNodeIds},
+			Ttls:    streamLineTtls(entry),
+		}
+		if batch != nil && !batch.Merge(linePublish) {
+			flush()
+		}
+		if batch == nil {
+			batch = s.newPublishTask(auth, map[string][]string{})
+			batch.Scopes, batch.RunId, batch.CanaryRate = run.Scopes, run.RunId, run.CanaryRate
+			batch.Merge(linePublish)
+		}
+		batchLines++
+		res.DepHashCount++
+		res.NodeIdCount += len(entry.NodeIds) + len(entry.FailedNodeIds) + len(entry.ErroredNodeIds)
+		if batchLines >= STREAM_BATCH_DEP_HASHES {
+			flush()
+		}
+	}
+	flush()
+	s.recordRunActivity(auth, runId, RunActivity{Publishes: 1})
+
+	sendResponse(w, r, res, nil, start)
+}
+
+func streamLineTtls(entry PublishStreamLine) map[string]int64 {
+	if entry.Ttl == 0 {
+		return nil
+	}
+	return map[string]int64{entry.DepHash: entry.Ttl}
+}
+
+// readLine reads a newline-terminated line (the final newline is optional), of at most maxLen bytes.
+func readLine(reader *bufio.Reader, maxLen int) ([]byte, error) {
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxLen {
+			return nil, fmt.Errorf("line longer than %d bytes", maxLen)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return line, nil
+		}
+		return line, err
+	}
+}
+
+// -- Publish sessions --
+// Resumable uploads: begin a session, append numbered chunks in any order (re-sending a
+// chunk is harmless), check which chunks arrived, then commit to publish them all at once.
+
+type PublishSessionBeginRequest struct {
+}
+
+type PublishSessionBeginResponse struct {
+	SessionId string `json:"session_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (s *ApiServer) PublishSessionBeginHandler(db *sqlite.Conn, req *PublishSessionBeginRequest, res *PublishSessionBeginResponse, auth AuthInfo) error {
+	sessionId, expiresAt, err := CreatePublishSession(db, auth.UserId, *publishSessionTtl)
+	if err != nil {
+		return err
+	}
+	*res = PublishSessionBeginResponse{SessionId: sessionId, ExpiresAt: expiresAt.Unix()}
+	return nil
+}
+
+type PublishSessionAppendRequest struct {
+	SessionId                string              `json:"session_id"`
+	ChunkIndex               int                 `json:"chunk_index"`
+	PassedNodeIdsPerTestFile map[string][]string `json:"passed_node_ids_per_test_file"`
+	// See /api/v1/publish
+	FailedNodeIdsPerTestFile  map[string][]string `json:"failed_node_ids_per_test_file,omitempty"`
+	ErroredNodeIdsPerTestFile map[string][]string `json:"errored_node_ids_per_test_file,omitempty"`
+	TtlPerTestFile            map[string]int64    `json:"ttl_per_test_file,omitempty"`
+}
+
+type PublishSessionAppendResponse struct {
+}
+
+func (s *ApiServer) PublishSessionAppendHandler(db *sqlite.Conn, req *PublishSessionAppendRequest, res *PublishSessionAppendResponse, auth AuthInfo) error {
+	*res = PublishSessionAppendResponse{}
+	err := CheckPublishSession(db, auth.UserId, req.SessionId)
+	if err != nil {
+		return err
+	}
+	for _, tests := range []map[string][]string{req.PassedNodeIdsPerTestFile, req.FailedNodeIdsPerTestFile, req.ErroredNodeIdsPerTestFile} {
+		err := ValidateTestHashes(tests)
+		if err != nil {
+			return err
+		}
+	}
+	err = validateTtls(req.TtlPerTestFile)
+	if err != nil {
+		return err
+	}
+	chunk := publishSessionChunk{
+		Passed:  req.PassedNodeIdsPerTestFile,
+		Failed:  req.FailedNodeIdsPerTestFile,
+		Errored: req.ErroredNodeIdsPerTestFile,
+		Ttls:    req.TtlPerTestFile,
+	}
+	if chunk.Passed == nil {
+		chunk.Passed = map[string][]string{}
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunk: %w", err)
+	}
+	return AddPublishSessionChunk(db, req.SessionId, req.ChunkIndex, data)
+}
+
+// publishSessionChunk is how chunks are stored. Chunks stored before failures and TTLs were
+// accepted are just the passed node ids, and have no "passed".
+type publishSessionChunk struct {
+	Passed  map[string][]string `json:"passed"`
+	Failed  map[string][]string `json:"failed,omitempty"`
+	Errored map[string][]string `json:"errored,omitempty"`
+	Ttls    map[string]int64    `json:"ttls,omitempty"`
+}
+
+func decodePublishSessionChunk(data []byte) (publishSessionChunk, error) {
+	var chunk publishSessionChunk
+	err := json.Unmarshal(data, &chunk)
+	if err == nil && chunk.Passed == nil {
+		err = json.Unmarshal(data, &chunk.Passed)
+	}
+	return chunk, err
+}
+
+type PublishSessionStatusRequest struct {
+	SessionId string `json:"session_id"`
+}
+
+type PublishSessionStatusResponse struct {
+	ReceivedChunks []int `json:"received_chunks"`
+}
+
+func (s *ApiServer) PublishSessionStatusHandler(db *sqlite.Conn, req *PublishSessionStatusRequest, res *PublishSessionStatusResponse, auth AuthInfo) error {
+	err := CheckPublishSession(db, auth.UserId, req.SessionId)
+	if err != nil {
+		return err
+	}
+	chunks, err := ListPublishSessionChunks(db, req.SessionId)
+	if err != nil {
+		return err
+	}
+	*res = PublishSessionStatusResponse{ReceivedChunks: chunks}
+	return nil
+}
+
+type PublishSessionCommitRequest struct {
+	SessionId string `json:"session_id"`
+	// Must match the number of chunks received, to catch lost chunks
+	ChunkCount int `json:"chunk_count"`
+	// See /api/v1/publish
+	Scope string `json:"scope,omitempty"`
+	RunId string `json:"run_id,omitempty"`
+}
+
+type PublishSessionCommitResponse struct {
+}
+
+// PublishSessionCommitHandler queues the session's chunks one at a time, reading each with a
+// connection of its own rather than in a transaction: queueing blocks while the queue is full,
+// and draining it needs the write lock. The session is only deleted once every chunk is queued,
+// so a commit that fails halfway can be retried, publishing a chunk twice is harmless.
+func (s *ApiServer) PublishSessionCommitHandler(_ *sqlite.Conn, req *PublishSessionCommitRequest, res *PublishSessionCommitResponse, auth AuthInfo) error {
+	err := validateScope(req.Scope)
+	if err == nil {
+		err = validateRunField("run_id", req.RunId)
+	}
+	if err != nil {
+		return err
+	}
+	*res = PublishSessionCommitResponse{}
+	run := PublishTask{UserId: auth.UserId}
+	err = s.withConn(s.dbPool, func(db *sqlite.Conn) error {
+		err := CheckPublishSession(db, auth.UserId, req.SessionId)
+		if err != nil {
+			return err
+		}
+		received, err := ListPublishSessionChunks(db, req.SessionId)
+		if err != nil {
+			return err
+		}
+		if len(received) != req.ChunkCount || (len(received) > 0 && received[len(received)-1] != req.ChunkCount-1) {
+			return HttpErrWrap(
+				http.StatusConflict,
+				"Missing chunks, see /api/v1/publish-session/status",
+				fmt.Errorf("session %s has %d chunks, expected %d", req.SessionId, len(received), req.ChunkCount),
+			).WithErrorCode("missing_chunks")
+		}
+		return s.setPublishTaskRun(db, &run, req.Scope, req.RunId)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < req.ChunkCount; i++ {
+		var chunk []byte
+		err := s.withConn(s.dbPool, func(db *sqlite.Conn) (err error) {
+			chunk, err = GetPublishSessionChunk(db, req.SessionId, i)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if chunk == nil {
+			// Another commit of the session finished first
+			return HttpErrWrap(http.StatusNotFound, "Publish Session Not Found", fmt.Errorf("session %s lost chunk %d", req.SessionId, i)).WithErrorCode("session_not_found")
+		}
+		decoded, err := decodePublishSessionChunk(chunk)
+		if err != nil {
+			return fmt.Errorf("failed to decode chunk %d of session %s: %w", i, req.SessionId, err)
+		}
+		task := s.newPublishTask(auth, decoded.Passed)
+		task.Failed, task.Errored, task.Ttls = decoded.Failed, decoded.Errored, decoded.Ttls
+		task.Scopes, task.RunId, task.CanaryRate = run.Scopes, run.RunId, run.CanaryRate
+		s.enqueue(task)
+	}
+
+	err = s.withConn(s.dbPool, func(db *sqlite.Conn) error {
+		return DbTxn(db, true, func() error {
+			return DeletePublishSession(db, req.SessionId)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	s.recordRunActivity(auth, req.RunId, RunActivity{Publishes: 1})
+	return nil
+}
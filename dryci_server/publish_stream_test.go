@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// queryPassed returns the sorted passed node ids of each dep hash, as seen by the user.
+func (ts *testServer) queryPassed(token string, depHashes ...string) [][]string {
+	ts.t.Helper()
+	var res QueryPassedResponse
+	status := ts.call(ts.public, "/api/v1/query-passed", token, QueryPassedRequest{TestFileHashes: depHashes}, &res)
+	if status != http.StatusOK {
+		ts.t.Fatalf("query-passed = %d", status)
+	}
+	for _, nodeIds := range res.NodeIds {
+		sort.Strings(nodeIds)
+	}
+	return res.NodeIds
+}
+
+func testDepHash(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+func testNodeId(i int) string {
+	return fmt.Sprintf("%032x", i)
+}
+
+func TestPublishStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantRes    PublishStreamResponse
+		// Node ids published under testDepHash(1) and testDepHash(2), even when the stream fails
+		wantPassed [][]string
+	}{
+		{
+			name:       "lines",
+			body:       fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [%q, %q]}\n\n{\"dep_hash\": %q, \"node_ids\": [%q]}", testDepHash(1), testNodeId(1), testNodeId(2), testDepHash(2), testNodeId(3)),
+			wantStatus: http.StatusOK,
+			wantRes:    PublishStreamResponse{DepHashCount: 2, NodeIdCount: 3},
+			wantPassed: [][]string{{testNodeId(1), testNodeId(2)}, {testNodeId(3)}},
+		},
+		{
+			name:       "repeated dep hash",
+			body:       fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [%q]}\n{\"dep_hash\": %q, \"node_ids\": [%q]}\n", testDepHash(1), testNodeId(1), testDepHash(1), testNodeId(2)),
+			wantStatus: http.StatusOK,
+			wantRes:    PublishStreamResponse{DepHashCount: 2, NodeIdCount: 2},
+			wantPassed: [][]string{{testNodeId(1), testNodeId(2)}, {}},
+		},
+		{
+			name:       "invalid json keeps earlier lines",
+			body:       fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [%q]}\n{\"dep_hash\": \n", testDepHash(1), testNodeId(1)),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "invalid_request",
+			wantPassed: [][]string{{testNodeId(1)}, {}},
+		},
+		{
+			name:       "unknown field",
+			body:       fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [], \"nope\": 1}\n", testDepHash(1)),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "invalid_request",
+			wantPassed: [][]string{{}, {}},
+		},
+		{
+			name:       "invalid dep hash",
+			body:       fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [%q]}\n{\"dep_hash\": \"abc\", \"node_ids\": []}\n", testDepHash(2), testNodeId(1)),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "invalid_dep_hash",
+			wantPassed: [][]string{{}, {testNodeId(1)}},
+		},
+		{
+			name:       "line too long",
+			body:       `{"dep_hash": "` + strings.Repeat("a", MAX_NDJSON_LINE_BYTES) + "\"}\n",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   "invalid_request",
+			wantPassed: [][]string{{}, {}},
+		},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t)
+		rec := ts.do(ts.public, "POST", "/api/v1/publish-stream", ts.adminToken, []byte(tt.body), nil)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d %s, want %d", tt.name, rec.Code, rec.Body.String(), tt.wantStatus)
+			continue
+		}
+		if tt.wantCode != "" {
+			var res ErrorResponse
+			json.Unmarshal(rec.Body.Bytes(), &res)
+			if res.Error.Code != tt.wantCode {
+				t.Errorf("%s: error code = %q, want %q", tt.name, res.Error.Code, tt.wantCode)
+			}
+		} else {
+			var res PublishStreamResponse
+			json.Unmarshal(rec.Body.Bytes(), &res)
+			if res != tt.wantRes {
+				t.Errorf("%s: response = %+v, want %+v", tt.name, res, tt.wantRes)
+			}
+		}
+		ts.applyBackground()
+		got := ts.queryPassed(ts.adminToken, testDepHash(1), testDepHash(2))
+		if fmt.Sprint(got) != fmt.Sprint(tt.wantPassed) {
+			t.Errorf("%s: passed = %v, want %v", tt.name, got, tt.wantPassed)
+		}
+	}
+}
+
+func TestPublishSession(t *testing.T) {
+	ts := newTestServer(t)
+	_, otherToken := ts.createUser("other@example.com", false)
+	var session PublishSessionBeginResponse
+	status := ts.call(ts.public, "/api/v1/publish-session/begin", ts.adminToken, PublishSessionBeginRequest{}, &session)
+	if status != http.StatusOK || !strings.HasPrefix(session.SessionId, "ps-") {
+		t.Fatalf("begin = %d %+v", status, session)
+	}
+	chunk := func(i int) map[string][]string {
+		return map[string][]string{testDepHash(i): {testNodeId(i)}}
+	}
+
+	steps := []struct {
+		name       string
+		path       string
+		token      string
+		req        interface{}
+		wantStatus int
+	}{
+		{name: "append chunk 1", path: "append", req: PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: 1, PassedNodeIdsPerTestFile: chunk(1)}, wantStatus: 200},
+		{name: "commit with a missing chunk", path: "commit", req: PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 2}, wantStatus: 409},
+		{name: "append chunk 0", path: "append", req: PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: 0, PassedNodeIdsPerTestFile: chunk(0)}, wantStatus: 200},
+		{name: "resend chunk 0", path: "append", req: PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: 0, PassedNodeIdsPerTestFile: chunk(3)}, wantStatus: 200},
+		{name: "negative chunk index", path: "append", req: PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: -1, PassedNodeIdsPerTestFile: chunk(0)}, wantStatus: 422},
+		{name: "chunk index too large", path: "append", req: PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: MAX_PUBLISH_SESSION_CHUNKS, PassedNodeIdsPerTestFile: chunk(0)}, wantStatus: 422},
+		{name: "invalid chunk", path: "append", req: PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: 2, PassedNodeIdsPerTestFile: map[string][]string{"abc": {}}}, wantStatus: 422},
+		{name: "another user's session", path: "append", token: otherToken, req: PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: 2, PassedNodeIdsPerTestFile: chunk(2)}, wantStatus: 404},
+		{name: "another user's status", path: "status", token: otherToken, req: PublishSessionStatusRequest{SessionId: session.SessionId}, wantStatus: 404},
+		{name: "another user's commit", path: "commit", token: otherToken, req: PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 2}, wantStatus: 404},
+		{name: "too many chunks", path: "commit", req: PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 1}, wantStatus: 409},
+		{name: "commit", path: "commit", req: PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 2}, wantStatus: 200},
+		{name: "commit twice", path: "commit", req: PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 2}, wantStatus: 404},
+	}
+	for _, step := range steps {
+		token := step.token
+		if token == "" {
+			token = ts.adminToken
+		}
+		if step.name == "commit" {
+			var res PublishSessionStatusResponse
+			ts.call(ts.public, "/api/v1/publish-session/status", token, PublishSessionStatusRequest{SessionId: session.SessionId}, &res)
+			if fmt.Sprint(res.ReceivedChunks) != "[0 1]" {
+				t.Errorf("received chunks = %v, want [0 1]", res.ReceivedChunks)
+			}
+			// Nothing is published before the commit
+			ts.applyBackground()
+			if got := ts.queryPassed(ts.adminToken, testDepHash(0)); len(got[0]) != 0 {
+				t.Errorf("published before commit: %v", got)
+			}
+		}
+		status := ts.call(ts.public, "/api/v1/publish-session/"+step.path, token, step.req, nil)
+		if status != step.wantStatus {
+			t.Errorf("%s: status = %d, want %d", step.name, status, step.wantStatus)
+		}
+	}
+
+	ts.applyBackground()
+	got := ts.queryPassed(ts.adminToken, testDepHash(0), testDepHash(1), testDepHash(3))
+	want := [][]string{{testNodeId(0)}, {testNodeId(1)}, {}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("passed = %v, want %v", got, want)
+	}
+}
+
+func TestPublishSessionExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	var expired, live PublishSessionBeginResponse
+	ts.call(ts.public, "/api/v1/publish-session/begin", ts.adminToken, PublishSessionBeginRequest{}, &expired)
+	ts.withConn(func(db *sqlite.Conn) {
+		err := sqlitex.Execute(db, "UPDATE publish_sessions SET expires_at = 0 WHERE id = ?", &sqlitex.ExecOptions{Args: []interface{}{expired.SessionId}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	status := ts.call(ts.public, "/api/v1/publish-session/status", ts.adminToken, PublishSessionStatusRequest{SessionId: expired.SessionId}, nil)
+	if status != http.StatusGone {
+		t.Errorf("expired session status = %d, want %d", status, http.StatusGone)
+	}
+
+	// Beginning another session cleans up the expired one
+	ts.call(ts.public, "/api/v1/publish-session/begin", ts.adminToken, PublishSessionBeginRequest{}, &live)
+	status = ts.call(ts.public, "/api/v1/publish-session/status", ts.adminToken, PublishSessionStatusRequest{SessionId: expired.SessionId}, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("cleaned up session status = %d, want %d", status, http.StatusNotFound)
+	}
+	status = ts.call(ts.public, "/api/v1/publish-session/status", ts.adminToken, PublishSessionStatusRequest{SessionId: live.SessionId}, nil)
+	if status != http.StatusOK {
+		t.Errorf("live session status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestPublishSessionCommitQueuesChunks(t *testing.T) {
+	ts := newTestServer(t)
+	var session PublishSessionBeginResponse
+	ts.call(ts.public, "/api/v1/publish-session/begin", ts.adminToken, PublishSessionBeginRequest{}, &session)
+	for i := 0; i < 3; i++ {
+		req := PublishSessionAppendRequest{SessionId: session.SessionId, ChunkIndex: i, PassedNodeIdsPerTestFile: map[string][]string{testDepHash(i): {testNodeId(i)}}}
+		ts.call(ts.public, "/api/v1/publish-session/append", ts.adminToken, req, nil)
+	}
+	status := ts.call(ts.public, "/api/v1/publish-session/commit", ts.adminToken, PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 3}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("commit = %d", status)
+	}
+	// Each chunk is its own task, and the session is gone once they're all queued
+	queued := 0
+	for _, w := range ts.allWorkers() {
+		tasks := []BackgroundTask{}
+		for len(w.queue) > 0 {
+			tasks = append(tasks, <-w.queue)
+		}
+		for _, task := range tasks {
+			if _, ok := task.(*PublishTask); ok {
+				queued++
+			}
+			w.queue <- task
+		}
+	}
+	if queued != 3 {
+		t.Errorf("queued %d tasks, want 3", queued)
+	}
+	status = ts.call(ts.public, "/api/v1/publish-session/status", ts.adminToken, PublishSessionStatusRequest{SessionId: session.SessionId}, nil)
+	if status != http.StatusNotFound {
+		t.Errorf("status after commit = %d, want 404", status)
+	}
+	ts.applyBackground()
+	got := ts.queryPassed(ts.adminToken, testDepHash(0), testDepHash(1), testDepHash(2))
+	if want := [][]string{{testNodeId(0)}, {testNodeId(1)}, {testNodeId(2)}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("passed = %v, want %v", got, want)
+	}
+}
+
+func TestPublishStreamAndSessionFailuresAndTtls(t *testing.T) {
+	ts := newTestServer(t)
+	expiresAt := func(depHash string) (expiresAt int64) {
+		t.Helper()
+		ts.withConn(func(db *sqlite.Conn) {
+			err := sqlitex.Execute(db, "SELECT IFNULL(expires_at, 0) FROM test_results WHERE dep_hash = ?", &sqlitex.ExecOptions{
+				Args: []interface{}{depHash},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					expiresAt = stmt.ColumnInt64(0)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+		return expiresAt
+	}
+	ts.call(ts.public, "/api/v1/publish", ts.adminToken, PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(1), testNodeId(2)}}}, nil)
+	ts.applyBackground()
+
+	body := fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [], \"failed_node_ids\": [%q]}\n{\"dep_hash\": %q, \"node_ids\": [%q], \"errored_node_ids\": [%q], \"ttl\": 60}\n",
+		testDepHash(1), testNodeId(1), testDepHash(2), testNodeId(3), testNodeId(4))
+	rec := ts.do(ts.public, "POST", "/api/v1/publish-stream", ts.adminToken, []byte(body), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("publish-stream = %d %s", rec.Code, rec.Body.String())
+	}
+	ts.applyBackground()
+	got := ts.queryPassed(ts.adminToken, testDepHash(1), testDepHash(2))
+	if want := [][]string{{testNodeId(2)}, {testNodeId(3)}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after stream: passed = %v, want %v", got, want)
+	}
+	if got := expiresAt(testDepHash(2)); got == 0 {
+		t.Errorf("stream ttl wasn't set")
+	}
+
+	var session PublishSessionBeginResponse
+	ts.call(ts.public, "/api/v1/publish-session/begin", ts.adminToken, PublishSessionBeginRequest{}, &session)
+	status := ts.call(ts.public, "/api/v1/publish-session/append", ts.adminToken, PublishSessionAppendRequest{
+		SessionId:                session.SessionId,
+		ChunkIndex:               0,
+		PassedNodeIdsPerTestFile: map[string][]string{testDepHash(3): {testNodeId(5)}},
+		FailedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(2)}},
+		TtlPerTestFile:           map[string]int64{testDepHash(3): 120},
+	}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("append = %d", status)
+	}
+	// Chunks stored before sessions took failures are just the passed node ids
+	ts.withConn(func(db *sqlite.Conn) {
+		legacy, _ := json.Marshal(map[string][]string{testDepHash(4): {testNodeId(6)}})
+		err := AddPublishSessionChunk(db, session.SessionId, 1, legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	status = ts.call(ts.public, "/api/v1/publish-session/commit", ts.adminToken, PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 2}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("commit = %d", status)
+	}
+	ts.applyBackground()
+	got = ts.queryPassed(ts.adminToken, testDepHash(1), testDepHash(3), testDepHash(4))
+	if want := [][]string{{}, {testNodeId(5)}, {testNodeId(6)}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after session: passed = %v, want %v", got, want)
+	}
+	if got := expiresAt(testDepHash(3)); got == 0 {
+		t.Errorf("session ttl wasn't set")
+	}
+
+	invalid := []struct {
+		name     string
+		body     string
+		wantCode string
+	}{
+		{name: "negative ttl", body: fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [], \"ttl\": -1}\n", testDepHash(1)), wantCode: "invalid_ttl"},
+		{name: "invalid failed node id", body: fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [], \"failed_node_ids\": [\"abc\"]}\n", testDepHash(1)), wantCode: "invalid_node_id"},
+	}
+	for _, tt := range invalid {
+		rec := ts.do(ts.public, "POST", "/api/v1/publish-stream", ts.adminToken, []byte(tt.body), nil)
+		var res ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != http.StatusUnprocessableEntity || res.Error.Code != tt.wantCode {
+			t.Errorf("%s: status = %d %q, want 422 %q", tt.name, rec.Code, res.Error.Code, tt.wantCode)
+		}
+	}
+	ts.call(ts.public, "/api/v1/publish-session/begin", ts.adminToken, PublishSessionBeginRequest{}, &session)
+	status = ts.call(ts.public, "/api/v1/publish-session/append", ts.adminToken, PublishSessionAppendRequest{SessionId: session.SessionId, TtlPerTestFile: map[string]int64{testDepHash(1): 0}}, nil)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("append with a zero ttl = %d, want 422", status)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const MAX_QUARANTINE_ENTRIES_PER_REQUEST = 1000
+
+type ListQuarantineRequest struct {
+}
+
+type ListQuarantineResponse struct {
+	Entries []QuarantineEntry `json:"entries"`
+}
+
+func (s *ApiServer) ListQuarantineHandler(db *sqlite.Conn, req *ListQuarantineRequest, res *ListQuarantineResponse, auth AuthInfo) error {
+	var entries []QuarantineEntry
+	err := s.withResultsDb(db, auth.UserId, func(rdb *sqlite.Conn) (err error) {
+		entries, err = ListQuarantine(rdb, auth.UserId)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*res = ListQuarantineResponse{Entries: entries}
+	return nil
+}
+
+type ChangeQuarantineRequest struct {
+	Entries []QuarantineEntry `json:"entries"`
+}
+
+type ChangeQuarantineResponse struct {
+	// Test file hashes with cached node IDs that the change hid or revealed
+	ChangedTestFileHashes []string `json:"changed_test_file_hashes"`
+}
+
+const ADD_QUARANTINE_DOC = `Quarantine node IDs or test file hashes, so they always run: query-passed leaves them out and publish doesn't store them.
+Each entry has a dep_hash (the whole test file hash), a node_id (under any test file hash), or both. Passes stored before
+the quarantine are kept, and reported again once it's removed with /api/v1/quarantine/remove.
+
+Example request:
+    {
+        "entries": [
+            {"dep_hash": "65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6", "reason": "flaky fixture"},
+            {"node_id": "0c5e3ad4ad0d6ca5f6e53bde2ce94d50"}
+        ]
+    }
+
+Example response:
+    {"changed_test_file_hashes": ["65fe2ae6a67ebab19ca6c79b85d6feba73c87d1bc09c36bf1ebcf85d48dd13e6"]}`
+
+func (s *ApiServer) AddQuarantineHandler(db *sqlite.Conn, req *ChangeQuarantineRequest, res *ChangeQuarantineResponse, auth AuthInfo) error {
+	return s.changeQuarantine(req, res, auth, AddQuarantine)
+}
+
+func (s *ApiServer) RemoveQuarantineHandler(db *sqlite.Conn, req *ChangeQuarantineRequest, res *ChangeQuarantineResponse, auth AuthInfo) error {
+	return s.changeQuarantine(req, res, auth, RemoveQuarantine)
+}
+
+func (s *ApiServer) changeQuarantine(
+	req *ChangeQuarantineRequest,
+	res *ChangeQuarantineResponse,
+	auth AuthInfo,
+	change func(db *sqlite.Conn, userId int, version int64, entries []QuarantineEntry) ([]string, error),
+) error {
+	if len(req.Entries) > MAX_QUARANTINE_ENTRIES_PER_REQUEST {
+		return HttpErrWrap(http.StatusRequestEntityTooLarge, "Too many entries", fmt.Errorf("%d quarantine entries", len(req.Entries))).WithErrorCode("too_many_entries")
+	}
+	for _, entry := range req.Entries {
+		if entry.DepHash == "" && entry.NodeId == "" {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "Quarantine entries need a dep_hash or a node_id", fmt.Errorf("empty quarantine entry")).WithErrorCode("invalid_quarantine_entry")
+		}
+		if entry.DepHash != "" {
+			err := validateDepHashes([]string{entry.DepHash})
+			if err != nil {
+				return err
+			}
+		}
+		if entry.NodeId != "" && (len(entry.NodeId) != NODEID_HASH_HEX_SIZE || !isHex(entry.NodeId)) {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid node id", fmt.Errorf("invalid node_id %q", entry.NodeId)).WithErrorCode("invalid_node_id")
+		}
+	}
+
+	changed := []string{}
+	err := s.withResultsConn(auth.UserId, func(rdb *sqlite.Conn) error {
+		return s.changeResults(rdb, auth.UserId, func(version int64) (depHashes []string, err error) {
+			changed, err = change(rdb, auth.UserId, version, req.Entries)
+			return changed, err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	// Rows of several scopes of a dep hash are reported once
+	depHashes := []string{}
+	for _, key := range changed {
+		depHash, _ := splitScopedDepHash(key)
+		if len(depHashes) == 0 || depHashes[len(depHashes)-1] != depHash {
+			depHashes = append(depHashes, depHash)
+		}
+	}
+	*res = ChangeQuarantineResponse{ChangedTestFileHashes: depHashes}
+	return nil
+}
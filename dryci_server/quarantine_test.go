@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	ts := newTestServer(t)
+	publish := func(tests map[string][]string) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", ts.adminToken, PublishRequest{PassedNodeIdsPerTestFile: tests}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	change := func(path string, entries ...QuarantineEntry) []string {
+		t.Helper()
+		var res ChangeQuarantineResponse
+		status := ts.call(ts.public, path, ts.adminToken, ChangeQuarantineRequest{Entries: entries}, &res)
+		if status != http.StatusOK {
+			t.Fatalf("%s = %d", path, status)
+		}
+		return res.ChangedTestFileHashes
+	}
+	checkPassed := func(name string, want [][]string) {
+		t.Helper()
+		got := ts.queryPassed(ts.adminToken, testDepHash(1), testDepHash(2))
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: passed = %v, want %v", name, got, want)
+		}
+	}
+
+	publish(map[string][]string{
+		testDepHash(1): {testNodeId(1), testNodeId(2)},
+		testDepHash(2): {testNodeId(2), testNodeId(3)},
+	})
+	// Warm up the cache, which the quarantine must invalidate
+	checkPassed("before", [][]string{{testNodeId(1), testNodeId(2)}, {testNodeId(2), testNodeId(3)}})
+
+	changed := change("/api/v1/quarantine/add", QuarantineEntry{NodeId: testNodeId(2), Reason: "flaky"})
+	if fmt.Sprint(changed) != fmt.Sprint([]string{testDepHash(1), testDepHash(2)}) {
+		t.Errorf("quarantining a node id changed %v", changed)
+	}
+	checkPassed("node id", [][]string{{testNodeId(1)}, {testNodeId(3)}})
+
+	changed = change("/api/v1/quarantine/add", QuarantineEntry{DepHash: testDepHash(2)}, QuarantineEntry{DepHash: testDepHash(1), NodeId: testNodeId(4)})
+	if fmt.Sprint(changed) != fmt.Sprint([]string{testDepHash(2)}) {
+		t.Errorf("quarantining a dep hash changed %v", changed)
+	}
+	checkPassed("dep hash", [][]string{{testNodeId(1)}, nil})
+
+	// Quarantined passes aren't stored
+	publish(map[string][]string{testDepHash(1): {testNodeId(4), testNodeId(5)}})
+	checkPassed("publish", [][]string{{testNodeId(1), testNodeId(5)}, nil})
+
+	var list ListQuarantineResponse
+	ts.call(ts.public, "/api/v1/quarantine/list", ts.adminToken, ListQuarantineRequest{}, &list)
+	if len(list.Entries) != 3 || list.Entries[0].NodeId != testNodeId(2) || list.Entries[0].Reason != "flaky" || list.Entries[0].CreatedAt == 0 {
+		t.Errorf("quarantine = %+v", list.Entries)
+	}
+
+	// Passes stored before the quarantine come back, the ones published during it don't
+	change("/api/v1/quarantine/remove", QuarantineEntry{NodeId: testNodeId(2)}, QuarantineEntry{DepHash: testDepHash(2)}, QuarantineEntry{DepHash: testDepHash(1), NodeId: testNodeId(4)})
+	checkPassed("after", [][]string{{testNodeId(1), testNodeId(2), testNodeId(5)}, {testNodeId(2), testNodeId(3)}})
+	list = ListQuarantineResponse{}
+	ts.call(ts.public, "/api/v1/quarantine/list", ts.adminToken, ListQuarantineRequest{}, &list)
+	if len(list.Entries) != 0 {
+		t.Errorf("quarantine after removing everything = %+v", list.Entries)
+	}
+
+	tooMany := make([]QuarantineEntry, MAX_QUARANTINE_ENTRIES_PER_REQUEST+1)
+	for i := range tooMany {
+		tooMany[i] = QuarantineEntry{NodeId: testNodeId(i)}
+	}
+	tests := []struct {
+		name       string
+		entries    []QuarantineEntry
+		wantStatus int
+	}{
+		{name: "empty entry", entries: []QuarantineEntry{{Reason: "nothing"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid dep hash", entries: []QuarantineEntry{{DepHash: "abc"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid node id", entries: []QuarantineEntry{{NodeId: "abc"}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "node id that isn't hex", entries: []QuarantineEntry{{NodeId: strings.Repeat("z", NODEID_HASH_HEX_SIZE)}}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "too many entries", entries: tooMany, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		status := ts.call(ts.public, "/api/v1/quarantine/add", ts.adminToken, ChangeQuarantineRequest{Entries: tt.entries}, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+}
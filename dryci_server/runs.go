@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Longest run id, metadata field, label key or value, and outcome
+const MAX_RUN_FIELD_SIZE = 256
+const MAX_RUN_LABELS = 32
+const MAX_RUNS_PER_REQUEST = 1000
+
+func validateRunField(name string, value string) error {
+	if len(value) > MAX_RUN_FIELD_SIZE {
+		return HttpErrWrap(
+			http.StatusUnprocessableEntity,
+			fmt.Sprintf("%s is longer than %d bytes", name, MAX_RUN_FIELD_SIZE),
+			fmt.Errorf("%s of %d bytes", name, len(value)),
+		).WithErrorCode("invalid_run_field")
+	}
+	return nil
+}
+
+func validateRunMetadata(meta RunMetadata) error {
+	for _, field := range []struct{ name, value string }{
+		{"commit", meta.Commit},
+		{"branch", meta.Branch},
+		{"ci_provider", meta.CiProvider},
+		{"ci_job", meta.CiJob},
+		{"environment", meta.Environment},
+	} {
+		err := validateRunField(field.name, field.value)
+		if err != nil {
+			return err
+		}
+	}
+	return validateLabels(meta.Labels)
+}
+
+// validateLabels checks run and token labels.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > MAX_RUN_LABELS {
+		return HttpErrWrap(http.StatusUnprocessableEntity, fmt.Sprintf("More than %d labels", MAX_RUN_LABELS), fmt.Errorf("%d labels", len(labels))).WithErrorCode("too_many_labels")
+	}
+	for key, value := range labels {
+		if key == "" {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "Empty label name", fmt.Errorf("empty label name")).WithErrorCode("invalid_run_field")
+		}
+		err := validateRunField("label name", key)
+		if err == nil {
+			err = validateRunField("label "+key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordRunActivity counts a query or publish towards the run, if there is one.
+func (s *ApiServer) recordRunActivity(auth AuthInfo, runId string, activity RunActivity) {
+	if runId == "" {
+		return
+	}
+	activity.Timestamp = time.Now()
+	activity.UserId = auth.UserId
+	activity.TokenId = auth.TokenId
+	activity.RunId = runId
+	s.enqueue(&activity)
+}
+
+type BeginRunRequest struct {
+	// Generated if empty. Runs that begin again with the same id have their metadata updated.
+	RunId    string      `json:"run_id,omitempty"`
+	Metadata RunMetadata `json:"metadata"`
+}
+
+type BeginRunResponse struct {
+	// Send it to /api/v1/query-passed and /api/v1/publish
+	RunId string `json:"run_id"`
+}
+
+const BEGIN_RUN_DOC = `Begin a run, to group the queries and publishes sent with its run_id and describe them for /api/v1/runs/list.
+Beginning a run is optional, runs are also created by the first query or publish with their run_id, without metadata.
+Every process of a run may begin it, non-empty fields replace the old ones and labels are merged.
+Like publishes, runs are recorded in the background, so they show up in /api/v1/runs/list a moment later.
+
+Example request:
+    {
+        "run_id": "4f1c0e2a9d7b4c55",
+        "metadata": {
+            "commit": "9fceb02d0ae598e95dc970b74767f19372d61af8",
+            "branch": "main",
+            "ci_provider": "github-actions",
+            "ci_job": "tests",
+            "environment": "linux-x86_64",
+            "labels": {"python": "3.12"}
+        }
+    }
+
+Example response:
+    {"run_id": "4f1c0e2a9d7b4c55"}`
+
+func (s *ApiServer) BeginRunHandler(_ *sqlite.Conn, req *BeginRunRequest, res *BeginRunResponse, auth AuthInfo) error {
+	err := validateRunField("run_id", req.RunId)
+	if err != nil {
+		return err
+	}
+	err = validateRunMetadata(req.Metadata)
+	if err != nil {
+		return err
+	}
+	runId := req.RunId
+	if runId == "" {
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		if err != nil {
+			return fmt.Errorf("failed to generate run id: %w", err)
+		}
+		runId = hex.EncodeToString(b)
+	}
+	s.enqueue(&RunBegin{
+		Timestamp: time.Now(),
+		UserId:    auth.UserId,
+		TokenId:   auth.TokenId,
+		RunId:     runId,
+		Metadata:  req.Metadata,
+	})
+	*res = BeginRunResponse{RunId: runId}
+	return nil
+}
+
+type EndRunRequest struct {
+	RunId string `json:"run_id"`
+	// Free-form, e.g. "passed" or "failed"
+	Outcome string `json:"outcome,omitempty"`
+}
+
+type EndRunResponse struct {
+}
+
+func (s *ApiServer) EndRunHandler(_ *sqlite.Conn, req *EndRunRequest, res *EndRunResponse, auth AuthInfo) error {
+	*res = EndRunResponse{}
+	if req.RunId == "" {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Missing run_id", fmt.Errorf("missing run_id")).WithErrorCode("invalid_run_field")
+	}
+	err := validateRunField("run_id", req.RunId)
+	if err == nil {
+		err = validateRunField("outcome", req.Outcome)
+	}
+	if err != nil {
+		return err
+	}
+	s.enqueue(&RunEnd{
+		Timestamp: time.Now(),
+		UserId:    auth.UserId,
+		TokenId:   auth.TokenId,
+		RunId:     req.RunId,
+		Outcome:   req.Outcome,
+	})
+	return nil
+}
+
+type ListRunsRequest struct {
+	// Only list runs whose metadata has these values and labels, empty fields match everything
+	Filter RunMetadata `json:"filter"`
+	// Only list runs that started before this unix timestamp, to page through them
+	StartedBefore int64 `json:"started_before,omitempty"`
+	// Also list the runs that started at started_before, ordered after this run id. To get the
+	// next page, send the started_at and run_id of the last run, since runs can share a second.
+	AfterRunId string `json:"after_run_id,omitempty"`
+	// Defaults to 100
+	Limit int `json:"limit,omitempty"`
+}
+
+type ListRunsResponse struct {
+	Runs []Run `json:"runs"`
+}
+
+func (s *ApiServer) ListRunsHandler(db *sqlite.Conn, req *ListRunsRequest, res *ListRunsResponse, auth AuthInfo) error {
+	limit, err := validateLimit(req.Limit, MAX_RUNS_PER_REQUEST)
+	if err == nil {
+		err = validateRunMetadata(req.Filter)
+	}
+	if err == nil {
+		err = validateRunField("after_run_id", req.AfterRunId)
+	}
+	if err != nil {
+		return err
+	}
+	runs, err := ListRuns(db, auth.UserId, req.Filter, req.StartedBefore, req.AfterRunId, limit)
+	if err != nil {
+		return err
+	}
+	*res = ListRunsResponse{Runs: runs}
+	return nil
+}
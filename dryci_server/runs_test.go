@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+func TestRuns(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.createUser("user@example.com", false)
+	call := func(path string, req interface{}, res interface{}) {
+		t.Helper()
+		status := ts.call(ts.public, path, token, req, res)
+		if status != http.StatusOK {
+			t.Fatalf("%s = %d", path, status)
+		}
+		ts.applyBackground()
+	}
+
+	var begun BeginRunResponse
+	call("/api/v1/runs/begin", BeginRunRequest{Metadata: RunMetadata{Branch: "main"}}, &begun)
+	if len(begun.RunId) != 32 {
+		t.Errorf("generated run id %q", begun.RunId)
+	}
+	// Beginning again merges the metadata
+	call("/api/v1/runs/begin", BeginRunRequest{RunId: "run-1", Metadata: RunMetadata{Commit: "abc", Branch: "main", Labels: map[string]string{"python": "3.12"}}}, nil)
+	call("/api/v1/runs/begin", BeginRunRequest{RunId: "run-1", Metadata: RunMetadata{CiJob: "tests", Labels: map[string]string{"os": "linux"}}}, nil)
+	call("/api/v1/query-passed", QueryPassedRequest{TestFileHashes: []string{testDepHash(1)}, RunId: "run-1"}, nil)
+	call("/api/v1/publish", PublishRequest{
+		PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(1)}},
+		RunId:                    "run-1",
+		TotalTestCount:           3,
+		PassedTestCount:          1,
+		SkippedByCacheTestCount:  2,
+	}, nil)
+	call("/api/v1/runs/end", EndRunRequest{RunId: "run-1", Outcome: "passed"}, nil)
+	// Runs that didn't begin are created by their first query or publish
+	call("/api/v1/query-passed", QueryPassedRequest{TestFileHashes: []string{testDepHash(1)}, RunId: "run-2"}, nil)
+
+	var res ListRunsResponse
+	call("/api/v1/runs/list", ListRunsRequest{Filter: RunMetadata{Branch: "main", Labels: map[string]string{"os": "linux"}}}, &res)
+	if len(res.Runs) != 1 {
+		t.Fatalf("runs = %+v", res.Runs)
+	}
+	run := res.Runs[0]
+	wantMeta := RunMetadata{Commit: "abc", Branch: "main", CiJob: "tests", Labels: map[string]string{"python": "3.12", "os": "linux"}}
+	if run.RunId != "run-1" || fmt.Sprint(run.Metadata) != fmt.Sprint(wantMeta) || run.TokenId != ts.tokenId(token) {
+		t.Errorf("run = %+v", run)
+	}
+	if run.QueryCount != 1 || run.PublishCount != 1 || run.TestCounts != (RunTestCounts{Total: 3, Passed: 1, SkippedByCache: 2}) {
+		t.Errorf("run counts = %+v", run)
+	}
+	if run.Outcome != "passed" || run.EndedAt == 0 || run.StartedAt == 0 || run.LastSeenAt < run.StartedAt {
+		t.Errorf("run times = %+v", run)
+	}
+
+	// Runs starting in the same second are paged by run id
+	got := []string{}
+	var startedBefore int64
+	afterRunId := ""
+	for i := 0; i < 4; i++ {
+		res = ListRunsResponse{}
+		call("/api/v1/runs/list", ListRunsRequest{StartedBefore: startedBefore, AfterRunId: afterRunId, Limit: 1}, &res)
+		if len(res.Runs) == 0 {
+			break
+		}
+		got = append(got, res.Runs[0].RunId)
+		startedBefore, afterRunId = res.Runs[0].StartedAt, res.Runs[0].RunId
+	}
+	sort.Strings(got)
+	if want := []string{begun.RunId, "run-1", "run-2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("paged runs = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		req  interface{}
+	}{
+		{name: "end without a run id", path: "/api/v1/runs/end", req: EndRunRequest{Outcome: "passed"}},
+		{name: "long run id", path: "/api/v1/runs/begin", req: BeginRunRequest{RunId: strings.Repeat("a", MAX_RUN_FIELD_SIZE+1)}},
+		{name: "long run id on publish", path: "/api/v1/publish", req: PublishRequest{RunId: strings.Repeat("a", MAX_RUN_FIELD_SIZE+1)}},
+		{name: "empty label name", path: "/api/v1/runs/begin", req: BeginRunRequest{Metadata: RunMetadata{Labels: map[string]string{"": "x"}}}},
+		{name: "long label", path: "/api/v1/runs/begin", req: BeginRunRequest{Metadata: RunMetadata{Labels: map[string]string{"a": strings.Repeat("a", MAX_RUN_FIELD_SIZE+1)}}}},
+		{name: "limit too large", path: "/api/v1/runs/list", req: ListRunsRequest{Limit: MAX_RUNS_PER_REQUEST + 1}},
+	}
+	for _, tt := range tests {
+		status := ts.call(ts.public, tt.path, token, tt.req, nil)
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d, want 422", tt.name, status)
+		}
+	}
+
+	// The gc job deletes runs that weren't seen for -run-ttl
+	ts.withConn(func(db *sqlite.Conn) {
+		var count int
+		err := DbTxn(db, true, func() (err error) {
+			count, err = DeleteOldRuns(db, time.Now().Add(time.Hour))
+			return err
+		})
+		if err != nil || count != 3 {
+			t.Errorf("DeleteOldRuns = %d, %v", count, err)
+		}
+	})
+}
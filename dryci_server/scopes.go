@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+)
+
+const MAX_SCOPE_SIZE = 128
+const MAX_SCOPE_FALLBACKS = 8
+
+// Results published with a scope, e.g. a branch, are kept apart from the unscoped ones in
+// test_results rows keyed "<dep_hash>@<scope>", so they share the cache, versions, GC and
+// provenance of unscoped rows. A query with a scope sees the union of the scope, the
+// namespace's fallback scopes and the unscoped results, its scope chain.
+
+func scopedDepHash(depHash string, scope string) string {
+	if scope == "" {
+		return depHash
+	}
+	return depHash + "@" + scope
+}
+
+func splitScopedDepHash(key string) (depHash string, scope string) {
+	if len(key) > DEP_HASH_HEX_SIZE && key[DEP_HASH_HEX_SIZE] == '@' {
+		return key[:DEP_HASH_HEX_SIZE], key[DEP_HASH_HEX_SIZE+1:]
+	}
+	return key, ""
+}
+
+// validDepHashKey checks the length of a dep hash, scoped or not.
+func validDepHashKey(key string) bool {
+	depHash, _ := splitScopedDepHash(key)
+	return len(depHash) == DEP_HASH_HEX_SIZE
+}
+
+// scopeTests rekeys node ids per dep hash to the scope's rows.
+func scopeTests(tests map[string][]string, scope string) map[string][]string {
+	if scope == "" {
+		return tests
+	}
+	scoped := make(map[string][]string, len(tests))
+	for depHash, nodeIds := range tests {
+		scoped[scopedDepHash(depHash, scope)] = nodeIds
+	}
+	return scoped
+}
+
+func validateScope(scope string) error {
+	if len(scope) > MAX_SCOPE_SIZE {
+		return HttpErrWrap(
+			http.StatusUnprocessableEntity,
+			fmt.Sprintf("scope is longer than %d bytes", MAX_SCOPE_SIZE),
+			fmt.Errorf("scope of %d bytes", len(scope)),
+		).WithErrorCode("invalid_scope")
+	}
+	return nil
+}
+
+// parseScopeFallbacks parses -scope-fallbacks.
+func parseScopeFallbacks(flagValue string) []string {
+	fallbacks := []string{}
+	for _, scope := range strings.Split(flagValue, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			fallbacks = append(fallbacks, scope)
+		}
+	}
+	return fallbacks
+}
+
+// scopeChain returns the scopes a query with `scope` sees, most specific first. It always
+// ends with the unscoped results, "".
+func (s *ApiServer) scopeChain(db *sqlite.Conn, userId int, scope string) ([]string, error) {
+	if scope == "" {
+		return []string{""}, nil
+	}
+	policy, err := GetNamespacePolicy(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	fallbacks := policy.ScopeFallbacks
+	if fallbacks == nil {
+		fallbacks = parseScopeFallbacks(*scopeFallbacks)
+	}
+	chain := []string{scope}
+	for _, fallback := range fallbacks {
+		if fallback != scope && fallback != "" {
+			chain = append(chain, fallback)
+		}
+	}
+	return append(chain, ""), nil
+}
+
+// queryScoped is queryPassed over a scope chain. Besides the merged node ids and versions per
+// dep hash, it returns the rows it read and their versions, which identify the response.
+//
+// A merged dep hash has the latest version of its rows, since a change to any of them gets a
+// newer version. Deleting a row doesn't, so dep hashes with a row missing get version 0 and
+// are always returned in full.
+func (s *ApiServer) queryScoped(db *sqlite.Conn, userId int, userVersion int64, depHashes []string, scopes []string, trust *trustFilter, minPublishedAt int64) (nodeIds [][]string, versions []int64, keys []string, keyVersions []int64, err error) {
+	if len(scopes) == 1 && scopes[0] == "" {
+		nodeIds, versions, err = s.queryPassed(db, userId, userVersion, depHashes, trust, minPublishedAt)
+		return nodeIds, versions, depHashes, versions, err
+	}
+	keys = make([]string, 0, len(depHashes)*len(scopes))
+	for _, depHash := range depHashes {
+		for _, scope := range scopes {
+			keys = append(keys, scopedDepHash(depHash, scope))
+		}
+	}
+	keyNodeIds, keyVersions, err := s.queryPassed(db, userId, userVersion, keys, trust, minPublishedAt)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	nodeIds = make([][]string, len(depHashes))
+	versions = make([]int64, len(depHashes))
+	for i := range depHashes {
+		rows := keyNodeIds[i*len(scopes) : (i+1)*len(scopes)]
+		rowVersions := keyVersions[i*len(scopes) : (i+1)*len(scopes)]
+		seen := map[string]bool{}
+		nodeIds[i] = []string{}
+		missing := false
+		for j, ids := range rows {
+			missing = missing || rowVersions[j] == 0
+			versions[i] = max(versions[i], rowVersions[j])
+			for _, nodeId := range ids {
+				if !seen[nodeId] {
+					seen[nodeId] = true
+					nodeIds[i] = append(nodeIds[i], nodeId)
+				}
+			}
+		}
+		if missing {
+			versions[i] = 0
+		}
+	}
+	return nodeIds, versions, keys, keyVersions, nil
+}
+
+// scopeGcWhere selects the rows of scopes that weren't published since `before` for
+// deleteResults, except the fallback scopes of their namespace.
+func scopeGcWhere(fallbacks map[int][]string, before int64) (string, []interface{}) {
+	perUser := map[string][]string{}
+	for userId, scopes := range fallbacks {
+		perUser[fmt.Sprint(userId)] = scopes
+	}
+	perUserJson, _ := json.Marshal(perUser)
+	defaultJson, _ := json.Marshal(parseScopeFallbacks(*scopeFallbacks))
+	where := `instr(dep_hash, '@') > 0
+		AND substr(dep_hash, 66) NOT IN (
+			SELECT value FROM json_each(IFNULL(json_extract(?1, '$."' || user_id || '"'), ?2))
+		)
+		AND (user_id, substr(dep_hash, 66)) IN (
+			SELECT user_id, substr(dep_hash, 66) FROM test_results WHERE instr(dep_hash, '@') > 0
+			GROUP BY user_id, substr(dep_hash, 66) HAVING MAX(accessed_at) < ?3
+		)`
+	return where, []interface{}{string(perUserJson), string(defaultJson), before}
+}
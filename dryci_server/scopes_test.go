@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+func TestParseScopeFallbacks(t *testing.T) {
+	tests := []struct {
+		flagValue string
+		want      []string
+	}{
+		{flagValue: "", want: []string{}},
+		{flagValue: "main", want: []string{"main"}},
+		{flagValue: " main , release,,", want: []string{"main", "release"}},
+	}
+	for _, tt := range tests {
+		got := parseScopeFallbacks(tt.flagValue)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseScopeFallbacks(%q) = %v, want %v", tt.flagValue, got, tt.want)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	status := ts.call(ts.admin, "/admin/api/v1/set-namespace-policy", ts.adminToken, SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{ScopeFallbacks: []string{"main"}}}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("set-namespace-policy = %d", status)
+	}
+	publish := func(req PublishRequest) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", token, req, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	passed := func(nodeIds ...int) map[string][]string {
+		tests := map[string][]string{testDepHash(1): {}}
+		for _, id := range nodeIds {
+			tests[testDepHash(1)] = append(tests[testDepHash(1)], testNodeId(id))
+		}
+		return tests
+	}
+	checkPassed := func(name string, want map[string][]string) {
+		t.Helper()
+		for scope, wantIds := range want {
+			var res QueryPassedResponse
+			status := ts.call(ts.public, "/api/v1/query-passed", token, QueryPassedRequest{TestFileHashes: []string{testDepHash(1)}, Scope: scope}, &res)
+			if status != http.StatusOK {
+				t.Fatalf("query-passed = %d", status)
+			}
+			got := res.NodeIds[0]
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(wantIds) {
+				t.Errorf("%s: passed in scope %q = %v, want %v", name, scope, got, wantIds)
+			}
+		}
+	}
+
+	publish(PublishRequest{PassedNodeIdsPerTestFile: passed(1), Scope: "main"})
+	publish(PublishRequest{PassedNodeIdsPerTestFile: passed(2)})
+	publish(PublishRequest{PassedNodeIdsPerTestFile: passed(3), Scope: "feature"})
+	publish(PublishRequest{PassedNodeIdsPerTestFile: passed(4), Scope: "other"})
+	checkPassed("published", map[string][]string{
+		"":        {testNodeId(2)},
+		"main":    {testNodeId(1), testNodeId(2)},
+		"feature": {testNodeId(1), testNodeId(2), testNodeId(3)},
+		"other":   {testNodeId(1), testNodeId(2), testNodeId(4)},
+	})
+
+	// A failure on the feature branch contradicts the pass it saw on main
+	publish(PublishRequest{FailedNodeIdsPerTestFile: passed(1), Scope: "feature"})
+	checkPassed("failed", map[string][]string{
+		"main":    {testNodeId(2)},
+		"feature": {testNodeId(2), testNodeId(3)},
+	})
+
+	// Streams and sessions publish to scopes too
+	body := fmt.Sprintf("{\"dep_hash\": %q, \"node_ids\": [%q]}\n", testDepHash(1), testNodeId(5))
+	rec := ts.do(ts.public, "POST", "/api/v1/publish-stream?scope=feature&run_id=run-1", token, []byte(body), nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("publish-stream = %d %s", rec.Code, rec.Body.String())
+	}
+	var session PublishSessionBeginResponse
+	ts.call(ts.public, "/api/v1/publish-session/begin", token, PublishSessionBeginRequest{}, &session)
+	ts.call(ts.public, "/api/v1/publish-session/append", token, PublishSessionAppendRequest{SessionId: session.SessionId, PassedNodeIdsPerTestFile: passed(6)}, nil)
+	status = ts.call(ts.public, "/api/v1/publish-session/commit", token, PublishSessionCommitRequest{SessionId: session.SessionId, ChunkCount: 1, Scope: "feature", RunId: "run-1"}, nil)
+	if status != http.StatusOK {
+		t.Errorf("publish-session/commit = %d", status)
+	}
+	ts.applyBackground()
+	checkPassed("stream and session", map[string][]string{
+		"":        {testNodeId(2)},
+		"feature": {testNodeId(2), testNodeId(3), testNodeId(5), testNodeId(6)},
+	})
+	var runs ListRunsResponse
+	ts.call(ts.public, "/api/v1/runs/list", token, ListRunsRequest{}, &runs)
+	if len(runs.Runs) != 1 || runs.Runs[0].PublishCount != 2 {
+		t.Errorf("runs = %+v", runs.Runs)
+	}
+
+	// Scopes that weren't published to are deleted, except fallbacks
+	publish(PublishRequest{PassedNodeIdsPerTestFile: passed(7), Scope: "main"})
+	where, args := scopeGcWhere(map[int][]string{userId: {"main"}}, time.Now().Add(time.Minute).Unix())
+	ts.withConn(func(db *sqlite.Conn) {
+		deleted, err := ts.deleteResults(db, where, args...)
+		got := []string{}
+		for _, key := range deleted {
+			got = append(got, key.depHash)
+		}
+		sort.Strings(got)
+		want := []string{scopedDepHash(testDepHash(1), "feature"), scopedDepHash(testDepHash(1), "other")}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("deleted %v, %v, want %v", got, err, want)
+		}
+	})
+	checkPassed("gc", map[string][]string{
+		"main":    {testNodeId(2), testNodeId(7)},
+		"feature": {testNodeId(2), testNodeId(7)},
+	})
+
+	// Invalidating node ids removes them from every scope
+	var invalidated InvalidateResponse
+	ts.callApplying(ts.public, "/api/v1/invalidate", token, InvalidateRequest{NodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(2), testNodeId(7)}}}, &invalidated)
+	got := []string{}
+	for _, entry := range invalidated.Invalidated {
+		got = append(got, entry.Scope)
+	}
+	if fmt.Sprint(got) != "[ main]" {
+		t.Errorf("invalidated scopes = %v", got)
+	}
+	checkPassed("invalidated", map[string][]string{"feature": {}})
+
+	tests := []struct {
+		name  string
+		admin bool
+		path  string
+		req   interface{}
+	}{
+		{name: "long query scope", path: "/api/v1/query-passed", req: QueryPassedRequest{Scope: strings.Repeat("a", MAX_SCOPE_SIZE+1)}},
+		{name: "long publish scope", path: "/api/v1/publish", req: PublishRequest{Scope: strings.Repeat("a", MAX_SCOPE_SIZE+1)}},
+		{name: "scoped dep hash", path: "/api/v1/query-passed", req: QueryPassedRequest{TestFileHashes: []string{testDepHash(1) + "@main"}}},
+		{name: "empty fallback", admin: true, path: "/admin/api/v1/set-namespace-policy", req: SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{ScopeFallbacks: []string{""}}}},
+		{name: "too many fallbacks", admin: true, path: "/admin/api/v1/set-namespace-policy", req: SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{ScopeFallbacks: make([]string, MAX_SCOPE_FALLBACKS+1)}}},
+	}
+	for _, tt := range tests {
+		mux, token := ts.public, token
+		if tt.admin {
+			mux, token = ts.admin, ts.adminToken
+		}
+		status := ts.call(mux, tt.path, token, tt.req, nil)
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d, want 422", tt.name, status)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// How long a query waits for a connection to a result shard
+const SHARD_TAKE_TIMEOUT = 10 * time.Second
+
+// With -result-shards, test results (test_results and result_versions) live in their own
+// SQLite files, each with its own background worker, so a heavy user's publishes only hold
+// the write lock of their shard. Users, tokens, usage and everything else stay in the control
+// database. Shards have the full schema, but only their test results are used.
+type resultShard struct {
+	name   string
+	dbPool *sqlitex.Pool
+	worker *backgroundWorker
+}
+
+// resultsTask is implemented by background tasks that write test results, which are applied
+// by the user's shard worker.
+type resultsTask interface {
+	BackgroundTask
+	writesResults()
+}
+
+func resultShardPath(i int) string {
+	return fmt.Sprintf("%s.shard-%d.db", strings.TrimSuffix(*dbPath, ".db"), i)
+}
+
+func openResultShards(count int) ([]*resultShard, error) {
+	shards := []*resultShard{}
+	for i := 0; i < count; i++ {
+		path := resultShardPath(i)
+		dbPool, err := OpenDbPool(path)
+		if err == nil {
+			err = MigrateDb(dbPool, *dbDowngrade, false)
+			if err != nil {
+				dbPool.Close()
+			}
+		}
+		if err != nil {
+			closeResultShards(shards)
+			return nil, fmt.Errorf("result shard %s: %w", path, err)
+		}
+		worker := newBackgroundWorkers(1, dbPool)[0]
+		shards = append(shards, &resultShard{name: fmt.Sprintf("shard-%d", i), dbPool: dbPool, worker: worker})
+	}
+	return shards, nil
+}
+
+func closeResultShards(shards []*resultShard) {
+	for _, shard := range shards {
+		shard.dbPool.Close()
+	}
+}
+
+// resultShardFor returns the shard holding the user's test results, nil if results aren't sharded.
+func (s *ApiServer) resultShardFor(userId int) *resultShard {
+	if len(s.resultShards) == 0 {
+		return nil
+	}
+	return s.resultShards[uint(userId)%uint(len(s.resultShards))]
+}
+
+// resultsPool returns the pool of the database holding the user's test results.
+func (s *ApiServer) resultsPool(userId int) *sqlitex.Pool {
+	if shard := s.resultShardFor(userId); shard != nil {
+		return shard.dbPool
+	}
+	return s.dbPool
+}
+
+// withResultsConn runs f with a connection of its own to the user's test results, for
+// writes outside of the request's transaction.
+func (s *ApiServer) withResultsConn(userId int, f func(rdb *sqlite.Conn) error) error {
+	return s.withConn(s.resultsPool(userId), f)
+}
+
+// withConn runs f with a connection of its own from the pool.
+func (s *ApiServer) withConn(pool *sqlitex.Pool, f func(db *sqlite.Conn) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SHARD_TAKE_TIMEOUT)
+	defer cancel()
+	db, err := pool.Take(ctx)
+	if err != nil {
+		return HttpErrWrap(http.StatusServiceUnavailable, "Server overloaded, try again later", err).WithErrorCode("overloaded")
+	}
+	defer pool.Put(db)
+	return f(db)
+}
+
+// withResultsDb runs f with a connection to the user's test results: `db` itself when results
+// aren't sharded, otherwise a read transaction on the user's shard.
+func (s *ApiServer) withResultsDb(db *sqlite.Conn, userId int, f func(rdb *sqlite.Conn) error) error {
+	shard := s.resultShardFor(userId)
+	if shard == nil {
+		return f(db)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SHARD_TAKE_TIMEOUT)
+	defer cancel()
+	rdb, err := shard.dbPool.Take(ctx)
+	if err != nil {
+		return HttpErrWrap(http.StatusServiceUnavailable, "Server overloaded, try again later", err).WithErrorCode("overloaded")
+	}
+	defer shard.dbPool.Put(rdb)
+	return DbTxn(rdb, false, func() error {
+		return f(rdb)
+	})
+}
+
+// forEachResultsDb runs f on every database holding test results: the control database `db`
+// when results aren't sharded, otherwise each shard. Shard connections are interrupted when
+// ctx is done, like the caller's.
+func (s *ApiServer) forEachResultsDb(ctx context.Context, db *sqlite.Conn, f func(name string, rdb *sqlite.Conn) error) error {
+	if len(s.resultShards) == 0 {
+		return f("control", db)
+	}
+	for _, shard := range s.resultShards {
+		err := s.withShardConn(ctx, shard, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachDb runs f on the control database `db`, then on every result shard.
+func (s *ApiServer) forEachDb(ctx context.Context, db *sqlite.Conn, f func(name string, db *sqlite.Conn) error) error {
+	err := f("control", db)
+	if err != nil {
+		return err
+	}
+	for _, shard := range s.resultShards {
+		err := s.withShardConn(ctx, shard, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ApiServer) withShardConn(ctx context.Context, shard *resultShard, f func(name string, db *sqlite.Conn) error) error {
+	rdb, err := shard.dbPool.Take(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to take connection to %s: %w", shard.name, err)
+	}
+	defer shard.dbPool.Put(rdb)
+	rdb.SetInterrupt(ctx.Done())
+	defer rdb.SetInterrupt(nil)
+	err = f(shard.name, rdb)
+	if err != nil {
+		return fmt.Errorf("%s: %w", shard.name, err)
+	}
+	return nil
+}
+
+// allWorkers returns the control workers followed by the shard workers.
+func (s *ApiServer) allWorkers() []*backgroundWorker {
+	workers := append([]*backgroundWorker{}, s.bgWorkers...)
+	for _, shard := range s.resultShards {
+		workers = append(workers, shard.worker)
+	}
+	return workers
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// shardResults moves the test server's results to `count` result shards.
+func (ts *testServer) shardResults(count int) {
+	ts.t.Helper()
+	defer func(path string) { *dbPath = path }(*dbPath)
+	*dbPath = filepath.Join(ts.t.TempDir(), "dryci.db")
+	shards, err := openResultShards(count)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() { closeResultShards(shards) })
+	ts.resultShards = shards
+}
+
+func countResults(t *testing.T, pool *sqlitex.Pool) int {
+	t.Helper()
+	count := 0
+	err := func() error {
+		db, err := pool.Take(context.Background())
+		if err != nil {
+			return err
+		}
+		defer pool.Put(db)
+		return sqlitex.Execute(db, "SELECT COUNT(*) FROM test_results", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				count = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestResultShards(t *testing.T) {
+	defer func(maxAttempts int) { *bgMaxAttempts = maxAttempts }(*bgMaxAttempts)
+	*bgMaxAttempts = 1
+	ts := newTestServer(t)
+	ts.shardResults(2)
+	// Consecutive ids land in different shards
+	_, token1 := ts.createUser("one@example.com", false)
+	userId2, token2 := ts.createUser("two@example.com", false)
+
+	for i, token := range []string{token1, token2} {
+		status := ts.call(ts.public, "/api/v1/publish", token, PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(i)}}}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+	}
+	// Fails in the shard, but the dead letter goes to the control database
+	ts.enqueue(ts.newPublishTask(AuthInfo{UserId: userId2}, map[string][]string{testDepHash(2): {"short"}}))
+	ts.applyBackground()
+
+	for i, token := range []string{token1, token2} {
+		got := ts.queryPassed(token, testDepHash(1))
+		if fmt.Sprint(got) != fmt.Sprint([][]string{{testNodeId(i)}}) {
+			t.Errorf("user %d: passed = %v", i+1, got)
+		}
+	}
+	if count := countResults(t, ts.dbPool); count != 0 {
+		t.Errorf("control database has %d results", count)
+	}
+	for _, shard := range ts.resultShards {
+		if count := countResults(t, shard.dbPool); count != 1 {
+			t.Errorf("%s has %d results, want 1", shard.name, count)
+		}
+	}
+	ts.withConn(func(db *sqlite.Conn) {
+		deadLetters, err := ListDeadLetters(db, nil, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deadLetters) != 1 || deadLetters[0].ShardKey != userId2 {
+			t.Errorf("dead letters = %+v", deadLetters)
+		}
+	})
+}
+
+func TestCheckResultShards(t *testing.T) {
+	tests := []struct {
+		name       string
+		hasResults bool
+		shards     []int
+		// Whether each check of shards fails
+		wantErr []bool
+	}{
+		{name: "unsharded", shards: []int{0, 0, 2}, wantErr: []bool{false, false, true}},
+		{name: "sharded", shards: []int{2, 2, 3, 0}, wantErr: []bool{false, false, true, true}},
+		{name: "existing results were unsharded", hasResults: true, shards: []int{2, 0}, wantErr: []bool{true, false}},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t)
+		ts.withConn(func(db *sqlite.Conn) {
+			if tt.hasResults {
+				err := DbTxn(db, true, func() error {
+					return PublishTestHashes(db, 1, 1, map[string][]string{testDepHash(1): {testNodeId(1)}}, nil)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, shards := range tt.shards {
+				err := DbTxn(db, true, func() error {
+					return CheckResultShards(db, shards)
+				})
+				if (err != nil) != tt.wantErr[i] {
+					t.Errorf("%s: check %d with %d shards = %v, want error %v", tt.name, i, shards, err, tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
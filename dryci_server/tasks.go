@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// BackgroundTask is a database write that's queued and applied in batches by a background
+// worker, so request handlers don't wait for the write lock.
+type BackgroundTask interface {
+	// Kind names the task in metrics, logs and the dead letter table
+	Kind() string
+	// Tasks with the same shard key are applied by the same worker, in order
+	ShardKey() int
+	// Apply runs in its own savepoint within the batch's transaction
+	Apply(db *sqlite.Conn) error
+}
+
+// batchedTask is implemented by tasks that share state with the rest of their batch, see
+// taskBatch. setBatch is called before each attempt.
+type batchedTask interface {
+	setBatch(batch *taskBatch)
+}
+
+// coalescingTask is implemented by tasks that are cheaper to apply merged. Before a batch is
+// applied, these tasks are split into parts, and parts with the same key are merged, unless
+// Merge returns false because applying them merged wouldn't be the same as in order.
+type coalescingTask interface {
+	BackgroundTask
+	Split() []coalescingTask
+	CoalesceKey() string
+	Merge(other coalescingTask) bool
+}
+
+// awaitedTask is implemented by tasks a request waits for. finished is called once the task
+// is committed, or with its error once it's out of attempts, instead of moving it to the dead
+// letter table.
+type awaitedTask interface {
+	finished(err error)
+}
+
+// -- Tasks --
+
+type UsageRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	UserId    int       `json:"user_id"`
+	Usage     Usage     `json:"usage"`
+}
+
+func (t *UsageRecord) Kind() string  { return "usage" }
+func (t *UsageRecord) ShardKey() int { return t.UserId }
+
+func (t *UsageRecord) Apply(db *sqlite.Conn) error {
+	return RecordUsage(db, t.UserId, t.Usage, t.Timestamp)
+}
+
+// RunActivity counts a query or publish sent with a run_id, see /api/v1/runs/list.
+type RunActivity struct {
+	Timestamp  time.Time     `json:"timestamp"`
+	UserId     int           `json:"user_id"`
+	TokenId    int64         `json:"token_id"`
+	RunId      string        `json:"run_id"`
+	Queries    int           `json:"queries,omitempty"`
+	Publishes  int           `json:"publishes,omitempty"`
+	TestCounts RunTestCounts `json:"test_counts"`
+}
+
+func (t *RunActivity) Kind() string  { return "run_activity" }
+func (t *RunActivity) ShardKey() int { return t.UserId }
+
+func (t *RunActivity) Apply(db *sqlite.Conn) error {
+	return RecordRunActivity(db, t.UserId, t.TokenId, t.RunId, t.Queries, t.Publishes, t.TestCounts, t.Timestamp)
+}
+
+// RunBegin records a run's metadata, see /api/v1/runs/begin.
+type RunBegin struct {
+	Timestamp time.Time   `json:"timestamp"`
+	UserId    int         `json:"user_id"`
+	TokenId   int64       `json:"token_id"`
+	RunId     string      `json:"run_id"`
+	Metadata  RunMetadata `json:"metadata"`
+}
+
+func (t *RunBegin) Kind() string  { return "run_begin" }
+func (t *RunBegin) ShardKey() int { return t.UserId }
+
+func (t *RunBegin) Apply(db *sqlite.Conn) error {
+	return BeginRun(db, t.UserId, t.TokenId, t.RunId, t.Metadata, t.Timestamp)
+}
+
+// RunEnd records a run's outcome, see /api/v1/runs/end.
+type RunEnd struct {
+	Timestamp time.Time `json:"timestamp"`
+	UserId    int       `json:"user_id"`
+	TokenId   int64     `json:"token_id"`
+	RunId     string    `json:"run_id"`
+	Outcome   string    `json:"outcome,omitempty"`
+}
+
+func (t *RunEnd) Kind() string  { return "run_end" }
+func (t *RunEnd) ShardKey() int { return t.UserId }
+
+func (t *RunEnd) Apply(db *sqlite.Conn) error {
+	return EndRun(db, t.UserId, t.TokenId, t.RunId, t.Outcome, t.Timestamp)
+}
+
+type PublishTask struct {
+	UserId int `json:"user_id"`
+	// The token that published the results, recorded with run_id as their provenance
+	TokenId int64 `json:"token_id,omitempty"`
+	// Passed node ids per dep hash
+	Tests   map[string][]string `json:"tests"`
+	Failed  map[string][]string `json:"failed,omitempty"`
+	Errored map[string][]string `json:"errored,omitempty"`
+	// The run's canaries are sampled if both are set
+	RunId      string  `json:"run_id,omitempty"`
+	CanaryRate float64 `json:"canary_rate,omitempty"`
+	// The scope chain of the publish, see scopeChain. Passes are published to the first
+	// scope, failures contradict passes in any of them. Empty for the unscoped results.
+	Scopes []string `json:"scopes,omitempty"`
+	// Seconds until the passes of a dep hash expire, from when they're applied
+	Ttls  map[string]int64 `json:"ttls,omitempty"`
+	batch *taskBatch
+}
+
+func (s *ApiServer) newPublishTask(auth AuthInfo, tests map[string][]string) *PublishTask {
+	return &PublishTask{UserId: auth.UserId, TokenId: auth.TokenId, Tests: tests}
+}
+
+// setPublishTaskRun publishes the task to the scope's chain, and samples canaries of the run.
+func (s *ApiServer) setPublishTaskRun(db *sqlite.Conn, task *PublishTask, scope string, runId string) error {
+	if scope != "" {
+		var err error
+		task.Scopes, err = s.scopeChain(db, task.UserId, scope)
+		if err != nil {
+			return err
+		}
+	}
+	if runId != "" {
+		rate, err := s.canaryRate(db, task.UserId)
+		if err != nil {
+			return err
+		}
+		task.RunId = runId
+		task.CanaryRate = rate
+	}
+	return nil
+}
+
+func (t *PublishTask) scopes() []string {
+	if len(t.Scopes) == 0 {
+		return []string{""}
+	}
+	return t.Scopes
+}
+
+func (t *PublishTask) Kind() string   { return "publish" }
+func (t *PublishTask) ShardKey() int  { return t.UserId }
+func (t *PublishTask) writesResults() {}
+
+// Apply publishes the passed node ids. A failed or errored node id that's in the user's
+// results means the dep hash doesn't capture all of the test's dependencies, and keeping it
+// would hide a real failure, so it's removed and recorded as a hermeticity violation. Node
+// ids that failed in the same task aren't published, even if they also passed.
+func (t *PublishTask) Apply(db *sqlite.Conn) error {
+	err := RecordTestPasses(db, t.UserId, t.Tests)
+	if err != nil {
+		return err
+	}
+	violations, err := RecordTestFailures(db, t.UserId, t.scopes(), t.Failed, t.Errored)
+	if err != nil {
+		return err
+	}
+
+	removed := map[string][]string{}
+	for _, v := range violations {
+		removed[v.DepHash] = append(removed[v.DepHash], v.NodeId)
+	}
+	passed := map[string][]string{}
+	for depHash, nodeIds := range t.Tests {
+		failed := map[string]bool{}
+		for _, nodeId := range t.Failed[depHash] {
+			failed[nodeId] = true
+		}
+		for _, nodeId := range t.Errored[depHash] {
+			failed[nodeId] = true
+		}
+		for _, nodeId := range nodeIds {
+			if !failed[nodeId] {
+				passed[depHash] = append(passed[depHash], nodeId)
+			}
+		}
+	}
+	if t.RunId != "" && t.CanaryRate > 0 {
+		samples, err := sampleCanaries(db, t, passed, violations)
+		if err != nil {
+			return err
+		}
+		err = AddCanarySamples(db, t.UserId, samples)
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now().Unix()
+	expiresAt := map[string]int64{}
+	for depHash, ttl := range t.Ttls {
+		expiresAt[scopedDepHash(depHash, t.scopes()[0])] = now + ttl
+	}
+	passed = scopeTests(passed, t.scopes()[0])
+	if len(passed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	version, err := t.batch.resultsVersion(db, t.UserId)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		err = RemoveTestNodeIds(db, t.UserId, version, removed)
+		if err != nil {
+			return err
+		}
+		err = AddHermeticityViolations(db, t.UserId, violations)
+		if err != nil {
+			return err
+		}
+		hermeticityViolationsTotal.Add(float64(len(violations)))
+		slog.Warn("Cached tests failed under the same dep hash, removed them from the results", "user_id", t.UserId, "count", len(violations))
+	}
+	err = PublishTestHashes(db, t.UserId, version, passed, expiresAt)
+	if err != nil {
+		return err
+	}
+	err = RecordTestProvenance(db, t.UserId, t.TokenId, t.RunId, passed)
+	if err != nil {
+		return err
+	}
+
+	changed := make([]string, 0, len(passed)+len(removed))
+	for depHash := range passed {
+		changed = append(changed, depHash)
+	}
+	for depHash := range removed {
+		if passed[depHash] == nil {
+			changed = append(changed, depHash)
+		}
+	}
+	t.batch.changedResults(t.UserId, changed)
+	return nil
+}
+
+func (t *PublishTask) setBatch(batch *taskBatch) { t.batch = batch }
+
+// Several shards of a CI run often publish the same dep hash, so publishes are merged per
+// (user, dep_hash, token, run, scopes) and each row is only read and written once per batch. A node id's runs
+// merged into one batch are counted once by test_failures.
+func (t *PublishTask) Split() []coalescingTask {
+	parts := map[string]*PublishTask{}
+	part := func(depHash string) *PublishTask {
+		if parts[depHash] == nil {
+			parts[depHash] = &PublishTask{UserId: t.UserId, TokenId: t.TokenId, Tests: map[string][]string{}, RunId: t.RunId, CanaryRate: t.CanaryRate, Scopes: t.Scopes}
+		}
+		return parts[depHash]
+	}
+	for depHash, nodeIds := range t.Tests {
+		part(depHash).Tests[depHash] = nodeIds
+		if ttl, ok := t.Ttls[depHash]; ok {
+			part(depHash).Ttls = map[string]int64{depHash: ttl}
+		}
+	}
+	for depHash, nodeIds := range t.Failed {
+		part(depHash).Failed = map[string][]string{depHash: nodeIds}
+	}
+	for depHash, nodeIds := range t.Errored {
+		part(depHash).Errored = map[string][]string{depHash: nodeIds}
+	}
+	split := make([]coalescingTask, 0, len(parts))
+	for _, p := range parts {
+		split = append(split, p)
+	}
+	return split
+}
+
+// Publishes are only merged within a token, run and scope chain, which are recorded as the
+// results' provenance, pick the run's canaries and where the results go.
+func (t *PublishTask) CoalesceKey() string {
+	for _, tests := range []map[string][]string{t.Tests, t.Failed, t.Errored} {
+		for depHash := range tests {
+			return fmt.Sprintf("%d:%s:%d:%g:%s:%q", t.UserId, depHash, t.TokenId, t.CanaryRate, t.RunId, t.Scopes)
+		}
+	}
+	return ""
+}
+
+// Merge merges a later publish, unless a node id passed in one and failed or errored in the
+// other. Applied in order, a pass after a failure is published and a failure after a pass is a
+// hermeticity violation, while a merged task would only see the failure.
+func (t *PublishTask) Merge(other coalescingTask) bool {
+	o := other.(*PublishTask)
+	if overlaps(t.Tests, o.Failed, o.Errored) || overlaps(o.Tests, t.Failed, t.Errored) {
+		return false
+	}
+	t.Tests = mergeNodeIds(t.Tests, o.Tests)
+	t.Failed = mergeNodeIds(t.Failed, o.Failed)
+	t.Errored = mergeNodeIds(t.Errored, o.Errored)
+	// Like separate publishes, the last one's TTL wins
+	for depHash := range o.Tests {
+		if ttl, ok := o.Ttls[depHash]; ok {
+			if t.Ttls == nil {
+				t.Ttls = map[string]int64{}
+			}
+			t.Ttls[depHash] = ttl
+		} else {
+			delete(t.Ttls, depHash)
+		}
+	}
+	return true
+}
+
+// overlaps reports if a node id of `tests` is in any of `others` under the same dep hash.
+func overlaps(tests map[string][]string, others ...map[string][]string) bool {
+	for _, other := range others {
+		for depHash, nodeIds := range other {
+			if len(tests[depHash]) == 0 {
+				continue
+			}
+			in := make(map[string]bool, len(tests[depHash]))
+			for _, nodeId := range tests[depHash] {
+				in[nodeId] = true
+			}
+			for _, nodeId := range nodeIds {
+				if in[nodeId] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func mergeNodeIds(into map[string][]string, from map[string][]string) map[string][]string {
+	if len(from) > 0 && into == nil {
+		into = map[string][]string{}
+	}
+	for depHash, nodeIds := range from {
+		seen := make(map[string]bool, len(into[depHash]))
+		for _, nodeId := range into[depHash] {
+			seen[nodeId] = true
+		}
+		for _, nodeId := range nodeIds {
+			if !seen[nodeId] {
+				seen[nodeId] = true
+				into[depHash] = append(into[depHash], nodeId)
+			}
+		}
+	}
+	return into
+}
+
+// removeResultsTask removes test results on the user's results worker, so the publishes
+// queued before it are applied first instead of adding back what it removes.
+type removeResultsTask struct {
+	userId  int
+	remove  func(rdb *sqlite.Conn, version int64) (removed []InvalidatedResults, changed []string, err error)
+	removed []InvalidatedResults
+	batch   *taskBatch
+	done    chan error
+}
+
+func (t *removeResultsTask) Kind() string   { return "remove_results" }
+func (t *removeResultsTask) ShardKey() int  { return t.userId }
+func (t *removeResultsTask) writesResults() {}
+
+func (t *removeResultsTask) Apply(db *sqlite.Conn) error {
+	version, err := t.batch.resultsVersion(db, t.userId)
+	if err != nil {
+		return err
+	}
+	removed, changed, err := t.remove(db, version)
+	if err != nil {
+		return err
+	}
+	for _, entry := range removed {
+		changed = append(changed, entry.key)
+	}
+	t.batch.changedResults(t.userId, changed)
+	t.removed = removed
+	return nil
+}
+
+func (t *removeResultsTask) setBatch(batch *taskBatch) { t.batch = batch }
+func (t *removeResultsTask) finished(err error)        { t.done <- err }
+
+// decodeTask restores a task from the dead letter table.
+func (s *ApiServer) decodeTask(kind string, payload []byte) (BackgroundTask, error) {
+	var task BackgroundTask
+	switch kind {
+	case "usage":
+		task = &UsageRecord{}
+	case "run_activity":
+		task = &RunActivity{}
+	case "run_begin":
+		task = &RunBegin{}
+	case "run_end":
+		task = &RunEnd{}
+	case "publish":
+		task = s.newPublishTask(AuthInfo{}, nil)
+	default:
+		return nil, fmt.Errorf("unknown task kind %q", kind)
+	}
+	err := json.Unmarshal(payload, task)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s task: %w", kind, err)
+	}
+	return task, nil
+}
+
+// -- Workers --
+
+type backgroundWorker struct {
+	// The database the worker writes to
+	dbPool *sqlitex.Pool
+	queue  chan BackgroundTask
+	// Unix nanoseconds of the last processed batch
+	lastBatch atomic.Int64
+}
+
+type queuedTask struct {
+	task     BackgroundTask
+	attempts int
+	// Error of the last attempt
+	err error
+}
+
+func newBackgroundWorkers(count int, dbPool *sqlitex.Pool) []*backgroundWorker {
+	workers := make([]*backgroundWorker, count)
+	for i := range workers {
+		workers[i] = &backgroundWorker{dbPool: dbPool, queue: make(chan BackgroundTask, BG_QUEUE_SIZE)}
+		workers[i].lastBatch.Store(time.Now().UnixNano())
+	}
+	return workers
+}
+
+// enqueue hands a task to its worker, blocking if the worker's queue is full. Test results
+// are written by the user's result shard worker, if results are sharded.
+func (s *ApiServer) enqueue(task BackgroundTask) {
+	if _, ok := task.(resultsTask); ok {
+		if shard := s.resultShardFor(task.ShardKey()); shard != nil {
+			shard.worker.queue <- task
+			return
+		}
+	}
+	s.bgWorkers[uint(task.ShardKey())%uint(len(s.bgWorkers))].queue <- task
+}
+
+func (s *ApiServer) queuedTasks() int {
+	queued := 0
+	for _, w := range s.allWorkers() {
+		queued += len(w.queue)
+	}
+	return queued
+}
+
+// runBackgroundWorker applies queued tasks in batches, one transaction per batch. Failed
+// tasks are retried in the next batch, up to -bg-max-attempts, then moved to the dead
+// letter table of the control database.
+func (s *ApiServer) runBackgroundWorker(w *backgroundWorker, done <-chan struct{}, db *sqlite.Conn, batchTime time.Duration) {
+	isDone := false
+	isSleeping := true
+	tasks := []queuedTask{}
+	nextCommitTime := time.Now().Add(9999 * time.Hour)
+	for !isDone {
+		doCommit := false
+		select {
+		case <-done:
+			isDone = true
+			doCommit = true
+			// Pick up anything queued before shutdown
+			for drained := false; !drained; {
+				select {
+				case task := <-w.queue:
+					tasks = append(tasks, queuedTask{task: task})
+				default:
+					drained = true
+				}
+			}
+		case <-time.After(time.Until(nextCommitTime)):
+			nextCommitTime = time.Now().Add(9999 * time.Hour)
+			isSleeping = true
+			doCommit = true
+		case task := <-w.queue:
+			tasks = append(tasks, queuedTask{task: task})
+			if isSleeping {
+				nextCommitTime = time.Now().Add(batchTime)
+				isSleeping = false
+			}
+		}
+
+		if doCommit {
+			tasks = s.applyBatch(db, tasks)
+			w.lastBatch.Store(time.Now().UnixNano())
+			// On shutdown, use up the remaining attempts right away
+			for isDone && len(tasks) > 0 {
+				tasks = s.applyBatch(db, tasks)
+			}
+			if len(tasks) > 0 {
+				nextCommitTime = time.Now().Add(batchTime)
+				isSleeping = false
+			}
+		}
+	}
+}
+
+func coalesceTasks(tasks []queuedTask) []queuedTask {
+	coalesced := make([]queuedTask, 0, len(tasks))
+	byKey := map[string]int{}
+	for _, t := range tasks {
+		ct, ok := t.task.(coalescingTask)
+		if !ok {
+			// Results written before and after it can't be merged across it
+			if _, ok := t.task.(resultsTask); ok {
+				byKey = map[string]int{}
+			}
+			coalesced = append(coalesced, t)
+			continue
+		}
+		for _, part := range ct.Split() {
+			key := part.Kind() + "/" + part.CoalesceKey()
+			if i, exists := byKey[key]; exists && coalesced[i].task.(coalescingTask).Merge(part) {
+				coalesced[i].attempts = max(coalesced[i].attempts, t.attempts)
+				continue
+			}
+			// Later parts with the key merge into this one, after the one it couldn't merge into
+			byKey[key] = len(coalesced)
+			coalesced = append(coalesced, queuedTask{task: part, attempts: t.attempts})
+		}
+	}
+	return coalesced
+}
+
+// taskBatch gives the tasks of a batch one new results version per user, so a batch of
+// publishes (which Split into a task per dep hash) only bumps it, and marks it pending in
+// the cache, once per user. The cache is invalidated once the batch is committed.
+type taskBatch struct {
+	cache     *ResultCache
+	versions  map[int]int64
+	depHashes map[int][]string
+	// Users whose version the current task bumped, rolled back with it if it fails
+	bumped []int
+}
+
+func newTaskBatch(cache *ResultCache) *taskBatch {
+	return &taskBatch{cache: cache, versions: map[int]int64{}, depHashes: map[int][]string{}}
+}
+
+// resultsVersion returns the batch's version of the user's results, bumping it the first time.
+func (b *taskBatch) resultsVersion(db *sqlite.Conn, userId int) (int64, error) {
+	if version, ok := b.versions[userId]; ok {
+		return version, nil
+	}
+	version, err := BumpResultsVersion(db, userId)
+	if err != nil {
+		return 0, err
+	}
+	b.versions[userId] = version
+	b.bumped = append(b.bumped, userId)
+	b.cache.MarkPending(userId, version)
+	return version, nil
+}
+
+// changedResults records the dep hashes to invalidate once the batch is committed.
+func (b *taskBatch) changedResults(userId int, depHashes []string) {
+	b.depHashes[userId] = append(b.depHashes[userId], depHashes...)
+}
+
+// taskDone is called after each task. A failed task's savepoint rolled back the versions it
+// bumped, so they're bumped again by the next task that needs them.
+func (b *taskBatch) taskDone(failed bool) {
+	if failed {
+		for _, userId := range b.bumped {
+			delete(b.versions, userId)
+			delete(b.depHashes, userId)
+			b.cache.ClearPending(userId)
+		}
+	}
+	b.bumped = b.bumped[:0]
+}
+
+func (b *taskBatch) afterTxn(committed bool) {
+	for userId, version := range b.versions {
+		if committed {
+			b.cache.Invalidate(userId, b.depHashes[userId], version)
+		}
+		b.cache.ClearPending(userId)
+	}
+}
+
+// applyBatch applies tasks in one transaction, returning the tasks to retry.
+func (s *ApiServer) applyBatch(db *sqlite.Conn, tasks []queuedTask) []queuedTask {
+	if len(tasks) == 0 {
+		return tasks
+	}
+	start := time.Now()
+	tasks = coalesceTasks(tasks)
+
+	retry := []queuedTask{}
+	dead := []queuedTask{}
+	batch := newTaskBatch(s.resultCache)
+	err := DbTxn(db, true, func() error {
+		for i := range tasks {
+			t := &tasks[i]
+			kind := t.task.Kind()
+			t.attempts++
+			if bt, ok := t.task.(batchedTask); ok {
+				bt.setBatch(batch)
+			}
+			taskStart := time.Now()
+			err := DbSavepoint(db, func() error {
+				return t.task.Apply(db)
+			})
+			batch.taskDone(err != nil)
+			bgTaskSeconds.Add(time.Since(taskStart).Seconds(), kind)
+			t.err = err
+			if err == nil {
+				bgTasksTotal.Inc(kind, "ok")
+				continue
+			}
+
+			logger := slog.With("kind", kind, "shard_key", t.task.ShardKey(), "attempts", t.attempts, "err", err)
+			if t.attempts < *bgMaxAttempts {
+				logger.Warn("Background task failed, will retry")
+				bgTasksTotal.Inc(kind, "retry")
+				retry = append(retry, *t)
+				continue
+			}
+			logger.Error("Background task failed, moving to dead letters")
+			bgTasksTotal.Inc(kind, "dead_letter")
+			dead = append(dead, *t)
+		}
+		return nil
+	})
+	bgBatchSeconds.Add(time.Since(start).Seconds())
+
+	batch.afterTxn(err == nil)
+	if err != nil {
+		slog.Error("Failed to commit background batch", "tasks", len(tasks), "err", err)
+		bgBatchesTotal.Inc("error")
+		// Nothing was written, so retry everything that has attempts left
+		retry = retry[:0]
+		dead = dead[:0]
+		for _, t := range tasks {
+			if t.attempts < *bgMaxAttempts {
+				retry = append(retry, t)
+			} else {
+				if t.err == nil {
+					t.err = err
+				}
+				dead = append(dead, t)
+			}
+		}
+		s.storeDeadLetters(finishAwaited(tasks, dead, false))
+		return retry
+	}
+	s.storeDeadLetters(finishAwaited(tasks, dead, true))
+	bgBatchesTotal.Inc("ok")
+	slog.Debug("Processed background tasks", "count", len(tasks), "retry", len(retry), "duration", time.Since(start))
+	return retry
+}
+
+// finishAwaited reports the awaited tasks of a batch that are done, returning the dead tasks
+// left to store.
+func finishAwaited(tasks []queuedTask, dead []queuedTask, committed bool) []queuedTask {
+	if committed {
+		for _, t := range tasks {
+			if at, ok := t.task.(awaitedTask); ok && t.err == nil {
+				at.finished(nil)
+			}
+		}
+	}
+	stored := []queuedTask{}
+	for _, t := range dead {
+		if at, ok := t.task.(awaitedTask); ok {
+			at.finished(t.err)
+			continue
+		}
+		stored = append(stored, t)
+	}
+	return stored
+}
+
+// storeDeadLetters writes tasks out of attempts to the control database, which may not be
+// the one their batch was applied to.
+func (s *ApiServer) storeDeadLetters(dead []queuedTask) {
+	if len(dead) == 0 {
+		return
+	}
+	db, err := s.dbPool.Take(context.Background())
+	if err != nil {
+		slog.Error("Failed to take database connection for dead letters, dropping tasks", "tasks", len(dead), "err", err)
+		return
+	}
+	defer s.dbPool.Put(db)
+	err = DbTxn(db, true, func() error {
+		for _, t := range dead {
+			err := DbSavepoint(db, func() error {
+				return AddDeadLetter(db, t.task, t.attempts, t.err)
+			})
+			if err != nil {
+				slog.Error("Failed to store dead letter, dropping task", "kind", t.task.Kind(), "shard_key", t.task.ShardKey(), "err", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to commit dead letters, dropping tasks", "tasks", len(dead), "err", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestCoalesceTasks(t *testing.T) {
+	publish := func(userId int, tests map[string][]string) *PublishTask {
+		return &PublishTask{UserId: userId, Tests: tests}
+	}
+	tests := []struct {
+		name  string
+		tasks []queuedTask
+		// Node ids per (user, dep hash) of the coalesced publishes
+		want         map[string][]string
+		wantAttempts map[string]int
+		wantOther    int
+	}{
+		{
+			name: "same dep hash is merged without duplicates",
+			tasks: []queuedTask{
+				{task: publish(1, map[string][]string{"a": {"1", "2"}})},
+				{task: publish(1, map[string][]string{"a": {"2", "3"}})},
+			},
+			want: map[string][]string{"1 a": {"1", "2", "3"}},
+		},
+		{
+			name: "dep hashes are split",
+			tasks: []queuedTask{
+				{task: publish(1, map[string][]string{"a": {"1"}, "b": {"2"}})},
+				{task: publish(1, map[string][]string{"b": {"3"}})},
+			},
+			want: map[string][]string{"1 a": {"1"}, "1 b": {"2", "3"}},
+		},
+		{
+			name: "users aren't merged",
+			tasks: []queuedTask{
+				{task: publish(1, map[string][]string{"a": {"1"}})},
+				{task: publish(2, map[string][]string{"a": {"2"}})},
+			},
+			want: map[string][]string{"1 a": {"1"}, "2 a": {"2"}},
+		},
+		{
+			name: "retried parts keep their attempts",
+			tasks: []queuedTask{
+				{task: publish(1, map[string][]string{"a": {"1"}}), attempts: 2},
+				{task: publish(1, map[string][]string{"a": {"2"}, "b": {"3"}})},
+			},
+			want:         map[string][]string{"1 a": {"1", "2"}, "1 b": {"3"}},
+			wantAttempts: map[string]int{"1 a": 2, "1 b": 0},
+		},
+		{
+			name: "other tasks pass through",
+			tasks: []queuedTask{
+				{task: &UsageRecord{UserId: 1}},
+				{task: publish(1, map[string][]string{"a": {"1"}})},
+				{task: &UsageRecord{UserId: 1}},
+			},
+			want:      map[string][]string{"1 a": {"1"}},
+			wantOther: 2,
+		},
+	}
+	for _, tt := range tests {
+		got := map[string][]string{}
+		gotAttempts := map[string]int{}
+		other := 0
+		for _, qt := range coalesceTasks(tt.tasks) {
+			p, ok := qt.task.(*PublishTask)
+			if !ok {
+				other++
+				continue
+			}
+			if len(p.Tests) != 1 {
+				t.Errorf("%s: coalesced publish has %d dep hashes", tt.name, len(p.Tests))
+			}
+			for depHash, nodeIds := range p.Tests {
+				key := fmt.Sprintf("%d %s", p.UserId, depHash)
+				if _, exists := got[key]; exists {
+					t.Errorf("%s: %s wasn't merged", tt.name, key)
+				}
+				got[key] = append([]string{}, nodeIds...)
+				sort.Strings(got[key])
+				gotAttempts[key] = qt.attempts
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: coalesced to %v, want %v", tt.name, got, tt.want)
+		}
+		for key, want := range tt.wantAttempts {
+			if gotAttempts[key] != want {
+				t.Errorf("%s: %s has %d attempts, want %d", tt.name, key, gotAttempts[key], want)
+			}
+		}
+		if other != tt.wantOther {
+			t.Errorf("%s: %d other tasks, want %d", tt.name, other, tt.wantOther)
+		}
+	}
+}
+
+// failingTask fails its first `Failures` attempts.
+type failingTask struct {
+	UserId   int `json:"user_id"`
+	Failures int `json:"failures"`
+	attempts *int
+	batch    *taskBatch
+}
+
+func (t *failingTask) Kind() string              { return "failing" }
+func (t *failingTask) ShardKey() int             { return t.UserId }
+func (t *failingTask) setBatch(batch *taskBatch) { t.batch = batch }
+
+func (t *failingTask) Apply(db *sqlite.Conn) error {
+	*t.attempts++
+	if *t.attempts <= t.Failures {
+		// Also bump the batch's results version, which the savepoint rolls back
+		_, err := t.batch.resultsVersion(db, t.UserId)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("attempt %d failed", *t.attempts)
+	}
+	return nil
+}
+
+func TestApplyBatchRetries(t *testing.T) {
+	defer func(maxAttempts int) { *bgMaxAttempts = maxAttempts }(*bgMaxAttempts)
+	*bgMaxAttempts = 3
+	tests := []struct {
+		name            string
+		failures        int
+		wantBatches     int
+		wantAttempts    int
+		wantDeadLetters int
+	}{
+		{name: "succeeds", failures: 0, wantBatches: 1, wantAttempts: 1},
+		{name: "succeeds on retry", failures: 1, wantBatches: 2, wantAttempts: 2},
+		{name: "succeeds on last attempt", failures: 2, wantBatches: 3, wantAttempts: 3},
+		{name: "out of attempts", failures: 5, wantBatches: 3, wantAttempts: 3, wantDeadLetters: 1},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t)
+		attempts := 0
+		tasks := []queuedTask{
+			{task: &failingTask{UserId: 1, Failures: tt.failures, attempts: &attempts}},
+			{task: ts.newPublishTask(AuthInfo{UserId: 1}, map[string][]string{testDepHash(1): {testNodeId(1)}})},
+		}
+		batches := 0
+		ts.withConn(func(db *sqlite.Conn) {
+			for ; len(tasks) > 0 && batches < 10; batches++ {
+				tasks = ts.applyBatch(db, tasks)
+				for _, qt := range tasks {
+					if qt.task.Kind() != "failing" {
+						t.Errorf("%s: %s task retried", tt.name, qt.task.Kind())
+					}
+				}
+			}
+
+			// The publish was applied once, and only it bumped the results version
+			version, err := GetResultsVersion(db, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != 1 {
+				t.Errorf("%s: results version = %d, want 1", tt.name, version)
+			}
+			nodeIds, _, _, err := QueryPassedTestHashes(db, 1, []string{testDepHash(1)}, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(nodeIds, [][]string{{testNodeId(1)}}) {
+				t.Errorf("%s: published %v", tt.name, nodeIds)
+			}
+
+			deadLetters, err := ListDeadLetters(db, nil, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deadLetters) != tt.wantDeadLetters {
+				t.Errorf("%s: %d dead letters, want %d", tt.name, len(deadLetters), tt.wantDeadLetters)
+			}
+			for _, dl := range deadLetters {
+				if dl.Kind != "failing" || dl.Attempts != *bgMaxAttempts || dl.Error == "" {
+					t.Errorf("%s: dead letter %+v", tt.name, dl)
+				}
+			}
+		})
+		if batches != tt.wantBatches || attempts != tt.wantAttempts {
+			t.Errorf("%s: %d batches and %d attempts, want %d and %d", tt.name, batches, attempts, tt.wantBatches, tt.wantAttempts)
+		}
+		if pending := len(ts.resultCache.pending); pending != 0 {
+			t.Errorf("%s: %d users left pending in the cache", tt.name, pending)
+		}
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	defer func(maxAttempts int) { *bgMaxAttempts = maxAttempts }(*bgMaxAttempts)
+	*bgMaxAttempts = 1
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	// An invalid node id fails every attempt
+	ts.enqueue(ts.newPublishTask(AuthInfo{UserId: userId}, map[string][]string{testDepHash(1): {testNodeId(1), "short"}}))
+	ts.applyBackground()
+	ts.withConn(func(db *sqlite.Conn) {
+		failing := &failingTask{UserId: userId, attempts: new(int)}
+		err := DbTxn(db, true, func() error {
+			return AddDeadLetter(db, failing, 1, fmt.Errorf("failed"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var list ListDeadLettersResponse
+	status := ts.call(ts.admin, "/admin/api/v1/list-dead-letters", ts.adminToken, ListDeadLettersRequest{}, &list)
+	if status != http.StatusOK || len(list.DeadLetters) != 2 {
+		t.Fatalf("list-dead-letters = %d, %+v", status, list)
+	}
+	publish, failing := list.DeadLetters[0], list.DeadLetters[1]
+	if publish.Kind != "publish" || publish.ShardKey != userId || publish.Attempts != 1 || publish.Error == "" {
+		t.Errorf("publish dead letter = %+v", publish)
+	}
+	var payload PublishTask
+	if err := json.Unmarshal(publish.Payload, &payload); err != nil || payload.UserId != userId {
+		t.Errorf("publish payload = %s, %v", publish.Payload, err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		req        interface{}
+		wantStatus int
+	}{
+		{name: "list needs a superuser", path: "/admin/api/v1/list-dead-letters", token: token, req: ListDeadLettersRequest{}, wantStatus: http.StatusForbidden},
+		{name: "negative limit", path: "/admin/api/v1/list-dead-letters", token: ts.adminToken, req: ListDeadLettersRequest{Limit: -1}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "limit too large", path: "/admin/api/v1/list-dead-letters", token: ts.adminToken, req: ListDeadLettersRequest{Limit: MAX_DEAD_LETTERS_PER_REQUEST + 1}, wantStatus: http.StatusUnprocessableEntity},
+		{name: "retry needs a superuser", path: "/admin/api/v1/retry-dead-letters", token: token, req: RetryDeadLettersRequest{Ids: []int64{publish.Id}}, wantStatus: http.StatusForbidden},
+		{name: "retry nothing", path: "/admin/api/v1/retry-dead-letters", token: ts.adminToken, req: RetryDeadLettersRequest{}, wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		status := ts.call(ts.admin, tt.path, tt.token, tt.req, nil)
+		if status != tt.wantStatus {
+			t.Errorf("%s: %s = %d, want %d", tt.name, tt.path, status, tt.wantStatus)
+		}
+	}
+
+	// failingTask isn't a kind the server knows, so it stays in place
+	var retry RetryDeadLettersResponse
+	status = ts.call(ts.admin, "/admin/api/v1/retry-dead-letters", ts.adminToken, RetryDeadLettersRequest{Ids: []int64{publish.Id, failing.Id, 9999}}, &retry)
+	if status != http.StatusOK || retry.Requeued != 1 || !reflect.DeepEqual(retry.Undecodable, []int64{failing.Id}) {
+		t.Errorf("retry-dead-letters = %d, %+v", status, retry)
+	}
+	// It fails again and goes back to the dead letters
+	ts.applyBackground()
+	list = ListDeadLettersResponse{}
+	ts.call(ts.admin, "/admin/api/v1/list-dead-letters", ts.adminToken, ListDeadLettersRequest{Limit: 1}, &list)
+	if len(list.DeadLetters) != 1 || list.DeadLetters[0].Id != failing.Id {
+		t.Errorf("after retrying: %+v", list.DeadLetters)
+	}
+}
+
+func TestPublishTaskSplitFailures(t *testing.T) {
+	task := &PublishTask{
+		UserId:  1,
+		Tests:   map[string][]string{"a": {"1"}},
+		Failed:  map[string][]string{"a": {"2"}, "b": {"3"}},
+		Errored: map[string][]string{"c": {"4"}},
+	}
+	got := map[string]string{}
+	for _, qt := range coalesceTasks([]queuedTask{{task: task}, {task: &PublishTask{UserId: 1, Failed: map[string][]string{"b": {"5"}}}}}) {
+		p := qt.task.(*PublishTask)
+		key := p.CoalesceKey()
+		if _, exists := got[key]; exists {
+			t.Errorf("%s wasn't merged", key)
+		}
+		got[key] = fmt.Sprint(p.Tests, p.Failed, p.Errored)
+	}
+	want := map[string]string{
+		"1:a:0:0::[]": "map[a:[1]] map[a:[2]] map[]",
+		"1:b:0:0::[]": "map[] map[b:[3 5]] map[]",
+		"1:c:0:0::[]": "map[] map[] map[c:[4]]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("coalesced to %v, want %v", got, want)
+	}
+}
+
+func TestPublishTaskMergeOrder(t *testing.T) {
+	pass := func(nodeId string) queuedTask {
+		return queuedTask{task: &PublishTask{UserId: 1, Tests: map[string][]string{"a": {nodeId}}}}
+	}
+	fail := func(nodeId string) queuedTask {
+		return queuedTask{task: &PublishTask{UserId: 1, Failed: map[string][]string{"a": {nodeId}}}}
+	}
+	got := []string{}
+	for _, qt := range coalesceTasks([]queuedTask{pass("1"), fail("1"), pass("2"), pass("1"), fail("3")}) {
+		p := qt.task.(*PublishTask)
+		got = append(got, fmt.Sprint(p.Tests, p.Failed))
+	}
+	want := []string{"map[a:[1]] map[]", "map[a:[2]] map[a:[1]]", "map[a:[1]] map[a:[3]]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("coalesced to %v, want %v", got, want)
+	}
+
+	// Applied in one batch, like separate publishes
+	ts := newTestServer(t)
+	publish := func(req PublishRequest) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", ts.adminToken, req, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+	}
+	tests := func(nodeIds ...int) map[string][]string {
+		tests := map[string][]string{testDepHash(1): {}}
+		for _, id := range nodeIds {
+			tests[testDepHash(1)] = append(tests[testDepHash(1)], testNodeId(id))
+		}
+		return tests
+	}
+	publish(PublishRequest{PassedNodeIdsPerTestFile: tests(1, 2)})
+	publish(PublishRequest{FailedNodeIdsPerTestFile: tests(1, 2)})
+	publish(PublishRequest{PassedNodeIdsPerTestFile: tests(1)})
+	ts.applyBackground()
+	if got := ts.queryPassed(ts.adminToken, testDepHash(1)); fmt.Sprint(got) != fmt.Sprint([][]string{{testNodeId(1)}}) {
+		t.Errorf("passed = %v, want only the node id that passed again", got)
+	}
+	ts.withConn(func(db *sqlite.Conn) {
+		violations := 0
+		err := sqlitex.Execute(db, "SELECT COUNT(*) FROM hermeticity_violations", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				violations = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+		if err != nil || violations != 2 {
+			t.Errorf("%d hermeticity violations, %v, want 2", violations, err)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Trust policies let many runners publish while queries only return what trusted runners
+// published, see TrustPolicy. Node ids are filtered by QueryPassedTestHashes, so filtered rows
+// are cached like any other, and changing the policy bumps all of the namespace's results.
+
+const MAX_TRUST_QUORUM = 100
+
+// trustFilter is a TrustPolicy resolved for QueryPassedTestHashes.
+type trustFilter struct {
+	tokenIds []int64
+	quorum   int
+}
+
+// trustFilter returns the user's trust filter, nil if every publish is trusted. Token labels
+// live in the control database `db`, provenance with the results.
+func (s *ApiServer) trustFilter(db *sqlite.Conn, userId int) (*trustFilter, error) {
+	policy, err := GetNamespacePolicy(db, userId)
+	if err != nil || policy.Trust == nil {
+		return nil, err
+	}
+	filter := &trustFilter{tokenIds: []int64{}, quorum: policy.Trust.Quorum}
+	if len(policy.Trust.TokenLabels) > 0 {
+		filter.tokenIds, err = TrustedTokenIds(db, userId, policy.Trust.TokenLabels)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func validateTrustPolicy(trust *TrustPolicy) error {
+	if trust == nil {
+		return nil
+	}
+	if len(trust.TokenLabels) == 0 && trust.Quorum == 0 {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "A trust policy needs token_labels or a quorum", fmt.Errorf("empty trust policy")).WithErrorCode("invalid_trust_policy")
+	}
+	if trust.Quorum < 0 || trust.Quorum > MAX_TRUST_QUORUM {
+		return HttpErrWrap(http.StatusUnprocessableEntity, fmt.Sprintf("quorum must be between 0 and %d", MAX_TRUST_QUORUM), fmt.Errorf("quorum %d out of range", trust.Quorum)).WithErrorCode("invalid_trust_policy")
+	}
+	return validateLabels(trust.TokenLabels)
+}
+
+// setNamespacePolicy sets the user's policy in a transaction of its own, then bumps their
+// results if the trust policy changed, so cached and `since` responses are filtered again.
+func (s *ApiServer) setNamespacePolicy(userId int, policy NamespacePolicy) error {
+	var old NamespacePolicy
+	err := s.withConn(s.dbPool, func(db *sqlite.Conn) error {
+		return DbTxn(db, true, func() (err error) {
+			old, err = GetNamespacePolicy(db, userId)
+			if err != nil {
+				return err
+			}
+			return SetNamespacePolicy(db, userId, policy)
+		})
+	})
+	if err != nil || reflect.DeepEqual(old.Trust, policy.Trust) {
+		return err
+	}
+	return s.withResultsConn(userId, func(rdb *sqlite.Conn) error {
+		return s.changeResults(rdb, userId, func(version int64) ([]string, error) {
+			return BumpAllResults(rdb, userId, version)
+		})
+	})
+}
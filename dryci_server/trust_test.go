@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestTrustPolicy(t *testing.T) {
+	ts := newTestServer(t)
+	userId, _ := ts.createUser("user@example.com", false)
+	createToken := func(labels map[string]string) string {
+		t.Helper()
+		var res CreateTokenResponse
+		status := ts.call(ts.admin, "/admin/api/v1/create-token", ts.adminToken, CreateTokenRequest{UserId: userId, Labels: labels}, &res)
+		if status != http.StatusOK {
+			t.Fatalf("create-token = %d", status)
+		}
+		return res.Token
+	}
+	protected := createToken(map[string]string{"ci": "protected", "os": "linux"})
+	runner1 := createToken(map[string]string{"ci": "fork"})
+	runner2 := createToken(nil)
+	publish := func(token string, runId string, nodeIds ...int) {
+		t.Helper()
+		tests := map[string][]string{testDepHash(1): {}}
+		for _, id := range nodeIds {
+			tests[testDepHash(1)] = append(tests[testDepHash(1)], testNodeId(id))
+		}
+		status := ts.call(ts.public, "/api/v1/publish", token, PublishRequest{PassedNodeIdsPerTestFile: tests, RunId: runId}, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	setTrust := func(trust *TrustPolicy) int {
+		t.Helper()
+		return ts.call(ts.admin, "/admin/api/v1/set-namespace-policy", ts.adminToken, SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{Trust: trust}}, nil)
+	}
+
+	publish(protected, "", 1)
+	publish(runner1, "run-1", 2)
+	// Runs of a single token don't make a quorum
+	publish(runner1, "run-2", 2)
+	publish(runner1, "run-1", 3)
+	publish(runner2, "", 3)
+	// Warm up the cache, which changing the trust policy must invalidate
+	all := [][]string{{testNodeId(1), testNodeId(2), testNodeId(3)}}
+	if got := ts.queryPassed(runner2, testDepHash(1)); fmt.Sprint(got) != fmt.Sprint(all) {
+		t.Errorf("without a trust policy: passed = %v, want %v", got, all)
+	}
+
+	tests := []struct {
+		name  string
+		trust *TrustPolicy
+		want  [][]string
+	}{
+		{name: "token labels", trust: &TrustPolicy{TokenLabels: map[string]string{"ci": "protected"}}, want: [][]string{{testNodeId(1)}}},
+		{name: "missing token label", trust: &TrustPolicy{TokenLabels: map[string]string{"ci": "protected", "os": "mac"}}, want: [][]string{{}}},
+		{name: "quorum", trust: &TrustPolicy{Quorum: 2}, want: [][]string{{testNodeId(3)}}},
+		{name: "either", trust: &TrustPolicy{TokenLabels: map[string]string{"ci": "protected"}, Quorum: 2}, want: [][]string{{testNodeId(1), testNodeId(3)}}},
+		{name: "removed", want: all},
+	}
+	for _, tt := range tests {
+		status := setTrust(tt.trust)
+		if status != http.StatusOK {
+			t.Fatalf("%s: set-namespace-policy = %d", tt.name, status)
+		}
+		if got := ts.queryPassed(runner2, testDepHash(1)); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: passed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Node ids published before provenance was recorded aren't trusted
+	setTrust(&TrustPolicy{TokenLabels: map[string]string{"ci": "protected"}})
+	ts.withConn(func(db *sqlite.Conn) {
+		err := sqlitex.Execute(db, "DELETE FROM test_provenance WHERE node_id = ?", &sqlitex.ExecOptions{Args: []interface{}{testNodeId(1)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ts.changeResults(db, userId, func(version int64) ([]string, error) {
+			return BumpAllResults(db, userId, version)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got := ts.queryPassed(runner2, testDepHash(1)); fmt.Sprint(got) != "[[]]" {
+		t.Errorf("without provenance: passed = %v", got)
+	}
+	publish(protected, "", 1)
+	if got := ts.queryPassed(runner2, testDepHash(1)); fmt.Sprint(got) != fmt.Sprint([][]string{{testNodeId(1)}}) {
+		t.Errorf("published again: passed = %v", got)
+	}
+
+	invalid := []struct {
+		name  string
+		trust *TrustPolicy
+	}{
+		{name: "empty", trust: &TrustPolicy{}},
+		{name: "negative quorum", trust: &TrustPolicy{Quorum: -1}},
+		{name: "quorum too large", trust: &TrustPolicy{Quorum: MAX_TRUST_QUORUM + 1}},
+		{name: "empty label name", trust: &TrustPolicy{TokenLabels: map[string]string{"": "x"}}},
+	}
+	for _, tt := range invalid {
+		if status := setTrust(tt.trust); status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: set-namespace-policy = %d, want 422", tt.name, status)
+		}
+	}
+	status := ts.call(ts.admin, "/admin/api/v1/create-token", ts.adminToken, CreateTokenRequest{UserId: userId, Labels: map[string]string{"": "x"}}, nil)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("create-token with an empty label name = %d, want 422", status)
+	}
+}
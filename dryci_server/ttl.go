@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Results age out in two ways: queries with a max_age (or their namespace's) ignore test file
+// hashes that weren't published within it, and publishers may give test file hashes a TTL,
+// after which every query ignores them and the gc job deletes them. Either way, the rows are
+// returned like unknown ones, with version 0, so `since` and ETags don't hide that they aged
+// out. Ages are per row rather than per node id (test_provenance has those), since rows are
+// what versions, and so `since` and the cache, track.
+
+// stale reports if the row expired, or was last published before minPublishedAt.
+func (a resultAge) stale(now int64, minPublishedAt int64) bool {
+	return (a.expiresAt != 0 && a.expiresAt <= now) || a.publishedAt < minPublishedAt
+}
+
+// minPublishedAt returns the oldest publish a query with `maxAge` seconds accepts, 0 for any.
+// Queries without a max_age use the namespace policy's, then -query-max-age.
+func (s *ApiServer) minPublishedAt(db *sqlite.Conn, userId int, maxAge int64) (int64, error) {
+	if maxAge == 0 {
+		policy, err := GetNamespacePolicy(db, userId)
+		if err != nil {
+			return 0, err
+		}
+		if policy.MaxAge != nil {
+			maxAge = *policy.MaxAge
+		} else {
+			maxAge = int64(queryMaxAge.Seconds())
+		}
+	}
+	if maxAge == 0 {
+		return 0, nil
+	}
+	return time.Now().Unix() - maxAge, nil
+}
+
+func validateMaxAge(maxAge int64) error {
+	if maxAge < 0 {
+		return HttpErrWrap(http.StatusUnprocessableEntity, "Invalid max_age", fmt.Errorf("negative max_age %d", maxAge)).WithErrorCode("invalid_max_age")
+	}
+	return nil
+}
+
+// validateTtls checks the TTLs of a publish, in seconds.
+func validateTtls(ttls map[string]int64) error {
+	for depHash, ttl := range ttls {
+		err := validateDepHashes([]string{depHash})
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			return HttpErrWrap(http.StatusUnprocessableEntity, "TTLs must be positive", fmt.Errorf("ttl %d of dep_hash:%s", ttl, depHash)).WithErrorCode("invalid_ttl")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestMaxAgeAndTtls(t *testing.T) {
+	ts := newTestServer(t)
+	userId, token := ts.createUser("user@example.com", false)
+	publish := func(req PublishRequest) {
+		t.Helper()
+		status := ts.call(ts.public, "/api/v1/publish", token, req, nil)
+		if status != http.StatusOK {
+			t.Fatalf("publish = %d", status)
+		}
+		ts.applyBackground()
+	}
+	query := func(name string, maxAge int64, want [][]string) {
+		t.Helper()
+		var res QueryPassedResponse
+		status := ts.call(ts.public, "/api/v1/query-passed", token, QueryPassedRequest{TestFileHashes: []string{testDepHash(1), testDepHash(2)}, MaxAge: maxAge}, &res)
+		if status != http.StatusOK {
+			t.Fatalf("%s: query-passed = %d", name, status)
+		}
+		for _, nodeIds := range res.NodeIds {
+			sort.Strings(nodeIds)
+		}
+		if fmt.Sprint(res.NodeIds) != fmt.Sprint(want) {
+			t.Errorf("%s: passed = %v, want %v", name, res.NodeIds, want)
+		}
+	}
+	setRows := func(set string, depHash string, value int64) {
+		t.Helper()
+		ts.withConn(func(db *sqlite.Conn) {
+			err := sqlitex.Execute(db, "UPDATE test_results SET "+set+" = ? WHERE dep_hash = ?", &sqlitex.ExecOptions{Args: []interface{}{value, depHash}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	expiresAt := func(depHash string) (expiresAt int64) {
+		t.Helper()
+		ts.withConn(func(db *sqlite.Conn) {
+			err := sqlitex.Execute(db, "SELECT IFNULL(expires_at, 0) FROM test_results WHERE dep_hash = ?", &sqlitex.ExecOptions{
+				Args: []interface{}{depHash},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					expiresAt = stmt.ColumnInt64(0)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+		return expiresAt
+	}
+
+	publish(PublishRequest{
+		PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(1)}, testDepHash(2): {testNodeId(2)}},
+		TtlPerTestFile:           map[string]int64{testDepHash(1): 3600},
+	})
+	now := time.Now().Unix()
+	if got := expiresAt(testDepHash(1)); got < now+3590 || got > now+3600 {
+		t.Errorf("expires_at = %d, want about %d", got, now+3600)
+	}
+	if got := expiresAt(testDepHash(2)); got != 0 {
+		t.Errorf("expires_at without a TTL = %d", got)
+	}
+
+	// Age the rows behind the cache's back, before it caches them
+	setRows("expires_at", testDepHash(1), now-1)
+	setRows("accessed_at", testDepHash(2), now-7200)
+	// Twice, to also go through the cache
+	for i := 0; i < 2; i++ {
+		query("expired", 0, [][]string{{}, {testNodeId(2)}})
+		query("max_age", 3600, [][]string{{}, {}})
+		query("max_age older than the row", 3*3600, [][]string{{}, {testNodeId(2)}})
+	}
+
+	maxAge := int64(3600)
+	status := ts.call(ts.admin, "/admin/api/v1/set-namespace-policy", ts.adminToken, SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{MaxAge: &maxAge}}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("set-namespace-policy = %d", status)
+	}
+	query("namespace max_age", 0, [][]string{{}, {}})
+	query("max_age overrides the namespace's", 3*3600, [][]string{{}, {testNodeId(2)}})
+
+	// Publishing again without a TTL makes the row fresh and clears the TTL
+	publish(PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(3)}, testDepHash(2): {testNodeId(4)}}})
+	if got := expiresAt(testDepHash(1)); got != 0 {
+		t.Errorf("expires_at after publishing without a TTL = %d", got)
+	}
+	query("published again", 0, [][]string{{testNodeId(1), testNodeId(3)}, {testNodeId(2), testNodeId(4)}})
+
+	// The gc job deletes expired rows
+	publish(PublishRequest{PassedNodeIdsPerTestFile: map[string][]string{testDepHash(1): {testNodeId(5)}}, TtlPerTestFile: map[string]int64{testDepHash(1): 1}})
+	ts.withConn(func(db *sqlite.Conn) {
+		deleted, err := ts.deleteResults(db, "expires_at <= ?", time.Now().Unix()+1)
+		if err != nil || len(deleted) != 1 || deleted[0].depHash != testDepHash(1) {
+			t.Errorf("deleted %v, %v", deleted, err)
+		}
+	})
+
+	negative := int64(-1)
+	tests := []struct {
+		name  string
+		admin bool
+		path  string
+		req   interface{}
+	}{
+		{name: "negative max_age", path: "/api/v1/query-passed", req: QueryPassedRequest{TestFileHashes: []string{testDepHash(1)}, MaxAge: -1}},
+		{name: "negative bloom max_age", path: "/api/v1/query-passed-bloom", req: QueryPassedBloomRequest{TestFileHashes: []string{testDepHash(1)}, MaxAge: -1}},
+		{name: "zero TTL", path: "/api/v1/publish", req: PublishRequest{TtlPerTestFile: map[string]int64{testDepHash(1): 0}}},
+		{name: "TTL of an invalid dep hash", path: "/api/v1/publish", req: PublishRequest{TtlPerTestFile: map[string]int64{"abc": 60}}},
+		{name: "negative namespace max_age", admin: true, path: "/admin/api/v1/set-namespace-policy", req: SetNamespacePolicyRequest{UserId: userId, Policy: NamespacePolicy{MaxAge: &negative}}},
+	}
+	for _, tt := range tests {
+		mux, token := ts.public, token
+		if tt.admin {
+			mux, token = ts.admin, ts.adminToken
+		}
+		status := ts.call(mux, tt.path, token, tt.req, nil)
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d, want 422", tt.name, status)
+		}
+	}
+}
+
+func TestPublishTaskMergeTtls(t *testing.T) {
+	task := &PublishTask{Tests: map[string][]string{"a": {"1"}, "b": {"2"}}, Ttls: map[string]int64{"a": 60, "b": 60}}
+	task.Merge(&PublishTask{Tests: map[string][]string{"a": {"3"}, "b": {"4"}, "c": {"5"}}, Ttls: map[string]int64{"a": 120, "c": 30}})
+	want := map[string]int64{"a": 120, "c": 30}
+	if fmt.Sprint(task.Ttls) != fmt.Sprint(want) {
+		t.Errorf("merged TTLs = %v, want %v", task.Ttls, want)
+	}
+}
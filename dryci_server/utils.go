@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -29,83 +30,211 @@ func fullWrite(w io.Writer, data string) error {
 
 const MAX_REQUEST_BODY_BYTES = 8 * 1024 * 1024
 
+type ErrorBody struct {
+	// Stable machine-readable error code, e.g. "token_expired"
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"request_id"`
+	// Whether the same request may succeed if retried later
+	Retryable bool `json:"retryable"`
+}
+
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// sendError sends the JSON error envelope. Its request id correlates it with the logs.
+func sendError(w http.ResponseWriter, r *http.Request, hc HttpCode) {
+	if isProtoRequest(r) {
+		sendConnectError(w, r, hc)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if hc.Retryable() && hc.Code() == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.WriteHeader(hc.Code())
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorBody{
+		Code:      hc.ErrorCode(),
+		Message:   hc.Message(),
+		RequestId: requestId(r),
+		Retryable: hc.Retryable(),
+	}})
+}
+
 func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
-	lr := io.LimitedReader{R: r.Body, N: MAX_REQUEST_BODY_BYTES}
-	dec := json.NewDecoder(&lr)
-	dec.DisallowUnknownFields()
-	err := dec.Decode(v)
+	body, err := decodeRequestBody(r)
+	if err != nil {
+		var hc HttpCode
+		if !errors.As(err, &hc) {
+			hc = HttpErrWrap(http.StatusBadRequest, "Bad request encoding", err).WithErrorCode("invalid_encoding")
+		}
+		sendError(w, r, hc)
+		requestLogger(r).Warn("Bad request encoding", "err", err)
+		return false
+	}
+	defer body.Close()
+
+	// The limit applies after decompression, to guard against compression bombs
+	lr := io.LimitedReader{R: body, N: MAX_REQUEST_BODY_BYTES}
+	if isProtoRequest(r) {
+		err = readProtoRequest(body, v)
+	} else {
+		dec := json.NewDecoder(&lr)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(v)
+	}
 	if err != nil {
 		if lr.N == 0 {
-			http.Error(w, "Request Entity Too Large, see /api/ for documentation", http.StatusRequestEntityTooLarge)
-			log.Printf("%d %s: Request Entity Too Large\n", http.StatusRequestEntityTooLarge, r.URL.Path)
+			sendError(w, r, HttpErrWrap(http.StatusRequestEntityTooLarge, "Request Entity Too Large, see /api/ for documentation", err))
+			requestLogger(r).Warn("Request Entity Too Large", "status", http.StatusRequestEntityTooLarge)
 			return false
 		}
-		http.Error(w, fmt.Sprintf("Unprocessable Entity, see /api/ for documentation: %v", err), http.StatusUnprocessableEntity)
-		log.Printf("%d %s: Unprocessable Entity: %v\n", http.StatusUnprocessableEntity, r.URL.Path, err)
+		var hc HttpCode
+		if !errors.As(err, &hc) {
+			hc = HttpErrWrap(http.StatusUnprocessableEntity, fmt.Sprintf("Unprocessable Entity, see /api/ for documentation: %v", err), err)
+		}
+		sendError(w, r, hc)
+		requestLogger(r).Warn(hc.Message(), "status", hc.Code(), "err", err)
 		return false
 	}
 	return true
 }
 
+func readProtoRequest(body io.Reader, v interface{}) error {
+	msg, ok := v.(protoUnmarshaler)
+	if !ok {
+		return HttpErrWrap(http.StatusUnsupportedMediaType, "This endpoint does not support "+PROTO_CONTENT_TYPE, fmt.Errorf("%T has no proto codec", v)).WithErrorCode("unsupported_content_type")
+	}
+	// Unlike JSON, a truncated message may still decode, so the whole body is read before
+	// decoding it. One byte past the limit tells a body at the limit from a longer one.
+	data, err := io.ReadAll(io.LimitReader(body, MAX_REQUEST_BODY_BYTES+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MAX_REQUEST_BODY_BYTES {
+		return HttpErrWrap(http.StatusRequestEntityTooLarge, "Request Entity Too Large, see /api/ for documentation", fmt.Errorf("proto body over %d bytes", MAX_REQUEST_BODY_BYTES))
+	}
+	return msg.UnmarshalProto(data)
+}
+
 func sendResponse(w http.ResponseWriter, r *http.Request, v interface{}, handlerErr error, handleStart time.Time) {
-	enc := json.NewEncoder(w)
-
-	var httpStatus int
-	var httpMessage string
-	if hc, ok := handlerErr.(HttpCode); ok {
-		httpStatus = hc.Code()
-		httpMessage = hc.Message()
-	} else if handlerErr != nil {
-		httpStatus = http.StatusInternalServerError
-		httpMessage = "Internal Server Error"
-	} else {
-		httpStatus = http.StatusOK
-		httpMessage = "OK"
+	var hc HttpCode
+	if !errors.As(handlerErr, &hc) && handlerErr != nil {
+		hc = HttpErrWrap(http.StatusInternalServerError, "Internal Server Error", handlerErr)
 	}
 
-	handleTime := time.Since(handleStart)
 	if handlerErr != nil {
-		http.Error(w, httpMessage, httpStatus)
-		log.Printf("%s %d %s: %v\n", handleTime, httpStatus, r.URL.Path, handlerErr)
+		logger := requestLogger(r).With("status", hc.Code(), "code", hc.ErrorCode(), "duration", time.Since(handleStart))
+		sendError(w, r, hc)
+		if hc.Code() >= 500 {
+			logger.Error(hc.Message(), "err", handlerErr)
+		} else {
+			logger.Warn(hc.Message(), "err", handlerErr)
+		}
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	err := enc.Encode(v)
+
+	if tagged, ok := v.(etagger); ok && tagged.ETag() != "" {
+		// Clients may cache the response, but must revalidate it
+		w.Header().Set("ETag", tagged.ETag())
+		w.Header().Set("Cache-Control", "private, no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), tagged.ETag()) {
+			w.WriteHeader(http.StatusNotModified)
+			requestLogger(r).Debug("Not modified", "status", http.StatusNotModified, "duration", time.Since(handleStart))
+			return
+		}
+	}
+
+	logger := requestLogger(r).With("status", http.StatusOK, "duration", time.Since(handleStart))
+	body, contentType, err := encodeResponse(r, v)
+	if err != nil {
+		sendError(w, r, HttpErrWrap(http.StatusInternalServerError, "Internal Server Error", err))
+		logger.Error("Failed to encode response", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	err = writeEncoded(w, r, body)
 	if err != nil {
-		log.Printf("%s %d %s: %v\n", handleTime, httpStatus, r.URL.Path, err)
+		logger.Warn("Failed to send response", "err", err)
 	} else {
-		log.Printf("%s %d %s\n", handleTime, httpStatus, r.URL.Path)
+		logger.Debug("OK")
+	}
+}
+
+// etagger is implemented by responses that support conditional requests.
+type etagger interface {
+	ETag() string
+}
+
+// etagMatches implements the weak comparison of If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeResponse encodes v in the same format as the request.
+func encodeResponse(r *http.Request, v interface{}) ([]byte, string, error) {
+	if isProtoRequest(r) {
+		msg, ok := v.(protoMarshaler)
+		if !ok {
+			return nil, "", fmt.Errorf("%T has no proto codec", v)
+		}
+		body, err := msg.MarshalProto()
+		return body, PROTO_CONTENT_TYPE, err
 	}
+
+	var body bytes.Buffer
+	err := json.NewEncoder(&body).Encode(v)
+	return body.Bytes(), "application/json", err
+}
+
+func authRequest(db *sqlite.Conn, r *http.Request) (AuthInfo, error) {
+	authorization := r.Header.Get("Authorization")
+	token, hasToken := strings.CutPrefix(authorization, "Bearer ")
+	if !hasToken {
+		return AuthInfo{}, HttpErrWrap(http.StatusUnauthorized, "Unauthorized", fmt.Errorf("missing bearer token")).WithErrorCode("missing_token")
+	}
+
+	var auth AuthInfo
+	err := DbTxn(db, false, func() error {
+		a, err := AuthUser(db, token)
+		auth = a
+		return err
+	})
+	if err == nil {
+		setRequestAuth(r, auth, token)
+	}
+	return auth, err
 }
 
 func jsonApi[INP interface{}, OUT interface{}](
 	s *ApiServer,
 	writesToDb bool,
 	usage Usage,
-	handler func(db *sqlite.Conn, req *INP, res *OUT, userId int) error,
-) http.HandlerFunc {
+	handler func(db *sqlite.Conn, req *INP, res *OUT, auth AuthInfo) error,
+) JsonApiHandler[INP, OUT] {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		authorization := r.Header.Get("Authorization")
-		token, hasToken := strings.CutPrefix(authorization, "Bearer ")
-		if !hasToken {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if r.Header.Get("Authorization") == "" {
+			sendResponse(w, r, nil, HttpErrWrap(http.StatusUnauthorized, "Unauthorized", fmt.Errorf("missing bearer token")).WithErrorCode("missing_token"), start)
 			return
 		}
 
 		db, err := s.dbPool.Take(r.Context())
 		if err != nil {
-			sendResponse(w, r, nil, HttpErrWrap(http.StatusServiceUnavailable, "Server overloaded, try again later", err), start)
+			sendResponse(w, r, nil, HttpErrWrap(http.StatusServiceUnavailable, "Server overloaded, try again later", err).WithErrorCode("overloaded"), start)
 			return
 		}
 		defer s.dbPool.Put(db)
 
-		userId := -1
-		err = DbTxn(db, false, func() error {
-			uid, err := AuthUser(db, token)
-			userId = uid
-			return err
-		})
+		auth, err := authRequest(db, r)
 		if err != nil {
 			sendResponse(w, r, nil, err, start)
 			return
@@ -117,25 +246,80 @@ func jsonApi[INP interface{}, OUT interface{}](
 			return
 		}
 
-		s.bgProcessChan <- UsageRecord{
+		s.enqueue(&UsageRecord{
 			Timestamp: time.Now(),
-			UserId:    userId,
+			UserId:    auth.UserId,
 			Usage:     usage,
-		}
+		})
 
 		var res OUT
 		err = DbTxn(db, writesToDb, func() error {
-			return handler(db, &req, &res, userId)
+			return handler(db, &req, &res, auth)
 		})
 
 		sendResponse(w, r, res, err, start)
 	}
 }
 
+// Listing endpoints return DEFAULT_LIST_LIMIT entries unless asked for up to MAX_LIST_LIMIT
+const DEFAULT_LIST_LIMIT = 100
+const MAX_LIST_LIMIT = 10000
+
+// validateLimit returns the limit of a listing request, DEFAULT_LIST_LIMIT if it's 0.
+func validateLimit(limit int, max int) (int, error) {
+	if limit == 0 {
+		return DEFAULT_LIST_LIMIT, nil
+	}
+	if limit < 0 || limit > max {
+		return 0, HttpErrWrap(http.StatusUnprocessableEntity, fmt.Sprintf("limit must be between 1 and %d", max), fmt.Errorf("limit %d out of range", limit)).WithErrorCode("invalid_limit")
+	}
+	return limit, nil
+}
+
+// requireSuperuser restricts a jsonApi handler to superusers.
+func requireSuperuser[INP interface{}, OUT interface{}](
+	handler func(db *sqlite.Conn, req *INP, res *OUT, auth AuthInfo) error,
+) func(db *sqlite.Conn, req *INP, res *OUT, auth AuthInfo) error {
+	return func(db *sqlite.Conn, req *INP, res *OUT, auth AuthInfo) error {
+		if !auth.Superuser {
+			return HttpErrWrap(http.StatusForbidden, "Forbidden", fmt.Errorf("user %d is not a superuser", auth.UserId))
+		}
+		return handler(db, req, res, auth)
+	}
+}
+
+// authenticate checks the request's token without holding on to a DB connection, for
+// handlers that aren't a single jsonApi transaction.
+func (s *ApiServer) authenticate(r *http.Request) (AuthInfo, error) {
+	db, err := s.dbPool.Take(r.Context())
+	if err != nil {
+		return AuthInfo{}, HttpErrWrap(http.StatusServiceUnavailable, "Server overloaded, try again later", err).WithErrorCode("overloaded")
+	}
+	defer s.dbPool.Put(db)
+	return authRequest(db, r)
+}
+
+// superuserOnly guards a plain (non-JSON) handler with superuser token authentication.
+func superuserOnly(s *ApiServer, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		auth, err := s.authenticate(r)
+		if err == nil && !auth.Superuser {
+			err = HttpErrWrap(http.StatusForbidden, "Forbidden", fmt.Errorf("user %d is not a superuser", auth.UserId))
+		}
+		if err != nil {
+			sendResponse(w, r, nil, err, start)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 type HttpErrWrapper struct {
-	code    int
-	message string
-	err     error
+	code      int
+	message   string
+	errorCode string
+	err       error
 }
 
 func (h HttpErrWrapper) Code() int {
@@ -146,6 +330,49 @@ func (h HttpErrWrapper) Message() string {
 	return h.message
 }
 
+// ErrorCode is the machine-readable error code, derived from the HTTP status unless set
+// explicitly with WithErrorCode.
+func (h HttpErrWrapper) ErrorCode() string {
+	if h.errorCode != "" {
+		return h.errorCode
+	}
+	switch h.code {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusUnprocessableEntity:
+		return "invalid_request"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	default:
+		if h.code >= 500 {
+			return "internal"
+		}
+		return "error"
+	}
+}
+
+// Retryable reports whether the failure is transient, as opposed to a problem with the request.
+func (h HttpErrWrapper) Retryable() bool {
+	switch h.code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	default:
+		return h.code >= 500
+	}
+}
+
 func (h HttpErrWrapper) Error() string {
 	if h.err == nil {
 		return h.message
@@ -153,12 +380,21 @@ func (h HttpErrWrapper) Error() string {
 	return h.err.Error()
 }
 
+func (h HttpErrWrapper) Unwrap() error {
+	return h.err
+}
+
 func (h HttpErrWrapper) Context(format string, args ...interface{}) HttpErrWrapper {
 	args = append(args, h.err)
 	h.err = fmt.Errorf(format+": %w", args...)
 	return h
 }
 
+func (h HttpErrWrapper) WithErrorCode(errorCode string) HttpErrWrapper {
+	h.errorCode = errorCode
+	return h
+}
+
 func HttpErrWrap(code int, message string, err error) HttpErrWrapper {
 	return HttpErrWrapper{code: code, message: message, err: err}
 }
@@ -166,48 +402,6 @@ func HttpErrWrap(code int, message string, err error) HttpErrWrapper {
 type HttpCode interface {
 	Code() int
 	Message() string
-}
-
-func batchedBackgroundWorker(
-	work <-chan interface{},
-	done <-chan struct{},
-	db *sqlite.Conn,
-	batchTime time.Duration,
-	handler func(db *sqlite.Conn, items []interface{}),
-) {
-
-	isDone := false
-	isSleeping := true
-	workItems := []interface{}{}
-	nextCommitTime := time.Now().Add(9999 * time.Hour)
-	for !isDone {
-		doCommit := false
-		select {
-		case <-done:
-			isDone = true
-			doCommit = true
-		case <-time.After(time.Until(nextCommitTime)):
-			nextCommitTime = time.Now().Add(9999 * time.Hour)
-			isSleeping = true
-			doCommit = true
-		case item := <-work:
-			workItems = append(workItems, item)
-			if isSleeping {
-				nextCommitTime = time.Now().Add(batchTime)
-				isSleeping = false
-			}
-		}
-
-		if doCommit && len(workItems) > 0 {
-			err := DbTxn(db, true, func() error {
-				// TODO: Consider subtransactions (savepoints) for isolation
-				handler(db, workItems)
-				return nil
-			})
-			workItems = []interface{}{}
-			if err != nil {
-				log.Printf("Failed to commit worker changes: %v", err)
-			}
-		}
-	}
+	ErrorCode() string
+	Retryable() bool
 }
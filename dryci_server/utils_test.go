@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	ts := newTestServer(t)
+	_, userToken := ts.createUser("user@example.com", false)
+	userId, disabledToken := ts.createUser("disabled@example.com", false)
+	var expiredToken string
+	ts.withConn(func(db *sqlite.Conn) {
+		var err error
+		expiredToken, _, err = CreateUserToken(db, userId, 60, nil)
+		if err == nil {
+			err = DisableUserToken(db, disabledToken)
+		}
+		if err == nil {
+			err = sqlitex.Execute(db, "UPDATE api_tokens SET expires_at = ? WHERE token = ?", &sqlitex.ExecOptions{
+				Args: []interface{}{time.Now().Add(-time.Minute).Unix(), expiredToken},
+			})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	depHash := strings.Repeat("a", DEP_HASH_HEX_SIZE)
+
+	tests := []struct {
+		name       string
+		mux        http.Handler
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "no token", path: "/api/v1/query-passed", body: `{}`, wantStatus: 401, wantCode: "missing_token"},
+		{name: "not a bearer token", path: "/api/v1/query-passed", token: "-", body: `{}`, wantStatus: 401, wantCode: "invalid_token"},
+		{name: "unknown token", path: "/api/v1/query-passed", token: "dryci-nope", body: `{}`, wantStatus: 401, wantCode: "invalid_token"},
+		{name: "overlong token", path: "/api/v1/query-passed", token: strings.Repeat("x", 41), body: `{}`, wantStatus: 401, wantCode: "invalid_token"},
+		{name: "disabled token", path: "/api/v1/query-passed", token: disabledToken, body: `{}`, wantStatus: 401, wantCode: "token_disabled"},
+		{name: "expired token", path: "/api/v1/query-passed", token: expiredToken, body: `{}`, wantStatus: 401, wantCode: "token_expired"},
+		{name: "malformed json", path: "/api/v1/query-passed", token: userToken, body: `{`, wantStatus: 422, wantCode: "invalid_request"},
+		{name: "unknown field", path: "/api/v1/query-passed", token: userToken, body: `{"nope": 1}`, wantStatus: 422, wantCode: "invalid_request"},
+		{name: "bad dep hash", path: "/api/v1/query-passed", token: userToken, body: `{"test_file_hashes": ["abc"]}`, wantStatus: 422, wantCode: "invalid_dep_hash"},
+		{name: "bad published dep hash", path: "/api/v1/publish", token: userToken, body: `{"passed_node_ids_per_test_file": {"abc": []}}`, wantStatus: 422, wantCode: "invalid_dep_hash"},
+		{name: "bad node id", path: "/api/v1/publish", token: userToken, body: fmt.Sprintf(`{"passed_node_ids_per_test_file": {%q: ["abc"]}}`, depHash), wantStatus: 422, wantCode: "invalid_node_id"},
+		{name: "too many node ids", path: "/api/v1/publish", token: userToken, body: fmt.Sprintf(`{"passed_node_ids_per_test_file": {%q: [%s"x"]}}`, depHash, strings.Repeat(`"x",`, MAX_NODEIDS_PER_DEP)), wantStatus: 422, wantCode: "too_many_node_ids"},
+		{name: "not a superuser", mux: ts.admin, path: "/admin/api/v1/create-user", token: userToken, body: `{"email": "x@example.com"}`, wantStatus: 403, wantCode: "forbidden"},
+		{name: "user exists", mux: ts.admin, path: "/admin/api/v1/create-user", token: ts.adminToken, body: `{"email": "user@example.com"}`, wantStatus: 409, wantCode: "user_exists"},
+		{name: "too large", path: "/api/v1/publish", token: userToken, body: `{"passed_node_ids_per_test_file": {"` + strings.Repeat("a", MAX_REQUEST_BODY_BYTES), wantStatus: 413, wantCode: "request_too_large"},
+	}
+	for _, tt := range tests {
+		mux := tt.mux
+		if mux == nil {
+			mux = ts.public
+		}
+		rec := ts.do(mux, "POST", tt.path, tt.token, []byte(tt.body), nil)
+		var res ErrorResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &res)
+		if err != nil {
+			t.Errorf("%s: failed to decode %q: %v", tt.name, rec.Body.String(), err)
+			continue
+		}
+		if rec.Code != tt.wantStatus || res.Error.Code != tt.wantCode {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, rec.Code, res.Error.Code, tt.wantStatus, tt.wantCode)
+		}
+		if res.Error.Message == "" || res.Error.Retryable || res.Error.RequestId != rec.Header().Get("X-Request-Id") {
+			t.Errorf("%s: error = %+v", tt.name, res.Error)
+		}
+		if rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: headers = %v", tt.name, rec.Header())
+		}
+	}
+}
+
+func TestSendResponseErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       string
+		wantMessage    string
+		wantRetryable  bool
+		wantRetryAfter string
+	}{
+		{name: "plain error", err: fmt.Errorf("disk on fire"), wantStatus: 500, wantCode: "internal", wantMessage: "Internal Server Error", wantRetryable: true},
+		{name: "http error", err: HttpErrWrap(http.StatusNotFound, "User Not Found", nil), wantStatus: 404, wantCode: "not_found", wantMessage: "User Not Found"},
+		{name: "wrapped http error", err: fmt.Errorf("context: %w", HttpErrWrap(http.StatusConflict, "Conflict", nil).WithErrorCode("user_exists")), wantStatus: 409, wantCode: "user_exists", wantMessage: "Conflict"},
+		{name: "rate limited", err: HttpErrWrap(http.StatusTooManyRequests, "Slow down", nil), wantStatus: 429, wantCode: "rate_limited", wantMessage: "Slow down", wantRetryable: true},
+		{name: "overloaded", err: HttpErrWrap(http.StatusServiceUnavailable, "Busy", nil), wantStatus: 503, wantCode: "unavailable", wantMessage: "Busy", wantRetryable: true, wantRetryAfter: "1"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		sendResponse(rec, httptest.NewRequest("POST", "/", nil), nil, tt.err, time.Now())
+		var res ErrorResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &res)
+		if err != nil {
+			t.Errorf("%s: failed to decode %q: %v", tt.name, rec.Body.String(), err)
+			continue
+		}
+		want := ErrorBody{Code: tt.wantCode, Message: tt.wantMessage, Retryable: tt.wantRetryable}
+		if rec.Code != tt.wantStatus || res.Error != want {
+			t.Errorf("%s: got %d %+v, want %d %+v", tt.name, rec.Code, res.Error, tt.wantStatus, want)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+			t.Errorf("%s: Retry-After = %q, want %q", tt.name, got, tt.wantRetryAfter)
+		}
+	}
+}
@@ -1,4 +1,5 @@
 import atexit
+import gzip
 import hashlib
 import json
 import os
@@ -6,14 +7,25 @@ from pathlib import Path
 import subprocess
 import threading
 from typing import Dict, List, Optional, Tuple
+import urllib.error
 import urllib.request
+import uuid
 
 import pytest
 
 _TEST_HASHES_INITIALIZED = False
+# Identifies this run to the server, which may withhold some cached tests from it as canaries
+_RUN_ID = os.environ.get("DRYCI_RUN_ID") or uuid.uuid4().hex
+# E.g. the branch, results published with a scope are only seen by queries with the same scope
+# (or one falling back to it on the server)
+_SCOPE = os.environ.get("DRYCI_SCOPE", "")
+# Seconds, only skip tests that passed that recently / until published passes expire
+_MAX_AGE = int(os.environ.get("DRYCI_MAX_AGE") or 0)
+_TTL = int(os.environ.get("DRYCI_TTL") or 0)
 
 _passed_key = pytest.StashKey[bool]()
 _failed_key = pytest.StashKey[bool]()
+_call_failed_key = pytest.StashKey[bool]()
 _skipped_key = pytest.StashKey[bool]()
 _skipped_by_cache_key = pytest.StashKey[bool]()
 _test_file_hash_key = pytest.StashKey[str]()
@@ -38,26 +50,92 @@ def pytest_addoption(parser):
     )
 
 
-def dryci_api_request(endpoint, data):
+def dryci_api_request(endpoint, data, optional=False):
+    """Optional requests don't disable test caching when they fail, and a server without the
+    endpoint (404, or 405 since it only has GET routes for unknown paths) isn't an error."""
     # TODO: Add retries
     # TODO: Make sure it uses system proxy & certificates
     server = os.environ.get("DRYCI_SERVER", "https://dryci.wazzaps.net")
-    req = urllib.request.Request(
-        server + endpoint,
-        data=json.dumps(data).encode("utf-8"),
-        headers={
-            "Authorization": f"Bearer {os.environ['DRYCI_TOKEN']}",
-            "Content-Type": "application/json",
-        },
-    )
-    with urllib.request.urlopen(req, timeout=int(os.environ.get("DRYCI_TIMEOUT", 3))) as response:
+    headers = {
+        "Authorization": f"Bearer {os.environ['DRYCI_TOKEN']}",
+        "Content-Type": "application/json",
+        "Accept-Encoding": "gzip",
+    }
+    body = json.dumps(data).encode("utf-8")
+    if len(body) > 1024:
+        body = gzip.compress(body, compresslevel=6)
+        headers["Content-Encoding"] = "gzip"
+    req = urllib.request.Request(server + endpoint, data=body, headers=headers)
+    consequence = "" if optional else ". disabling test caching"
+    try:
+        response = urllib.request.urlopen(req, timeout=int(os.environ.get("DRYCI_TIMEOUT", 3)))
+    except urllib.error.HTTPError as e:
+        if optional and e.code in (404, 405):
+            return
+        # The server describes errors as {"error": {"code", "message", "request_id", "retryable"}}
+        try:
+            error = json.loads(e.read())["error"]
+        except Exception:
+            error = {"code": "unknown", "message": e.reason, "request_id": None}
+        print(
+            f"[DryCI Error: request to {endpoint} failed with code {e.code} ({error['code']}: "
+            f"{error['message']}, request id {error['request_id']}){consequence}]"
+        )
+        return
+    with response:
         if response.status != 200:
             print(
-                f"[DryCI Error: request failed with code {response.status}. "
-                "disabling test caching]"
+                f"[DryCI Error: request to {endpoint} failed with code {response.status}"
+                f"{consequence}]"
             )
             return
-        return json.loads(response.read())
+        response_body = response.read()
+        if response.headers.get("Content-Encoding") == "gzip":
+            response_body = gzip.decompress(response_body)
+        return json.loads(response_body)
+
+
+def _run_metadata() -> dict:
+    """Describes the run from the CI's environment variables, DRYCI_* variables take precedence."""
+    env = os.environ
+    if env.get("GITHUB_ACTIONS"):
+        provider, commit, branch, job = (
+            "github-actions",
+            env.get("GITHUB_SHA"),
+            env.get("GITHUB_HEAD_REF") or env.get("GITHUB_REF_NAME"),
+            env.get("GITHUB_JOB"),
+        )
+    elif env.get("GITLAB_CI"):
+        provider, commit, branch, job = (
+            "gitlab-ci",
+            env.get("CI_COMMIT_SHA"),
+            env.get("CI_COMMIT_REF_NAME"),
+            env.get("CI_JOB_NAME"),
+        )
+    elif env.get("JENKINS_URL"):
+        provider, commit, branch, job = (
+            "jenkins",
+            env.get("GIT_COMMIT"),
+            env.get("BRANCH_NAME") or env.get("GIT_BRANCH"),
+            env.get("JOB_NAME"),
+        )
+    else:
+        provider, commit, branch, job = None, None, None, None
+    labels = {}
+    # DRYCI_LABELS is a comma-separated list of name=value pairs
+    for label in env.get("DRYCI_LABELS", "").split(","):
+        name, sep, value = label.partition("=")
+        if sep and name.strip():
+            labels[name.strip()] = value.strip()
+    metadata = {
+        "commit": env.get("DRYCI_COMMIT") or commit,
+        "branch": env.get("DRYCI_BRANCH") or branch,
+        "ci_provider": env.get("DRYCI_CI_PROVIDER") or provider,
+        "ci_job": env.get("DRYCI_CI_JOB") or job,
+        "environment": env.get("DRYCI_ENVIRONMENT"),
+        "labels": labels,
+    }
+    return {key: value for key, value in metadata.items() if value}
 
 
 def _hash_nodeid(item, salt: str) -> bytes:
@@ -99,6 +177,15 @@ def skip_cached_tests(items, config):
             item.stash[_hashed_nodeid_key] = hashed_nodeid
 
         _TEST_HASHES_INITIALIZED = True
+        # Runs are only bookkeeping, failing to record one mustn't stop the caching
+        try:
+            dryci_api_request(
+                "/api/v1/runs/begin",
+                {"run_id": _RUN_ID, "metadata": _run_metadata()},
+                optional=True,
+            )
+        except Exception as e:
+            print(f"[DryCI Error: Failed while beginning the run: {e!r}]")
         if config.option.dryci_no_skip:
             return
 
@@ -114,7 +201,13 @@ def skip_cached_tests(items, config):
                 missing_paths.add(path)
 
         passed_tests = dryci_api_request(
-            "/api/v1/query-passed", {"test_file_hashes": queries_hashes}
+            "/api/v1/query-passed",
+            {
+                "test_file_hashes": queries_hashes,
+                "run_id": _RUN_ID,
+                "scope": _SCOPE,
+                "max_age": _MAX_AGE,
+            },
         )
         if passed_tests is None or "node_ids" not in passed_tests:
             return
@@ -206,6 +299,8 @@ def pytest_runtest_makereport(item, call):
     if result.when == "call":
         item.stash[_passed_key] = item.stash.get(_passed_key, True) and result.passed
     item.stash[_failed_key] = item.stash.get(_failed_key, False) or result.failed
+    if result.when == "call" and result.failed:
+        item.stash[_call_failed_key] = True
     item.stash[_skipped_key] = item.stash.get(_skipped_key, False) or result.skipped
     return result
 
@@ -225,6 +320,8 @@ def pytest_runtestloop(session):
             skipped_by_cache_test_count = 0
 
             tests_to_publish = {}
+            failed_tests = {}
+            errored_tests = {}
             for item in session.items:
                 if item.stash.get(_passed_key, False):
                     tests_to_publish.setdefault(item.stash[_test_file_hash_key], []).append(
@@ -232,6 +329,15 @@ def pytest_runtestloop(session):
                     )
                     passed_test_count += 1
                 if item.stash.get(_failed_key, False):
+                    # Failures in setup/teardown are errors rather than test failures
+                    if item.stash.get(_call_failed_key, False):
+                        failed_tests.setdefault(item.stash[_test_file_hash_key], []).append(
+                            item.stash[_hashed_nodeid_key]
+                        )
+                    else:
+                        errored_tests.setdefault(item.stash[_test_file_hash_key], []).append(
+                            item.stash[_hashed_nodeid_key]
+                        )
                     failed_test_count += 1
                 if item.stash.get(_skipped_key, False):
                     skipped_test_count += 1
@@ -242,6 +348,13 @@ def pytest_runtestloop(session):
                 "/api/v1/publish",
                 {
                     "passed_node_ids_per_test_file": tests_to_publish,
+                    "failed_node_ids_per_test_file": failed_tests,
+                    "errored_node_ids_per_test_file": errored_tests,
+                    "run_id": _RUN_ID,
+                    "scope": _SCOPE,
+                    "ttl_per_test_file": (
+                        {test_file_hash: _TTL for test_file_hash in tests_to_publish} if _TTL > 0 else {}
+                    ),
                     "total_test_count": len(session.items),
                     "passed_test_count": passed_test_count,
                     "failed_test_count": failed_test_count,
@@ -254,3 +367,16 @@ def pytest_runtestloop(session):
             print(f"[DryCI Error: Failed while publishing test results: {e!r}]")
 
     return result
+
+
+def pytest_sessionfinish(session, exitstatus):
+    if not session.config.option.dryci or not _TEST_HASHES_INITIALIZED:
+        return
+    try:
+        dryci_api_request(
+            "/api/v1/runs/end",
+            {"run_id": _RUN_ID, "outcome": "passed" if exitstatus == 0 else "failed"},
+            optional=True,
+        )
+    except Exception as e:
+        print(f"[DryCI Error: Failed while ending the run: {e!r}]")